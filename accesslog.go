@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const accessLogContextKey contextKey = "accessLog"
+
+// accessLogEntry collects what handlers further down learn about a request,
+// such as who made it and which backend served it
+type accessLogEntry struct {
+	backend string
+	subject string
+	email   string
+}
+
+// NewAccessLogger writes access log lines to w, one JSON object per request
+// with format json, or else logfmt-style text
+func NewAccessLogger(w io.Writer, format string) *slog.Logger {
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, nil))
+	}
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// AccessLogMiddleware logs one line per request once it has been answered
+func AccessLogMiddleware(next http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		entry := &accessLogEntry{}
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogContextKey, entry)))
+
+		// The request ID may have been set by a plugin on the way in
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = recorder.Header().Get("X-Request-ID")
+		}
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "access",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes", recorder.bytes),
+			slog.String("remote_addr", clientAddr(r).String()),
+			slog.String("backend", entry.backend),
+			slog.String("user_sub", entry.subject),
+			slog.String("user_email", entry.email),
+			slog.String("request_id", requestID),
+			slog.String("trace_id", traceID(r.Context())),
+			fingerprintAttr(r.Context()),
+		)
+	})
+}
+
+func accessLogFromContext(ctx context.Context) (*accessLogEntry, bool) {
+	entry, ok := ctx.Value(accessLogContextKey).(*accessLogEntry)
+	return entry, ok
+}
+
+// logAccessBackend records the backend a request was sent to. With retries
+// the last one tried is logged.
+func logAccessBackend(ctx context.Context, endpoint string) {
+	if entry, ok := accessLogFromContext(ctx); ok {
+		entry.backend = endpoint
+	}
+}
+
+// logAccessUser records who made a request
+func logAccessUser(ctx context.Context, claims Claims) {
+	if entry, ok := accessLogFromContext(ctx); ok {
+		entry.subject = claims.Subject
+		entry.email = claims.Email
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// RequireAdmin guards the operator endpoints under /admin/ with a static
+// bearer token, kept separate from the end-user OIDC tokens
+func RequireAdmin(token string, next http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		presented := strings.TrimPrefix(authHeader, "Bearer ")
+
+		if !strings.HasPrefix(authHeader, "Bearer ") || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized: Missing or invalid admin token", http.StatusUnauthorized)
+
+			logger.Warn("rejected admin request", slog.String("path", r.URL.Path))
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ConfigHandler serves the configuration the gateway runs with, after
+// defaults, the config file, and reloads, with its secrets redacted as in
+// support bundles
+func ConfigHandler(config func() *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := redactedConfig(config())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+// logLevel is the body of the log level endpoint
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// LogLevelHandler serves the log level on GET, and sets it on PUT to one of
+// debug, info, warn, or error, until the gateway restarts
+func LogLevelHandler(level *slog.LevelVar, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var req logLevel
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+
+			var parsed slog.Level
+			if err := parsed.UnmarshalText([]byte(req.Level)); err != nil {
+				http.Error(w, "level must be one of: debug, info, warn, error", http.StatusBadRequest)
+				return
+			}
+
+			previous := level.Level()
+			level.Set(parsed)
+			logger.Warn("log level changed by operator", slog.String("from", previous.String()), slog.String("to", parsed.String()))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(logLevel{Level: strings.ToLower(level.Level().String())})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/civil-labs/civil-gateway/adminclient"
+)
+
+const adminUsage = `usage: admin [-url URL] [-token TOKEN] [-timeout 30s] <command> [args]
+
+commands:
+  jobs                      list the scheduled jobs
+  memory                    show memory usage
+  slos                      show the SLOs and their burn rates
+  blocks                    list the blocked client addresses
+  unblock <addr>            lift the block on a client address
+  backends                  show every pool's endpoints
+  drain <host:port>         take an endpoint out of rotation
+  undrain <host:port>       put a drained endpoint back in rotation
+  refresh [pool]            rediscover the backends of every pool, or of pool
+  config                    show the effective config, secrets redacted
+  reload                    reload the config, listing the changes that
+                            need a restart
+  log-level [level]         show the log level, or set it to debug, info,
+                            warn, or error
+  canary [pool]             judge every canary, or the canary of pool,
+                            exiting 1 when it fails
+  layers [file]             show the layer manifest, or replace it with file
+  purge [-layer L] [paths]  purge paths or a layer from the cache and CDN
+  cache-stats [top]         show the tile cache stats
+  captures                  list the captured requests
+  capture <id>              show a captured request
+  support-bundle <file>     download a support bundle
+
+The URL and token default to CIVIL_ADMIN_URL, or http://localhost on
+CIVIL_ADMIN_PORT or 8080, and CIVIL_ADMIN_TOKEN.`
+
+// runAdmin is the admin command, which calls the admin API of a running
+// gateway
+func runAdmin(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, adminUsage) }
+	baseURL := flags.String("url", getEnv("CIVIL_ADMIN_URL", "http://localhost:"+getEnv("CIVIL_ADMIN_PORT", "8080")), "the gateway's base URL")
+	token := flags.String("token", os.Getenv("CIVIL_ADMIN_TOKEN"), "the admin token")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long the call may take")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	client := adminclient.New(*baseURL, *token)
+	result, err := runAdminCommand(ctx, client, flags.Arg(0), flags.Args()[1:])
+	if errors.Is(err, errAdminUsage) {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if result != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	}
+
+	// A pipeline can roll back on the exit status alone
+	if judgment, ok := result.(adminclient.CanaryJudgment); ok && judgment.Verdict == "fail" {
+		return 1
+	}
+	return 0
+}
+
+// errAdminUsage is an unknown command or wrong arguments
+var errAdminUsage = errors.New("invalid admin command")
+
+// runAdminCommand runs one admin command, returning what to print, if
+// anything
+func runAdminCommand(ctx context.Context, client *adminclient.Client, command string, args []string) (any, error) {
+	arg := func() (string, error) {
+		if len(args) != 1 {
+			return "", errAdminUsage
+		}
+		return args[0], nil
+	}
+
+	switch command {
+	case "jobs":
+		return client.Jobs(ctx)
+	case "memory":
+		return client.Memory(ctx)
+	case "slos":
+		return client.SLOs(ctx)
+	case "blocks":
+		return client.Blocks(ctx)
+	case "backends":
+		return client.Backends(ctx)
+	case "captures":
+		return client.Captures(ctx)
+	case "config":
+		return client.Config(ctx)
+	case "reload":
+		return client.ReloadConfig(ctx)
+
+	case "refresh":
+		if len(args) == 0 {
+			return nil, client.RefreshDiscovery(ctx, "")
+		}
+		pool, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		return nil, client.RefreshDiscovery(ctx, pool)
+
+	case "log-level":
+		if len(args) == 0 {
+			return client.LogLevel(ctx)
+		}
+		level, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		return client.SetLogLevel(ctx, level)
+
+	case "canary":
+		if len(args) == 0 {
+			return client.Canaries(ctx)
+		}
+		pool, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		return client.Canary(ctx, pool)
+
+	case "unblock", "drain", "undrain", "capture":
+		value, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		switch command {
+		case "unblock":
+			return nil, client.Unblock(ctx, value)
+		case "drain":
+			return nil, client.Drain(ctx, value)
+		case "undrain":
+			return nil, client.Undrain(ctx, value)
+		default:
+			return client.Capture(ctx, value)
+		}
+
+	case "layers":
+		if len(args) == 0 {
+			return client.Layers(ctx)
+		}
+		manifest, err := os.ReadFile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return client.PutLayers(ctx, manifest)
+
+	case "purge":
+		flags := flag.NewFlagSet("admin purge", flag.ExitOnError)
+		layer := flags.String("layer", "", "purge every tile of this layer")
+		flags.Parse(args)
+		return client.Purge(ctx, adminclient.PurgeRequest{Paths: flags.Args(), Layer: *layer})
+
+	case "cache-stats":
+		top := defaultHottestKeys
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return nil, errAdminUsage
+			}
+			top = n
+		}
+		return client.CacheStats(ctx, top)
+
+	case "support-bundle":
+		path, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := client.SupportBundle(ctx, f); err != nil {
+			return nil, err
+		}
+		return nil, f.Close()
+	}
+
+	return nil, errAdminUsage
+}
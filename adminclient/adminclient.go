@@ -0,0 +1,378 @@
+// Package adminclient is a client for the gateway's admin API, the
+// operator endpoints under /admin/ guarded by CIVIL_ADMIN_TOKEN.
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the admin API of one gateway, at BaseURL like
+// http://10.0.1.5:8080, with the admin token
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New is a client for the gateway at baseURL, authenticating with token
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Error is an admin API call the gateway answered with an error status
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// do calls the admin API, encoding body as JSON if it isn't nil, and
+// returns the response for the caller to close when it succeeds
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(message)),
+		}
+	}
+	return resp, nil
+}
+
+// call calls the admin API and decodes the JSON answer into out, unless out
+// is nil
+func (c *Client) call(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+	}
+	return nil
+}
+
+// Job is a scheduled background job and how its runs went
+type Job struct {
+	Name         string    `json:"name"`
+	Interval     string    `json:"interval"`
+	Running      bool      `json:"running"`
+	Runs         uint64    `json:"runs"`
+	Failures     uint64    `json:"failures"`
+	LastRun      time.Time `json:"last_run,omitzero"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastSuccess  time.Time `json:"last_success,omitzero"`
+	NextRun      time.Time `json:"next_run,omitzero"`
+}
+
+// Jobs lists the scheduled jobs
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	err := c.call(ctx, http.MethodGet, "/admin/jobs", nil, &jobs)
+	return jobs, err
+}
+
+// Memory is the memory the gateway's stateful parts use, as JSON
+func (c *Client) Memory(ctx context.Context) (json.RawMessage, error) {
+	var usage json.RawMessage
+	err := c.call(ctx, http.MethodGet, "/admin/memory", nil, &usage)
+	return usage, err
+}
+
+// SLO is one service level objective and how fast its error budget burns,
+// by window
+type SLO struct {
+	Name      string             `json:"name"`
+	Prefix    string             `json:"prefix"`
+	Objective float64            `json:"objective"`
+	Latency   string             `json:"latency,omitempty"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+}
+
+// SLOs lists the service level objectives
+func (c *Client) SLOs(ctx context.Context) ([]SLO, error) {
+	var slos []SLO
+	err := c.call(ctx, http.MethodGet, "/admin/slos", nil, &slos)
+	return slos, err
+}
+
+// BlockedClient is a blocked client address
+type BlockedClient struct {
+	Addr    string    `json:"addr"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+}
+
+// Blocks lists the blocked client addresses
+func (c *Client) Blocks(ctx context.Context) ([]BlockedClient, error) {
+	var blocks []BlockedClient
+	err := c.call(ctx, http.MethodGet, "/admin/blocks", nil, &blocks)
+	return blocks, err
+}
+
+// Unblock lifts the block on a client address
+func (c *Client) Unblock(ctx context.Context, addr string) error {
+	return c.call(ctx, http.MethodDelete, "/admin/blocks/"+url.PathEscape(addr), nil, nil)
+}
+
+// Backends is the state of one pool's endpoints, as http://host:port
+type Backends struct {
+	Endpoints           []string            `json:"endpoints"`
+	Rotation            []string            `json:"rotation"`
+	Down                []string            `json:"down,omitempty"`
+	Ejected             []string            `json:"ejected,omitempty"`
+	Drained             []string            `json:"drained,omitempty"`
+	Weights             map[string]int      `json:"weights,omitempty"`
+	Zones               map[string]string   `json:"zones,omitempty"`
+	Capabilities        map[string][]string `json:"capabilities,omitempty"`
+	LastSuccess         time.Time           `json:"last_success"`
+	LastDiscovered      time.Time           `json:"last_discovered"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	ServingStale        bool                `json:"serving_stale"`
+}
+
+// Backends is the state of every pool's endpoints, by pool
+func (c *Client) Backends(ctx context.Context) (map[string]Backends, error) {
+	var pools map[string]Backends
+	err := c.call(ctx, http.MethodGet, "/admin/backends", nil, &pools)
+	return pools, err
+}
+
+// Drain takes the endpoint at addr, a host:port, out of rotation in every
+// pool that has it, letting the requests it is serving finish
+func (c *Client) Drain(ctx context.Context, addr string) error {
+	return c.call(ctx, http.MethodPost, "/admin/backends/"+url.PathEscape(addr)+"/drain", nil, nil)
+}
+
+// Undrain puts a drained endpoint back in rotation
+func (c *Client) Undrain(ctx context.Context, addr string) error {
+	return c.call(ctx, http.MethodDelete, "/admin/backends/"+url.PathEscape(addr)+"/drain", nil, nil)
+}
+
+// RefreshDiscovery has the backends of pool, or of every pool when empty,
+// rediscovered now rather than at the next interval. The refresh happens in
+// the background after it returns.
+func (c *Client) RefreshDiscovery(ctx context.Context, pool string) error {
+	path := "/admin/discovery/refresh"
+	if pool != "" {
+		path = "/admin/discovery/" + url.PathEscape(pool) + "/refresh"
+	}
+	return c.call(ctx, http.MethodPost, path, nil, nil)
+}
+
+// Config is the configuration the gateway runs with, with its secrets
+// redacted, as JSON
+func (c *Client) Config(ctx context.Context) (json.RawMessage, error) {
+	var config json.RawMessage
+	err := c.call(ctx, http.MethodGet, "/admin/config", nil, &config)
+	return config, err
+}
+
+// ConfigReload is what a config reload applied
+type ConfigReload struct {
+	// The settings that changed but only apply after a restart
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// ReloadConfig has the gateway load its config again and apply the routes'
+// auth, CORS, rate limits, and issuers. A rejected config is an *Error with
+// status 422 and the gateway keeps running with the config it had.
+func (c *Client) ReloadConfig(ctx context.Context) (ConfigReload, error) {
+	var reload ConfigReload
+	err := c.call(ctx, http.MethodPost, "/admin/config/reload", nil, &reload)
+	return reload, err
+}
+
+// LogLevel is the level the gateway logs at
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// LogLevel is the level the gateway logs at now
+func (c *Client) LogLevel(ctx context.Context) (LogLevel, error) {
+	var level LogLevel
+	err := c.call(ctx, http.MethodGet, "/admin/log-level", nil, &level)
+	return level, err
+}
+
+// SetLogLevel has the gateway log at level, one of debug, info, warn, or
+// error, until it restarts
+func (c *Client) SetLogLevel(ctx context.Context, level string) (LogLevel, error) {
+	var set LogLevel
+	err := c.call(ctx, http.MethodPut, "/admin/log-level", LogLevel{Level: level}, &set)
+	return set, err
+}
+
+// CanaryStats is how a stable pool or its canary did over the analysis
+// window
+type CanaryStats struct {
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       string  `json:"p50"`
+	P95       string  `json:"p95"`
+}
+
+// CanaryJudgment is whether a canary does well enough against its stable
+// pool to keep rolling out: pass, fail, or inconclusive while there are too
+// few requests to tell
+type CanaryJudgment struct {
+	Pool            string      `json:"pool"`
+	CanaryPool      string      `json:"canary_pool"`
+	Weight          int         `json:"weight"`
+	Verdict         string      `json:"verdict"`
+	Reasons         []string    `json:"reasons,omitempty"`
+	Window          string      `json:"window"`
+	Stable          CanaryStats `json:"stable"`
+	Canary          CanaryStats `json:"canary"`
+	ErrorRateDelta  float64     `json:"error_rate_delta"`
+	P50LatencyDelta string      `json:"p50_latency_delta"`
+	P95LatencyDelta string      `json:"p95_latency_delta"`
+}
+
+// Canaries lists the judgment of every canary
+func (c *Client) Canaries(ctx context.Context) ([]CanaryJudgment, error) {
+	var judgments []CanaryJudgment
+	err := c.call(ctx, http.MethodGet, "/admin/canary", nil, &judgments)
+	return judgments, err
+}
+
+// Canary is the judgment of the canary of pool. A failing canary is a
+// judgment, not an error.
+func (c *Client) Canary(ctx context.Context, pool string) (CanaryJudgment, error) {
+	var judgment CanaryJudgment
+	err := c.call(ctx, http.MethodGet, "/admin/canary/"+url.PathEscape(pool), nil, &judgment)
+
+	// The gateway answers a failing canary with 409 and the judgment
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		if json.Unmarshal([]byte(apiErr.Message), &judgment) == nil {
+			return judgment, nil
+		}
+	}
+	return judgment, err
+}
+
+// Layers is the current layer manifest, as JSON
+func (c *Client) Layers(ctx context.Context) (json.RawMessage, error) {
+	var manifest json.RawMessage
+	err := c.call(ctx, http.MethodGet, "/admin/layers", nil, &manifest)
+	return manifest, err
+}
+
+// PutLayers replaces the layer manifest, answering with the new one
+func (c *Client) PutLayers(ctx context.Context, manifest json.RawMessage) (json.RawMessage, error) {
+	var current json.RawMessage
+	err := c.call(ctx, http.MethodPut, "/admin/layers", manifest, &current)
+	return current, err
+}
+
+// PurgeRequest is what to purge from the tile cache and the CDN: paths,
+// which can end in *, and every tile of a layer
+type PurgeRequest struct {
+	Paths []string `json:"paths"`
+	Layer string   `json:"layer,omitempty"`
+}
+
+// PurgeResult is what a purge dropped
+type PurgeResult struct {
+	Paths          []string `json:"paths"`
+	CacheEntries   int      `json:"cache_entries"`
+	InvalidationID string   `json:"invalidation_id,omitempty"`
+}
+
+// Purge drops paths from the tile cache and invalidates them in the CDN
+func (c *Client) Purge(ctx context.Context, purge PurgeRequest) (PurgeResult, error) {
+	var result PurgeResult
+	err := c.call(ctx, http.MethodPost, "/admin/purge", purge, &result)
+	return result, err
+}
+
+// CacheStats is the tile cache's stats with its top hottest keys, as JSON
+func (c *Client) CacheStats(ctx context.Context, top int) (json.RawMessage, error) {
+	var stats json.RawMessage
+	err := c.call(ctx, http.MethodGet, "/admin/cache/stats?top="+strconv.Itoa(top), nil, &stats)
+	return stats, err
+}
+
+// Captures lists the captured requests, newest first, as JSON
+func (c *Client) Captures(ctx context.Context) (json.RawMessage, error) {
+	var captures json.RawMessage
+	err := c.call(ctx, http.MethodGet, "/admin/captures", nil, &captures)
+	return captures, err
+}
+
+// Capture is one captured request, as JSON
+func (c *Client) Capture(ctx context.Context, id string) (json.RawMessage, error) {
+	var capture json.RawMessage
+	err := c.call(ctx, http.MethodGet, "/admin/captures/"+url.PathEscape(id), nil, &capture)
+	return capture, err
+}
+
+// SupportBundle writes a support bundle, a gzipped tarball, to w
+func (c *Client) SupportBundle(ctx context.Context, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/admin/support-bundle", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
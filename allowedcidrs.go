@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+var discoveryRejected = NewCounter(
+	"civil_gateway_discovery_rejected_instances_total",
+	"Discovered instances left out of the pool because their address is outside the allowed CIDRs",
+	"pool",
+)
+
+// parseCIDRs parses CIDRs like 10.0.0.0/16
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowedInstances leaves out the instances whose address isn't inside one
+// of the allowed CIDRs, so a misregistered instance never gets requests
+// carrying users' tokens. Hostnames are resolved and allowed only if every
+// address they resolve to is. The proxy resolves them again when it dials,
+// and its transport checks the address it connects to as well, see
+// allowedDialControl. With no CIDRs every instance is allowed.
+func (bm *BackendManager) allowedInstances(ctx context.Context, instances []DiscoveredInstance) []DiscoveredInstance {
+	bm.mu.RLock()
+	allowed := bm.allowedCIDRs
+	bm.mu.RUnlock()
+
+	if len(allowed) == 0 {
+		return instances
+	}
+
+	rejected := map[string]bool{}
+	kept := slices.DeleteFunc(slices.Clone(instances), func(inst DiscoveredInstance) bool {
+		ok, err := addressAllowed(ctx, inst.Address, allowed)
+		if ok {
+			return false
+		}
+
+		rejected[inst.Address] = true
+		discoveryRejected.Inc(bm.pool)
+
+		bm.mu.RLock()
+		known := bm.rejected[inst.Address]
+		bm.mu.RUnlock()
+		if !known {
+			bm.logger.Error("rejected a discovered instance outside the allowed CIDRs",
+				slog.String("address", inst.Address),
+				slog.Any("error", err),
+			)
+		}
+		return true
+	})
+
+	// Instances are logged once, when first rejected, and again if they
+	// come back after being fixed and then go bad again
+	bm.mu.Lock()
+	bm.rejected = rejected
+	bm.mu.Unlock()
+
+	return kept
+}
+
+// addressAllowed reports whether the host of address, an IP or a hostname,
+// is inside one of allowed
+func addressAllowed(ctx context.Context, address string, allowed []netip.Prefix) (bool, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false, err
+	}
+
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(allowed, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return false, fmt.Errorf("%s is outside the allowed CIDRs", addr)
+		}
+	}
+	return len(addrs) > 0, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// analyticsFlushTimeout bounds exporting the last interval at shutdown
+const analyticsFlushTimeout = 10 * time.Second
+
+var analyticsRows = NewCounter(
+	"civil_gateway_analytics_rows_total",
+	"Aggregated usage rows, by whether they were exported or suppressed for having too few users",
+	"result",
+)
+
+// AnalyticsConfig is how usage analytics are aggregated before export.
+// Tiles are counted by layer, by zoom band of ZoomBand levels, and by the
+// cell at GeoZoom they fall in, so no row says which tiles anyone viewed.
+// Rows with fewer than MinUsers distinct users are suppressed, and counted
+// together in one row that is itself only exported with MinUsers users.
+// The rows are exported every Interval to the bucket at BucketURL, like
+// s3://analytics?region=us-west-2&prefix=tiles/.
+type AnalyticsConfig struct {
+	BucketURL string
+	Interval  time.Duration
+	GeoZoom   int
+	ZoomBand  int
+	MinUsers  int
+}
+
+// analyticsKey is the row a tile request is counted in
+type analyticsKey struct {
+	layer    string
+	zoomBand int
+	cellX    int
+	cellY    int
+}
+
+type analyticsCounts struct {
+	requests int64
+	bytes    int64
+	users    map[uint64]struct{}
+}
+
+// AnalyticsRow is one line of an export. The users are counted, never
+// named; suppressed rows have no layer or cell.
+type AnalyticsRow struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Layer      string    `json:"layer,omitempty"`
+	MinZoom    *int      `json:"min_zoom,omitempty"`
+	MaxZoom    *int      `json:"max_zoom,omitempty"`
+	GeoZoom    *int      `json:"geo_zoom,omitempty"`
+	CellX      *int      `json:"cell_x,omitempty"`
+	CellY      *int      `json:"cell_y,omitempty"`
+	Suppressed bool      `json:"suppressed,omitempty"`
+	Requests   int64     `json:"requests"`
+	Bytes      int64     `json:"bytes"`
+	Users      int       `json:"users"`
+}
+
+// UsageAnalytics aggregates tile traffic into coarse, k-anonymous rows and
+// exports them, for usage analytics that don't keep anyone's tile trail.
+// Users are told apart by a hash salted afresh every interval, so nothing
+// kept or exported links a user across intervals.
+type UsageAnalytics struct {
+	config AnalyticsConfig
+	bucket *blob.Bucket
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	start  time.Time
+	salt   []byte
+	counts map[analyticsKey]*analyticsCounts
+}
+
+// NewUsageAnalytics opens the export bucket and exports every interval on
+// stage, and once more when it stops
+func NewUsageAnalytics(ctx context.Context, stage *Stage, config AnalyticsConfig, logger *slog.Logger) (*UsageAnalytics, error) {
+	if config.GeoZoom < 0 || config.ZoomBand < 1 || config.MinUsers < 1 {
+		return nil, fmt.Errorf("invalid analytics aggregation: geo zoom %d, zoom band %d, min users %d", config.GeoZoom, config.ZoomBand, config.MinUsers)
+	}
+
+	bucket, err := blob.OpenBucket(ctx, config.BucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open analytics bucket: %w", err)
+	}
+
+	a := &UsageAnalytics{
+		config: config,
+		bucket: bucket,
+		logger: logger,
+	}
+	a.reset(time.Now())
+
+	stage.Go("analytics", func(ctx context.Context) error {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.Export(ctx); err != nil {
+					logger.Error("failed to export analytics", slog.Any("error", err))
+				}
+			case <-ctx.Done():
+				flushCtx, cancel := context.WithTimeout(context.Background(), analyticsFlushTimeout)
+				if err := a.Export(flushCtx); err != nil {
+					logger.Error("failed to export analytics", slog.Any("error", err))
+				}
+				cancel()
+				return bucket.Close()
+			}
+		}
+	})
+
+	return a, nil
+}
+
+// reset starts a new interval, with a new salt. Must hold a.mu or be called
+// before a is shared.
+func (a *UsageAnalytics) reset(now time.Time) {
+	a.start = now
+	a.salt = make([]byte, 16)
+	rand.Read(a.salt)
+	a.counts = map[analyticsKey]*analyticsCounts{}
+}
+
+// Middleware counts each request once it has been answered. It must run
+// behind EgressMeter.Middleware, which collects the layer, tile, and user.
+func (a *UsageAnalytics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		entry, ok := r.Context().Value(trafficContextKey).(*trafficEntry)
+		if !ok || !entry.tile {
+			return
+		}
+
+		// Anonymous users are told apart by address
+		user := entry.tenant
+		if user == "" {
+			user = clientAddr(r).String()
+		}
+		a.record(entry, user, recorder.bytes)
+	})
+}
+
+func (a *UsageAnalytics) record(entry *trafficEntry, user string, bytes int64) {
+	key := analyticsKey{
+		layer:    entry.layer,
+		zoomBand: entry.z / a.config.ZoomBand,
+	}
+
+	shift := entry.z - a.cellZoom(key.zoomBand)
+	key.cellX = entry.x >> shift
+	key.cellY = entry.y >> shift
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counts, ok := a.counts[key]
+	if !ok {
+		counts = &analyticsCounts{users: map[uint64]struct{}{}}
+		a.counts[key] = counts
+	}
+	counts.requests++
+	counts.bytes += bytes
+	counts.users[hashKey(string(a.salt)+user)] = struct{}{}
+}
+
+// cellZoom is the zoom of the cells tiles in zoomBand are counted in. Bands
+// starting below the geo zoom count in cells of their lowest zoom, so every
+// tile of the band falls in exactly one.
+func (a *UsageAnalytics) cellZoom(zoomBand int) int {
+	return min(a.config.GeoZoom, zoomBand*a.config.ZoomBand)
+}
+
+// rows aggregates the counts of an interval into the rows to export,
+// folding the rows with too few users into the suppressed row
+func (a *UsageAnalytics) rows(start, end time.Time, counts map[analyticsKey]*analyticsCounts) []AnalyticsRow {
+	var rows []AnalyticsRow
+	suppressed := &analyticsCounts{users: map[uint64]struct{}{}}
+	suppressedRows := 0
+
+	for key, c := range counts {
+		if len(c.users) < a.config.MinUsers {
+			suppressed.requests += c.requests
+			suppressed.bytes += c.bytes
+			for user := range c.users {
+				suppressed.users[user] = struct{}{}
+			}
+			suppressedRows++
+			continue
+		}
+
+		minZoom := key.zoomBand * a.config.ZoomBand
+		maxZoom := minZoom + a.config.ZoomBand - 1
+		geoZoom := a.cellZoom(key.zoomBand)
+		rows = append(rows, AnalyticsRow{
+			Start:    start,
+			End:      end,
+			Layer:    key.layer,
+			MinZoom:  &minZoom,
+			MaxZoom:  &maxZoom,
+			GeoZoom:  &geoZoom,
+			CellX:    &key.cellX,
+			CellY:    &key.cellY,
+			Requests: c.requests,
+			Bytes:    c.bytes,
+			Users:    len(c.users),
+		})
+	}
+	analyticsRows.Add(float64(len(rows)), "exported")
+	analyticsRows.Add(float64(suppressedRows), "suppressed")
+
+	if len(suppressed.users) >= a.config.MinUsers {
+		rows = append(rows, AnalyticsRow{
+			Start:      start,
+			End:        end,
+			Suppressed: true,
+			Requests:   suppressed.requests,
+			Bytes:      suppressed.bytes,
+			Users:      len(suppressed.users),
+		})
+	}
+	return rows
+}
+
+// Export writes the rows of the interval that just ended as JSON lines,
+// named for when it started, and starts the next one
+func (a *UsageAnalytics) Export(ctx context.Context) error {
+	now := time.Now()
+
+	a.mu.Lock()
+	start, counts := a.start, a.counts
+	a.reset(now)
+	a.mu.Unlock()
+
+	rows := a.rows(start, now, counts)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	// Gateways starting an interval at the same second are kept apart
+	key := start.UTC().Format("2006/01/02/150405") + "-" + rand.Text() + ".jsonl"
+	if err := a.bucket.WriteAll(ctx, key, body.Bytes(), &blob.WriterOptions{ContentType: "application/x-ndjson"}); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+
+	a.logger.Debug("exported analytics", slog.String("key", key), slog.Int("rows", len(rows)))
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/time/rate"
+)
+
+var apiKeyAuth = NewCounter(
+	"civil_gateway_api_key_auth_total",
+	"Requests authenticated by API key, by result",
+	"result",
+)
+
+// APIKeyConfig is one API key, for callers like mapping pipelines that
+// can't go through an OIDC flow. The key is given in Key, or better as the
+// hex SHA-256 of it in SHA256 so the file holds no usable secret. Routes
+// are the path prefixes the key may call, any when empty, and RateLimit
+// the requests per second it may make, with bursts of up to RateBurst.
+// The key authenticates as the subject apikey:<id>, in Groups.
+type APIKeyConfig struct {
+	ID        string   `json:"id" yaml:"id"`
+	Key       string   `json:"key,omitempty" yaml:"key,omitempty"`
+	SHA256    string   `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	Owner     string   `json:"owner" yaml:"owner"`
+	Routes    []string `json:"routes,omitempty" yaml:"routes,omitempty"`
+	Groups    []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+	RateLimit float64  `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateBurst int      `json:"rate_burst,omitempty" yaml:"rate_burst,omitempty"`
+}
+
+// apiKey is a loaded key, with its own rate limiter if it is limited
+type apiKey struct {
+	config  APIKeyConfig
+	digest  []byte
+	limiter *rate.Limiter
+}
+
+// APIKeyStore authenticates requests carrying an X-API-Key header against
+// keys loaded from a file or a Secrets Manager secret, reloaded so keys
+// can be issued and revoked without a restart
+type APIKeyStore struct {
+	source  string
+	secrets *secretsmanager.Client
+	logger  *slog.Logger
+
+	mu   sync.RWMutex
+	keys []*apiKey
+}
+
+// NewAPIKeyStore loads the keys from source, a JSON or YAML file or the ARN
+// of a Secrets Manager secret holding the JSON, failing if they can't be
+func NewAPIKeyStore(ctx context.Context, source string, logger *slog.Logger) (*APIKeyStore, error) {
+	store := &APIKeyStore{source: source, logger: logger}
+
+	if strings.HasPrefix(source, secretsManagerARNPrefix) {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		store.secrets = secretsmanager.NewFromConfig(cfg)
+	}
+
+	if err := store.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the keys again. A failed reload keeps the keys already
+// loaded. Keys whose rate limit didn't change keep their buckets. Run as a
+// scheduled job.
+func (s *APIKeyStore) Reload(ctx context.Context) error {
+	data, err := readSecretSource(ctx, s.secrets, s.source)
+	if err != nil {
+		return fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	var configs []APIKeyConfig
+	if filepath.Ext(s.source) == ".yaml" || filepath.Ext(s.source) == ".yml" {
+		err = yaml.Unmarshal(data, &configs)
+	} else {
+		err = json.Unmarshal(data, &configs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse API keys: %w", err)
+	}
+
+	s.mu.RLock()
+	previous := map[string]*apiKey{}
+	for _, key := range s.keys {
+		previous[key.config.ID] = key
+	}
+	s.mu.RUnlock()
+
+	keys := make([]*apiKey, 0, len(configs))
+	ids := map[string]bool{}
+	for _, config := range configs {
+		key, err := newAPIKey(config)
+		if err != nil {
+			return err
+		}
+		if ids[config.ID] {
+			return fmt.Errorf("API key %s is listed twice", config.ID)
+		}
+		ids[config.ID] = true
+
+		if old, ok := previous[config.ID]; ok && old.limiter != nil && key.limiter != nil &&
+			old.config.RateLimit == config.RateLimit && old.config.RateBurst == config.RateBurst {
+			key.limiter = old.limiter
+		}
+		keys = append(keys, key)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	s.logger.Debug("loaded API keys", slog.Int("keys", len(keys)))
+	return nil
+}
+
+func newAPIKey(config APIKeyConfig) (*apiKey, error) {
+	if config.ID == "" {
+		return nil, fmt.Errorf("API key without an id")
+	}
+
+	var digest []byte
+	switch {
+	case config.Key != "" && config.SHA256 != "":
+		return nil, fmt.Errorf("API key %s has both a key and a sha256, only one is needed", config.ID)
+	case config.Key != "":
+		sum := sha256.Sum256([]byte(config.Key))
+		digest = sum[:]
+	case config.SHA256 != "":
+		var err error
+		digest, err = hex.DecodeString(config.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("API key %s has an invalid sha256, expected 64 hex digits", config.ID)
+		}
+	default:
+		return nil, fmt.Errorf("API key %s has neither a key nor a sha256", config.ID)
+	}
+
+	for _, route := range config.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("API key %s: route %q must be a path starting with /", config.ID, route)
+		}
+	}
+
+	key := &apiKey{config: config, digest: digest}
+	if config.RateLimit > 0 {
+		key.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), rateBurst(config.RateLimit, config.RateBurst))
+	}
+	return key, nil
+}
+
+// lookup finds the key matching presented. Every key is compared, in
+// constant time, so how long it takes tells nothing about the keys.
+func (s *APIKeyStore) lookup(presented string) *apiKey {
+	digest := sha256.Sum256([]byte(presented))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *apiKey
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare(digest[:], key.digest) == 1 {
+			found = key
+		}
+	}
+	return found
+}
+
+// allowsRoute reports whether the key may call path
+func (k *apiKey) allowsRoute(path string) bool {
+	if len(k.config.Routes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(k.config.Routes, func(route string) bool { return underRoute(path, route) })
+}
+
+// underRoute reports whether path is route or below it, matching whole path
+// segments, so /tiles/parcels doesn't cover /tiles/parcels-private
+func underRoute(path, route string) bool {
+	if !strings.HasPrefix(path, route) {
+		return false
+	}
+	return len(path) == len(route) || strings.HasSuffix(route, "/") || path[len(route)] == '/'
+}
+
+// delay takes a token from the key's bucket, or else reports how long until
+// one is free without taking it
+func (k *apiKey) delay() time.Duration {
+	if k.limiter == nil {
+		return 0
+	}
+
+	now := time.Now()
+	reservation := k.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// Middleware authenticates requests with an X-API-Key header by their key,
+// and passes the others to bearer, the token auth
+func (s *APIKeyStore) Middleware(bearer func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withToken := bearer(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented := r.Header.Get("X-API-Key")
+			if presented == "" {
+				withToken.ServeHTTP(w, r)
+				return
+			}
+
+			key := s.lookup(presented)
+			if key == nil {
+				apiKeyAuth.Inc("invalid")
+				writeError(w, r, http.StatusUnauthorized, "invalid_api_key", "")
+				s.logger.Debug("Unauthorized: Invalid API key")
+				return
+			}
+
+			if !key.allowsRoute(r.URL.Path) {
+				apiKeyAuth.Inc("forbidden")
+				writeError(w, r, http.StatusForbidden, "route_forbidden", "")
+				s.logger.Debug("API key not allowed on route", slog.String("key", key.config.ID), slog.String("path", r.URL.Path))
+				return
+			}
+
+			if delay := key.delay(); delay > 0 {
+				apiKeyAuth.Inc("rate_limited")
+				rateLimited.Inc("api_key")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, "rate_limited", "")
+				return
+			}
+
+			apiKeyAuth.Inc("ok")
+			serveAuthenticated(w, r, next, Claims{
+				Subject:           "apikey:" + key.config.ID,
+				PreferredUsername: key.config.Owner,
+				Groups:            key.config.Groups,
+			})
+		})
+	}
+}
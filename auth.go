@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
-	"io"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 )
@@ -24,114 +32,406 @@ type Claims struct {
 	Groups            []string `json:"groups"`
 }
 
-// RequireAuth is the middleware wrapper
-func RequireAuth(authServer string, idpHost string, allowedClientIDs []string, logger *slog.Logger) (func(http.Handler) http.Handler, error) {
+// providerDiscovery is the part of an issuer's OIDC discovery document the
+// gateway uses
+type providerDiscovery struct {
+	JWKSURL    string   `json:"jwks_uri"`
+	Algorithms []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// discoverProvider reads the discovery document the issuer publishes under
+// /.well-known/openid-configuration
+func discoverProvider(issuerURL string) (providerDiscovery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return providerDiscovery{}, fmt.Errorf("failed to discover OIDC provider %s: %w", issuerURL, err)
+	}
 
-	providerConfig := oidc.ProviderConfig{
-		IssuerURL:   "https://" + authServer,
-		AuthURL:     "https://" + authServer,
-		TokenURL:    "https://" + authServer + "/token",
-		UserInfoURL: "https://" + authServer + "/userinfo",
-		JWKSURL:     "http://" + idpHost + "/keys",
-		Algorithms:  []string{"RS256"}, // Dex uses RS256 by default
+	var discovery providerDiscovery
+	if err := provider.Claims(&discovery); err != nil {
+		return providerDiscovery{}, fmt.Errorf("failed to read discovery document of %s: %w", issuerURL, err)
+	}
+	if discovery.JWKSURL == "" {
+		return providerDiscovery{}, fmt.Errorf("discovery document of %s has no jwks_uri", issuerURL)
 	}
 
-	DumpRawJWKS(providerConfig.JWKSURL, logger)
+	// Unsigned tokens are never accepted, whatever the issuer says
+	discovery.Algorithms = slices.DeleteFunc(discovery.Algorithms, func(alg string) bool { return alg == "none" })
+
+	return discovery, nil
+}
+
+// IssuerConfig is one OIDC issuer whose tokens are accepted. The signing
+// keys are fetched from JWKSURL, which can be an internal address of the
+// IDP, or else from the jwks_uri found through OIDC discovery. Tokens must
+// be for one of ClientIDs, by their aud claim, or client_id for issuers like
+// Cognito whose access tokens have no audience. GroupsClaim names the claim
+// holding the user's groups, groups unless set, like cognito:groups.
+type IssuerConfig struct {
+	Issuer      string   `json:"issuer"`
+	JWKSURL     string   `json:"jwks_url,omitempty"`
+	ClientIDs   []string `json:"client_ids"`
+	GroupsClaim string   `json:"groups_claim,omitempty"`
+}
+
+// issuerVerifier verifies the tokens of one issuer against its own keys
+type issuerVerifier struct {
+	config   IssuerConfig
+	verifier *oidc.IDTokenVerifier
+	jwks     *JWKSCache
+}
+
+// newIssuerVerifier fetches the issuer's signing keys once up front. They
+// are refreshed by the job Issuers.Update schedules.
+func newIssuerVerifier(config IssuerConfig, logger *slog.Logger) (*issuerVerifier, error) {
+	algorithms := []string{oidc.RS256} // Dex uses RS256 by default
+
+	jwksURL := config.JWKSURL
+	if jwksURL == "" {
+		discovery, err := discoverProvider(config.Issuer)
+		if err != nil {
+			return nil, err
+		}
 
-	// Initialize the Provider to securely fetch the JWKS keys from Dex
-	provider := providerConfig.NewProvider(context.Background())
+		jwksURL = discovery.JWKSURL
+		if len(discovery.Algorithms) > 0 {
+			algorithms = discovery.Algorithms
+		}
+
+		logger.Info("discovered OIDC provider", slog.String("issuer", config.Issuer), slog.String("jwks_url", jwksURL), slog.Any("algorithms", algorithms))
+	}
+
+	// Verifying against cached keys keeps the IDP off the request path. If
+	// the first fetch fails, the keys are fetched again on the first token
+	jwks := NewJWKSCache(jwksURL, algorithms, logger)
+	if err := jwks.Refresh(context.Background()); err != nil {
+		logger.Warn("failed to fetch signing keys, retrying on demand", slog.String("url", jwksURL), slog.Any("error", err))
+	}
 
 	// Configure the verifier to not run the clientID check
 	// We'll need to do it manually as we'll have a list of acceptable
 	// client IDs
-	verifier := provider.Verifier(&oidc.Config{
-		SkipClientIDCheck: true,
+	verifier := oidc.NewVerifier(config.Issuer, jwks, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: algorithms,
 	})
 
-	// Return the actual middleware function
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract the token
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-				http.Error(w, "Unauthorized: Missing or invalid Bearer token", http.StatusUnauthorized)
+	return &issuerVerifier{config: config, verifier: verifier, jwks: jwks}, nil
+}
 
-				logger.Debug("Unauthorized: Missing or invalid Bearer token")
+// allowsClient reports whether the token is for one of the issuer's clients
+func (v *issuerVerifier) allowsClient(idToken *oidc.IDToken) bool {
+	// We have to iterate over aud, as coreos/oidc normalizes it to
+	// an array no matter what to handle an edge case in the spec
+	for _, aud := range idToken.Audience {
+		if slices.Contains(v.config.ClientIDs, aud) {
+			return true
+		}
+	}
 
-				return
+	if len(idToken.Audience) == 0 {
+		var access struct {
+			ClientID string `json:"client_id"`
+		}
+		if err := idToken.Claims(&access); err == nil && access.ClientID != "" {
+			return slices.Contains(v.config.ClientIDs, access.ClientID)
+		}
+	}
+	return false
+}
+
+// claims parses the identity claims, taking the groups from the issuer's
+// groups claim
+func (v *issuerVerifier) claims(idToken *oidc.IDToken) (Claims, error) {
+	var claims Claims
+	if err := idToken.Claims(&claims); err != nil {
+		return Claims{}, err
+	}
+
+	if v.config.GroupsClaim != "" && v.config.GroupsClaim != "groups" {
+		var raw map[string]any
+		if err := idToken.Claims(&raw); err != nil {
+			return Claims{}, err
+		}
+		claims.Groups = nil
+		if groups, ok := raw[v.config.GroupsClaim].([]any); ok {
+			for _, group := range groups {
+				if name, ok := group.(string); ok {
+					claims.Groups = append(claims.Groups, name)
+				}
 			}
-			rawIDToken := strings.TrimPrefix(authHeader, "Bearer ")
+		}
+	}
+	return claims, nil
+}
 
-			logger.Debug("Request contains token", slog.String("token", rawIDToken))
+// tokenIssuer reads the iss claim of a token without verifying it, to pick
+// the verifier that will
+func tokenIssuer(rawToken string) (string, bool) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
 
-			// Verify the cryptographic signature and expiration
-			idToken, err := verifier.Verify(r.Context(), rawIDToken)
-			if err != nil {
-				http.Error(w, "Unauthorized: Invalid or expired token", http.StatusUnauthorized)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
 
-				logger.Debug("Unauthorized: Invalid or expired token", slog.Any("error", err))
+	var token struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &token); err != nil || token.Issuer == "" {
+		return "", false
+	}
+	return token.Issuer, true
+}
 
-				return
-			}
+// Issuers are the OIDC issuers whose tokens are accepted. Each token is
+// verified by the issuer its iss claim names, with that issuer's keys, so
+// IDPs can be migrated with both accepted during the cutover.
+type Issuers struct {
+	scheduler   *Scheduler
+	jwksRefresh time.Duration
+	logger      *slog.Logger
 
-			// Manually check if the audience is one of the allowed clients
-			// We have to iterate over aud, as coreos/oidc normalizes it to
-			// an array no matter what to handle an edge case in the spec
-			isValidAudience := false
-			for _, aud := range idToken.Audience {
-				for _, allowed := range allowedClientIDs {
-					if aud == allowed {
-						isValidAudience = true
-						break
-					}
-				}
-			}
+	// mu serializes swaps, verifiers is read by every request
+	mu        sync.Mutex
+	verifiers atomic.Pointer[map[string]*issuerVerifier]
+}
 
-			if !isValidAudience {
-				http.Error(w, "Unauthorized: Unrecognized client application", http.StatusUnauthorized)
+func NewIssuers(issuers []IssuerConfig, scheduler *Scheduler, jwksRefresh time.Duration, logger *slog.Logger) (*Issuers, error) {
+	i := &Issuers{
+		scheduler:   scheduler,
+		jwksRefresh: jwksRefresh,
+		logger:      logger,
+	}
+	i.verifiers.Store(&map[string]*issuerVerifier{})
+	if err := i.Update(issuers); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
 
-				logger.Debug("Unauthorized: Unrecognized client application")
+// Update swaps in issuers for the tokens verified after it. If any issuer
+// fails to set up, the old issuers stay in place.
+func (i *Issuers) Update(issuers []IssuerConfig) error {
+	commit, err := i.Prepare(issuers)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare sets up the verifiers of issuers, and returns the function that
+// swaps them in. Issuers whose config is unchanged keep their cached keys;
+// the keys of the others are fetched now.
+func (i *Issuers) Prepare(issuers []IssuerConfig) (func(), error) {
+	current := *i.verifiers.Load()
+	verifiers := make(map[string]*issuerVerifier, len(issuers))
+	for _, issuer := range issuers {
+		if verifier, ok := current[issuer.Issuer]; ok && reflect.DeepEqual(verifier.config, issuer) {
+			verifiers[issuer.Issuer] = verifier
+			continue
+		}
+		verifier, err := newIssuerVerifier(issuer, i.logger)
+		if err != nil {
+			return nil, err
+		}
+		verifiers[issuer.Issuer] = verifier
+	}
 
-				return
+	return func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+
+		// Each issuer's keys are refreshed by a job named for it, which
+		// goes with the verifier it refreshes
+		current := *i.verifiers.Load()
+		for name, verifier := range current {
+			if verifiers[name] != verifier {
+				i.scheduler.Remove("auth:jwks:" + name)
+			}
+		}
+		for name, verifier := range verifiers {
+			if current[name] != verifier {
+				i.scheduler.Add("auth:jwks:"+name, i.jwksRefresh, verifier.jwks.Refresh)
 			}
+		}
+		i.verifiers.Store(&verifiers)
+	}, nil
+}
+
+// RequireAuth is the middleware wrapper for tokens issued by any of the
+// issuers
+func (i *Issuers) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Extract the token, which WebSocket upgrades from browsers can
+		// only send in the query
+		authHeader := r.Header.Get("Authorization")
+		if token, ok := webSocketToken(r); ok && authHeader == "" {
+			authHeader = "Bearer " + token
+		}
+		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+			writeError(w, r, http.StatusUnauthorized, "missing_token", "")
+
+			i.logger.Debug("Unauthorized: Missing or invalid Bearer token")
+
+			return
+		}
+		rawIDToken := strings.TrimPrefix(authHeader, "Bearer ")
+
+		i.logger.Debug("Request contains token", slog.String("token", rawIDToken))
 
-			// 3. Parse the LLDAP claims
-			var claims Claims
-			if err := idToken.Claims(&claims); err != nil {
-				http.Error(w, "Internal Error: Failed to parse identity claims", http.StatusInternalServerError)
+		issuer, ok := tokenIssuer(rawIDToken)
+		verifier := (*i.verifiers.Load())[issuer]
+		if !ok || verifier == nil {
+			writeError(w, r, http.StatusUnauthorized, "invalid_token", "")
 
-				logger.Debug("Unauthorized: Failed to parse identity claims", slog.Any("error", err))
+			i.logger.Debug("Unauthorized: Token from an unknown issuer", slog.String("issuer", issuer))
 
-				return
+			return
+		}
+
+		// Verify the cryptographic signature and expiration
+		start := time.Now()
+		idToken, err := verifier.verifier.Verify(r.Context(), rawIDToken)
+		result := "ok"
+		if err != nil {
+			result = "invalid"
+		}
+		tokenVerifyDuration.Observe(time.Since(start).Seconds(), result)
+		if err != nil {
+			code := "invalid_token"
+			var expired *oidc.TokenExpiredError
+			if errors.As(err, &expired) {
+				code = "expired_token"
 			}
+			writeError(w, r, http.StatusUnauthorized, code, "")
 
-			// 4. Inject the claims into the request context
-			ctx := context.WithValue(r.Context(), userContextKey, claims)
+			i.logger.Debug("Unauthorized: Invalid or expired token", slog.Any("error", err))
 
-			slog.Debug("authentication successful")
+			return
+		}
 
-			// Pass the request down the chain with the newly populated context
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
-	}, nil
+		// Manually check if the audience is one of the allowed clients
+		if !verifier.allowsClient(idToken) {
+			writeError(w, r, http.StatusUnauthorized, "unknown_client", "")
+
+			i.logger.Debug("Unauthorized: Unrecognized client application")
+
+			return
+		}
+
+		// 3. Parse the LLDAP claims
+		claims, err := verifier.claims(idToken)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "invalid_claims", "")
+
+			i.logger.Debug("Unauthorized: Failed to parse identity claims", slog.Any("error", err))
+
+			return
+		}
+
+		serveAuthenticated(w, r, next, claims)
+	})
 }
 
-// DumpRawJWKS makes a raw HTTP request to the IDP and prints the exact response body.
-func DumpRawJWKS(jwksURL string, logger *slog.Logger) {
-	logger.Debug("attempting to fetch raw keys", slog.String("url", jwksURL))
+// serveAuthenticated passes a request whose caller has been identified
+// down the chain, with their claims in the context
+func serveAuthenticated(w http.ResponseWriter, r *http.Request, next http.Handler, claims Claims) {
+	logAccessUser(r.Context(), claims)
+	recordTrafficTenant(r.Context(), claims)
 
-	resp, err := http.Get(jwksURL)
-	if err != nil {
-		logger.Debug("network request failed", slog.Any("error", err))
+	// 4. Give plugins their say on the authenticated request
+	if !runAuthHooks(w, r, claims) {
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logger.Debug("failed to read JWKS response body", slog.Any("error", err))
-		return
+	// 5. Inject the claims into the request context
+	ctx := context.WithValue(r.Context(), userContextKey, claims)
+
+	slog.Debug("authentication successful")
+
+	// Pass the request down the chain with the newly populated context
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireGroups lets through only users in one of groups. It must run
+// behind RequireAuth, which puts the claims in the context.
+func RequireGroups(groups []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(userContextKey).(Claims)
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, "missing_claims", "")
+			return
+		}
+
+		if !slices.ContainsFunc(claims.Groups, func(group string) bool { return slices.Contains(groups, group) }) {
+			writeError(w, r, http.StatusForbidden, "group_forbidden", "")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PoolAuth is a pool's auth requirements, RequireAuth unless its auth is
+// none and RequireGroups for its groups, which a config reload can change
+type PoolAuth struct {
+	auth      func(http.Handler) http.Handler
+	anonymous func(http.Handler) http.Handler
+	next      http.Handler
+	handler   atomic.Pointer[http.Handler]
+	pool      atomic.Pointer[PoolConfig]
+}
+
+// NewPoolAuth puts next behind the requirements of pool, authenticating
+// with auth, or anonymous when the pool needs no token
+func NewPoolAuth(pool PoolConfig, auth, anonymous func(http.Handler) http.Handler, next http.Handler) *PoolAuth {
+	p := &PoolAuth{auth: auth, anonymous: anonymous, next: next}
+	p.Update(pool)
+	return p
+}
+
+// Update swaps in the requirements of pool for the requests after it
+func (p *PoolAuth) Update(pool PoolConfig) {
+	handler := p.next
+	if len(pool.Groups) > 0 {
+		handler = RequireGroups(pool.Groups, handler)
+	}
+	if pool.Auth != "none" {
+		handler = p.auth(handler)
+	} else {
+		handler = p.anonymous(handler)
 	}
+	p.handler.Store(&handler)
+	p.pool.Store(&pool)
+}
+
+// Routed puts next, the handler layers route to the pool with, behind the
+// pool's requirements too. Requests authenticated on the way in, by the
+// pool of the path, aren't authenticated or rate limited again, but must
+// still be in the pool's groups.
+func (p *PoolAuth) Routed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pool := p.pool.Load()
+
+		handler := next
+		if len(pool.Groups) > 0 {
+			handler = RequireGroups(pool.Groups, handler)
+		}
+		if _, authenticated := r.Context().Value(userContextKey).(Claims); !authenticated && pool.Auth != "none" {
+			handler = p.auth(handler)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-	logger.Debug("JWKS response", slog.Any("status", resp.StatusCode), slog.Any("payload", string(body)))
+func (p *PoolAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*p.handler.Load()).ServeHTTP(w, r)
 }
@@ -1,122 +1,556 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
-	"github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// BackendManager handles the list of IPs and round-robin selection
+var (
+	probeFailures = NewCounter(
+		"civil_gateway_probe_failures_total",
+		"Failed active health probes of pool endpoints",
+		"pool",
+	)
+	probeUnhealthyEndpoints = NewGauge(
+		"civil_gateway_probe_unhealthy_endpoints",
+		"Discovered endpoints taken out of rotation by failed health probes",
+		"pool",
+	)
+)
+
+// BackendManager handles the list of IPs and picking one for each request
 type BackendManager struct {
-	client      *servicediscovery.Client
-	namespace   string
-	serviceName string
-	endpoints   []string
-	mu          sync.RWMutex
-	rrCounter   uint64
+	pool       string
+	discoverer Discoverer
+	endpoints  []string
+	mu         sync.RWMutex
+	// The endpoints requests are sent to: the discovered endpoints minus
+	// those failing active probes, ejected for failing requests, or drained
+	// by an operator
+	rotation []string
+	drained  map[string]bool
+	probes   map[string]*endpointProbe
+	probe    ProbeConfig
+	strategy endpointStrategy
+	logger   *slog.Logger
+
+	// Where endpoints are asked what they are capable of when discovered,
+	// and what they answered. See probeCapabilities
+	capabilitiesPath string
+	capabilities     map[string][]string
+
+	// The gateway's own availability zone and those of the endpoints, which
+	// requests stay within while it has zoneMinEndpoints healthy. See local
+	zone             string
+	zoneMinEndpoints int
+	zones            map[string]string
+
+	// The weights of the endpoints registered with a WEIGHT attribute other
+	// than 1, which the strategy gives proportionally more or less traffic
+	weights map[string]int
+
+	// How much is discovered. See DiscoveryConfig
+	pageSize     int
+	maxInstances int
+
+	// The CIDRs discovered addresses must be in, and the addresses last
+	// rejected for not being. See allowedInstances
+	allowedCIDRs []netip.Prefix
+	rejected     map[string]bool
+
+	// What an empty answer does, and when the endpoints were last
+	// discovered and whether they are kept past an empty one
+	emptyPolicy       string
+	emptyMaxStaleness time.Duration
+	lastDiscovered    time.Time
+	servingStale      bool
+
+	// Stored reputations of endpoints not yet seeded, and the error rate
+	// that makes them suspect. See ReputationStore
+	seeds            map[string]EndpointReputation
+	suspectErrorRate float64
+
+	// Discovery health, guarded by mu
+	interval            time.Duration
+	discoveryJitter     float64
+	maxBackoff          time.Duration
+	lastSuccess         time.Time
+	consecutiveFailures int
 }
 
-// NewBackendManager initializes the AWS client
-func NewBackendManager(ctx context.Context, namespace, serviceName string) (*BackendManager, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// NewBackendManager discovers the pool's backends with the provider it is
+// configured with
+func NewBackendManager(ctx context.Context, pc PoolConfig, logger *slog.Logger) (*BackendManager, error) {
+	logger = logger.With(slog.String("pool", pc.Name))
+
+	discoverer, err := newDiscoverer(ctx, pc, logger)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+		return nil, err
 	}
 
+	return newBackendManager(pc, discoverer, logger), nil
+}
+
+// newBackendManagerWithClient builds a BackendManager discovering through
+// any Cloud Map client, which lets the discovery simulation swap in a fake
+func newBackendManagerWithClient(ctx context.Context, pc PoolConfig, newClient discoveryClientFactory, logger *slog.Logger) (*BackendManager, error) {
+	logger = logger.With(slog.String("pool", pc.Name))
+
+	discoverer, err := newCloudMapDiscovererWithClient(ctx, pc, newClient, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBackendManager(pc, discoverer, logger), nil
+}
+
+func newBackendManager(pc PoolConfig, discoverer Discoverer, logger *slog.Logger) *BackendManager {
 	return &BackendManager{
-		client:      servicediscovery.NewFromConfig(cfg),
-		namespace:   namespace,
-		serviceName: serviceName,
+		pool:       pc.Name,
+		discoverer: discoverer,
+		strategy:   &roundRobinStrategy{},
+		logger:     logger,
 		// Init an empty list for pointer safety before initial poll
 		endpoints: []string{},
-	}, nil
+		rotation:  []string{},
+		probes:    map[string]*endpointProbe{},
+		// Filled in as endpoints are discovered, if capabilities are probed
+		capabilities: map[string][]string{},
+		// What DiscoverInstances answers with by default, until polling
+		// is configured
+		pageSize:     100,
+		maxInstances: 100,
+		emptyPolicy:  emptyDiscoveryKeepLastKnown,
+	}
 }
 
-// StartPolling updates the endpoint list every 'interval'
-func (bm *BackendManager) StartPolling(ctx context.Context, interval time.Duration) {
+// StartPolling polls immediately, then updates the endpoint list every
+// interval as a scheduled job
+func (bm *BackendManager) StartPolling(ctx context.Context, scheduler *Scheduler, discovery DiscoveryConfig) {
+	bm.configureDiscovery(discovery)
+
 	// Poll immediately on start
 	bm.refreshEndpoints(ctx)
 
-	ticker := time.NewTicker(interval)
-
-	// Creates an anonymous function as a goroutine
-	go func() {
-		for {
-			select {
-			// When the process defined by main attempts to shutdown, the read-only channel
-			// returned by ctx.Done() will unblock and let this goroutine shutodown
-			// Normally, the ticker (also a read-only channel) will return a value first
-			// and unblock that path
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				bm.refreshEndpoints(ctx)
-			}
-		}
-	}()
+	scheduler.AddPaced("discovery:"+bm.pool, discovery.Interval, bm.discoveryDelay, bm.refreshEndpoints)
 }
 
-func (bm *BackendManager) refreshEndpoints(ctx context.Context) {
-	// Call AWS Cloud Map to get healthy instances
-	output, err := bm.client.DiscoverInstances(ctx, &servicediscovery.DiscoverInstancesInput{
-		NamespaceName: aws.String(bm.namespace),
-		ServiceName:   aws.String(bm.serviceName),
-		HealthStatus:  types.HealthStatusFilterHealthy, // Only get healthy instances
-		MaxResults:    aws.Int32(100),
-	})
+// configureDiscovery sets how often and how much is discovered. Cloud Map
+// pages hold at most 100 instances.
+func (bm *BackendManager) configureDiscovery(discovery DiscoveryConfig) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	bm.interval = discovery.Interval
+	bm.discoveryJitter = discovery.Jitter
+	bm.maxBackoff = discovery.MaxBackoff
+	bm.pageSize = min(max(discovery.PageSize, 1), 100)
+	bm.maxInstances = max(discovery.MaxInstances, 1)
+	bm.emptyPolicy = cmp.Or(discovery.EmptyPolicy, emptyDiscoveryKeepLastKnown)
+	bm.emptyMaxStaleness = discovery.EmptyMaxStaleness
+	bm.capabilitiesPath = discovery.CapabilitiesPath
+	bm.zone = discovery.Zone
+	bm.zoneMinEndpoints = discovery.ZoneMinEndpoints
+	bm.allowedCIDRs = discovery.AllowedCIDRs
+}
+
+func (bm *BackendManager) refreshEndpoints(ctx context.Context) error {
+	bm.mu.RLock()
+	limits := discoveryLimits{pageSize: bm.pageSize, maxInstances: bm.maxInstances}
+	bm.mu.RUnlock()
+
+	ctx, span := tracer().Start(ctx, "discovery.discover", trace.WithAttributes(
+		attribute.String("civil.pool", bm.pool),
+	))
+
+	instances, err := bm.discoverer.Discover(ctx, limits)
+	if err == nil {
+		span.SetAttributes(attribute.Int("discovery.instances", len(instances)))
+	}
+	endSpan(span, err)
 	if err != nil {
-		log.Printf("Error discovering instances: %v", err)
-		return
+		bm.recordDiscoveryFailure(ctx, err)
+		return err
 	}
 
+	bm.recordDiscoverySuccess()
+
+	if len(instances) >= limits.maxInstances {
+		instances = instances[:limits.maxInstances]
+		discoveryTruncated.Inc(bm.pool)
+		bm.logger.Warn("discovered as many instances as the pool takes, any more are left out",
+			slog.Int("max_instances", limits.maxInstances),
+		)
+	}
+
+	// Instances outside the allowed CIDRs are treated as never discovered
+	instances = bm.allowedInstances(ctx, instances)
+
 	var newEndpoints []string
-	for _, inst := range output.Instances {
-		// Cloud Map stores connection info in Attributes
-		ip := inst.Attributes["AWS_INSTANCE_IPV4"]
-		port := inst.Attributes["AWS_INSTANCE_PORT"]
-
-		if ip != "" {
-			addr := ip
-			if port != "" {
-				addr = fmt.Sprintf("%s:%s", ip, port)
-			}
-			newEndpoints = append(newEndpoints, "http://"+addr)
+	newWeights := map[string]int{}
+	newZones := map[string]string{}
+	for _, inst := range instances {
+		endpoint := "http://" + inst.Address
+		newEndpoints = append(newEndpoints, endpoint)
+
+		if inst.Weight > 1 {
+			newWeights[endpoint] = inst.Weight
+		}
+		if inst.Zone != "" {
+			newZones[endpoint] = inst.Zone
 		}
 	}
 
+	// New endpoints are asked about their capabilities before they take
+	// requests that need them
+	bm.probeCapabilities(ctx, newEndpoints)
+
+	bm.mu.Lock()
 	if len(newEndpoints) > 0 {
-		bm.mu.Lock()
+		if bm.servingStale {
+			bm.servingStale = false
+			bm.logger.Info("discovery found healthy instances again", slog.Int("endpoints", len(newEndpoints)))
+		}
+		discoveryServingStale.Set(0, bm.pool)
+
 		bm.endpoints = newEndpoints
-		bm.mu.Unlock()
+		bm.weights = newWeights
+		bm.zones = newZones
+		bm.lastDiscovered = time.Now()
+		bm.updateRotation()
+	} else {
+		bm.applyEmptyDiscovery(time.Now())
 	}
+	bm.mu.Unlock()
+
+	discoveryEndpoints.Set(float64(bm.EndpointCount()), bm.pool)
+
+	return nil
+}
+
+// SetStrategy replaces how endpoints are picked, round-robin by default
+func (bm *BackendManager) SetStrategy(strategy endpointStrategy) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.strategy = strategy
 }
 
-// NextEndpoint returns the next URL in the rotation
-func (bm *BackendManager) NextEndpoint() (string, error) {
+// NextEndpoint returns the URL the strategy picks for the next request,
+// among the endpoints with the required capabilities, in the gateway's own
+// zone if enough are. key is the request's affinity key, if any
+func (bm *BackendManager) NextEndpoint(key string, required []string) (string, error) {
 	bm.mu.RLock()
 	defer bm.mu.RUnlock()
 
-	if len(bm.endpoints) == 0 {
+	if len(bm.rotation) == 0 {
 		return "", fmt.Errorf("no healthy endpoints available")
 	}
 
-	// Atomic increment for thread-safe round robin
-	val := atomic.AddUint64(&bm.rrCounter, 1)
-	index := val % uint64(len(bm.endpoints))
-	return bm.endpoints[index], nil
+	return bm.strategy.pick(bm.local(bm.capable(bm.rotation, required)), bm.weights, key), nil
+}
+
+// NextEndpointExcluding picks like NextEndpoint among the endpoints not in
+// exclude, for retrying a request somewhere it hasn't failed yet
+func (bm *BackendManager) NextEndpointExcluding(exclude []string, key string, required []string) (string, error) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	candidates := make([]string, 0, len(bm.rotation))
+	for _, endpoint := range bm.rotation {
+		if !slices.Contains(exclude, endpoint) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no other healthy endpoints available")
+	}
+
+	return bm.strategy.pick(bm.local(bm.capable(candidates, required)), bm.weights, key), nil
 }
 
 // IsReady returns true if we have at least one healthy backend
 func (bm *BackendManager) IsReady() bool {
 	bm.mu.RLock()
 	defer bm.mu.RUnlock()
-	return len(bm.endpoints) > 0
+	return len(bm.rotation) > 0
+}
+
+// EndpointCount returns how many healthy endpoints are in the rotation
+func (bm *BackendManager) EndpointCount() int {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return len(bm.rotation)
+}
+
+// BackendState is a snapshot of a pool's endpoints and discovery, for
+// support bundles
+type BackendState struct {
+	Endpoints           []string            `json:"endpoints"`
+	Rotation            []string            `json:"rotation"`
+	Down                []string            `json:"down,omitempty"`
+	Ejected             []string            `json:"ejected,omitempty"`
+	Drained             []string            `json:"drained,omitempty"`
+	Weights             map[string]int      `json:"weights,omitempty"`
+	Zones               map[string]string   `json:"zones,omitempty"`
+	Capabilities        map[string][]string `json:"capabilities,omitempty"`
+	LastSuccess         time.Time           `json:"last_success"`
+	LastDiscovered      time.Time           `json:"last_discovered"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	ServingStale        bool                `json:"serving_stale"`
+}
+
+// State is a snapshot of the pool's endpoints and discovery
+func (bm *BackendManager) State() BackendState {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	state := BackendState{
+		Endpoints:           slices.Clone(bm.endpoints),
+		Rotation:            slices.Clone(bm.rotation),
+		Weights:             maps.Clone(bm.weights),
+		Zones:               maps.Clone(bm.zones),
+		Capabilities:        maps.Clone(bm.capabilities),
+		LastSuccess:         bm.lastSuccess,
+		LastDiscovered:      bm.lastDiscovered,
+		ConsecutiveFailures: bm.consecutiveFailures,
+		ServingStale:        bm.servingStale,
+	}
+	for endpoint := range bm.drained {
+		state.Drained = append(state.Drained, endpoint)
+	}
+	for endpoint, probe := range bm.probes {
+		if probe.down {
+			state.Down = append(state.Down, endpoint)
+		}
+		if probe.ejected {
+			state.Ejected = append(state.Ejected, endpoint)
+		}
+	}
+	return state
+}
+
+// ProbeConfig sets up active health probing and passive ejection of
+// endpoints. Probing is off when Path is empty, ejection when EjectAfter is 0.
+type ProbeConfig struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Consecutive failed probes before an endpoint leaves the rotation
+	FailureThreshold int
+	// Consecutive failed requests before an endpoint is ejected, and how
+	// long it stays out at least
+	EjectAfter    int
+	EjectCooldown time.Duration
+}
+
+// endpointProbe is the health of one endpoint, from active probes and from
+// the requests sent to it, guarded by mu
+type endpointProbe struct {
+	failures int
+	down     bool
+
+	requestFailures int
+	ejected         bool
+	ejectedUntil    time.Time
+
+	// The endpoint's track record, kept across restarts. See
+	// EndpointReputation
+	errorRate   float64
+	ejections   int
+	lastEjected time.Time
+}
+
+// StartProbing checks every discovered endpoint on probe.Path each
+// interval, as a scheduled job. Cloud Map's health status lags by minutes,
+// so endpoints failing FailureThreshold probes in a row are taken out of the
+// rotation right away, and put back on their first successful probe.
+// Endpoints ejected for failing requests are put back the same way.
+func (bm *BackendManager) StartProbing(scheduler *Scheduler, probe ProbeConfig) {
+	bm.mu.Lock()
+	bm.probe = probe
+	bm.mu.Unlock()
+
+	if probe.Path == "" {
+		return
+	}
+
+	scheduler.Add("probe:"+bm.pool, probe.Interval, bm.probeEndpoints)
+}
+
+func (bm *BackendManager) probeEndpoints(ctx context.Context) error {
+	bm.mu.RLock()
+	endpoints := slices.Clone(bm.endpoints)
+	bm.mu.RUnlock()
+
+	healthy := make([]bool, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Go(func() {
+			healthy[i] = bm.probeEndpoint(ctx, endpoint)
+		})
+	}
+	wg.Wait()
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	now := time.Now()
+	for i, endpoint := range endpoints {
+		state, ok := bm.probes[endpoint]
+		if !ok {
+			state = &endpointProbe{}
+			bm.probes[endpoint] = state
+		}
+
+		if healthy[i] {
+			if state.down {
+				bm.logger.Info("endpoint passed its health probe, back in rotation", slog.String("endpoint", endpoint))
+			}
+			state.failures = 0
+			state.down = false
+
+			if state.readmittable(now) {
+				state.readmit()
+				bm.logger.Info("ejected endpoint passed its health probe, back in rotation", slog.String("endpoint", endpoint))
+			}
+			continue
+		}
+
+		probeFailures.Inc(bm.pool)
+		state.failures++
+		if !state.down && state.failures >= bm.probe.FailureThreshold {
+			state.down = true
+			bm.logger.Warn("endpoint failed its health probes, removed from rotation", slog.String("endpoint", endpoint), slog.Int("failures", state.failures))
+		}
+	}
+
+	bm.updateRotation()
+
+	return nil
+}
+
+func (bm *BackendManager) probeEndpoint(ctx context.Context, endpoint string) bool {
+	ctx, cancel := context.WithTimeout(ctx, bm.probe.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+bm.probe.Path, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", probeUserAgent())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// updateRotation rebuilds the rotation from the discovered endpoints and
+// their health. Must be called with mu held. If every endpoint is unhealthy
+// the checks are more likely wrong than the whole pool, so they all stay in
+// rotation. Drained endpoints are left out regardless.
+func (bm *BackendManager) updateRotation() {
+	bm.applySeeds()
+
+	serving := make([]string, 0, len(bm.endpoints))
+	for _, endpoint := range bm.endpoints {
+		if !bm.drained[endpoint] {
+			serving = append(serving, endpoint)
+		}
+	}
+
+	rotation := make([]string, 0, len(serving))
+	ejected := 0
+	for _, endpoint := range serving {
+		state, ok := bm.probes[endpoint]
+		if ok && state.ejected {
+			ejected++
+		}
+		if !ok || (!state.down && !state.ejected) {
+			rotation = append(rotation, endpoint)
+		}
+	}
+
+	if len(rotation) == 0 && len(serving) > 0 {
+		bm.logger.Warn("every endpoint is failing its health checks, keeping them all in rotation")
+		rotation = serving
+	}
+
+	// Forget endpoints that are no longer discovered
+	for endpoint := range bm.probes {
+		if !slices.Contains(bm.endpoints, endpoint) {
+			delete(bm.probes, endpoint)
+		}
+	}
+	for endpoint := range bm.capabilities {
+		if !slices.Contains(bm.endpoints, endpoint) {
+			delete(bm.capabilities, endpoint)
+		}
+	}
+	for endpoint := range bm.drained {
+		if !slices.Contains(bm.endpoints, endpoint) {
+			delete(bm.drained, endpoint)
+		}
+	}
+
+	bm.rotation = rotation
+	probeUnhealthyEndpoints.Set(float64(len(serving)-len(rotation)), bm.pool)
+	outlierEjectedEndpoints.Set(float64(ejected), bm.pool)
+	discoveryEndpoints.Set(float64(len(rotation)), bm.pool)
+
+	if bm.zone != "" {
+		local := 0
+		for _, endpoint := range rotation {
+			if bm.zones[endpoint] == bm.zone {
+				local++
+			}
+		}
+		zoneLocalEndpoints.Set(float64(local), bm.pool)
+	}
+}
+
+const endpointContextKey contextKey = "upstreamEndpoint"
+
+// SelectEndpoint picks the next endpoint for each request and passes it to the
+// proxy via the request context. Responds 503 when the pool has no endpoints.
+// Plugins may override the pick with OnUpstreamSelect.
+func (bm *BackendManager) SelectEndpoint(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, err := bm.NextEndpoint(affinityKey(r), requiredCapabilities(r))
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, "no_healthy_backends", "")
+			return
+		}
+
+		endpoint, ok := runUpstreamSelectHooks(w, r, bm.pool, endpoint)
+		if !ok {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), endpointContextKey, endpoint)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// endpointFromContext returns the endpoint chosen by SelectEndpoint, if any
+func endpointFromContext(ctx context.Context) (string, bool) {
+	endpoint, ok := ctx.Value(endpointContextKey).(string)
+	return endpoint, ok
 }
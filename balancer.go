@@ -0,0 +1,264 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// endpointStrategy picks which endpoint of a pool gets the next request.
+// endpoints is never empty. Each endpoint gets a share of the requests in
+// proportion to its weight, 1 unless weights says otherwise. key is the
+// request's affinity key, empty when it has none. See affinityKey
+type endpointStrategy interface {
+	pick(endpoints []string, weights map[string]int, key string) string
+}
+
+// endpointWeight is the weight of endpoint, 1 by default
+func endpointWeight(weights map[string]int, endpoint string) int {
+	if weight, ok := weights[endpoint]; ok {
+		return weight
+	}
+	return 1
+}
+
+// pickWeighted walks endpoints for the one n falls on, each taking up as
+// many of the numbers up to their total weight as its own weight
+func pickWeighted(endpoints []string, weights map[string]int, n int) string {
+	for _, endpoint := range endpoints {
+		n -= endpointWeight(weights, endpoint)
+		if n < 0 {
+			return endpoint
+		}
+	}
+	return endpoints[len(endpoints)-1]
+}
+
+// totalWeight is the sum of the weights of endpoints
+func totalWeight(endpoints []string, weights map[string]int) int {
+	total := 0
+	for _, endpoint := range endpoints {
+		total += endpointWeight(weights, endpoint)
+	}
+	return total
+}
+
+// newEndpointStrategy builds the named strategy: round_robin (the default),
+// least_outstanding, random, or consistent_hash. tracker supplies the
+// in-flight counts least_outstanding and consistent_hash balance on.
+func newEndpointStrategy(name string, tracker *SaturationTracker) (endpointStrategy, error) {
+	switch name {
+	case "", "round_robin":
+		return &roundRobinStrategy{}, nil
+	case "least_outstanding":
+		return &leastOutstandingStrategy{tracker: tracker}, nil
+	case "random":
+		return randomStrategy{}, nil
+	case "consistent_hash":
+		return &consistentHashStrategy{tracker: tracker}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", name)
+	}
+}
+
+type roundRobinStrategy struct {
+	counter atomic.Uint64
+}
+
+func (s *roundRobinStrategy) pick(endpoints []string, weights map[string]int, key string) string {
+	if len(weights) == 0 {
+		return endpoints[s.counter.Add(1)%uint64(len(endpoints))]
+	}
+
+	total := totalWeight(endpoints, weights)
+	return pickWeighted(endpoints, weights, int(s.counter.Add(1)%uint64(total)))
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) pick(endpoints []string, weights map[string]int, key string) string {
+	if len(weights) == 0 {
+		return endpoints[rand.IntN(len(endpoints))]
+	}
+
+	return pickWeighted(endpoints, weights, rand.IntN(totalWeight(endpoints, weights)))
+}
+
+// leastOutstandingStrategy sends each request to the endpoint with the
+// fewest requests in flight for its weight, so a backend stuck on slow
+// renders is given less work and one twice the size twice as much. Ties go
+// round-robin, so an idle pool still spreads its load.
+type leastOutstandingStrategy struct {
+	tracker *SaturationTracker
+	counter atomic.Uint64
+}
+
+func (s *leastOutstandingStrategy) pick(endpoints []string, weights map[string]int, key string) string {
+	start := int(s.counter.Add(1) % uint64(len(endpoints)))
+
+	load := func(endpoint string) float64 {
+		return float64(s.tracker.InFlight(endpointHost(endpoint))) / float64(endpointWeight(weights, endpoint))
+	}
+
+	best := endpoints[start]
+	bestLoad := load(best)
+
+	for i := 1; i < len(endpoints) && bestLoad > 0; i++ {
+		endpoint := endpoints[(start+i)%len(endpoints)]
+		if l := load(endpoint); l < bestLoad {
+			best, bestLoad = endpoint, l
+		}
+	}
+
+	return best
+}
+
+// hashRingReplicas is how many points each unit of an endpoint's weight
+// takes on the hash ring. More points spread the tiles more evenly.
+const hashRingReplicas = 100
+
+// hashLoadFactor bounds the load of any endpoint under consistent hashing to
+// this many times the average, so a popular tile can't swamp its backend
+const hashLoadFactor = 1.25
+
+// consistentHashStrategy sends every request for the same tile to the same
+// endpoint, so the tile servers' render caches stay warm. Endpoints sit on a
+// hash ring, and a request goes to the first endpoint after its key's hash,
+// which means an endpoint joining or leaving only moves the tiles next to it.
+// Endpoints already carrying their bound of the load are passed over for the
+// next one on the ring. Requests without a key go round-robin.
+type consistentHashStrategy struct {
+	tracker *SaturationTracker
+	counter atomic.Uint64
+	ring    atomic.Pointer[hashRing]
+}
+
+func (s *consistentHashStrategy) pick(endpoints []string, weights map[string]int, key string) string {
+	if key == "" {
+		return endpoints[s.counter.Add(1)%uint64(len(endpoints))]
+	}
+
+	ring := s.ring.Load()
+	if ring == nil || !ring.builtFrom(endpoints, weights) {
+		ring = newHashRing(endpoints, weights)
+		s.ring.Store(ring)
+	}
+
+	var total int64
+	for _, endpoint := range endpoints {
+		total += s.tracker.InFlight(endpointHost(endpoint))
+	}
+
+	// Each endpoint may take its weighted share of the requests in flight,
+	// this one included, times the load factor
+	share := float64(total+1) / float64(totalWeight(endpoints, weights)) * hashLoadFactor
+
+	start := ring.search(hashKey(key))
+	for i := range ring.points {
+		endpoint := ring.points[(start+i)%len(ring.points)].endpoint
+		bound := math.Ceil(share * float64(endpointWeight(weights, endpoint)))
+		if float64(s.tracker.InFlight(endpointHost(endpoint))) < bound {
+			return endpoint
+		}
+	}
+	return ring.points[start].endpoint
+}
+
+// hashRing places hashRingReplicas points per unit of weight for each
+// endpoint, sorted by hash
+type hashRing struct {
+	endpoints []string
+	weights   map[string]int
+	points    []hashRingPoint
+}
+
+type hashRingPoint struct {
+	hash     uint64
+	endpoint string
+}
+
+func newHashRing(endpoints []string, weights map[string]int) *hashRing {
+	ring := &hashRing{
+		endpoints: slices.Clone(endpoints),
+		weights:   maps.Clone(weights),
+		points:    make([]hashRingPoint, 0, totalWeight(endpoints, weights)*hashRingReplicas),
+	}
+
+	for _, endpoint := range endpoints {
+		for i := range endpointWeight(weights, endpoint) * hashRingReplicas {
+			ring.points = append(ring.points, hashRingPoint{
+				hash:     hashKey(endpoint + "#" + strconv.Itoa(i)),
+				endpoint: endpoint,
+			})
+		}
+	}
+
+	slices.SortFunc(ring.points, func(a, b hashRingPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return ring
+}
+
+// builtFrom reports whether the ring places exactly endpoints, weighted as
+// weights says
+func (r *hashRing) builtFrom(endpoints []string, weights map[string]int) bool {
+	return slices.Equal(r.endpoints, endpoints) && maps.Equal(r.weights, weights)
+}
+
+// search is the index of the first point at or after hash, wrapping around
+func (r *hashRing) search(hash uint64) int {
+	i, _ := slices.BinarySearchFunc(r.points, hash, func(p hashRingPoint, hash uint64) int {
+		return cmp.Compare(p.hash, hash)
+	})
+	return i % len(r.points)
+}
+
+// hashKey hashes the same way on every gateway, so all of them send a tile
+// to the same endpoint. FNV-1a is mixed further because similar keys, like
+// neighbouring tiles, would otherwise land close together on the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// The splitmix64 finalizer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// affinityKey is the tile a request is for, as its layer path and z/x/y
+// without the format, since every format of a tile is rendered from the
+// same data. Requests for anything but a tile have no key.
+func affinityKey(r *http.Request) string {
+	p := path.Clean("/" + r.URL.Path)
+
+	z, x, y, ok := parseTileCoords(p)
+	if !ok {
+		return ""
+	}
+
+	dir := p
+	for range 3 {
+		dir = path.Dir(dir)
+	}
+	return path.Join(dir, fmt.Sprintf("%d/%d/%d", z, x, y))
+}
+
+// endpointHost is the host:port the tracker records an endpoint's requests
+// under
+func endpointHost(endpoint string) string {
+	return strings.TrimPrefix(endpoint, "http://")
+}
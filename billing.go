@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+// billingSpoolSuffix marks the batches in the spool directory that are
+// complete and waiting for upload
+const billingSpoolSuffix = ".jsonl.gz"
+
+var (
+	billingRecords = NewCounter(
+		"civil_gateway_billing_records_total",
+		"Billable tile serves, by whether they were spooled, uploaded, or lost",
+		"result",
+	)
+	billingSpooled = NewGauge(
+		"civil_gateway_billing_spooled_batches",
+		"Batches of billing records spooled to disk and not yet uploaded",
+	)
+)
+
+// BillingConfig is where the tile access log goes. Records are batched in
+// memory for up to FlushInterval or BatchSize records, written to SpoolDir,
+// and uploaded from there to the bucket at BucketURL, like
+// s3://billing?region=us-west-2&prefix=tiles/.
+type BillingConfig struct {
+	BucketURL     string
+	SpoolDir      string
+	FlushInterval time.Duration
+	BatchSize     int
+
+	// The caller's group starting with TenantGroupPrefix, without it, is
+	// the tenant billed
+	TenantGroupPrefix string
+}
+
+// BillingRecord is one billable tile serve
+type BillingRecord struct {
+	Time     time.Time `json:"time"`
+	Subject  string    `json:"subject,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Layer    string    `json:"layer,omitempty"`
+	Zoom     int       `json:"zoom"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	CacheHit bool      `json:"cache_hit"`
+}
+
+// BillingLog is the record finance bills tile serves from, kept apart from
+// the access log, which is sampled, rotated, and shaped for debugging.
+// Every batch is written to the local spool before it is uploaded, and
+// stays there until the upload succeeds, so an S3 outage delays records
+// rather than losing them. Batches are never rewritten once uploaded;
+// make the bucket immutable with S3 Object Lock.
+type BillingLog struct {
+	config BillingConfig
+	bucket *blob.Bucket
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	records []BillingRecord
+	full    chan struct{}
+
+	// uploading serializes uploads, so a batch is never sent twice at once
+	uploading sync.Mutex
+}
+
+// NewBillingLog opens the bucket and the spool, and flushes and uploads on
+// stage every interval, and once more when it stops. Batches left in the
+// spool by an earlier run are uploaded first.
+func NewBillingLog(ctx context.Context, stage *Stage, config BillingConfig, logger *slog.Logger) (*BillingLog, error) {
+	if config.BatchSize < 1 {
+		return nil, fmt.Errorf("invalid billing batch size %d", config.BatchSize)
+	}
+	if err := os.MkdirAll(config.SpoolDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create billing spool: %w", err)
+	}
+
+	bucket, err := blob.OpenBucket(ctx, config.BucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open billing bucket: %w", err)
+	}
+
+	b := &BillingLog{
+		config: config,
+		bucket: bucket,
+		logger: logger,
+		full:   make(chan struct{}, 1),
+	}
+
+	stage.Go("billing", func(ctx context.Context) error {
+		ticker := time.NewTicker(config.FlushInterval)
+		defer ticker.Stop()
+
+		b.upload(ctx)
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.full:
+			case <-ctx.Done():
+				// Whatever doesn't make it up now is uploaded by the
+				// next run from the spool
+				b.flush()
+				uploadCtx, cancel := context.WithTimeout(context.Background(), analyticsFlushTimeout)
+				b.upload(uploadCtx)
+				cancel()
+				return bucket.Close()
+			}
+
+			b.flush()
+			b.upload(ctx)
+		}
+	})
+
+	return b, nil
+}
+
+// Middleware records each tile served once it has been answered. It must
+// run behind EgressMeter.Middleware, which collects the layer, tile, and
+// caller.
+func (b *BillingLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		entry, ok := r.Context().Value(trafficContextKey).(*trafficEntry)
+		if !ok || !entry.tile {
+			return
+		}
+
+		// Only tiles the client got are billed
+		if recorder.status >= http.StatusBadRequest || (recorder.status >= 300 && recorder.status != http.StatusNotModified) {
+			return
+		}
+
+		cache := recorder.Header().Get("X-Cache")
+		b.record(BillingRecord{
+			Time:     time.Now().UTC(),
+			Subject:  entry.tenant,
+			Tenant:   b.tenant(entry.groups),
+			Layer:    entry.layer,
+			Zoom:     entry.z,
+			Status:   recorder.status,
+			Bytes:    recorder.bytes,
+			CacheHit: strings.HasPrefix(cache, "HIT") || strings.HasPrefix(cache, "STALE"),
+		})
+	})
+}
+
+// tenant is the tenant a caller in groups is billed as
+func (b *BillingLog) tenant(groups []string) string {
+	if b.config.TenantGroupPrefix == "" {
+		return ""
+	}
+	i := slices.IndexFunc(groups, func(group string) bool { return strings.HasPrefix(group, b.config.TenantGroupPrefix) })
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimPrefix(groups[i], b.config.TenantGroupPrefix)
+}
+
+func (b *BillingLog) record(record BillingRecord) {
+	b.mu.Lock()
+	b.records = append(b.records, record)
+	full := len(b.records) >= b.config.BatchSize
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the records batched so far to the spool as one gzipped
+// JSON lines file. The file only gets its final name once it is synced,
+// so a crash never leaves a partial batch to upload.
+func (b *BillingLog) flush() {
+	b.mu.Lock()
+	records := b.records
+	b.records = nil
+	b.mu.Unlock()
+
+	if len(records) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	encoder := json.NewEncoder(gz)
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+	gz.Close()
+
+	// Batches are named for when their first serve happened, and kept
+	// apart from those of other replicas and of the same second
+	name := records[0].Time.Format("20060102T150405.000000000Z") + "-" + rand.Text() + billingSpoolSuffix
+	if err := writeFileSynced(filepath.Join(b.config.SpoolDir, name), body.Bytes()); err != nil {
+		billingRecords.Add(float64(len(records)), "lost")
+		b.logger.Error("failed to spool billing records, they are lost", slog.Int("records", len(records)), slog.Any("error", err))
+		return
+	}
+	billingRecords.Add(float64(len(records)), "spooled")
+}
+
+// writeFileSynced writes data to path through a temporary file that is
+// synced before it is renamed into place
+func writeFileSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// upload sends every spooled batch to the bucket, oldest first, removing
+// each once it is stored. It stops at the first failure and leaves the
+// rest for the next try.
+func (b *BillingLog) upload(ctx context.Context) {
+	b.uploading.Lock()
+	defer b.uploading.Unlock()
+
+	names, err := filepath.Glob(filepath.Join(b.config.SpoolDir, "*"+billingSpoolSuffix))
+	if err != nil {
+		b.logger.Error("failed to list billing spool", slog.Any("error", err))
+		return
+	}
+	slices.Sort(names)
+	billingSpooled.Set(float64(len(names)))
+
+	for i, path := range names {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.logger.Error("failed to read spooled billing batch", slog.String("path", path), slog.Any("error", err))
+			continue
+		}
+
+		// The key is the batch's name, so a batch uploaded again after a
+		// crash overwrites itself instead of being counted twice
+		name := filepath.Base(path)
+		key := name[:4] + "/" + name[4:6] + "/" + name[6:8] + "/" + name
+		if err := b.bucket.WriteAll(ctx, key, data, &blob.WriterOptions{ContentType: "application/gzip"}); err != nil {
+			b.logger.Warn("failed to upload billing batch, keeping it spooled", slog.String("key", key), slog.Int("spooled", len(names)-i), slog.Any("error", err))
+			return
+		}
+
+		records, _ := countGzipLines(data)
+		billingRecords.Add(float64(records), "uploaded")
+		if err := os.Remove(path); err != nil {
+			b.logger.Error("failed to remove uploaded billing batch", slog.String("path", path), slog.Any("error", err))
+		}
+		billingSpooled.Set(float64(len(names) - i - 1))
+	}
+}
+
+// countGzipLines counts the lines of gzipped data
+func countGzipLines(data []byte) (int, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	var plain bytes.Buffer
+	if _, err := plain.ReadFrom(gz); err != nil {
+		return 0, err
+	}
+	return bytes.Count(plain.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// splitBlobURL splits the URL of a single object into the bucket URL that
+// blob.OpenBucket takes and the key within it. Plain paths are local files.
+func splitBlobURL(uriStr string) (bucketURL, key string, err error) {
+	u, err := url.Parse(uriStr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid object URL %q: %w", uriStr, err)
+	}
+
+	if u.Scheme == "" {
+		bucketURL = "file://" + filepath.Dir(uriStr)
+		key = filepath.Base(uriStr)
+	} else if u.Scheme == "file" {
+		bucketURL = "file://" + filepath.Dir(u.Path)
+		key = filepath.Base(u.Path)
+	} else {
+		bucketURL = u.Scheme + "://" + u.Host
+		if u.RawQuery != "" {
+			bucketURL += "?" + u.RawQuery
+		}
+		key = strings.TrimPrefix(u.Path, "/")
+	}
+
+	return bucketURL, key, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	blockedRequests = NewCounter(
+		"civil_gateway_blocked_requests_total",
+		"Requests turned away because the client address is blocked",
+	)
+	blockedClients = NewGauge(
+		"civil_gateway_blocked_clients",
+		"Client addresses currently blocked",
+	)
+)
+
+// blockedClientBytes is roughly what a block costs
+const blockedClientBytes = 160
+
+// BlockedClient is a blocked address, as served on /admin/blocks
+type BlockedClient struct {
+	Addr    string    `json:"addr"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+
+	size int64
+}
+
+// IPBlocklist turns away every request from client addresses that other
+// parts of the gateway have flagged, until the block expires
+type IPBlocklist struct {
+	mu      sync.RWMutex
+	blocked map[netip.Addr]BlockedClient
+	memory  *MemoryPool
+	logger  *slog.Logger
+}
+
+func NewIPBlocklist(logger *slog.Logger) *IPBlocklist {
+	return &IPBlocklist{
+		blocked: map[netip.Addr]BlockedClient{},
+		logger:  logger,
+	}
+}
+
+// SetMemoryPool accounts for the blocks in pool. Set it before any are
+// made.
+func (b *IPBlocklist) SetMemoryPool(pool *MemoryPool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.memory = pool
+}
+
+// Block blocks addr for ttl. Blocking an address that is already blocked
+// extends the block. Trusted proxies are never blocked: every client behind
+// them would be.
+func (b *IPBlocklist) Block(addr netip.Addr, reason string, ttl time.Duration) {
+	if !addr.IsValid() {
+		return
+	}
+	if isTrustedProxy(addr) {
+		b.logger.Warn("not blocking trusted proxy",
+			slog.String("client", addr.String()),
+			slog.String("reason", reason),
+		)
+		return
+	}
+
+	now := time.Now()
+
+	b.mu.Lock()
+	entry, exists := b.blocked[addr]
+	if !exists {
+		entry = BlockedClient{
+			Addr:  addr.String(),
+			Since: now,
+		}
+
+		// The address is blocked either way, but only accounted for if
+		// there is room
+		if b.memory.Reserve(blockedClientBytes) {
+			entry.size = blockedClientBytes
+		}
+	}
+	entry.Reason = reason
+	entry.Expires = now.Add(ttl)
+	b.blocked[addr] = entry
+	count := len(b.blocked)
+	b.mu.Unlock()
+
+	blockedClients.Set(float64(count))
+
+	if !exists {
+		b.logger.Warn("blocked client address",
+			slog.String("client", addr.String()),
+			slog.String("reason", reason),
+			slog.Duration("ttl", ttl),
+		)
+	}
+}
+
+// Unblock lifts the block on addr, if there is one
+func (b *IPBlocklist) Unblock(addr netip.Addr) bool {
+	b.mu.Lock()
+	entry, exists := b.blocked[addr]
+	b.memory.Release(entry.size)
+	delete(b.blocked, addr)
+	count := len(b.blocked)
+	b.mu.Unlock()
+
+	blockedClients.Set(float64(count))
+
+	return exists
+}
+
+func (b *IPBlocklist) IsBlocked(addr netip.Addr) bool {
+	b.mu.RLock()
+	entry, exists := b.blocked[addr]
+	b.mu.RUnlock()
+
+	return exists && time.Now().Before(entry.Expires)
+}
+
+// Middleware rejects requests from blocked addresses before anything else
+// looks at them
+func (b *IPBlocklist) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.IsBlocked(clientAddr(r)) {
+			blockedRequests.Inc()
+			writeError(w, r, http.StatusForbidden, "client_blocked", "")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Prune drops expired blocks. Run as a scheduled job.
+func (b *IPBlocklist) Prune(ctx context.Context) error {
+	now := time.Now()
+
+	b.mu.Lock()
+	for addr, entry := range b.blocked {
+		if !now.Before(entry.Expires) {
+			b.memory.Release(entry.size)
+			delete(b.blocked, addr)
+		}
+	}
+	count := len(b.blocked)
+	b.mu.Unlock()
+
+	blockedClients.Set(float64(count))
+
+	return nil
+}
+
+// Blocked returns the current blocks, soonest to expire first
+func (b *IPBlocklist) Blocked() []BlockedClient {
+	b.mu.RLock()
+	entries := make([]BlockedClient, 0, len(b.blocked))
+	for _, entry := range b.blocked {
+		entries = append(entries, entry)
+	}
+	b.mu.RUnlock()
+
+	slices.SortFunc(entries, func(a, b BlockedClient) int {
+		return a.Expires.Compare(b.Expires)
+	})
+
+	return entries
+}
+
+// BlocksHandler serves the current blocks as JSON
+func (b *IPBlocklist) BlocksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(b.Blocked())
+	}
+}
+
+// UnblockHandler lifts the block on the {addr} path value
+func (b *IPBlocklist) UnblockHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(r.PathValue("addr"))
+		if err != nil {
+			http.Error(w, "Bad Request: invalid address", http.StatusBadRequest)
+			return
+		}
+
+		if !b.Unblock(addr.Unmap()) {
+			http.NotFound(w, r)
+			return
+		}
+
+		b.logger.Info("client address unblocked by operator", slog.String("client", addr.String()))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,891 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxCacheEntryBytes is the largest response the cache will buffer
+// unless configured otherwise. Bigger responses are streamed to the client
+// and not stored.
+const defaultMaxCacheEntryBytes = 8 << 20
+
+var (
+	cacheRequests = NewCounter(
+		"civil_gateway_cache_requests_total",
+		"Tile cache lookups by result",
+		"result",
+	)
+	cacheEarlyRefreshes = NewCounter(
+		"civil_gateway_cache_early_refreshes_total",
+		"Cache entries refreshed in the background before they expired",
+	)
+	cacheEvictions = NewCounter(
+		"civil_gateway_cache_evictions_total",
+		"Cache entries evicted to stay under the size limit",
+	)
+	cacheBypasses = NewCounter(
+		"civil_gateway_cache_bypasses_total",
+		"Responses too large to cache, streamed straight through",
+	)
+	cacheBypassedBytes = NewCounter(
+		"civil_gateway_cache_bypassed_bytes_total",
+		"Bytes of responses too large to cache, streamed straight through",
+	)
+	cacheRevalidations = NewCounter(
+		"civil_gateway_cache_revalidations_total",
+		"Stale cache entries revalidated with the backend by ETag, by result",
+		"result",
+	)
+	cacheEntries = NewGauge(
+		"civil_gateway_cache_entries",
+		"Entries in the tile cache",
+	)
+	cacheBytes = NewGauge(
+		"civil_gateway_cache_bytes",
+		"Bytes of response bodies held in the tile cache",
+	)
+)
+
+// CacheEntry is one stored response
+type CacheEntry struct {
+	Key     string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Stored  time.Time
+	Expires time.Time
+	// How long the response took to fetch, which scales how early the
+	// entry may be refreshed
+	FetchDuration time.Duration
+
+	// Times the entry was served, for the hottest keys in the stats
+	hits atomic.Int64
+}
+
+func (e *CacheEntry) size() int64 {
+	return int64(len(e.Body) + len(e.Key))
+}
+
+// TileCache stores tile responses in front of the reverse proxy.
+//
+// Entries written together, like a whole zoom level, would also expire
+// together and send a burst of refreshes to the backends. Two things spread
+// that out: each entry's TTL is shortened by a random jitter, and entries
+// close to expiry are refreshed early in the background with a probability
+// that rises as expiry nears (the XFetch algorithm). Clients keep being
+// served the cached copy while the refresh runs.
+//
+// Bodies are stored once per distinct content, so the many tiles that are
+// byte-identical only count against maxBytes once.
+type TileCache struct {
+	ttl           time.Duration
+	maxEntryBytes int64
+	jitter        float64
+	refreshBeta   float64
+	policyName    string
+	stage         *Stage
+	logger        *slog.Logger
+
+	mu         sync.Mutex
+	policy     cachePolicy
+	bodies     *cacheBodyStore
+	size       int64
+	maxBytes   int64
+	evictions  int64
+	refreshing map[string]bool
+	tiers      map[string]*cacheTierStats
+
+	variants variantSelector
+
+	// Optional tier shared with the other replicas, checked on memory misses
+	shared *SharedCache
+
+	// Bounds on the TTLs backends ask for with X-Gateway-Cache-TTL
+	hintMinTTL time.Duration
+	hintMaxTTL time.Duration
+
+	// Share of the memory budget, which can make the cache evict before
+	// reaching maxBytes
+	memory *MemoryPool
+
+	// While degraded reports true, expired entries up to maxStale past
+	// expiry are served as they are
+	degraded func() bool
+	maxStale time.Duration
+
+	// While the pool of a request is down, expired entries up to
+	// outageMaxStale past expiry are served instead of failing
+	outageMaxStale time.Duration
+}
+
+// NewTileCache creates a cache evicting by policy, one of lru, lfu, or arc.
+// Responses over maxEntryBytes stream through without being buffered.
+func NewTileCache(stage *Stage, ttl time.Duration, maxBytes, maxEntryBytes int64, policy string, jitter, refreshBeta float64, logger *slog.Logger) (*TileCache, error) {
+	p, err := newCachePolicy(policy, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == "" {
+		policy = "lru"
+	}
+
+	return &TileCache{
+		ttl:           ttl,
+		maxEntryBytes: maxEntryBytes,
+		jitter:        min(max(jitter, 0), 1),
+		refreshBeta:   max(refreshBeta, 0),
+		policyName:    policy,
+		stage:         stage,
+		logger:        logger,
+		policy:        p,
+		bodies:        newCacheBodyStore(),
+		maxBytes:      maxBytes,
+		refreshing:    map[string]bool{},
+		tiers:         map[string]*cacheTierStats{},
+	}, nil
+}
+
+// get returns the entry for key, expired or not, and counts it as used
+func (c *TileCache) get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.policy.get(key)
+}
+
+func (c *TileCache) set(entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size -= c.bodies.release(entry.Key)
+	c.size += c.bodies.acquire(entry)
+	c.policy.add(entry)
+
+	// Evict whatever the policy values least until back under the limit
+	// and within the memory budget
+	c.memory.Set(c.size)
+	for c.size > c.maxBytes || c.memory.Over() {
+		evicted, ok := c.policy.evict()
+		if !ok {
+			break
+		}
+		c.size -= c.bodies.release(evicted.Key)
+		c.memory.Set(c.size)
+		c.evictions++
+		cacheEvictions.Inc()
+	}
+
+	cacheEntries.Set(float64(c.policy.len()))
+	cacheBytes.Set(float64(c.size))
+}
+
+// SetMemoryPool accounts for the cache's entries in pool, evicting them to
+// make room for the other pools
+func (c *TileCache) SetMemoryPool(pool *MemoryPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.memory = pool
+	c.memory.Set(c.size)
+	c.memory.SetEvictor(c.shrink)
+}
+
+// shrink evicts whatever the policy values least until n bytes are freed
+func (c *TileCache) shrink(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.size - n
+	for c.size > target {
+		evicted, ok := c.policy.evict()
+		if !ok {
+			break
+		}
+		c.size -= c.bodies.release(evicted.Key)
+		c.evictions++
+		cacheEvictions.Inc()
+	}
+	c.memory.Set(c.size)
+
+	cacheEntries.Set(float64(c.policy.len()))
+	cacheBytes.Set(float64(c.size))
+}
+
+// SetDegradation has expired entries served without waiting on the backend
+// while degraded reports true, as long as they expired no more than maxStale
+// ago. They are refreshed in the background.
+func (c *TileCache) SetDegradation(degraded func() bool, maxStale time.Duration) {
+	c.degraded = degraded
+	c.maxStale = maxStale
+}
+
+// SetOutageStaleness has expired entries served, as long as they expired no
+// more than maxStale ago, for requests to a pool with no healthy backends,
+// so maps keep drawing what was cached rather than failing during an outage.
+// Pools are marked down by markPoolDown.
+func (c *TileCache) SetOutageStaleness(maxStale time.Duration) {
+	c.outageMaxStale = maxStale
+}
+
+// servesStale reports whether the expired entry is served as it is
+func (c *TileCache) servesStale(entry *CacheEntry, now time.Time) bool {
+	return c.degraded != nil && c.degraded() && now.Sub(entry.Expires) <= c.maxStale
+}
+
+// servesStaleInOutage reports whether the expired entry is served as it is
+// because the pool of r is down
+func (c *TileCache) servesStaleInOutage(r *http.Request, entry *CacheEntry, now time.Time) bool {
+	return c.outageMaxStale > 0 && isPoolDown(r.Context()) && now.Sub(entry.Expires) <= c.outageMaxStale
+}
+
+const poolDownContextKey contextKey = "poolDown"
+
+// markPoolDown marks the requests passed to next while pool has no healthy
+// backends, for the cache to serve them stale entries
+func markPoolDown(pool *BackendManager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pool.IsReady() {
+			r = r.WithContext(context.WithValue(r.Context(), poolDownContextKey, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isPoolDown(ctx context.Context) bool {
+	down, _ := ctx.Value(poolDownContextKey).(bool)
+	return down
+}
+
+// SetSharedCache adds the tier shared with the other replicas
+func (c *TileCache) SetSharedCache(shared *SharedCache) {
+	c.shared = shared
+}
+
+// Purge drops the entries for path, or every path under it when it ends in
+// *, from every tier. Returns how many were dropped from memory.
+func (c *TileCache) Purge(ctx context.Context, path string) (int, error) {
+	purged := c.purgeLocal(path)
+
+	if c.shared != nil {
+		if err := c.shared.purge(ctx, path); err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeLocal drops the entries for path from memory only
+func (c *TileCache) purgeLocal(path string) int {
+	prefix, wildcard := strings.CutSuffix(path, "*")
+	if !wildcard {
+		path = normalizeTilePath(path)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for key := range c.bodies.keys {
+		keyPath, _, _ := strings.Cut(key, "?")
+		if keyPath != path && !(wildcard && strings.HasPrefix(keyPath, prefix)) {
+			continue
+		}
+
+		c.policy.remove(key)
+		c.size -= c.bodies.release(key)
+		purged++
+	}
+	c.memory.Set(c.size)
+
+	cacheEntries.Set(float64(c.policy.len()))
+	cacheBytes.Set(float64(c.size))
+
+	return purged
+}
+
+// ttlFor is the request's layer's cache TTL, or the cache's own
+func (c *TileCache) ttlFor(r *http.Request) time.Duration {
+	if layer, ok := layerFromContext(r.Context()); ok && layer.CacheTTL > 0 {
+		return layer.CacheTTL
+	}
+	return c.ttl
+}
+
+// expiry picks when a fresh entry expires, cutting up to jitter of the TTL
+// off at random
+func (c *TileCache) expiry(stored time.Time, ttl time.Duration) time.Time {
+	ttl = time.Duration(float64(ttl) * (1 - c.jitter*rand.Float64()))
+	return stored.Add(ttl)
+}
+
+// shouldRefreshEarly is XFetch: refresh when now - delta*beta*ln(rand) is
+// past expiry, with delta the time the entry took to fetch
+func (c *TileCache) shouldRefreshEarly(entry *CacheEntry, now time.Time) bool {
+	if c.refreshBeta == 0 || entry.FetchDuration <= 0 {
+		return false
+	}
+
+	gap := -float64(entry.FetchDuration) * c.refreshBeta * math.Log(1-rand.Float64())
+	return !now.Add(time.Duration(gap)).Before(entry.Expires)
+}
+
+// Middleware serves GET requests from the cache, filling it on misses.
+// Responses that vary on Accept are stored once per content type, and the
+// variant served is the one the request's Accept header ranks highest.
+func (c *TileCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || isDryRun(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cacheKey(r)
+		ttl := c.ttlFor(r)
+		now := time.Now()
+
+		// An editor's fresh tile is stored under the key it was asked for,
+		// without the bust parameter
+		if bypass, ok := cacheBypassFromContext(r.Context()); ok {
+			cacheRequests.Inc("bypass")
+			w.Header().Set("X-Cache", "BYPASS")
+			if r.Method == http.MethodHead {
+				next.ServeHTTP(w, bustedRequest(r, bypass))
+				return
+			}
+
+			recorder := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, limit: c.maxEntryBytes}
+			start := time.Now()
+			next.ServeHTTP(recorder, bustedRequest(r, bypass))
+			c.store(key, ttl, recorder, time.Since(start))
+			return
+		}
+
+		entry, ok := c.get(key)
+		if !ok {
+			if contentType, found := c.variants.choose(r.Header.Get("Accept")); found {
+				entry, ok = c.get(variantKey(key, contentType))
+			}
+		}
+		if ok && now.Before(entry.Expires) {
+			result := "hit"
+			if c.shouldRefreshEarly(entry, now) && c.refreshAsync(entry, ttl, r, next) {
+				result = "early_refresh"
+			}
+			cacheRequests.Inc(result)
+			c.recordLookup(memoryTier, true)
+			entry.hits.Add(1)
+
+			serveCacheEntry(w, r, entry, "HIT")
+			return
+		}
+
+		if ok && c.servesStale(entry, now) {
+			c.refreshAsync(entry, ttl, r, next)
+			cacheRequests.Inc("stale")
+			entry.hits.Add(1)
+
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			serveCacheEntry(w, r, entry, "STALE")
+			return
+		}
+
+		// There is nothing to refresh from while the pool is down, so the
+		// entry is refreshed by the first request once it is back
+		if ok && c.servesStaleInOutage(r, entry, now) {
+			cacheRequests.Inc("stale_outage")
+			entry.hits.Add(1)
+
+			w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+			serveCacheEntry(w, r, entry, "STALE")
+			return
+		}
+
+		c.recordLookup(memoryTier, false)
+
+		if c.shared != nil {
+			keys := []string{key}
+			if contentType, found := c.variants.choose(r.Header.Get("Accept")); found {
+				keys = append(keys, variantKey(key, contentType))
+			}
+
+			shared, found := c.shared.get(r.Context(), keys...)
+			fresh := found && now.Before(shared.Expires)
+			c.recordLookup(sharedTier, fresh)
+			if fresh {
+				cacheRequests.Inc("shared_hit")
+				c.set(c.shared.near(shared, now))
+
+				serveCacheEntry(w, r, shared, "HIT-SHARED")
+				return
+			}
+
+			// Another replica may have cached what this one never saw,
+			// which beats failing while the pool is down
+			if found && c.servesStaleInOutage(r, shared, now) {
+				cacheRequests.Inc("stale_outage")
+				c.set(shared)
+				shared.hits.Add(1)
+
+				w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+				serveCacheEntry(w, r, shared, "STALE-SHARED")
+				return
+			}
+		}
+
+		cacheRequests.Inc("miss")
+		w.Header().Set("X-Cache", "MISS")
+
+		// HEAD responses have no body worth storing
+		if r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A stale entry with an ETag is revalidated, so an unchanged tile
+		// costs the backend a 304 rather than the whole body
+		req := r
+		recorder := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, limit: c.maxEntryBytes}
+		if ok && r.Header.Get("If-None-Match") == "" {
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				req = r.Clone(r.Context())
+				req.Header.Set("If-None-Match", etag)
+				recorder.revalidating = true
+			}
+		}
+
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+
+		if recorder.overflow {
+			cacheBypasses.Inc()
+			cacheBypassedBytes.Add(float64(recorder.bypassed))
+		}
+
+		if recorder.revalidating && recorder.status == http.StatusNotModified {
+			cacheRevalidations.Inc("not_modified")
+			serveCacheEntry(w, r, c.renew(entry, c.renewalTTL(recorder, entry, ttl), time.Since(start)), "REVALIDATED")
+			return
+		}
+		if recorder.revalidating {
+			cacheRevalidations.Inc("modified")
+		}
+
+		c.store(key, ttl, recorder, time.Since(start))
+	})
+}
+
+// refreshAsync refetches key in the background unless that is already
+// happening. Reports whether a refresh was started.
+func (c *TileCache) refreshAsync(entry *CacheEntry, ttl time.Duration, r *http.Request, next http.Handler) bool {
+	key := entry.Key
+
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return false
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	cacheEarlyRefreshes.Inc()
+
+	c.stage.Go("cache-refresh", func(ctx context.Context) error {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+
+		// The refresh is sent as the request was, with its claims, layer,
+		// and pool state, but outlives it and ends with the stage instead
+		reqCtx, cancel := context.WithCancel(refreshContext(r.Context()))
+		defer cancel()
+		defer context.AfterFunc(ctx, cancel)()
+
+		req := r.Clone(reqCtx)
+		req.Header.Del("If-None-Match")
+		etag := entry.Header.Get("ETag")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		recorder := &cacheRecorder{status: http.StatusOK, limit: c.maxEntryBytes}
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+
+		if etag != "" && recorder.status == http.StatusNotModified {
+			cacheRevalidations.Inc("not_modified")
+			c.renew(entry, c.renewalTTL(recorder, entry, ttl), time.Since(start))
+			return nil
+		}
+		if etag != "" {
+			cacheRevalidations.Inc("modified")
+		}
+
+		// The entry may be a variant, stored again under the request's key
+		if !c.store(cacheKey(r), ttl, recorder, time.Since(start)) {
+			c.logger.Debug("early cache refresh was not stored", slog.String("key", key), slog.Int("status", recorder.status))
+		}
+
+		return nil
+	})
+
+	return true
+}
+
+// refreshContext is ctx without its cancellation, and without the entries
+// the request being answered is logged, billed, and captured with, which
+// the refresh must not write to once the request is done
+func refreshContext(ctx context.Context) context.Context {
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range []contextKey{accessLogContextKey, trafficContextKey, captureContextKey} {
+		ctx = context.WithValue(ctx, key, nil)
+	}
+	return ctx
+}
+
+// store keeps a recorded response to the request with key if it can be
+// cached, for no longer than its cache hint or Cache-Control allows, under
+// the variant key for its content type if it varies on Accept. Reports
+// whether it did.
+func (c *TileCache) store(key string, ttl time.Duration, recorder *cacheRecorder, fetchDuration time.Duration) bool {
+	if recorder.overflow || !isCacheableStatus(recorder.status) || recorder.Header().Get("Set-Cookie") != "" {
+		return false
+	}
+	if !variesOnlyCacheably(recorder.Header()) {
+		return false
+	}
+
+	header := cacheableHeaders(recorder.Header())
+
+	ttl, ok := c.cacheTTL(recorder.hint, header, ttl)
+	if !ok {
+		return false
+	}
+
+	if variesOnAccept(header) {
+		contentType := mediaType(header.Get("Content-Type"))
+		if contentType == "" {
+			return false
+		}
+		c.variants.observe(contentType)
+		key = variantKey(key, contentType)
+	}
+
+	now := time.Now()
+
+	entry := &CacheEntry{
+		Key:           key,
+		Status:        recorder.status,
+		Header:        header,
+		Body:          recorder.body.Bytes(),
+		Stored:        now,
+		Expires:       c.expiry(now, ttl),
+		FetchDuration: fetchDuration,
+	}
+	c.set(entry)
+
+	if c.shared != nil {
+		c.shared.put(entry)
+	}
+
+	return true
+}
+
+// renewalTTL is how long an entry the backend confirmed is unchanged is kept
+// for, by the hint on the 304 if any. A 304 saying not to cache leaves the
+// renewed entry already expired.
+func (c *TileCache) renewalTTL(recorder *cacheRecorder, entry *CacheEntry, ttl time.Duration) time.Duration {
+	ttl, _ = c.cacheTTL(recorder.hint, entry.Header, ttl)
+	return ttl
+}
+
+// renew stores a fresh copy of an entry the backend confirmed is unchanged
+func (c *TileCache) renew(entry *CacheEntry, ttl time.Duration, fetchDuration time.Duration) *CacheEntry {
+	now := time.Now()
+
+	renewed := &CacheEntry{
+		Key:           entry.Key,
+		Status:        entry.Status,
+		Header:        entry.Header,
+		Body:          entry.Body,
+		Stored:        now,
+		Expires:       c.expiry(now, ttl),
+		FetchDuration: fetchDuration,
+	}
+	renewed.hits.Store(entry.hits.Load())
+
+	c.set(renewed)
+
+	if c.shared != nil {
+		c.shared.put(renewed)
+	}
+
+	return renewed
+}
+
+// cacheKey is the request's normalized tile path and query, so the spellings
+// of one tile share an entry
+func cacheKey(r *http.Request) string {
+	query := r.URL.Query()
+	for _, param := range unkeyedParams {
+		query.Del(param)
+	}
+
+	return normalizeTilePath(r.URL.Path) + "?" + query.Encode()
+}
+
+// unkeyedParams are query parameters that don't change the tile: the
+// CloudFront signed URL parameters differ per user and expiry
+var unkeyedParams = []string{"Policy", "Signature", "Key-Pair-Id", "Expires"}
+
+// normalizeTilePath cleans the path and, if it ends in z/x/y, writes the
+// coordinates without leading zeros and the extension in lowercase
+func normalizeTilePath(p string) string {
+	p = path.Clean("/" + p)
+
+	z, x, y, ok := parseTileCoords(p)
+	if !ok {
+		return p
+	}
+
+	dir := p
+	for range 3 {
+		dir = path.Dir(dir)
+	}
+
+	tile := fmt.Sprintf("%d/%d/%d", z, x, y)
+	if ext := path.Ext(p); ext != "" {
+		tile += strings.ToLower(ext)
+	}
+
+	return path.Join(dir, tile)
+}
+
+// cacheControlTTL is how long the gateway may keep a response given its
+// Cache-Control header: s-maxage or max-age when shorter than ttl, and not
+// at all when the backend forbids shared caching. Reports false when the
+// response must not be stored.
+func cacheControlTTL(h http.Header, ttl time.Duration) (time.Duration, bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, value := range h.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache", "private":
+				return 0, false
+			case "max-age":
+				if seconds, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+					maxAge = seconds
+				}
+			case "s-maxage":
+				if seconds, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+					sMaxAge = seconds
+				}
+			}
+		}
+	}
+
+	// s-maxage is meant for shared caches like the gateway
+	seconds := maxAge
+	if sMaxAge >= 0 {
+		seconds = sMaxAge
+	}
+	if seconds < 0 {
+		return ttl, true
+	}
+	if seconds == 0 {
+		return 0, false
+	}
+
+	return min(ttl, time.Duration(seconds)*time.Second), true
+}
+
+// Tiles that exist, and the answers for tiles that don't
+func isCacheableStatus(status int) bool {
+	return status == http.StatusOK || status == http.StatusNoContent || status == http.StatusNotFound
+}
+
+// headers that belong to one response and are never replayed from the cache
+// or shared with coalesced requests
+var uncachedHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Date", "Set-Cookie", "X-Cache", "X-Request-ID", captureIDHeader}
+
+// isUncachedHeader reports whether the header called name is one of
+// uncachedHeaders
+func isUncachedHeader(name string) bool {
+	return slices.ContainsFunc(uncachedHeaders, func(uncached string) bool { return strings.EqualFold(uncached, name) })
+}
+
+func cacheableHeaders(h http.Header) http.Header {
+	clone := h.Clone()
+	for _, name := range uncachedHeaders {
+		clone.Del(name)
+	}
+	for name := range clone {
+		if isCORSHeader(name) {
+			delete(clone, name)
+		}
+	}
+	return clone
+}
+
+// isCORSHeader reports whether name is one of the CORS response headers,
+// which CORSPolicy sets for each request's own origin
+func isCORSHeader(name string) bool {
+	return strings.HasPrefix(http.CanonicalHeaderKey(name), "Access-Control-")
+}
+
+// addVary adds the names in values to the Vary header of h that it doesn't
+// name already
+func addVary(h http.Header, values []string) {
+	named := map[string]bool{}
+	for _, value := range h.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			named[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	for _, value := range values {
+		for name := range strings.SplitSeq(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !named[strings.ToLower(name)] {
+				named[strings.ToLower(name)] = true
+				h.Add("Vary", name)
+			}
+		}
+	}
+}
+
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, entry *CacheEntry, result string) {
+	// Entries are stored as the backend sent them, gzipped or not
+	if strings.EqualFold(entry.Header.Get("Content-Encoding"), "gzip") && !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+		if plain, ok := gunzipEntry(entry); ok {
+			entry = plain
+		}
+	}
+
+	// The CORS headers and Vary set for this request stay
+	for name, values := range entry.Header {
+		switch {
+		case isCORSHeader(name):
+		case name == "Vary":
+			addVary(w.Header(), values)
+		default:
+			w.Header()[name] = values
+		}
+	}
+
+	w.Header().Set("X-Cache", result)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// cacheRecorder copies a response into a buffer while passing it on. With no
+// ResponseWriter it only records, for background refreshes. The response's
+// headers are kept apart from those set on the ResponseWriter for this
+// request, so only the backend's are stored, and are copied over once the
+// status is written. While revalidating, a 304 is held back from the
+// client, headers and all, and the cached entry served instead.
+type cacheRecorder struct {
+	http.ResponseWriter
+	header       http.Header
+	status       int
+	wroteHeader  bool
+	body         bytes.Buffer
+	overflow     bool
+	revalidating bool
+
+	// Taken off the response before it is passed on
+	hint cacheHint
+
+	// Bytes buffered at most, defaultMaxCacheEntryBytes when 0, and how
+	// many were streamed past the buffer once over it
+	limit    int64
+	bypassed int64
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.header == nil {
+		rec.header = http.Header{}
+	}
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+		rec.hint = takeCacheHint(rec.Header())
+
+		// A response announcing its size as too big is never buffered at all
+		if length, err := strconv.ParseInt(rec.Header().Get("Content-Length"), 10, 64); err == nil && length > rec.maxBytes() {
+			rec.overflow = true
+		}
+	}
+	if rec.revalidating && rec.status == http.StatusNotModified {
+		return
+	}
+	if rec.ResponseWriter != nil {
+		h := rec.ResponseWriter.Header()
+		for name, values := range rec.Header() {
+			for _, value := range values {
+				h.Add(name, value)
+			}
+		}
+		rec.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	switch {
+	case rec.overflow:
+		rec.bypassed += int64(len(b))
+	case int64(rec.body.Len()+len(b)) > rec.maxBytes():
+		// Too big to cache, stop buffering but keep streaming
+		rec.overflow = true
+		rec.bypassed = int64(rec.body.Len() + len(b))
+		rec.body = bytes.Buffer{}
+	default:
+		rec.body.Write(b)
+	}
+
+	if rec.ResponseWriter != nil && !(rec.revalidating && rec.status == http.StatusNotModified) {
+		return rec.ResponseWriter.Write(b)
+	}
+	return len(b), nil
+}
+
+func (rec *cacheRecorder) maxBytes() int64 {
+	if rec.limit > 0 {
+		return rec.limit
+	}
+	return defaultMaxCacheEntryBytes
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,75 @@
+package main
+
+import "crypto/sha256"
+
+var cacheUniqueBodies = NewGauge(
+	"civil_gateway_cache_unique_bodies",
+	"Distinct response bodies held in the tile cache",
+)
+
+// cacheBodyStore keeps one copy of each distinct response body, addressed by
+// its hash, for the entries of the tile cache to share. Large stretches of
+// a tile set are byte-identical blank or water tiles, which would otherwise
+// each hold a copy. Not safe for concurrent use; the TileCache serializes
+// calls to it.
+type cacheBodyStore struct {
+	bodies map[[sha256.Size]byte]*cacheBody
+	keys   map[string][sha256.Size]byte
+}
+
+type cacheBody struct {
+	data []byte
+	refs int
+}
+
+func newCacheBodyStore() *cacheBodyStore {
+	return &cacheBodyStore{
+		bodies: map[[sha256.Size]byte]*cacheBody{},
+		keys:   map[string][sha256.Size]byte{},
+	}
+}
+
+// acquire points the entry's body at the shared copy, storing the body if it
+// is new. The key must not hold a body already. Returns the bytes this adds
+// to the cache: the key, and the body if no other entry had it.
+func (s *cacheBodyStore) acquire(entry *CacheEntry) int64 {
+	sum := sha256.Sum256(entry.Body)
+	s.keys[entry.Key] = sum
+
+	added := int64(len(entry.Key))
+
+	if body, ok := s.bodies[sum]; ok {
+		body.refs++
+		entry.Body = body.data
+	} else {
+		s.bodies[sum] = &cacheBody{data: entry.Body, refs: 1}
+		added += int64(len(entry.Body))
+	}
+
+	cacheUniqueBodies.Set(float64(len(s.bodies)))
+
+	return added
+}
+
+// release drops the key's hold on its body. Returns the bytes this frees:
+// the key, and the body if it was the last entry to hold it.
+func (s *cacheBodyStore) release(key string) int64 {
+	sum, ok := s.keys[key]
+	if !ok {
+		return 0
+	}
+	delete(s.keys, key)
+
+	freed := int64(len(key))
+
+	body := s.bodies[sum]
+	body.refs--
+	if body.refs == 0 {
+		delete(s.bodies, sum)
+		freed += int64(len(body.data))
+	}
+
+	cacheUniqueBodies.Set(float64(len(s.bodies)))
+
+	return freed
+}
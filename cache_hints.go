@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers backends send to tune how long the gateway caches a response.
+// X-Gateway-Cache-TTL is seconds or a duration like 5m, and takes the place
+// of Cache-Control for the gateway. X-Gateway-No-Cache keeps the response
+// out of the cache. Both are removed before the response goes anywhere else.
+const (
+	cacheTTLHintHeader = "X-Gateway-Cache-TTL"
+	noCacheHintHeader  = "X-Gateway-No-Cache"
+)
+
+var cacheHints = NewCounter(
+	"civil_gateway_cache_hints_total",
+	"Cache hints sent by backends, by what the cache made of them",
+	"result",
+)
+
+// cacheHint is a backend's say on caching one response. A ttl of 0 means
+// none was given.
+type cacheHint struct {
+	noCache bool
+	ttl     time.Duration
+}
+
+// takeCacheHint reads the hint headers and removes them
+func takeCacheHint(h http.Header) cacheHint {
+	var hint cacheHint
+
+	if value := h.Get(noCacheHintHeader); value != "" {
+		// Any value but an explicit false counts
+		noCache, err := strconv.ParseBool(value)
+		hint.noCache = noCache || err != nil
+	}
+
+	if value := h.Get(cacheTTLHintHeader); value != "" {
+		if ttl, ok := parseCacheTTLHint(value); ok {
+			hint.ttl = ttl
+			hint.noCache = hint.noCache || ttl == 0
+		} else {
+			cacheHints.Inc("invalid")
+		}
+	}
+
+	h.Del(noCacheHintHeader)
+	h.Del(cacheTTLHintHeader)
+
+	return hint
+}
+
+func parseCacheTTLHint(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if ttl, err := time.ParseDuration(value); err == nil && ttl >= 0 {
+		return ttl, true
+	}
+	return 0, false
+}
+
+// SetCacheHintBounds limits the TTLs backends can ask for to between minTTL
+// and maxTTL. Until set, TTL hints are ignored.
+func (c *TileCache) SetCacheHintBounds(minTTL, maxTTL time.Duration) {
+	c.hintMinTTL = minTTL
+	c.hintMaxTTL = maxTTL
+}
+
+// cacheTTL is how long to keep a response: the TTL its backend asked for,
+// within the hint bounds, or else as long as its Cache-Control allows.
+// Reports false if it isn't to be cached.
+func (c *TileCache) cacheTTL(hint cacheHint, header http.Header, ttl time.Duration) (time.Duration, bool) {
+	if hint.noCache {
+		cacheHints.Inc("no_cache")
+		return 0, false
+	}
+	if hint.ttl == 0 || c.hintMaxTTL <= 0 {
+		return cacheControlTTL(header, ttl)
+	}
+
+	bounded := min(max(hint.ttl, c.hintMinTTL), c.hintMaxTTL)
+	if bounded != hint.ttl {
+		cacheHints.Inc("clamped")
+	} else {
+		cacheHints.Inc("ttl")
+	}
+	return bounded, true
+}
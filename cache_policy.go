@@ -0,0 +1,421 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"container/list"
+	"fmt"
+	"slices"
+)
+
+// cachePolicy decides which entry goes when the tile cache is full. Policies
+// are not safe for concurrent use; the TileCache serializes calls to them.
+type cachePolicy interface {
+	// get returns the entry and counts it as used
+	get(key string) (*CacheEntry, bool)
+	// add inserts the entry, replacing any with the same key
+	add(entry *CacheEntry)
+	// evict removes and returns the entry the policy values least
+	evict() (*CacheEntry, bool)
+	// remove drops the entry for key, if there is one
+	remove(key string) bool
+	len() int
+	// entries lists every entry, least valued first
+	entries() []*CacheEntry
+}
+
+func newCachePolicy(name string, maxBytes int64) (cachePolicy, error) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(), nil
+	case "lfu":
+		return newLFUPolicy(), nil
+	case "arc":
+		return newARCPolicy(maxBytes), nil
+	default:
+		return nil, fmt.Errorf("unknown cache eviction policy %q", name)
+	}
+}
+
+// lruPolicy evicts the least recently used entry
+type lruPolicy struct {
+	items map[string]*list.Element
+	order *list.List
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+func (p *lruPolicy) get(key string) (*CacheEntry, bool) {
+	elem, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+	p.order.MoveToFront(elem)
+	return elem.Value.(*CacheEntry), true
+}
+
+func (p *lruPolicy) add(entry *CacheEntry) {
+	if elem, ok := p.items[entry.Key]; ok {
+		elem.Value = entry
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.items[entry.Key] = p.order.PushFront(entry)
+}
+
+func (p *lruPolicy) evict() (*CacheEntry, bool) {
+	elem := p.order.Back()
+	if elem == nil {
+		return nil, false
+	}
+	entry := p.order.Remove(elem).(*CacheEntry)
+	delete(p.items, entry.Key)
+	return entry, true
+}
+
+func (p *lruPolicy) remove(key string) bool {
+	elem, ok := p.items[key]
+	if !ok {
+		return false
+	}
+	p.order.Remove(elem)
+	delete(p.items, key)
+	return true
+}
+
+func (p *lruPolicy) len() int {
+	return p.order.Len()
+}
+
+func (p *lruPolicy) entries() []*CacheEntry {
+	entries := make([]*CacheEntry, 0, p.order.Len())
+	for elem := p.order.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, elem.Value.(*CacheEntry))
+	}
+	return entries
+}
+
+// lfuPolicy evicts the least frequently used entry, and of those the least
+// recently used. Suits tile sets where a few areas are always in view.
+type lfuPolicy struct {
+	items map[string]*lfuItem
+	queue lfuQueue
+	clock uint64
+}
+
+type lfuItem struct {
+	entry    *CacheEntry
+	uses     uint64
+	lastUsed uint64
+	index    int
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		items: map[string]*lfuItem{},
+	}
+}
+
+func (p *lfuPolicy) touch(item *lfuItem) {
+	p.clock++
+	item.uses++
+	item.lastUsed = p.clock
+	heap.Fix(&p.queue, item.index)
+}
+
+func (p *lfuPolicy) get(key string) (*CacheEntry, bool) {
+	item, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+	p.touch(item)
+	return item.entry, true
+}
+
+func (p *lfuPolicy) add(entry *CacheEntry) {
+	if item, ok := p.items[entry.Key]; ok {
+		item.entry = entry
+		p.touch(item)
+		return
+	}
+
+	p.clock++
+	item := &lfuItem{entry: entry, uses: 1, lastUsed: p.clock}
+	p.items[entry.Key] = item
+	heap.Push(&p.queue, item)
+}
+
+func (p *lfuPolicy) evict() (*CacheEntry, bool) {
+	if p.queue.Len() == 0 {
+		return nil, false
+	}
+	item := heap.Pop(&p.queue).(*lfuItem)
+	delete(p.items, item.entry.Key)
+	return item.entry, true
+}
+
+func (p *lfuPolicy) remove(key string) bool {
+	item, ok := p.items[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(&p.queue, item.index)
+	delete(p.items, key)
+	return true
+}
+
+func (p *lfuPolicy) len() int {
+	return p.queue.Len()
+}
+
+func (p *lfuPolicy) entries() []*CacheEntry {
+	items := slices.Clone(p.queue)
+	slices.SortFunc(items, func(a, b *lfuItem) int {
+		return cmp.Or(cmp.Compare(a.uses, b.uses), cmp.Compare(a.lastUsed, b.lastUsed))
+	})
+
+	entries := make([]*CacheEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, item.entry)
+	}
+	return entries
+}
+
+// lfuQueue is a min-heap on (uses, lastUsed)
+type lfuQueue []*lfuItem
+
+func (q lfuQueue) Len() int { return len(q) }
+
+func (q lfuQueue) Less(i, j int) bool {
+	if q[i].uses != q[j].uses {
+		return q[i].uses < q[j].uses
+	}
+	return q[i].lastUsed < q[j].lastUsed
+}
+
+func (q lfuQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *lfuQueue) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *lfuQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// arcPolicy is the Adaptive Replacement Cache, sized in bytes. It keeps
+// entries seen once (t1) apart from entries seen again (t2), remembers the
+// keys it recently evicted from each (b1, b2), and shifts its target split
+// between recency and frequency toward whichever side those ghosts show was
+// evicted too eagerly. Copes with scans, such as a client panning across a
+// whole zoom level, better than LRU.
+type arcPolicy struct {
+	capacity int64
+	target   int64
+
+	t1, t2, b1, b2   *list.List
+	t1Bytes, t2Bytes int64
+	b1Bytes, b2Bytes int64
+	items            map[string]*list.Element
+	ghosts           map[string]*list.Element
+	// Whether the last insert was a key remembered in b2, which tips a tie
+	// toward evicting from t1
+	lastGhostHitB2 bool
+}
+
+type arcItem struct {
+	entry *CacheEntry
+	list  *list.List
+}
+
+type arcGhost struct {
+	key  string
+	size int64
+	list *list.List
+}
+
+func newARCPolicy(capacity int64) *arcPolicy {
+	return &arcPolicy{
+		capacity: capacity,
+		t1:       list.New(),
+		t2:       list.New(),
+		b1:       list.New(),
+		b2:       list.New(),
+		items:    map[string]*list.Element{},
+		ghosts:   map[string]*list.Element{},
+	}
+}
+
+func (p *arcPolicy) get(key string) (*CacheEntry, bool) {
+	elem, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := elem.Value.(*arcItem)
+	p.promote(elem, item)
+	return item.entry, true
+}
+
+// promote moves an entry to the front of t2, the frequently used side
+func (p *arcPolicy) promote(elem *list.Element, item *arcItem) {
+	if item.list == p.t1 {
+		p.t1.Remove(elem)
+		p.t1Bytes -= item.entry.size()
+		item.list = p.t2
+		p.items[item.entry.Key] = p.t2.PushFront(item)
+		p.t2Bytes += item.entry.size()
+		return
+	}
+	p.t2.MoveToFront(elem)
+}
+
+func (p *arcPolicy) add(entry *CacheEntry) {
+	size := entry.size()
+
+	if elem, ok := p.items[entry.Key]; ok {
+		item := elem.Value.(*arcItem)
+		old := item.entry.size()
+		if item.list == p.t1 {
+			p.t1Bytes += size - old
+		} else {
+			p.t2Bytes += size - old
+		}
+		item.entry = entry
+		p.promote(elem, item)
+		return
+	}
+
+	// A ghost hit means the key was evicted too early, so the target moves
+	// toward the side that evicted it and the entry goes straight to t2
+	if elem, ok := p.ghosts[entry.Key]; ok {
+		ghost := elem.Value.(*arcGhost)
+		p.lastGhostHitB2 = ghost.list == p.b2
+
+		if ghost.list == p.b1 {
+			delta := size
+			if p.b1Bytes > 0 && p.b2Bytes > p.b1Bytes {
+				delta = size * p.b2Bytes / p.b1Bytes
+			}
+			p.target = min(p.capacity, p.target+delta)
+		} else {
+			delta := size
+			if p.b2Bytes > 0 && p.b1Bytes > p.b2Bytes {
+				delta = size * p.b1Bytes / p.b2Bytes
+			}
+			p.target = max(0, p.target-delta)
+		}
+
+		p.removeGhost(elem, ghost)
+		p.items[entry.Key] = p.t2.PushFront(&arcItem{entry: entry, list: p.t2})
+		p.t2Bytes += size
+		return
+	}
+
+	p.lastGhostHitB2 = false
+	p.items[entry.Key] = p.t1.PushFront(&arcItem{entry: entry, list: p.t1})
+	p.t1Bytes += size
+}
+
+func (p *arcPolicy) evict() (*CacheEntry, bool) {
+	var from *list.List
+	switch {
+	case p.t1.Len() > 0 && (p.t1Bytes > p.target || (p.lastGhostHitB2 && p.t1Bytes == p.target) || p.t2.Len() == 0):
+		from = p.t1
+	case p.t2.Len() > 0:
+		from = p.t2
+	default:
+		return nil, false
+	}
+
+	elem := from.Back()
+	item := from.Remove(elem).(*arcItem)
+	delete(p.items, item.entry.Key)
+
+	size := item.entry.size()
+	ghosts := p.b1
+	if from == p.t1 {
+		p.t1Bytes -= size
+		p.b1Bytes += size
+	} else {
+		p.t2Bytes -= size
+		ghosts = p.b2
+		p.b2Bytes += size
+	}
+	p.ghosts[item.entry.Key] = ghosts.PushFront(&arcGhost{key: item.entry.Key, size: size, list: ghosts})
+
+	p.trimGhosts()
+
+	return item.entry, true
+}
+
+// trimGhosts keeps the remembered keys to no more than the capacity's worth
+func (p *arcPolicy) trimGhosts() {
+	for p.b1Bytes+p.b2Bytes > p.capacity {
+		from := p.b2
+		if p.b1Bytes > p.b2Bytes {
+			from = p.b1
+		}
+		elem := from.Back()
+		p.removeGhost(elem, elem.Value.(*arcGhost))
+	}
+}
+
+func (p *arcPolicy) removeGhost(elem *list.Element, ghost *arcGhost) {
+	ghost.list.Remove(elem)
+	delete(p.ghosts, ghost.key)
+	if ghost.list == p.b1 {
+		p.b1Bytes -= ghost.size
+	} else {
+		p.b2Bytes -= ghost.size
+	}
+}
+
+// remove drops the entry without remembering it as a ghost, since it was
+// not evicted for lack of space
+func (p *arcPolicy) remove(key string) bool {
+	elem, ok := p.items[key]
+	if !ok {
+		return false
+	}
+
+	item := elem.Value.(*arcItem)
+	item.list.Remove(elem)
+	delete(p.items, key)
+	if item.list == p.t1 {
+		p.t1Bytes -= item.entry.size()
+	} else {
+		p.t2Bytes -= item.entry.size()
+	}
+	return true
+}
+
+func (p *arcPolicy) len() int {
+	return p.t1.Len() + p.t2.Len()
+}
+
+func (p *arcPolicy) entries() []*CacheEntry {
+	entries := make([]*CacheEntry, 0, p.len())
+	for _, l := range []*list.List{p.t1, p.t2} {
+		for elem := l.Back(); elem != nil; elem = elem.Prev() {
+			entries = append(entries, elem.Value.(*arcItem).entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// sharedTier is the Redis tier of the tile cache, shared by every replica
+	sharedTier = "shared"
+	// sharedCacheKeyPrefix namespaces the gateway's keys in Redis
+	sharedCacheKeyPrefix = "civil:tile:"
+	// sharedCachePurgeChannel carries purged paths to every replica, so
+	// each drops its near-cached copies
+	sharedCachePurgeChannel = "civil:tile:purge"
+)
+
+var sharedCacheErrors = NewCounter(
+	"civil_gateway_cache_shared_errors_total",
+	"Failed calls to the shared cache tier, by operation",
+	"operation",
+)
+
+// SharedCacheConfig sets up the shared tier. TTL, when set, replaces the
+// entries' own expiry in Redis, NearTTL caps how long a replica serves an
+// entry fetched from Redis out of its own memory, and WriteThrough stores
+// new entries in Redis before the response completes instead of in the
+// background. Entries are kept in Redis for Retain past their expiry, so a
+// replica that has never seen a tile can still serve it stale while its
+// pool is down.
+type SharedCacheConfig struct {
+	URL          string
+	TTL          time.Duration
+	NearTTL      time.Duration
+	Timeout      time.Duration
+	WriteThrough bool
+	Retain       time.Duration
+}
+
+// SharedCache is a Redis or ElastiCache tier between the in-memory cache
+// and the backends, so a tile rendered for one replica is a hit for all of
+// them. Each replica's memory tier acts as its near-cache. Purges are
+// broadcast to every replica over pub/sub; NearTTL bounds how stale a
+// replica can be if it misses one.
+type SharedCache struct {
+	client *redis.Client
+	config SharedCacheConfig
+	stage  *Stage
+	logger *slog.Logger
+}
+
+// NewSharedCache connects to the Redis at config.URL, such as
+// rediss://cache.example.com:6379/0, and listens for purges on stage,
+// calling purge with each purged path
+func NewSharedCache(ctx context.Context, stage *Stage, config SharedCacheConfig, purge func(path string) int, logger *slog.Logger) (*SharedCache, error) {
+	options, err := redis.ParseURL(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shared cache URL: %w", err)
+	}
+
+	client := redis.NewClient(options)
+
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to reach shared cache: %w", err)
+	}
+
+	sc := &SharedCache{
+		client: client,
+		config: config,
+		stage:  stage,
+		logger: logger,
+	}
+
+	stage.Go("cache-shared-purges", func(ctx context.Context) error {
+		defer client.Close()
+
+		sub := client.Subscribe(ctx, sharedCachePurgeChannel)
+		defer sub.Close()
+
+		messages := sub.Channel()
+		for {
+			select {
+			case msg := <-messages:
+				purged := purge(msg.Payload)
+				logger.Debug("purged near-cached entries for another replica", slog.String("path", msg.Payload), slog.Int("entries", purged))
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
+	return sc, nil
+}
+
+// get looks the keys up in Redis, returning the first one found. Errors are
+// counted and treated as misses, so an unreachable Redis only costs the
+// timeout.
+func (sc *SharedCache) get(ctx context.Context, keys ...string) (*CacheEntry, bool) {
+	ctx, cancel := context.WithTimeout(ctx, sc.config.Timeout)
+	defer cancel()
+
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = sharedCacheKeyPrefix + key
+	}
+
+	values, err := sc.client.MGet(ctx, redisKeys...).Result()
+	if err != nil {
+		sharedCacheErrors.Inc("get")
+		recordError("shared_cache_failed")
+		sc.logger.Debug("shared cache lookup failed", slog.Any("error", err))
+		return nil, false
+	}
+
+	for _, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var entry CacheEntry
+		if err := gob.NewDecoder(strings.NewReader(raw)).Decode(&entry); err != nil {
+			sharedCacheErrors.Inc("decode")
+			recordError("shared_cache_failed")
+			continue
+		}
+		return &entry, true
+	}
+
+	return nil, false
+}
+
+// near is the copy of an entry from Redis kept in memory, expiring no later
+// than NearTTL from now
+func (sc *SharedCache) near(entry *CacheEntry, now time.Time) *CacheEntry {
+	if sc.config.NearTTL > 0 && entry.Expires.After(now.Add(sc.config.NearTTL)) {
+		entry.Expires = now.Add(sc.config.NearTTL)
+	}
+	return entry
+}
+
+// put stores the entry in Redis until it expires, or for TTL if set, and
+// Retain past that. With
+// write-through it returns once stored, and otherwise right away.
+func (sc *SharedCache) put(entry *CacheEntry) {
+	shared := &CacheEntry{
+		Key:           entry.Key,
+		Status:        entry.Status,
+		Header:        entry.Header,
+		Body:          entry.Body,
+		Stored:        entry.Stored,
+		Expires:       entry.Expires,
+		FetchDuration: entry.FetchDuration,
+	}
+	if sc.config.TTL > 0 {
+		shared.Expires = shared.Stored.Add(sc.config.TTL)
+	}
+
+	write := func(ctx context.Context) error {
+		ttl := time.Until(shared.Expires) + sc.config.Retain
+		if ttl <= 0 {
+			return nil
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(shared); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, sc.config.Timeout)
+		defer cancel()
+
+		if err := sc.client.Set(ctx, sharedCacheKeyPrefix+shared.Key, buf.Bytes(), ttl).Err(); err != nil {
+			sharedCacheErrors.Inc("put")
+			recordError("shared_cache_failed")
+			sc.logger.Debug("failed to store entry in shared cache", slog.String("key", shared.Key), slog.Any("error", err))
+		}
+		return nil
+	}
+
+	if sc.config.WriteThrough {
+		write(context.Background())
+		return
+	}
+	sc.stage.Go("cache-shared-put", write)
+}
+
+// purge deletes the entries for path, or every path under it when it ends
+// in *, from Redis and tells the other replicas to drop them too
+func (sc *SharedCache) purge(ctx context.Context, path string) error {
+	prefix, wildcard := strings.CutSuffix(path, "*")
+
+	var pattern string
+	if wildcard {
+		pattern = sharedCacheKeyPrefix + escapeRedisPattern(prefix) + "*"
+	} else {
+		// The key goes on with the query and any variant
+		pattern = sharedCacheKeyPrefix + escapeRedisPattern(normalizeTilePath(path)+"?") + "*"
+	}
+
+	var errs []error
+
+	iter := sc.client.Scan(ctx, 0, pattern, 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	for batch := range slices.Chunk(keys, 500) {
+		if err := sc.client.Unlink(ctx, batch...).Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := sc.client.Publish(ctx, sharedCachePurgeChannel, path).Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		sharedCacheErrors.Inc("purge")
+		recordError("shared_cache_failed")
+		return fmt.Errorf("failed to purge shared cache: %w", err)
+	}
+
+	return nil
+}
+
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// escapeRedisPattern escapes the glob characters of a Redis SCAN pattern
+func escapeRedisPattern(s string) string {
+	return redisPatternEscaper.Replace(s)
+}
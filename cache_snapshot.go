@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// cacheSnapshotVersion changes whenever CacheEntry changes shape, so an old
+// snapshot is skipped instead of misread
+const cacheSnapshotVersion = 1
+
+// cacheSnapshotTimeout bounds writing the snapshot during shutdown
+const cacheSnapshotTimeout = 8 * time.Second
+
+type cacheSnapshotHeader struct {
+	Version int
+	Written time.Time
+	Entries int
+}
+
+// snapshot lists the unexpired entries, least valued first, so that
+// restoring them in order leaves the most valued entries safest from eviction
+func (c *TileCache) snapshot(now time.Time) []*CacheEntry {
+	c.mu.Lock()
+	all := c.policy.entries()
+	c.mu.Unlock()
+
+	entries := make([]*CacheEntry, 0, len(all))
+	for _, entry := range all {
+		if now.Before(entry.Expires) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// SaveSnapshot writes the cache to the object at uri, a local path or a
+// file://, s3://, or other blob URL
+func (c *TileCache) SaveSnapshot(ctx context.Context, uri string) error {
+	bucketURL, key, err := splitBlobURL(uri)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return fmt.Errorf("failed to open cache snapshot bucket: %w", err)
+	}
+	defer bucket.Close()
+
+	entries := c.snapshot(time.Now())
+
+	w, err := bucket.NewWriter(ctx, key, &blob.WriterOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+
+	buffered := bufio.NewWriter(w)
+	enc := gob.NewEncoder(buffered)
+
+	err = enc.Encode(cacheSnapshotHeader{
+		Version: cacheSnapshotVersion,
+		Written: time.Now(),
+		Entries: len(entries),
+	})
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(entry)
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+
+	c.logger.Info("saved cache snapshot", slog.String("url", uri), slog.Int("entries", len(entries)))
+
+	return nil
+}
+
+// RestoreSnapshot loads a snapshot written by SaveSnapshot. Entries stored
+// longer than maxAge ago, or already expired, are skipped. A missing
+// snapshot is not an error.
+func (c *TileCache) RestoreSnapshot(ctx context.Context, uri string, maxAge time.Duration) error {
+	bucketURL, key, err := splitBlobURL(uri)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return fmt.Errorf("failed to open cache snapshot bucket: %w", err)
+	}
+	defer bucket.Close()
+
+	r, err := bucket.NewReader(ctx, key, nil)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		c.logger.Info("no cache snapshot to restore", slog.String("url", uri))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+	defer r.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(r))
+
+	var header cacheSnapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+
+	if header.Version != cacheSnapshotVersion {
+		c.logger.Warn("skipping cache snapshot from another version", slog.Int("version", header.Version))
+		return nil
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-maxAge)
+	restored := 0
+
+	for range header.Entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var entry CacheEntry
+		if err := dec.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return fmt.Errorf("failed to read cache snapshot: %w", err)
+		}
+
+		if entry.Stored.Before(cutoff) || !now.Before(entry.Expires) {
+			continue
+		}
+
+		// Entries cached since startup are newer than the snapshot's
+		if _, ok := c.get(entry.Key); ok {
+			continue
+		}
+
+		c.set(&entry)
+		restored++
+	}
+
+	c.logger.Info("restored cache snapshot",
+		slog.String("url", uri),
+		slog.Int("entries", restored),
+		slog.Duration("snapshot_age", now.Sub(header.Written).Round(time.Second)),
+	)
+
+	return nil
+}
+
+// startCacheSnapshots restores the snapshot in the background at startup and
+// writes a new one when the stage shuts down
+func startCacheSnapshots(stage *Stage, cache *TileCache, uri string, maxAge time.Duration, logger *slog.Logger) {
+	stage.Go("cache-snapshot", func(ctx context.Context) error {
+		if err := cache.RestoreSnapshot(ctx, uri, maxAge); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error("failed to restore cache snapshot", slog.Any("error", err))
+		}
+
+		<-ctx.Done()
+
+		// The stage's context is done, so saving gets its own deadline
+		saveCtx, cancel := context.WithTimeout(context.Background(), cacheSnapshotTimeout)
+		defer cancel()
+
+		if err := cache.SaveSnapshot(saveCtx, uri); err != nil {
+			logger.Error("failed to save cache snapshot", slog.Any("error", err))
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// memoryTier is the in-process tier of the tile cache
+const memoryTier = "memory"
+
+// defaultHottestKeys is how many of the most served keys the stats list
+// unless ?top= asks for another number
+const defaultHottestKeys = 20
+
+type cacheTierStats struct {
+	hits   int64
+	misses int64
+}
+
+// CacheStats is the body of GET /admin/cache/stats
+type CacheStats struct {
+	Policy  string `json:"policy"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	// Distinct bodies, which identical tiles share
+	UniqueBodies int              `json:"unique_bodies"`
+	MaxBytes     int64            `json:"max_bytes"`
+	Evictions    int64            `json:"evictions"`
+	Tiers        []CacheTierStats `json:"tiers"`
+	Hottest      []CacheKeyStats  `json:"hottest"`
+}
+
+type CacheTierStats struct {
+	Name     string  `json:"name"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+type CacheKeyStats struct {
+	Key   string `json:"key"`
+	Hits  int64  `json:"hits"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (c *TileCache) recordLookup(tier string, hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats, ok := c.tiers[tier]
+	if !ok {
+		stats = &cacheTierStats{}
+		c.tiers[tier] = stats
+	}
+
+	if hit {
+		stats.hits++
+	} else {
+		stats.misses++
+	}
+}
+
+// Stats summarizes the cache, listing the top most served keys
+func (c *TileCache) Stats(top int) CacheStats {
+	c.mu.Lock()
+	stats := CacheStats{
+		Policy:       c.policyName,
+		Entries:      c.policy.len(),
+		Bytes:        c.size,
+		UniqueBodies: len(c.bodies.bodies),
+		MaxBytes:     c.maxBytes,
+		Evictions:    c.evictions,
+		Tiers:        []CacheTierStats{},
+	}
+	for name, tier := range c.tiers {
+		stats.Tiers = append(stats.Tiers, CacheTierStats{
+			Name:     name,
+			Hits:     tier.hits,
+			Misses:   tier.misses,
+			HitRatio: hitRatio(tier.hits, tier.misses),
+		})
+	}
+	entries := c.policy.entries()
+	c.mu.Unlock()
+
+	slices.SortFunc(stats.Tiers, func(a, b CacheTierStats) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	hottest := make([]CacheKeyStats, 0, len(entries))
+	for _, entry := range entries {
+		if hits := entry.hits.Load(); hits > 0 {
+			hottest = append(hottest, CacheKeyStats{Key: entry.Key, Hits: hits, Bytes: entry.size()})
+		}
+	}
+	slices.SortFunc(hottest, func(a, b CacheKeyStats) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.Key, b.Key))
+	})
+	stats.Hottest = hottest[:min(top, len(hottest))]
+
+	return stats
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// StatsHandler serves the cache stats. ?top= sets how many hot keys to list.
+func (c *TileCache) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		top := defaultHottestKeys
+		if value := r.URL.Query().Get("top"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "Bad Request: invalid top", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(c.Stats(top))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cacheBypassContextKey contextKey = "cacheBypass"
+
+var cacheBypassRequests = NewCounter(
+	"civil_gateway_cache_bypass_requests_total",
+	"Requests asking to skip the tile cache, by pool and whether the caller was allowed to",
+	"pool", "result",
+)
+
+// cacheBypass is how a request skips the cache: bustParam, when set, is the
+// query parameter added to the request to the pool so the backend's own
+// caches miss too
+type cacheBypass struct {
+	bustParam string
+}
+
+// CacheBypass lets editors see a tile right after they changed it. Requests
+// sent with Cache-Control: no-cache or X-Bypass-Cache: true by a user in one
+// of groups skip the cache lookup, and what the pool answers replaces the
+// cached tile for everyone else. Others asking the same are served from the
+// cache as usual. It must run behind RequireAuth, which puts the claims in
+// the context, and in front of the cache.
+func CacheBypass(pool string, groups []string, bustParam string, next http.Handler) http.Handler {
+	bypass := cacheBypass{bustParam: bustParam}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !asksToBypassCache(r.Header) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, _ := r.Context().Value(userContextKey).(Claims)
+		if !slices.ContainsFunc(claims.Groups, func(group string) bool { return slices.Contains(groups, group) }) {
+			cacheBypassRequests.Inc(pool, "denied")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cacheBypassRequests.Inc(pool, "bypassed")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cacheBypassContextKey, bypass)))
+	})
+}
+
+// asksToBypassCache reports whether the request headers ask for a response
+// fresh from the pool
+func asksToBypassCache(h http.Header) bool {
+	if bypass, err := strconv.ParseBool(h.Get("X-Bypass-Cache")); err == nil && bypass {
+		return true
+	}
+	for _, value := range h.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheBypassFromContext is how the request was allowed to skip the cache,
+// if it was
+func cacheBypassFromContext(ctx context.Context) (cacheBypass, bool) {
+	bypass, ok := ctx.Value(cacheBypassContextKey).(cacheBypass)
+	return bypass, ok
+}
+
+// bustedRequest is r with the bust parameter of bypass set to the current
+// time, or r itself without one
+func bustedRequest(r *http.Request, bypass cacheBypass) *http.Request {
+	if bypass.bustParam == "" {
+		return r
+	}
+
+	busted := r.Clone(r.Context())
+	query := busted.URL.Query()
+	query.Set(bypass.bustParam, strconv.FormatInt(time.Now().UnixNano(), 36))
+	busted.URL.RawQuery = query.Encode()
+	return busted
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// canaryBuckets is how many minutes of requests each canary keeps, enough
+// for the longest analysis window
+const canaryBuckets = 60
+
+// canaryLatencyBounds are the upper bounds, in seconds, of the latency
+// buckets percentiles are estimated from
+var canaryLatencyBounds = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// What a canary's judgment can be. See CanaryAnalyzer
+const (
+	canaryPass         = "pass"
+	canaryFail         = "fail"
+	canaryInconclusive = "inconclusive"
+)
+
+var (
+	canaryRequests = NewCounter(
+		"civil_gateway_canary_requests_total",
+		"Requests to pools under a weighted rollout, by stable pool, variant, and whether they failed",
+		"pool", "variant", "result",
+	)
+	canaryErrorRateDelta = NewGauge(
+		"civil_gateway_canary_error_rate_delta",
+		"Error rate of the canary minus that of its stable pool over the analysis window",
+		"pool",
+	)
+	canaryLatencyDelta = NewGauge(
+		"civil_gateway_canary_latency_delta_seconds",
+		"Latency percentile of the canary minus that of its stable pool over the analysis window",
+		"pool", "quantile",
+	)
+	canaryVerdict = NewGauge(
+		"civil_gateway_canary_verdict",
+		"Judgment of each canary: 1 pass, 0 inconclusive, -1 fail",
+		"pool",
+	)
+)
+
+// CanaryThresholds are how much worse than its stable pool a canary may do
+// before it fails, and how many requests each needs over the window before
+// it is judged at all
+type CanaryThresholds struct {
+	Window          time.Duration
+	MaxErrorDelta   float64
+	MaxLatencyDelta time.Duration
+	MinRequests     int64
+}
+
+// canaryBucket counts a minute of requests to one variant
+type canaryBucket struct {
+	minute  int64
+	total   int64
+	errors  int64
+	latency [len(canaryLatencyBounds) + 1]int64
+}
+
+// canaryVariant is the last canaryBuckets minutes of requests to the stable
+// pool or its canary
+type canaryVariant struct {
+	mu      sync.Mutex
+	buckets [canaryBuckets]canaryBucket
+}
+
+func (v *canaryVariant) record(now time.Time, failed bool, elapsed time.Duration) {
+	minute := now.Unix() / 60
+	bound := sort.SearchFloat64s(canaryLatencyBounds[:], elapsed.Seconds())
+
+	v.mu.Lock()
+	bucket := &v.buckets[minute%canaryBuckets]
+	if bucket.minute != minute {
+		*bucket = canaryBucket{minute: minute}
+	}
+	bucket.total++
+	if failed {
+		bucket.errors++
+	}
+	bucket.latency[bound]++
+	v.mu.Unlock()
+}
+
+// CanaryStats is how one variant did over the analysis window
+type CanaryStats struct {
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       string  `json:"p50"`
+	P95       string  `json:"p95"`
+
+	p50, p95 time.Duration
+}
+
+// stats sums the requests of the last minutes
+func (v *canaryVariant) stats(now time.Time, minutes int) CanaryStats {
+	current := now.Unix() / 60
+
+	var stats CanaryStats
+	var latency [len(canaryLatencyBounds) + 1]int64
+
+	v.mu.Lock()
+	for _, bucket := range v.buckets {
+		if bucket.minute > current-int64(minutes) && bucket.minute <= current {
+			stats.Requests += bucket.total
+			stats.Errors += bucket.errors
+			for i, n := range bucket.latency {
+				latency[i] += n
+			}
+		}
+	}
+	v.mu.Unlock()
+
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+	}
+	stats.p50 = latencyQuantile(latency[:], stats.Requests, 0.5)
+	stats.p95 = latencyQuantile(latency[:], stats.Requests, 0.95)
+	stats.P50 = stats.p50.String()
+	stats.P95 = stats.p95.String()
+	return stats
+}
+
+// latencyQuantile estimates the q quantile of total requests counted into
+// the canaryLatencyBounds buckets, interpolating within the bucket it falls
+// in. Requests slower than the last bound count as taking it.
+func latencyQuantile(counts []int64, total int64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range counts {
+		if float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(canaryLatencyBounds) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = canaryLatencyBounds[i-1]
+		}
+		seconds := lower + (canaryLatencyBounds[i]-lower)*(rank-float64(seen))/float64(n)
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return time.Duration(canaryLatencyBounds[len(canaryLatencyBounds)-1] * float64(time.Second))
+}
+
+// canary is a stable pool, the canary pool taking weight percent of its
+// requests, and how each did
+type canary struct {
+	pool       string
+	canaryPool string
+	weight     int
+
+	stable canaryVariant
+	canary canaryVariant
+}
+
+// CanaryJudgment is whether a canary does well enough against its stable
+// pool to keep rolling out, for /admin/canary
+type CanaryJudgment struct {
+	Pool            string      `json:"pool"`
+	CanaryPool      string      `json:"canary_pool"`
+	Weight          int         `json:"weight"`
+	Verdict         string      `json:"verdict"`
+	Reasons         []string    `json:"reasons,omitempty"`
+	Window          string      `json:"window"`
+	Stable          CanaryStats `json:"stable"`
+	Canary          CanaryStats `json:"canary"`
+	ErrorRateDelta  float64     `json:"error_rate_delta"`
+	P50LatencyDelta string      `json:"p50_latency_delta"`
+	P95LatencyDelta string      `json:"p95_latency_delta"`
+}
+
+// CanaryAnalyzer splits the requests of pools under a weighted rollout
+// between the stable pool and its canary, and compares their error rates
+// and latencies so a deployment pipeline can roll back a bad release
+// without anyone watching dashboards
+type CanaryAnalyzer struct {
+	thresholds CanaryThresholds
+
+	mu       sync.Mutex
+	canaries map[string]*canary
+}
+
+func NewCanaryAnalyzer(thresholds CanaryThresholds) *CanaryAnalyzer {
+	return &CanaryAnalyzer{
+		thresholds: thresholds,
+		canaries:   map[string]*canary{},
+	}
+}
+
+// Split sends weight percent of the requests for pool to canaryHandler, the
+// canary pool's, and the rest to stable, recording how each does
+func (a *CanaryAnalyzer) Split(pool string, stable http.Handler, canaryPool string, canaryHandler http.Handler, weight int) http.Handler {
+	c := &canary{pool: pool, canaryPool: canaryPool, weight: weight}
+
+	a.mu.Lock()
+	a.canaries[pool] = c
+	a.mu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		variant, name, next := &c.stable, "stable", stable
+		if rand.IntN(100) < weight {
+			variant, name, next = &c.canary, "canary", canaryHandler
+		}
+
+		start := time.Now()
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// Requests the client gave up on say nothing about the release
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			return
+		}
+
+		failed := recorder.status >= http.StatusInternalServerError
+		variant.record(start, failed, time.Since(start))
+		if failed {
+			canaryRequests.Inc(pool, name, "error")
+		} else {
+			canaryRequests.Inc(pool, name, "ok")
+		}
+	})
+}
+
+// judge compares a canary to its stable pool over the analysis window
+func (a *CanaryAnalyzer) judge(c *canary, now time.Time) CanaryJudgment {
+	minutes := int(a.thresholds.Window / time.Minute)
+	stable := c.stable.stats(now, minutes)
+	canary := c.canary.stats(now, minutes)
+
+	judgment := CanaryJudgment{
+		Pool:            c.pool,
+		CanaryPool:      c.canaryPool,
+		Weight:          c.weight,
+		Verdict:         canaryPass,
+		Window:          a.thresholds.Window.String(),
+		Stable:          stable,
+		Canary:          canary,
+		ErrorRateDelta:  canary.ErrorRate - stable.ErrorRate,
+		P50LatencyDelta: (canary.p50 - stable.p50).String(),
+		P95LatencyDelta: (canary.p95 - stable.p95).String(),
+	}
+
+	if stable.Requests < a.thresholds.MinRequests || canary.Requests < a.thresholds.MinRequests {
+		judgment.Verdict = canaryInconclusive
+		judgment.Reasons = append(judgment.Reasons, fmt.Sprintf("need %d requests to each pool, have %d stable and %d canary",
+			a.thresholds.MinRequests, stable.Requests, canary.Requests))
+		return judgment
+	}
+
+	if judgment.ErrorRateDelta > a.thresholds.MaxErrorDelta {
+		judgment.Verdict = canaryFail
+		judgment.Reasons = append(judgment.Reasons, fmt.Sprintf("error rate %.2f%% against %.2f%% stable, over the allowed %.2f%% more",
+			canary.ErrorRate*100, stable.ErrorRate*100, a.thresholds.MaxErrorDelta*100))
+	}
+	if delta := canary.p95 - stable.p95; a.thresholds.MaxLatencyDelta > 0 && delta > a.thresholds.MaxLatencyDelta {
+		judgment.Verdict = canaryFail
+		judgment.Reasons = append(judgment.Reasons, fmt.Sprintf("p95 latency %s against %s stable, over the allowed %s more",
+			canary.p95, stable.p95, a.thresholds.MaxLatencyDelta))
+	}
+	return judgment
+}
+
+// Evaluate updates the comparative metrics of every canary. Run as a
+// scheduled job.
+func (a *CanaryAnalyzer) Evaluate(ctx context.Context) error {
+	now := time.Now()
+	minutes := int(a.thresholds.Window / time.Minute)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for pool, c := range a.canaries {
+		stable := c.stable.stats(now, minutes)
+		canary := c.canary.stats(now, minutes)
+
+		canaryErrorRateDelta.Set(canary.ErrorRate-stable.ErrorRate, pool)
+		canaryLatencyDelta.Set((canary.p50 - stable.p50).Seconds(), pool, "0.5")
+		canaryLatencyDelta.Set((canary.p95 - stable.p95).Seconds(), pool, "0.95")
+
+		switch a.judge(c, now).Verdict {
+		case canaryPass:
+			canaryVerdict.Set(1, pool)
+		case canaryFail:
+			canaryVerdict.Set(-1, pool)
+		default:
+			canaryVerdict.Set(0, pool)
+		}
+	}
+	return nil
+}
+
+// JudgmentsHandler serves the judgment of every canary as JSON
+func (a *CanaryAnalyzer) JudgmentsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		a.mu.Lock()
+		judgments := []CanaryJudgment{}
+		for _, c := range a.canaries {
+			judgments = append(judgments, a.judge(c, now))
+		}
+		a.mu.Unlock()
+
+		sort.Slice(judgments, func(i, j int) bool { return judgments[i].Pool < judgments[j].Pool })
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(judgments)
+	}
+}
+
+// JudgmentHandler serves the judgment of the canary of the {pool} path
+// value as JSON, for a deployment pipeline to poll. The status says the
+// verdict: 200 pass, 202 inconclusive, and 409 fail.
+func (a *CanaryAnalyzer) JudgmentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		c, ok := a.canaries[r.PathValue("pool")]
+		a.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		judgment := a.judge(c, time.Now())
+
+		status := http.StatusOK
+		switch judgment.Verdict {
+		case canaryInconclusive:
+			status = http.StatusAccepted
+		case canaryFail:
+			status = http.StatusConflict
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(judgment)
+	}
+}
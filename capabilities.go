@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capabilitiesTimeout bounds probing one endpoint for its capabilities
+const capabilitiesTimeout = 2 * time.Second
+
+var capabilityFallbacks = NewCounter(
+	"civil_gateway_capability_fallbacks_total",
+	"Requests needing a capability no endpoint in rotation has, sent to any endpoint instead",
+	"pool", "capability",
+)
+
+// endpointCapabilities is what a backend answers on its capabilities path:
+// the features it has that not every version of the renderer does, like
+// {"capabilities": ["webp", "mvt-2.1"]}
+type endpointCapabilities struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// requiredCapabilities are the capabilities a backend needs to serve r: the
+// format of the tile, from its extension, and the version of vector tiles
+// asked for in Accept, like mvt-2.1
+func requiredCapabilities(r *http.Request) []string {
+	var required []string
+
+	if ext := strings.TrimPrefix(path.Ext(r.URL.Path), "."); ext != "" {
+		required = append(required, strings.ToLower(ext))
+	}
+
+	for part := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil || mediaType != "application/vnd.mapbox-vector-tile" || params["version"] == "" {
+			continue
+		}
+		required = append(required, "mvt-"+params["version"])
+	}
+
+	return required
+}
+
+// probeCapabilities asks the endpoints not probed yet what they are capable
+// of. Endpoints that don't answer are asked again on the next discovery,
+// while those answering without a list of capabilities have none.
+func (bm *BackendManager) probeCapabilities(ctx context.Context, endpoints []string) {
+	bm.mu.RLock()
+	probePath := bm.capabilitiesPath
+	var unknown []string
+	for _, endpoint := range endpoints {
+		if _, ok := bm.capabilities[endpoint]; !ok {
+			unknown = append(unknown, endpoint)
+		}
+	}
+	bm.mu.RUnlock()
+
+	if probePath == "" || len(unknown) == 0 {
+		return
+	}
+
+	capabilities := make([][]string, len(unknown))
+	answered := make([]bool, len(unknown))
+	var wg sync.WaitGroup
+	for i, endpoint := range unknown {
+		wg.Go(func() {
+			capabilities[i], answered[i] = bm.probeEndpointCapabilities(ctx, endpoint+probePath)
+		})
+	}
+	wg.Wait()
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	for i, endpoint := range unknown {
+		if !answered[i] {
+			continue
+		}
+		bm.capabilities[endpoint] = capabilities[i]
+		if len(capabilities[i]) > 0 {
+			bm.logger.Info("endpoint has capabilities",
+				slog.String("endpoint", endpoint),
+				slog.Any("capabilities", capabilities[i]),
+			)
+		}
+	}
+}
+
+// probeEndpointCapabilities fetches the capabilities at url, reporting
+// whether the endpoint answered at all
+func (bm *BackendManager) probeEndpointCapabilities(ctx context.Context, url string) ([]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, capabilitiesTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("User-Agent", probeUserAgent())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		bm.logger.Debug("failed to probe endpoint capabilities", slog.String("url", url), slog.Any("error", err))
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, true
+	}
+
+	var answer endpointCapabilities
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&answer); err != nil {
+		bm.logger.Warn("endpoint answered with invalid capabilities", slog.String("url", url), slog.Any("error", err))
+		return nil, true
+	}
+
+	for i, capability := range answer.Capabilities {
+		answer.Capabilities[i] = strings.ToLower(capability)
+	}
+	return answer.Capabilities, true
+}
+
+// capable narrows endpoints down to those with the required capabilities.
+// Capabilities are opt-in: one no endpoint of the pool advertises, like
+// png, is taken to be had by all, so only requests for features some
+// versions lack are routed by them. If none of endpoints has a capability
+// the request needs, it goes to any of them rather than nowhere. Must be
+// called with mu held.
+func (bm *BackendManager) capable(endpoints, required []string) []string {
+	for _, capability := range required {
+		if !bm.advertised(capability) {
+			continue
+		}
+
+		var filtered []string
+		for _, endpoint := range endpoints {
+			if slices.Contains(bm.capabilities[endpoint], capability) {
+				filtered = append(filtered, endpoint)
+			}
+		}
+
+		if len(filtered) == 0 {
+			capabilityFallbacks.Inc(bm.pool, capability)
+			continue
+		}
+		endpoints = filtered
+	}
+
+	return endpoints
+}
+
+// advertised reports whether any endpoint of the pool has capability. Must
+// be called with mu held.
+func (bm *BackendManager) advertised(capability string) bool {
+	for _, capabilities := range bm.capabilities {
+		if slices.Contains(capabilities, capability) {
+			return true
+		}
+	}
+	return false
+}
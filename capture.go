@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const captureContextKey contextKey = "capture"
+
+// CaptureHeader flags a request for capture. Its value must be the capture
+// secret, and it is never passed upstream.
+const CaptureHeader = "X-Civil-Capture"
+
+// captureIDHeader tells the caller which capture to look up
+const captureIDHeader = "X-Civil-Capture-Id"
+
+// maxCaptures is how many captures are kept; the oldest is dropped first
+const maxCaptures = 100
+
+// headers that never end up in a capture
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", CaptureHeader}
+
+// Capture is everything the gateway saw of one flagged request
+type Capture struct {
+	ID              string      `json:"id"`
+	Start           time.Time   `json:"start"`
+	Duration        string      `json:"duration"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Client          string      `json:"client"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBytes   int64       `json:"response_bytes"`
+
+	// Filled in when the request was proxied
+	Backend          string      `json:"backend,omitempty"`
+	UpstreamURL      string      `json:"upstream_url,omitempty"`
+	UpstreamStatus   int         `json:"upstream_status,omitempty"`
+	UpstreamHeaders  http.Header `json:"upstream_headers,omitempty"`
+	UpstreamDuration string      `json:"upstream_duration,omitempty"`
+	UpstreamError    string      `json:"upstream_error,omitempty"`
+
+	mu sync.Mutex
+
+	// What the capture is accounted for in the memory pool
+	size int64
+}
+
+// CaptureStore keeps the most recent captures for /admin/captures
+type CaptureStore struct {
+	secret string
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	captures []*Capture
+
+	// When the pool is full, the oldest captures make room
+	memory *MemoryPool
+}
+
+func NewCaptureStore(secret string, logger *slog.Logger) *CaptureStore {
+	return &CaptureStore{
+		secret: secret,
+		logger: logger,
+	}
+}
+
+// SetMemoryPool accounts for the captures in pool. Set it before any are
+// taken.
+func (s *CaptureStore) SetMemoryPool(pool *MemoryPool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory = pool
+}
+
+func (s *CaptureStore) add(c *Capture) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.size = c.estimateSize()
+	for !s.memory.Reserve(c.size) {
+		if len(s.captures) == 0 {
+			s.logger.Warn("dropped capture larger than its memory pool", slog.String("capture_id", c.ID))
+			return
+		}
+		s.drop()
+	}
+
+	s.captures = append(s.captures, c)
+	for len(s.captures) > maxCaptures {
+		s.drop()
+	}
+}
+
+// drop forgets the oldest capture. Called with mu held.
+func (s *CaptureStore) drop() {
+	s.memory.Release(s.captures[0].size)
+	s.captures = slices.Delete(s.captures, 0, 1)
+}
+
+// estimateSize is roughly what the capture holds
+func (c *Capture) estimateSize() int64 {
+	size := int64(512 + len(c.URL) + len(c.UpstreamURL) + len(c.UpstreamError))
+	for _, h := range []http.Header{c.RequestHeaders, c.ResponseHeaders, c.UpstreamHeaders} {
+		for name, values := range h {
+			size += int64(len(name))
+			for _, value := range values {
+				size += int64(len(value)) + 16
+			}
+		}
+	}
+	return size
+}
+
+// Middleware captures requests that carry a valid capture header. Requests
+// with a wrong secret are served normally.
+func (s *CaptureStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get(CaptureHeader)
+		if presented == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.Header.Del(CaptureHeader)
+
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(s.secret)) != 1 {
+			s.logger.Warn("ignored capture request with an invalid secret", slog.String("path", r.URL.Path))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+
+		c := &Capture{
+			ID:             hex.EncodeToString(id),
+			Start:          time.Now(),
+			Method:         r.Method,
+			URL:            redactURL(r.URL),
+			Client:         clientAddr(r).String(),
+			RequestHeaders: redactHeaders(r.Header),
+		}
+
+		w.Header().Set(captureIDHeader, c.ID)
+
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), captureContextKey, c)))
+
+		c.mu.Lock()
+		c.Duration = time.Since(c.Start).String()
+		c.Status = recorder.status
+		c.ResponseHeaders = redactHeaders(w.Header())
+		c.ResponseBytes = recorder.bytes
+		c.mu.Unlock()
+
+		s.add(c)
+
+		s.logger.Info("captured flagged request", slog.String("capture_id", c.ID), slog.String("path", r.URL.Path))
+	})
+}
+
+// CapturesHandler lists the captures, newest first
+func (s *CaptureStore) CapturesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		captures := slices.Clone(s.captures)
+		s.mu.Unlock()
+
+		slices.Reverse(captures)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(captures)
+	}
+}
+
+// CaptureHandler serves the capture with the {id} path value
+func (s *CaptureStore) CaptureHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		s.mu.Lock()
+		i := slices.IndexFunc(s.captures, func(c *Capture) bool { return c.ID == id })
+		var c *Capture
+		if i >= 0 {
+			c = s.captures[i]
+		}
+		s.mu.Unlock()
+
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+func redactHeaders(h http.Header) http.Header {
+	clone := h.Clone()
+	for _, name := range redactedHeaders {
+		if clone.Get(name) != "" {
+			clone.Set(name, "[redacted]")
+		}
+	}
+	return clone
+}
+
+// redactURL is u with the signature of a signed URL redacted
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	if !query.Has(signedURLParam) {
+		return u.String()
+	}
+	query.Set(signedURLParam, "[redacted]")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// captureWriter records the status and size of the response
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// captureTransport fills in the upstream half of a capture
+type captureTransport struct {
+	next http.RoundTripper
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, ok := req.Context().Value(captureContextKey).(*Capture)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.UpstreamURL = req.URL.String()
+	c.UpstreamDuration = time.Since(start).String()
+	if endpoint, ok := endpointFromContext(req.Context()); ok {
+		c.Backend = endpoint
+	}
+
+	if err != nil {
+		c.UpstreamError = err.Error()
+		return nil, err
+	}
+
+	c.UpstreamStatus = resp.StatusCode
+	c.UpstreamHeaders = redactHeaders(resp.Header)
+
+	return resp, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+var cdnPurges = NewCounter(
+	"civil_gateway_cdn_purges_total",
+	"Purges requested through the admin API, by result",
+	"result",
+)
+
+// CDN tells the CDN in front of the gateway, CloudFront, how long it may
+// keep tile responses, and purges them from it on request
+type CDN struct {
+	sMaxAge        time.Duration
+	distributionID string
+	client         *cloudfront.Client
+	cache          *TileCache
+	layers         *Layers
+	logger         *slog.Logger
+}
+
+// NewCDN creates the CDN integration. Invalidations are only issued when a
+// distribution ID is given; the tile cache may be nil.
+func NewCDN(ctx context.Context, sMaxAge time.Duration, distributionID string, cache *TileCache, layers *Layers, logger *slog.Logger) (*CDN, error) {
+	cdn := &CDN{
+		sMaxAge:        sMaxAge,
+		distributionID: distributionID,
+		cache:          cache,
+		layers:         layers,
+		logger:         logger,
+	}
+
+	if distributionID != "" {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load SDK config: %v", err)
+		}
+		cdn.client = cloudfront.NewFromConfig(cfg)
+	}
+
+	return cdn, nil
+}
+
+// Middleware adds the CDN caching headers to tile responses. Surrogate-Key
+// names the layer so a whole layer can be purged from CDNs that support it.
+func (cdn *CDN) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []string{"tiles"}
+		if layer, ok := layerFromContext(r.Context()); ok {
+			keys = append(keys, "layer:"+layer.Name)
+		}
+
+		next.ServeHTTP(&cdnResponseWriter{ResponseWriter: w, cdn: cdn, keys: keys}, r)
+	})
+}
+
+// setHeaders runs just before the status is written, once the backend's
+// own headers are known
+func (cdn *CDN) setHeaders(h http.Header, status int, keys []string) {
+	h.Set("Surrogate-Key", strings.Join(keys, " "))
+
+	// Only what the tile cache would also keep is worth keeping at the edge,
+	// and never what the backend marked as private
+	cacheControl := h.Get("Cache-Control")
+	if cdn.sMaxAge <= 0 || !isCacheableStatus(status) || strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store") {
+		return
+	}
+
+	maxAge := strconv.Itoa(int(cdn.sMaxAge.Seconds()))
+	h.Set("Surrogate-Control", "max-age="+maxAge)
+
+	if !strings.Contains(cacheControl, "s-maxage") {
+		if cacheControl != "" {
+			cacheControl += ", "
+		}
+		h.Set("Cache-Control", cacheControl+"s-maxage="+maxAge)
+	}
+}
+
+type cdnResponseWriter struct {
+	http.ResponseWriter
+	cdn         *CDN
+	keys        []string
+	wroteHeader bool
+}
+
+func (w *cdnResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.cdn.setHeaders(w.Header(), status, w.keys)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cdnResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush
+func (w *cdnResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// PurgeRequest is the body of POST /admin/purge. Paths ending in * purge
+// everything under them, and a layer purges everything under its path.
+type PurgeRequest struct {
+	Paths []string `json:"paths"`
+	Layer string   `json:"layer"`
+}
+
+type PurgeResponse struct {
+	Paths          []string `json:"paths"`
+	CacheEntries   int      `json:"cache_entries"`
+	InvalidationID string   `json:"invalidation_id,omitempty"`
+}
+
+// Purge drops paths from the tile cache and invalidates them in CloudFront
+func (cdn *CDN) Purge(ctx context.Context, paths []string) (PurgeResponse, error) {
+	resp := PurgeResponse{Paths: paths}
+
+	if cdn.cache != nil {
+		for _, path := range paths {
+			purged, err := cdn.cache.Purge(ctx, path)
+			resp.CacheEntries += purged
+			if err != nil {
+				return resp, err
+			}
+		}
+	}
+
+	if cdn.client == nil {
+		return resp, nil
+	}
+
+	out, err := cdn.client.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(cdn.distributionID),
+		InvalidationBatch: &types.InvalidationBatch{
+			CallerReference: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10)),
+			Paths: &types.Paths{
+				Items:    paths,
+				Quantity: aws.Int32(int32(len(paths))),
+			},
+		},
+	})
+	if err != nil {
+		return resp, fmt.Errorf("failed to create CloudFront invalidation: %w", err)
+	}
+
+	resp.InvalidationID = aws.ToString(out.Invalidation.Id)
+
+	return resp, nil
+}
+
+// PurgeHandler serves POST /admin/purge
+func (cdn *CDN) PurgeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req PurgeRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		paths := req.Paths
+		if req.Layer != "" {
+			layer, ok := cdn.layers.Lookup(req.Layer)
+			if !ok {
+				http.Error(w, "Bad Request: unknown layer "+req.Layer, http.StatusBadRequest)
+				return
+			}
+			paths = append(paths, layer.Path+"*")
+		}
+
+		for _, path := range paths {
+			if !strings.HasPrefix(path, "/") {
+				http.Error(w, "Bad Request: paths must start with /", http.StatusBadRequest)
+				return
+			}
+		}
+		if len(paths) == 0 {
+			http.Error(w, "Bad Request: nothing to purge", http.StatusBadRequest)
+			return
+		}
+
+		resp, err := cdn.Purge(r.Context(), paths)
+		if err != nil {
+			cdnPurges.Inc("failed")
+			cdn.logger.Error("failed to purge", slog.Any("paths", paths), slog.Any("error", err))
+			http.Error(w, "Bad Gateway: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		cdnPurges.Inc("ok")
+		cdn.logger.Info("purged by operator",
+			slog.Any("paths", paths),
+			slog.Int("cache_entries", resp.CacheEntries),
+			slog.String("invalidation_id", resp.InvalidationID),
+		)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudFrontEncoding is base64 with the characters CloudFront can't take in
+// query strings and cookies swapped out: + for -, = for _, and / for ~
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+// CloudFrontSigner mints short-lived CloudFront signed cookies and URL
+// parameters, so CloudFront can serve cached tiles straight to users the
+// gateway has already authenticated. Each layer the user may see gets its
+// own policy, scoped to the layer's path, since a CloudFront policy can only
+// hold one statement.
+type CloudFrontSigner struct {
+	key          *rsa.PrivateKey
+	keyPairID    string
+	domain       string
+	cookieDomain string
+	ttl          time.Duration
+	layers       *Layers
+	logger       *slog.Logger
+}
+
+// NewCloudFrontSigner parses the PEM encoded RSA private key of the
+// CloudFront key pair. domain is the distribution's domain name.
+func NewCloudFrontSigner(privateKeyPEM []byte, keyPairID, domain, cookieDomain string, ttl time.Duration, layers *Layers, logger *slog.Logger) (*CloudFrontSigner, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block in CloudFront private key")
+	}
+
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CloudFront private key: %w", err)
+		}
+		key = parsed
+	default:
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CloudFront private key: %w", err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("CloudFront private key is not an RSA key")
+		}
+		key = rsaKey
+	}
+
+	return &CloudFrontSigner{
+		key:          key,
+		keyPairID:    keyPairID,
+		domain:       domain,
+		cookieDomain: cookieDomain,
+		ttl:          ttl,
+		layers:       layers,
+		logger:       logger,
+	}, nil
+}
+
+// cloudFrontPolicy is a CloudFront custom policy
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement `json:"Statement"`
+}
+
+type cloudFrontStatement struct {
+	Resource  string `json:"Resource"`
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		} `json:"DateLessThan"`
+	} `json:"Condition"`
+}
+
+// SignedLayer is what a client needs to fetch one layer through CloudFront
+type SignedLayer struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Query to append to the layer's tile URLs when cookies can't be used
+	Query string `json:"query"`
+
+	policy    string
+	signature string
+}
+
+// sign builds and signs the policy granting access to everything under path
+// until expires
+func (s *CloudFrontSigner) sign(path string, expires time.Time) (policy, signature string, err error) {
+	statement := cloudFrontStatement{Resource: "https://" + s.domain + path + "*"}
+	statement.Condition.DateLessThan.EpochTime = expires.Unix()
+
+	raw, err := json.Marshal(cloudFrontPolicy{Statement: []cloudFrontStatement{statement}})
+	if err != nil {
+		return "", "", err
+	}
+
+	digest := sha1.Sum(raw)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", "", err
+	}
+
+	return cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(raw)),
+		cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(sig)),
+		nil
+}
+
+// Sign mints credentials for each layer the claims allow. Without a layer
+// manifest, the credentials cover all of /tiles/.
+func (s *CloudFrontSigner) Sign(claims Claims, expires time.Time) ([]SignedLayer, error) {
+	var signed []SignedLayer
+
+	layers := s.layers.All()
+	if len(layers) == 0 {
+		layers = []*Layer{{Name: "tiles", Path: "/tiles/"}}
+	}
+
+	for _, layer := range layers {
+		if !layer.Allows(claims) {
+			continue
+		}
+
+		policy, signature, err := s.sign(layer.Path, expires)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign policy for layer %s: %w", layer.Name, err)
+		}
+
+		query := url.Values{}
+		query.Set("Policy", policy)
+		query.Set("Signature", signature)
+		query.Set("Key-Pair-Id", s.keyPairID)
+
+		signed = append(signed, SignedLayer{
+			Name:      layer.Name,
+			Path:      layer.Path,
+			Query:     query.Encode(),
+			policy:    policy,
+			signature: signature,
+		})
+	}
+
+	return signed, nil
+}
+
+// Handler serves POST /cdn/credentials behind RequireAuth. It sets one set
+// of CloudFront cookies per layer, scoped to the layer's path, and returns
+// the same credentials as URL parameters.
+func (s *CloudFrontSigner) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "")
+			return
+		}
+
+		claims, ok := r.Context().Value(userContextKey).(Claims)
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, "missing_claims", "")
+			return
+		}
+
+		expires := time.Now().Add(s.ttl)
+
+		signed, err := s.Sign(claims, expires)
+		if err != nil {
+			s.logger.Error("failed to mint CloudFront credentials", slog.Any("error", err))
+			writeError(w, r, http.StatusInternalServerError, "cdn_credentials_failed", "")
+			return
+		}
+		if signed == nil {
+			signed = []SignedLayer{}
+		}
+
+		for _, layer := range signed {
+			for name, value := range map[string]string{
+				"CloudFront-Policy":      layer.policy,
+				"CloudFront-Signature":   layer.signature,
+				"CloudFront-Key-Pair-Id": s.keyPairID,
+			} {
+				http.SetCookie(w, &http.Cookie{
+					Name:     name,
+					Value:    value,
+					Path:     layer.Path,
+					Domain:   s.cookieDomain,
+					Expires:  expires,
+					Secure:   true,
+					HttpOnly: true,
+					SameSite: http.SameSiteNoneMode,
+				})
+			}
+		}
+
+		s.logger.Debug("minted CloudFront credentials", slog.String("subject", claims.Subject), slog.Int("layers", len(signed)))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Domain  string        `json:"domain"`
+			Expires time.Time     `json:"expires"`
+			Layers  []SignedLayer `json:"layers"`
+		}{
+			Domain:  s.domain,
+			Expires: expires,
+			Layers:  signed,
+		})
+	}
+}
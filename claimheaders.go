@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// claimHeaderPrefix marks the headers backends can trust to carry the
+// caller's verified claims. Clients can never send them.
+const claimHeaderPrefix = "X-Auth-"
+
+// defaultClaimHeaders tells backends who is asking, for per-user styling
+// and audit
+var defaultClaimHeaders = map[string]string{
+	"sub":    "X-Auth-Subject",
+	"email":  "X-Auth-Email",
+	"groups": "X-Auth-Groups",
+}
+
+// claimValues are the claims that can be forwarded, by claim name
+var claimValues = map[string]func(Claims) string{
+	"sub":                func(c Claims) string { return c.Subject },
+	"email":              func(c Claims) string { return c.Email },
+	"email_verified":     func(c Claims) string { return strconv.FormatBool(c.EmailVerified) },
+	"preferred_username": func(c Claims) string { return c.PreferredUsername },
+	"groups":             func(c Claims) string { return strings.Join(c.Groups, ",") },
+}
+
+// ClaimHeaders forwards the verified claims of the caller to backends, as
+// the headers they are mapped to. Every X-Auth-* header, and every header a
+// claim is mapped to, is stripped from what the client sent first, so a
+// backend seeing one knows it came from the gateway. A backend that answers
+// each caller differently must say so with Vary, like Vary: X-Auth-Subject,
+// or the cache and coalescer share its response with everyone.
+type ClaimHeaders struct {
+	headers map[string]string
+}
+
+// NewClaimHeaders maps claims, by name, to the headers they are forwarded
+// in, like {"sub": "X-Auth-Subject"}
+func NewClaimHeaders(mapping map[string]string) (ClaimHeaders, error) {
+	headers := map[string]string{}
+	for claim, header := range mapping {
+		if _, ok := claimValues[claim]; !ok {
+			return ClaimHeaders{}, fmt.Errorf("claim %q can't be forwarded, expected one of sub, email, email_verified, preferred_username, or groups", claim)
+		}
+		if header == "" || strings.ContainsAny(header, " :\r\n") {
+			return ClaimHeaders{}, fmt.Errorf("invalid header %q for claim %s", header, claim)
+		}
+		headers[claim] = textproto.CanonicalMIMEHeaderKey(header)
+	}
+	return ClaimHeaders{headers: headers}, nil
+}
+
+// apply strips the claim headers the client sent and sets them from the
+// claims RequireAuth verified, if it did
+func (c ClaimHeaders) apply(req *http.Request) {
+	for name := range req.Header {
+		if strings.HasPrefix(name, claimHeaderPrefix) {
+			req.Header.Del(name)
+		}
+	}
+	for _, header := range c.headers {
+		req.Header.Del(header)
+	}
+
+	claims, ok := req.Context().Value(userContextKey).(Claims)
+	if !ok {
+		return
+	}
+	for claim, header := range c.headers {
+		// Values that can't be sent in a header are left out rather
+		// than failing the request
+		if value := claimValues[claim](claims); value != "" && !strings.ContainsAny(value, "\r\n\x00") {
+			req.Header.Set(header, value)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// credentialRebuildThreshold is how many consecutive credential failures are
+// tolerated before the discovery client is rebuilt from a fresh SDK config
+const credentialRebuildThreshold = 3
+
+// discoverMaxResults is the most instances DiscoverInstances answers with
+const discoverMaxResults = 1000
+
+// weightAttribute is the Cloud Map custom attribute instances are weighted
+// by, between 1 and maxEndpointWeight
+const (
+	weightAttribute   = "WEIGHT"
+	maxEndpointWeight = 1000
+)
+
+// maxInstanceAttributeBytes bounds the attributes of an instance, keys and
+// values together. Real registrations take a few hundred bytes, so more is
+// something other than a backend registering itself.
+const maxInstanceAttributeBytes = 8 << 10
+
+// Why an instance was skipped, as the reason label of
+// civil_gateway_discovery_skipped_instances_total
+const (
+	skipOversizedAttributes = "oversized_attributes"
+	skipMissingIPv4         = "missing_ipv4"
+	skipInvalidIPv4         = "invalid_ipv4"
+	skipMissingIPv6         = "missing_ipv6"
+	skipInvalidIPv6         = "invalid_ipv6"
+	skipMissingPort         = "missing_port"
+	skipInvalidPort         = "invalid_port"
+	skipDuplicate           = "duplicate"
+)
+
+var discoverySkipped = NewCounter(
+	"civil_gateway_discovery_skipped_instances_total",
+	"Cloud Map instances left out of the pool because their registration is malformed, by reason",
+	"pool", "reason",
+)
+
+var discoveryClientRebuilds = NewCounter(
+	"civil_gateway_discovery_client_rebuilds_total",
+	"Discovery clients rebuilt after repeated credential failures",
+	"pool",
+)
+
+// discoveryAPI is the part of the Cloud Map client discovery uses
+type discoveryAPI interface {
+	DiscoverInstances(ctx context.Context, params *servicediscovery.DiscoverInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.DiscoverInstancesOutput, error)
+	ListNamespaces(ctx context.Context, params *servicediscovery.ListNamespacesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListNamespacesOutput, error)
+	ListServices(ctx context.Context, params *servicediscovery.ListServicesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListServicesOutput, error)
+	ListInstances(ctx context.Context, params *servicediscovery.ListInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListInstancesOutput, error)
+	GetInstancesHealthStatus(ctx context.Context, params *servicediscovery.GetInstancesHealthStatusInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.GetInstancesHealthStatusOutput, error)
+}
+
+// discoveryClientFactory builds a discovery client along with the
+// credentials provider it signs with
+type discoveryClientFactory func(ctx context.Context) (discoveryAPI, aws.CredentialsProvider, error)
+
+// cloudMapDiscoverer finds the healthy instances of a Cloud Map service
+type cloudMapDiscoverer struct {
+	pool        string
+	namespace   string
+	serviceName string
+	family      string
+	defaultPort int
+	newClient   discoveryClientFactory
+	logger      *slog.Logger
+
+	mu          sync.RWMutex
+	client      discoveryAPI
+	credentials aws.CredentialsProvider
+	service     cloudMapService
+
+	// Why each instance skipped in the last poll was, so it is only
+	// logged when first skipped
+	skipped map[string]string
+}
+
+// newCloudMapDiscoverer builds the client. When the pool has a role ARN,
+// instances are discovered with credentials from assuming that role, so the
+// namespace can live in another AWS account.
+func newCloudMapDiscoverer(ctx context.Context, pc PoolConfig, logger *slog.Logger) (*cloudMapDiscoverer, error) {
+	newClient := func(ctx context.Context) (discoveryAPI, aws.CredentialsProvider, error) {
+		return newDiscoveryClient(ctx, pc.RoleArn, pc.ExternalID)
+	}
+
+	return newCloudMapDiscovererWithClient(ctx, pc, newClient, logger)
+}
+
+// newCloudMapDiscovererWithClient discovers through any client, which lets
+// the discovery simulation swap in a fake
+func newCloudMapDiscovererWithClient(ctx context.Context, pc PoolConfig, newClient discoveryClientFactory, logger *slog.Logger) (*cloudMapDiscoverer, error) {
+	client, credentials, err := newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudMapDiscoverer{
+		pool:        pc.Name,
+		namespace:   pc.Namespace,
+		serviceName: pc.Service,
+		family:      pc.AddressFamily,
+		defaultPort: pc.Port,
+		newClient:   newClient,
+		logger:      logger,
+		client:      client,
+		credentials: credentials,
+	}, nil
+}
+
+// newDiscoveryClient loads the SDK config from scratch, so it also serves to
+// rebuild a client whose credential chain has gone bad
+func newDiscoveryClient(ctx context.Context, roleArn, externalID string) (discoveryAPI, aws.CredentialsProvider, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+
+	if roleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "civil-gateway-discovery"
+			if externalID != "" {
+				o.ExternalID = aws.String(externalID)
+			}
+		})
+
+		// The cache refreshes the assumed credentials shortly before they expire
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return servicediscovery.NewFromConfig(cfg), cfg.Credentials, nil
+}
+
+// Discover finds the healthy instances of the service. Cloud Map stores
+// their addresses, and weight and zone if set, in their attributes.
+// Instances registering no port get the pool's port, if it has one.
+func (d *cloudMapDiscoverer) Discover(ctx context.Context, limits discoveryLimits) ([]DiscoveredInstance, error) {
+	d.mu.RLock()
+	client := d.client
+	d.mu.RUnlock()
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("cloudmap.namespace", d.namespace),
+		attribute.String("cloudmap.service", d.serviceName),
+	)
+
+	summaries, err := d.discoverInstances(ctx, client, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []DiscoveredInstance
+	seen := map[string]bool{}
+	skipped := map[string]string{}
+	for _, inst := range summaries {
+		addr, reason := instanceAddress(inst.Attributes, d.family, d.defaultPort)
+		if reason == "" && seen[addr] {
+			reason = skipDuplicate
+		}
+		if reason != "" {
+			d.skip(inst, reason, skipped)
+			continue
+		}
+
+		seen[addr] = true
+		instances = append(instances, DiscoveredInstance{
+			Address: addr,
+			Weight:  d.instanceWeight(inst),
+			Zone:    inst.Attributes[zoneAttribute],
+		})
+	}
+
+	d.mu.Lock()
+	d.skipped = skipped
+	d.mu.Unlock()
+
+	return instances, nil
+}
+
+// instanceAddress is the host:port an instance registered, in the address
+// family asked for, or why its registration can't be routed to: attributes
+// too big to be real, a missing or malformed AWS_INSTANCE_IPV4 or
+// AWS_INSTANCE_IPV6, or a missing or out of range AWS_INSTANCE_PORT.
+// defaultPort, when set, stands in for a missing port.
+func instanceAddress(attributes map[string]string, family string, defaultPort int) (string, string) {
+	size := 0
+	for key, value := range attributes {
+		size += len(key) + len(value)
+	}
+	if size > maxInstanceAttributeBytes {
+		return "", skipOversizedAttributes
+	}
+
+	ipv4, ipv6 := attributes["AWS_INSTANCE_IPV4"], attributes["AWS_INSTANCE_IPV6"]
+	if family == addressFamilyPreferV6 {
+		family = addressFamilyV4
+		if ipv6 != "" {
+			family = addressFamilyV6
+		}
+	}
+
+	var addr netip.Addr
+	if family == addressFamilyV6 {
+		if ipv6 == "" {
+			return "", skipMissingIPv6
+		}
+		parsed, err := netip.ParseAddr(ipv6)
+		if err != nil || !parsed.Is6() || parsed.Is4In6() || parsed.Zone() != "" {
+			return "", skipInvalidIPv6
+		}
+		addr = parsed
+	} else {
+		if ipv4 == "" {
+			return "", skipMissingIPv4
+		}
+		parsed, err := netip.ParseAddr(ipv4)
+		if err != nil || !parsed.Is4() {
+			return "", skipInvalidIPv4
+		}
+		addr = parsed
+	}
+
+	port := attributes["AWS_INSTANCE_PORT"]
+	if port == "" {
+		if defaultPort == 0 {
+			return "", skipMissingPort
+		}
+		port = strconv.Itoa(defaultPort)
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return "", skipInvalidPort
+	}
+
+	return netip.AddrPortFrom(addr, uint16(number)).String(), ""
+}
+
+// skip counts an instance left out of the pool, and logs it unless it was
+// already skipped for the same reason last poll
+func (d *cloudMapDiscoverer) skip(inst types.HttpInstanceSummary, reason string, skipped map[string]string) {
+	id := aws.ToString(inst.InstanceId)
+	skipped[id] = reason
+	discoverySkipped.Inc(d.pool, reason)
+
+	d.mu.RLock()
+	known := d.skipped[id] == reason
+	d.mu.RUnlock()
+	if known {
+		return
+	}
+
+	// Values are cut short, as they may be the oversized ones
+	truncate := func(value string) string {
+		if len(value) > 64 {
+			return value[:64] + "..."
+		}
+		return value
+	}
+	d.logger.Warn("skipped a malformed Cloud Map instance",
+		slog.String("instance", id),
+		slog.String("reason", reason),
+		slog.String("ipv4", truncate(inst.Attributes["AWS_INSTANCE_IPV4"])),
+		slog.String("ipv6", truncate(inst.Attributes["AWS_INSTANCE_IPV6"])),
+		slog.String("port", truncate(inst.Attributes["AWS_INSTANCE_PORT"])),
+		slog.Int("attributes", len(inst.Attributes)),
+	)
+}
+
+// instanceWeight is the WEIGHT attribute the instance was registered with,
+// which sizes its share of the traffic relative to the rest of the pool, like
+// 4 for a c7g.2xlarge next to c7g.large instances left at the default of 1
+func (d *cloudMapDiscoverer) instanceWeight(inst types.HttpInstanceSummary) int {
+	value, ok := inst.Attributes[weightAttribute]
+	if !ok {
+		return 1
+	}
+
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 || weight > maxEndpointWeight {
+		d.logger.Warn("ignoring invalid instance weight",
+			slog.String("instance", aws.ToString(inst.InstanceId)),
+			slog.String("weight", value),
+		)
+		return 1
+	}
+	return weight
+}
+
+// recoverCredentials drops cached credentials so the next call fetches new
+// ones, and rebuilds the whole client once that alone hasn't helped
+func (d *cloudMapDiscoverer) recoverCredentials(ctx context.Context, failures int) {
+	d.mu.RLock()
+	credentials := d.credentials
+	d.mu.RUnlock()
+
+	if cache, ok := credentials.(*aws.CredentialsCache); ok {
+		cache.Invalidate()
+	}
+
+	if failures%credentialRebuildThreshold != 0 {
+		return
+	}
+
+	client, credentials, err := d.newClient(ctx)
+	if err != nil {
+		d.logger.Error("failed to rebuild discovery client", slog.Any("error", err))
+		return
+	}
+
+	d.mu.Lock()
+	d.client = client
+	d.credentials = credentials
+	d.mu.Unlock()
+
+	discoveryClientRebuilds.Inc(d.pool)
+
+	d.logger.Warn("rebuilt discovery client after repeated credential failures", slog.Int("consecutive_failures", failures))
+}
+
+// cloudMapService is a service's ID, which listing takes in place of the
+// names DiscoverInstances goes by, and whether it reports health at all
+type cloudMapService struct {
+	id            string
+	healthChecked bool
+}
+
+// discoverInstances finds the healthy instances of the service, up to the
+// pool's cap. It takes one DiscoverInstances call unless that comes back
+// full, as there may then be more than it could answer with.
+func (d *cloudMapDiscoverer) discoverInstances(ctx context.Context, client discoveryAPI, limits discoveryLimits) ([]types.HttpInstanceSummary, error) {
+	limit := min(limits.maxInstances, discoverMaxResults)
+	output, err := client.DiscoverInstances(ctx, &servicediscovery.DiscoverInstancesInput{
+		NamespaceName: aws.String(d.namespace),
+		ServiceName:   aws.String(d.serviceName),
+		HealthStatus:  types.HealthStatusFilterHealthy, // Only get healthy instances
+		MaxResults:    aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	instances := output.Instances
+	if len(instances) >= limit && limits.maxInstances > limit {
+		return d.listInstances(ctx, client, limits)
+	}
+
+	return instances, nil
+}
+
+// listInstances pages through every instance of the service and keeps the
+// healthy ones, up to the pool's cap. It takes a call per page for the
+// instances and another for their health, so it is only for services too
+// big for DiscoverInstances.
+func (d *cloudMapDiscoverer) listInstances(ctx context.Context, client discoveryAPI, limits discoveryLimits) ([]types.HttpInstanceSummary, error) {
+	pageSize := aws.Int32(int32(limits.pageSize))
+
+	service, err := d.resolveService(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// Instances are healthy unless reported otherwise, like those of
+	// services without health checks are to DiscoverInstances
+	health := map[string]types.HealthStatus{}
+	if service.healthChecked {
+		pages := servicediscovery.NewGetInstancesHealthStatusPaginator(client, &servicediscovery.GetInstancesHealthStatusInput{
+			ServiceId:  aws.String(service.id),
+			MaxResults: pageSize,
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			maps.Copy(health, page.Status)
+		}
+	}
+
+	var instances []types.HttpInstanceSummary
+	pages := servicediscovery.NewListInstancesPaginator(client, &servicediscovery.ListInstancesInput{
+		ServiceId:  aws.String(service.id),
+		MaxResults: pageSize,
+	})
+	for pages.HasMorePages() && len(instances) < limits.maxInstances {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, instance := range page.Instances {
+			if health[aws.ToString(instance.Id)] == types.HealthStatusUnhealthy {
+				continue
+			}
+			instances = append(instances, types.HttpInstanceSummary{
+				InstanceId:    instance.Id,
+				NamespaceName: aws.String(d.namespace),
+				ServiceName:   aws.String(d.serviceName),
+				Attributes:    instance.Attributes,
+			})
+			if len(instances) == limits.maxInstances {
+				break
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// resolveService looks up the service by the names the pool is configured
+// with, once, as IDs don't change
+func (d *cloudMapDiscoverer) resolveService(ctx context.Context, client discoveryAPI) (cloudMapService, error) {
+	d.mu.RLock()
+	service := d.service
+	d.mu.RUnlock()
+	if service.id != "" {
+		return service, nil
+	}
+
+	// DiscoverInstances takes the namespace's HTTP name
+	namespaces, err := client.ListNamespaces(ctx, &servicediscovery.ListNamespacesInput{
+		Filters: []types.NamespaceFilter{{
+			Name:      types.NamespaceFilterNameHttpName,
+			Values:    []string{d.namespace},
+			Condition: types.FilterConditionEq,
+		}},
+	})
+	if err != nil {
+		return service, err
+	}
+	if len(namespaces.Namespaces) == 0 {
+		return service, fmt.Errorf("namespace %q not found", d.namespace)
+	}
+
+	pages := servicediscovery.NewListServicesPaginator(client, &servicediscovery.ListServicesInput{
+		Filters: []types.ServiceFilter{{
+			Name:      types.ServiceFilterNameNamespaceId,
+			Values:    []string{aws.ToString(namespaces.Namespaces[0].Id)},
+			Condition: types.FilterConditionEq,
+		}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return service, err
+		}
+
+		for _, summary := range page.Services {
+			if aws.ToString(summary.Name) != d.serviceName {
+				continue
+			}
+
+			service = cloudMapService{
+				id:            aws.ToString(summary.Id),
+				healthChecked: summary.HealthCheckConfig != nil || summary.HealthCheckCustomConfig != nil,
+			}
+			d.mu.Lock()
+			d.service = service
+			d.mu.Unlock()
+			return service, nil
+		}
+	}
+
+	return service, fmt.Errorf("service %q not found in namespace %q", d.serviceName, d.namespace)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// CloudWatchPublisher periodically exports the pool saturation figures as
+// CloudWatch custom metrics, so the tile-server ASG can scale on what the
+// gateway observes rather than on backend CPU
+type CloudWatchPublisher struct {
+	client         *cloudwatch.Client
+	namespace      string
+	pool           string
+	tracker        *SaturationTracker
+	backends       func() int
+	targetInFlight float64
+	targetP95      time.Duration
+	logger         *slog.Logger
+}
+
+// NewCloudWatchPublisher initializes the AWS client
+func NewCloudWatchPublisher(ctx context.Context, namespace, pool string, tracker *SaturationTracker, backends func() int, targetInFlight float64, targetP95 time.Duration, logger *slog.Logger) (*CloudWatchPublisher, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+
+	return &CloudWatchPublisher{
+		client:         cloudwatch.NewFromConfig(cfg),
+		namespace:      namespace,
+		pool:           pool,
+		tracker:        tracker,
+		backends:       backends,
+		targetInFlight: targetInFlight,
+		targetP95:      targetP95,
+		logger:         logger,
+	}, nil
+}
+
+func (p *CloudWatchPublisher) publish(ctx context.Context) error {
+	snap := p.tracker.Snapshot(p.backends())
+	now := time.Now()
+
+	dimensions := []types.Dimension{
+		{Name: aws.String("Pool"), Value: aws.String(p.pool)},
+	}
+
+	datum := func(name string, value float64, unit types.StandardUnit) types.MetricDatum {
+		return types.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(value),
+			Unit:       unit,
+		}
+	}
+
+	_, err := p.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(p.namespace),
+		MetricData: []types.MetricDatum{
+			datum("PoolSaturation", snap.Score(p.targetInFlight, p.targetP95), types.StandardUnitPercent),
+			datum("InFlightPerBackend", snap.InFlightPerBackend, types.StandardUnitCount),
+			datum("QueueDepth", float64(snap.QueueDepth), types.StandardUnitCount),
+			datum("UpstreamLatencyP95", float64(snap.P95Latency.Milliseconds()), types.StandardUnitMilliseconds),
+			datum("HealthyBackends", float64(snap.Backends), types.StandardUnitCount),
+		},
+	})
+	if err != nil {
+		p.logger.Error("failed to publish saturation metrics to CloudWatch", slog.String("pool", p.pool), slog.Any("error", err))
+		return err
+	}
+
+	p.logger.Debug("published saturation metrics",
+		slog.String("pool", p.pool),
+		slog.Int("backends", snap.Backends),
+		slog.Float64("in_flight_per_backend", snap.InFlightPerBackend),
+		slog.Int64("queue_depth", snap.QueueDepth),
+		slog.Duration("p95_latency", snap.P95Latency),
+	)
+
+	return nil
+}
+
+// startCloudWatchPublisher starts exporting a pool's saturation when a
+// CloudWatch namespace is configured
+func startCloudWatchPublisher(ctx context.Context, scheduler *Scheduler, cfg *Config, pool string, tracker *SaturationTracker, backends func() int, logger *slog.Logger) {
+	if cfg.CloudWatchNamespace == "" {
+		return
+	}
+
+	publisher, err := NewCloudWatchPublisher(
+		ctx,
+		cfg.CloudWatchNamespace,
+		pool,
+		tracker,
+		backends,
+		cfg.SaturationTargetInFlight,
+		cfg.SaturationTargetP95,
+		logger,
+	)
+	if err != nil {
+		logger.Error("failed to create CloudWatch publisher", slog.String("pool", pool), slog.Any("error", err))
+		return
+	}
+
+	scheduler.Add("cloudwatch:"+pool, cfg.CloudWatchInterval, publisher.publish)
+}
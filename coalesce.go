@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+var coalescedRequests = NewCounter(
+	"civil_gateway_coalesced_requests_total",
+	"Coalesced GETs, by whether they went upstream for others to share, were served a shared response, or went upstream alone after all",
+	"result",
+)
+
+// Coalescer shares one upstream request between concurrent identical GETs.
+// When a popular tile expires, the first request for it goes upstream and
+// those arriving while it is in flight wait for its response rather than
+// each asking the backends for the same tile. Responses over maxBytes, or
+// that set cookies, aren't shared, and whoever was waiting on them goes
+// upstream after all.
+type Coalescer struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an upstream request in flight. Once done is closed, ok
+// says whether the response was recorded for the waiters.
+type coalescedCall struct {
+	done   chan struct{}
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+func NewCoalescer(maxBytes int64) *Coalescer {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxCacheEntryBytes
+	}
+
+	return &Coalescer{
+		maxBytes: maxBytes,
+		calls:    map[string]*coalescedCall{},
+	}
+}
+
+// coalesceKey is what makes two requests identical: the tile, as the cache
+// keys it, and the headers the response is negotiated on
+func coalesceKey(r *http.Request) string {
+	return cacheKey(r) + "\x00" + r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+// Middleware coalesces the GETs passed through to next. Range requests and
+// dry runs are always sent on their own.
+func (c *Coalescer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Header.Get("Range") != "" || isDryRun(r.Context()) || isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := coalesceKey(r)
+
+		c.mu.Lock()
+		call, inFlight := c.calls[key]
+		if !inFlight {
+			call = &coalescedCall{done: make(chan struct{})}
+			c.calls[key] = call
+		}
+		c.mu.Unlock()
+
+		if inFlight {
+			c.wait(w, r, call, next)
+			return
+		}
+
+		coalescedRequests.Inc("upstream")
+		recorder := &coalesceRecorder{ResponseWriter: w, header: http.Header{}, status: http.StatusOK, limit: c.maxBytes}
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+
+			// A response varying on the caller, like on their forwarded
+			// claims, is theirs alone
+			if !recorder.overflow && recorder.header.Get("Set-Cookie") == "" && variesOnlyCacheably(recorder.header) && r.Context().Err() == nil {
+				call.ok = true
+				call.status = recorder.status
+				call.header = recorder.header
+				call.body = recorder.body.Bytes()
+			}
+			close(call.done)
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// wait serves the response of the request already in flight, or sends r
+// upstream itself if that response can't be shared
+func (c *Coalescer) wait(w http.ResponseWriter, r *http.Request, call *coalescedCall, next http.Handler) {
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if !call.ok {
+		coalescedRequests.Inc("alone")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	coalescedRequests.Inc("shared")
+	for name, values := range call.header {
+		if !isUncachedHeader(name) {
+			w.Header()[name] = slices.Clone(values)
+		}
+	}
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+}
+
+// coalesceRecorder passes a response on while keeping a copy for the
+// requests waiting on it. Handlers further down get a header map of their
+// own, so only the headers of the response itself are shared, not those
+// set on the way in for the request that went upstream.
+type coalesceRecorder struct {
+	http.ResponseWriter
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	limit       int64
+	overflow    bool
+}
+
+func (rec *coalesceRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *coalesceRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.status = status
+	rec.wroteHeader = true
+
+	for name, values := range rec.header {
+		rec.ResponseWriter.Header()[name] = slices.Clone(values)
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *coalesceRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.limit {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *coalesceRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *coalesceRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+var upstreamDecompressions = NewCounter(
+	"civil_gateway_upstream_decompressions_total",
+	"Gzipped upstream responses decompressed for clients that don't accept gzip",
+)
+
+// upstreamGzipTransport asks backends for gzip whatever the client sent, so
+// gateway to backend traffic is compressed even for clients that can't take
+// it, and decompresses the response for those clients
+type upstreamGzipTransport struct {
+	next http.RoundTripper
+}
+
+func (t *upstreamGzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clientGzip := acceptsEncoding(req.Header.Get("Accept-Encoding"), "gzip")
+
+	out := req.Clone(req.Context())
+	out.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil || clientGzip || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp, err
+	}
+
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+
+	upstreamDecompressions.Inc()
+
+	resp.Body = &gunzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return resp, nil
+}
+
+// gunzipBody decompresses a gzipped body, reading the gzip header on the
+// first Read rather than when the response is returned
+type gunzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *gunzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gunzipBody) Close() error {
+	return b.body.Close()
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows coding,
+// by name or through *, with a q-value above 0
+func acceptsEncoding(header, coding string) bool {
+	accepted := false
+	for part := range strings.SplitSeq(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		switch {
+		case strings.EqualFold(name, coding):
+			// An explicit entry beats *
+			return q > 0
+		case name == "*":
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
+
+// gunzipEntry is a cached gzipped entry decompressed for a client that
+// doesn't accept gzip. Reports false if the body isn't valid gzip.
+func gunzipEntry(entry *CacheEntry) (*CacheEntry, bool) {
+	zr, err := gzip.NewReader(bytes.NewReader(entry.Body))
+	if err != nil {
+		return nil, false
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, false
+	}
+
+	header := entry.Header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	header.Del("ETag")
+
+	return &CacheEntry{
+		Key:     entry.Key,
+		Status:  entry.Status,
+		Header:  header,
+		Body:    body,
+		Stored:  entry.Stored,
+		Expires: entry.Expires,
+	}, true
+}
+
+var compressedResponses = NewCounter(
+	"civil_gateway_compressed_responses_total",
+	"Responses compressed by the gateway, by encoding",
+	"encoding",
+)
+
+// compressibleTypes are the media types worth compressing. Image tiles are
+// already compressed, so compressing them again only costs CPU.
+var compressibleTypes = []string{
+	"application/vnd.mapbox-vector-tile",
+	"application/x-protobuf",
+	"application/json",
+	"application/geo+json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// CompressionConfig sets how hard responses are compressed. Levels are
+// those of compress/gzip, 1 to 9, and brotli, 0 to 11. Responses shorter
+// than MinBytes aren't worth the trouble.
+type CompressionConfig struct {
+	GzipLevel   int
+	BrotliLevel int
+	MinBytes    int64
+}
+
+// Compressor compresses responses the backends sent uncompressed, with
+// brotli or gzip as the client accepts
+type Compressor struct {
+	config CompressionConfig
+	gzip   sync.Pool
+	brotli sync.Pool
+}
+
+func NewCompressor(config CompressionConfig) (*Compressor, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, config.GzipLevel); err != nil {
+		return nil, fmt.Errorf("invalid gzip level %d", config.GzipLevel)
+	}
+	if config.BrotliLevel < brotli.BestSpeed || config.BrotliLevel > brotli.BestCompression {
+		return nil, fmt.Errorf("invalid brotli level %d", config.BrotliLevel)
+	}
+
+	c := &Compressor{config: config}
+	c.gzip.New = func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, config.GzipLevel)
+		return zw
+	}
+	c.brotli.New = func() any {
+		return brotli.NewWriterLevel(io.Discard, config.BrotliLevel)
+	}
+	return c, nil
+}
+
+// Middleware compresses responses for clients that accept it. WebSocket
+// upgrades are passed through untouched.
+func (c *Compressor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Brotli compresses tiles better, so it wins when both are accepted
+		accept := r.Header.Get("Accept-Encoding")
+		encoding := ""
+		switch {
+		case acceptsEncoding(accept, "br"):
+			encoding = "br"
+		case acceptsEncoding(accept, "gzip"):
+			encoding = "gzip"
+		}
+
+		// Compressed responses carry weakened ETags, and If-None-Match
+		// compares tags weakly anyway
+		if values := r.Header.Values("If-None-Match"); len(values) > 0 {
+			r.Header.Del("If-None-Match")
+			for _, value := range values {
+				r.Header.Add("If-None-Match", strings.ReplaceAll(value, "W/", ""))
+			}
+		}
+
+		cw := &compressWriter{ResponseWriter: w, compressor: c, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressible reports whether a response with header h and status is
+// worth compressing
+func (c *Compressor) compressible(h http.Header, status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && length < c.config.MinBytes {
+		return false
+	}
+	return compressibleType(h.Get("Content-Type"))
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return strings.HasPrefix(mediaType, "text/") || slices.Contains(compressibleTypes, mediaType) || strings.HasSuffix(mediaType, "+json")
+}
+
+// compressWriter decides whether to compress when the response headers are
+// written, and then compresses everything written after
+type compressWriter struct {
+	http.ResponseWriter
+	compressor  *Compressor
+	encoding    string
+	wroteHeader bool
+	zw          io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if status >= http.StatusContinue && status < http.StatusOK {
+		// Informational responses come before the real one
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if compressibleType(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if w.encoding != "" && w.compressor.compressible(h, status) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		switch w.encoding {
+		case "br":
+			bw := w.compressor.brotli.Get().(*brotli.Writer)
+			bw.Reset(w.ResponseWriter)
+			w.zw = bw
+		case "gzip":
+			zw := w.compressor.gzip.Get().(*gzip.Writer)
+			zw.Reset(w.ResponseWriter)
+			w.zw = zw
+		}
+		compressedResponses.Inc(w.encoding)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been compressed so far, for streamed responses
+func (w *compressWriter) Flush() {
+	if w.zw != nil {
+		switch zw := w.zw.(type) {
+		case *gzip.Writer:
+			zw.Flush()
+		case *brotli.Writer:
+			zw.Flush()
+		}
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finishes the compressed stream and returns the writer to its pool
+func (w *compressWriter) close() {
+	if w.zw == nil {
+		return
+	}
+	w.zw.Close()
+
+	switch zw := w.zw.(type) {
+	case *gzip.Writer:
+		zw.Reset(io.Discard)
+		w.compressor.gzip.Put(zw)
+	case *brotli.Writer:
+		zw.Reset(io.Discard)
+		w.compressor.brotli.Put(zw)
+	}
+}
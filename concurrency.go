@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveWindow is how long each latency window lasts. The baseline is
+	// the lowest latency of the current and the previous window, so it
+	// follows the backends as they change, within two windows.
+	adaptiveWindow = 10 * time.Second
+	// adaptiveBackoff is what the limit is multiplied by on congestion
+	adaptiveBackoff = 0.9
+)
+
+var (
+	concurrencyLimit = NewGauge(
+		"civil_gateway_concurrency_limit",
+		"In-flight request limit the adaptive controller settled on, by pool",
+		"pool",
+	)
+	concurrencyInFlight = NewGauge(
+		"civil_gateway_concurrency_in_flight",
+		"Requests in flight to each pool's backends",
+		"pool",
+	)
+	concurrencyQueued = NewGauge(
+		"civil_gateway_concurrency_queued",
+		"Requests waiting for a pool's concurrency limit to admit them",
+		"pool",
+	)
+	concurrencyShed = NewCounter(
+		"civil_gateway_concurrency_shed_total",
+		"Requests turned away for going over a pool's concurrency limit, by why",
+		"pool", "reason",
+	)
+)
+
+// ConcurrencyConfig sets up adaptive concurrency limits. Each pool's limit
+// starts at InitialLimit and stays between MinLimit and MaxLimit. Latency
+// over Tolerance times the baseline counts as congestion. Up to QueueSize
+// requests over the limit wait up to QueueTimeout to be admitted, shared
+// between tenants in proportion to TenantWeights, by subject, where tenants
+// not listed weigh 1. The tenants' queues are accounted for in Memory.
+type ConcurrencyConfig struct {
+	Adaptive      bool
+	InitialLimit  int
+	MinLimit      int
+	MaxLimit      int
+	Tolerance     float64
+	QueueSize     int
+	QueueTimeout  time.Duration
+	TenantWeights map[string]float64
+	Memory        *MemoryPool
+}
+
+// AdaptiveLimiter finds how many requests a pool's backends can take at once
+// by AIMD on latency. While requests come back near the baseline latency
+// and the limit is being used, it grows by one per limit's worth of
+// requests. When latency climbs past the tolerance, or backends fail or time
+// out, it shrinks by a factor. Requests over the limit wait briefly in a
+// queue and are otherwise shed with a 503, so the backends are never pushed
+// past what they sustain as the fleet scales up and down.
+//
+// The queue is weighted-fair across tenants, so when there isn't enough to
+// go round each tenant gets its share rather than whoever sends the most
+// getting everything. Each queued request is tagged with when it would
+// finish if every tenant with requests queued were served at its weight,
+// and the earliest is admitted first. When the queue is full, the request
+// tagged latest is shed, which is the newest of the tenant furthest over
+// its share.
+type AdaptiveLimiter struct {
+	pool   string
+	config ConcurrencyConfig
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	windowStart  time.Time
+	windowMin    time.Duration
+	previousMin  time.Duration
+	lastDecrease time.Time
+
+	// virtual is the start tag of the request admitted last, which the
+	// tags of tenants starting to queue again begin from
+	virtual float64
+	queued  int
+	tenants map[string]*tenantQueue
+}
+
+// tenantQueueBytes is roughly what a tenant's queue costs besides its name
+// and waiters
+const tenantQueueBytes = 96
+
+// tenantQueue holds one tenant's queued requests, in the order they came
+type tenantQueue struct {
+	weight     float64
+	lastFinish float64
+	waiters    []*admissionWaiter
+	size       int64
+}
+
+// admissionWaiter is a queued request. ready is sent whether it was admitted
+// once it leaves the queue, other than by giving up itself.
+type admissionWaiter struct {
+	tenant string
+	start  float64
+	finish float64
+	ready  chan bool
+}
+
+func NewAdaptiveLimiter(pool string, config ConcurrencyConfig) *AdaptiveLimiter {
+	config.MinLimit = max(config.MinLimit, 1)
+	config.MaxLimit = max(config.MaxLimit, config.MinLimit)
+	config.InitialLimit = min(max(config.InitialLimit, config.MinLimit), config.MaxLimit)
+	if config.Tolerance <= 1 {
+		config.Tolerance = 2
+	}
+	if config.QueueTimeout <= 0 {
+		config.QueueSize = 0
+	}
+
+	concurrencyLimit.Set(float64(config.InitialLimit), pool)
+
+	return &AdaptiveLimiter{
+		pool:        pool,
+		config:      config,
+		limit:       float64(config.InitialLimit),
+		windowStart: time.Now(),
+		tenants:     map[string]*tenantQueue{},
+	}
+}
+
+// Middleware sheds the requests over the limit and learns from the rest
+func (l *AdaptiveLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason, ok := l.acquire(r.Context(), admissionTenant(r)); !ok {
+			// Nobody is waiting for the answer of a client that went away
+			if r.Context().Err() != nil {
+				return
+			}
+
+			concurrencyShed.Inc(l.pool, reason)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "backends_at_capacity", "")
+			return
+		}
+
+		start := time.Now()
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// Failures of the backends are congestion, but not those of the
+		// client going away
+		failed := recorder.status == http.StatusBadGateway || recorder.status == http.StatusServiceUnavailable || recorder.status == http.StatusGatewayTimeout
+		l.release(time.Since(start), failed && r.Context().Err() == nil)
+	})
+}
+
+// QueueDepth is how many requests are waiting to be admitted
+func (l *AdaptiveLimiter) QueueDepth() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.queued)
+}
+
+// acquire takes a slot under the limit for tenant, waiting in the queue if
+// there is none free, or else reports why it couldn't
+func (l *AdaptiveLimiter) acquire(ctx context.Context, tenant string) (string, bool) {
+	l.mu.Lock()
+
+	// Requests only skip the queue when there is nobody in it
+	if l.queued == 0 && l.inFlight < int(l.limit) {
+		l.admit()
+		l.mu.Unlock()
+		return "", true
+	}
+
+	waiter, reason := l.enqueue(tenant)
+	l.mu.Unlock()
+	if waiter == nil {
+		return reason, false
+	}
+
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case admitted := <-waiter.ready:
+		return "evicted", admitted
+	case <-ctx.Done():
+		reason = "cancelled"
+	case <-timer.C:
+		reason = "queue_timeout"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.dequeue(waiter) {
+		return reason, false
+	}
+
+	// It left the queue as it gave up. A slot it was given is handed on,
+	// rather than learning from a request that was never sent.
+	if <-waiter.ready {
+		l.vacate()
+		l.dispatch()
+	}
+	return reason, false
+}
+
+// admit takes a slot. l.mu must be held.
+func (l *AdaptiveLimiter) admit() {
+	l.inFlight++
+	concurrencyInFlight.Set(float64(l.inFlight), l.pool)
+}
+
+// vacate gives back a slot. l.mu must be held.
+func (l *AdaptiveLimiter) vacate() {
+	l.inFlight--
+	concurrencyInFlight.Set(float64(l.inFlight), l.pool)
+}
+
+// enqueue queues a request of tenant, making room by shedding the request
+// tagged latest if the queue is full. It returns nil and why if the request
+// itself is shed. l.mu must be held.
+func (l *AdaptiveLimiter) enqueue(tenant string) (*admissionWaiter, string) {
+	if l.config.QueueSize <= 0 {
+		return nil, "limit"
+	}
+
+	queue, ok := l.tenants[tenant]
+	if !ok {
+		weight, ok := l.config.TenantWeights[tenant]
+		if !ok || weight <= 0 {
+			weight = 1
+		}
+		queue = &tenantQueue{weight: weight}
+
+		// The tenant is queued either way, but only accounted for if there
+		// is room
+		if size := tenantQueueBytes + int64(len(tenant)); l.config.Memory.Reserve(size) {
+			queue.size = size
+		}
+		l.tenants[tenant] = queue
+	}
+
+	start := max(l.virtual, queue.lastFinish)
+	waiter := &admissionWaiter{
+		tenant: tenant,
+		start:  start,
+		finish: start + 1/queue.weight,
+		ready:  make(chan bool, 1),
+	}
+
+	if l.queued >= l.config.QueueSize {
+		latest := l.latest()
+		if latest == nil || latest.finish <= waiter.finish {
+			l.forgetIdle(tenant)
+			return nil, "queue_full"
+		}
+		l.dequeue(latest)
+		latest.ready <- false
+	}
+
+	queue.lastFinish = waiter.finish
+	queue.waiters = append(queue.waiters, waiter)
+	l.queued++
+	concurrencyQueued.Set(float64(l.queued), l.pool)
+	return waiter, ""
+}
+
+// latest is the queued request tagged to finish last, which is at the back
+// of its tenant's queue. l.mu must be held.
+func (l *AdaptiveLimiter) latest() *admissionWaiter {
+	var latest *admissionWaiter
+	for _, queue := range l.tenants {
+		if len(queue.waiters) == 0 {
+			continue
+		}
+		if back := queue.waiters[len(queue.waiters)-1]; latest == nil || back.finish > latest.finish {
+			latest = back
+		}
+	}
+	return latest
+}
+
+// dequeue takes waiter out of the queue, reporting whether it was still in
+// it. l.mu must be held.
+func (l *AdaptiveLimiter) dequeue(waiter *admissionWaiter) bool {
+	queue := l.tenants[waiter.tenant]
+	if queue == nil {
+		return false
+	}
+
+	i := slices.Index(queue.waiters, waiter)
+	if i < 0 {
+		return false
+	}
+
+	// The tenant's later requests keep their tags. Only the last one
+	// leaving gives back its place for the next.
+	if i == len(queue.waiters)-1 {
+		queue.lastFinish = waiter.start
+	}
+	queue.waiters = slices.Delete(queue.waiters, i, i+1)
+	l.queued--
+	concurrencyQueued.Set(float64(l.queued), l.pool)
+	l.forgetIdle(waiter.tenant)
+	return true
+}
+
+// forgetIdle drops the queue of tenant once it has nothing in it and
+// nothing to catch up on, so tenants don't pile up. l.mu must be held.
+func (l *AdaptiveLimiter) forgetIdle(tenant string) {
+	if queue := l.tenants[tenant]; queue != nil && len(queue.waiters) == 0 && queue.lastFinish <= l.virtual {
+		l.config.Memory.Release(queue.size)
+		delete(l.tenants, tenant)
+	}
+}
+
+// dispatch admits queued requests, earliest finish first, while there are
+// slots free. l.mu must be held.
+func (l *AdaptiveLimiter) dispatch() {
+	for l.queued > 0 && l.inFlight < int(l.limit) {
+		var next *admissionWaiter
+		for _, queue := range l.tenants {
+			if len(queue.waiters) > 0 && (next == nil || queue.waiters[0].finish < next.finish) {
+				next = queue.waiters[0]
+			}
+		}
+
+		l.virtual = max(l.virtual, next.start)
+		l.dequeue(next)
+		l.admit()
+		next.ready <- true
+	}
+
+	// Tenants that caught up while others were served have nothing left to
+	// be owed
+	for tenant := range l.tenants {
+		l.forgetIdle(tenant)
+	}
+}
+
+func (l *AdaptiveLimiter) release(latency time.Duration, failed bool) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// The slot is handed on, and any the limit grew by filled, on the way out
+	defer l.dispatch()
+
+	inFlight := l.inFlight
+	l.vacate()
+
+	if now.Sub(l.windowStart) > adaptiveWindow {
+		l.previousMin, l.windowMin = l.windowMin, 0
+		l.windowStart = now
+	}
+	if !failed && (l.windowMin == 0 || latency < l.windowMin) {
+		l.windowMin = latency
+	}
+
+	baseline := l.windowMin
+	if l.previousMin > 0 && (baseline == 0 || l.previousMin < baseline) {
+		baseline = l.previousMin
+	}
+
+	congested := failed || (baseline > 0 && float64(latency) > l.config.Tolerance*float64(baseline))
+	switch {
+	case congested:
+		// Once per round trip, like TCP, so the requests that were already
+		// in flight when the limit came down don't bring it down again
+		if now.Sub(l.lastDecrease) < latency {
+			return
+		}
+		l.lastDecrease = now
+		l.limit = math.Max(float64(l.config.MinLimit), l.limit*adaptiveBackoff)
+	case float64(inFlight) >= l.limit/2:
+		// Only grow while the limit is actually being used, or it would
+		// drift up to the maximum while traffic is light
+		l.limit = math.Min(float64(l.config.MaxLimit), l.limit+1/l.limit)
+	default:
+		return
+	}
+
+	concurrencyLimit.Set(math.Floor(l.limit), l.pool)
+}
+
+// admissionTenant is who a request is queued as: the user it was
+// authenticated as, or else the client address, resolved through trusted
+// proxies like the client rate limit is
+func admissionTenant(r *http.Request) string {
+	if claims, ok := r.Context().Value(userContextKey).(Claims); ok && claims.Subject != "" {
+		return claims.Subject
+	}
+	return clientAddr(r).String()
+}
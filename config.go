@@ -1,32 +1,466 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds all the runtime configuration
 type Config struct {
 	Verbose             bool
+	LeakCheck           bool // Report background goroutines still running after shutdown
+	RequireFIPS         bool // Refuse to start unless crypto runs in FIPS 140-3 mode
 	Port                uint16
 	AuthServer          string
 	IDPHost             string // Use local address here. Its where the gateway will make requests for JWKS
+	OIDCIssuer          string // Issuer of accepted tokens. Defaults to https://AuthServer
+	JWKSURL             string // Where the signing keys are fetched. Found through OIDC discovery when empty
 	DBReaderHost        string
 	TileServerHost      string
 	DexGrpcAddress      string
 	AllowedClientsIds   []string
 	InstanceMetadataUrl string
+
+	// Every issuer whose tokens are accepted. Without CIVIL_OIDC_ISSUERS
+	// it is OIDCIssuer alone, with JWKSURL and AllowedClientsIds
+	Issuers []IssuerConfig
+
+	// How often the IDP's signing keys are refetched. Keys the gateway hasn't
+	// seen are also fetched when a token first names one
+	JWKSRefresh time.Duration
+
+	// API keys accepted in X-API-Key next to tokens, from a JSON or YAML
+	// file or a Secrets Manager ARN, reloaded every APIKeysReload. No keys
+	// are accepted when empty
+	APIKeys       string
+	APIKeysReload time.Duration
+
+	// HMAC keys of signed tile URLs, one per line, from a file or a Secrets
+	// Manager ARN. URLs last the TTL unless asked for otherwise, up to the
+	// max. No signed URLs are issued or accepted when empty
+	SignedURLKeys   string
+	SignedURLTTL    time.Duration
+	SignedURLMaxTTL time.Duration
+
+	// Bearer token for the operator endpoints under /admin/. They are not
+	// served at all when this is empty
+	AdminToken string
+	// Serves the operator endpoints on a listener of their own instead of
+	// next to the public routes, only on the loopback interface when
+	// AdminLocalhostOnly is set
+	AdminPort          uint16
+	AdminLocalhostOnly bool
+
+	// The config file, re-read on SIGHUP, and also whenever it changes when
+	// ConfigWatchInterval is set. Only the routes' auth and groups, CORS,
+	// rate limits, and issuers apply without a restart
+	ConfigFile          string
+	ConfigWatchInterval time.Duration
+
+	// Cloud Map discovery for the tile server pool. When no pool is served
+	// under /tiles/, tiles are proxied straight to TileServerHost
+	CloudMapNamespace string
+	CloudMapService   string
+	DiscoveryInterval time.Duration
+	// Each poll takes up to DiscoveryMaxInstances healthy instances, paged
+	// DiscoveryPageSize at a time for services bigger than DiscoverInstances
+	// answers for. See DiscoveryConfig
+	DiscoveryPageSize     int
+	DiscoveryMaxInstances int
+	// What a poll finding no healthy instances does to the endpoints, and
+	// how long they are kept at most. See DiscoveryConfig
+	DiscoveryEmptyPolicy       string
+	DiscoveryEmptyMaxStaleness time.Duration
+	// Polls are spread DiscoveryJitter of the interval either way, and
+	// back off up to DiscoveryMaxBackoff apart while they fail. See
+	// DiscoveryConfig
+	DiscoveryJitter     float64
+	DiscoveryMaxBackoff time.Duration
+	// SNS topic of Cloud Map change events from EventBridge, which every
+	// replica subscribes a queue of its own to. Cloud Map pools are
+	// rediscovered as their instances change, and only polled every
+	// DiscoveryEventsFallbackInterval. See DiscoveryEvents
+	DiscoveryEventsTopicArn         string
+	DiscoveryEventsFallbackInterval time.Duration
+	// Where newly discovered endpoints are asked for their capabilities,
+	// which route requests needing them. Disabled when set empty
+	CapabilitiesPath string
+	// Prefer endpoints in the gateway's availability zone while at least
+	// ZoneMinEndpoints of them are healthy. See detectZone
+	ZoneAware        bool
+	ZoneMinEndpoints int
+	// Discovered backends must be inside one of these, like the VPC's CIDRs.
+	// Any address is allowed when empty
+	BackendAllowedCIDRs []netip.Prefix
+
+	// Every Cloud Map discovered pool, including the tile pool above and the
+	// routes of the config file
+	Pools []PoolConfig
+
+	// CloudWatch export of the tile pool's saturation. Disabled when the
+	// namespace is empty
+	CloudWatchNamespace      string
+	CloudWatchInterval       time.Duration
+	SaturationTargetInFlight float64
+	SaturationTargetP95      time.Duration
+
+	// Wake-up of a scaled-to-zero tile pool. Either "ecs" or "sns", or empty
+	// to answer 503 straight away when the pool is empty
+	WakeUpAction          string
+	WakeUpPool            string
+	WakeUpECSCluster      string
+	WakeUpECSService      string
+	WakeUpECSDesiredCount int32
+	WakeUpSNSTopicArn     string
+	WakeUpWait            time.Duration
+	WakeUpCooldown        time.Duration
+	WakeUpRetryAfter      time.Duration
+
+	// Gateway-level request filtering, evaluated before auth. No rules means
+	// no filtering
+	WAFRules []WAFRuleConfig
+
+	// Decoy paths that always 404 and block whoever asks for them, and for
+	// how long
+	HoneypotPaths   []string
+	IPBlockDuration time.Duration
+	// Load balancers and proxies in front of the gateway. Requests from them
+	// are taken to come from the address they appended to X-Forwarded-For,
+	// and they are never blocked. Empty means clients connect directly
+	TrustedProxies []netip.Prefix
+
+	// Fingerprint clients (user agent, header names, JA3) for logs and
+	// rate-limit keys
+	Fingerprint bool
+
+	// Port for a standalone grpc.health.v1 server. 0 serves it only on the
+	// main port
+	GRPCHealthPort uint16
+
+	// HTTPS listener, served next to the plain HTTP one when a certificate
+	// is set. The certificate and key are PEM file paths or Secrets Manager
+	// ARNs, reloaded every TLSReload. HTTPSRedirectPort, when set, answers
+	// plain HTTP with a redirect to the HTTPS listener
+	TLSPort           uint16
+	TLSCert           string
+	TLSKey            string
+	TLSReload         time.Duration
+	HTTPSRedirectPort uint16
+
+	// Timeouts of every listener, as in http.Server. The write timeout must
+	// outlast the longest route timeout for a timed out route to still be
+	// answered with a 504. Zero turns a timeout off
+	ServerReadHeaderTimeout time.Duration
+	ServerReadTimeout       time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+
+	// How long the gateway keeps serving after failing readiness on
+	// shutdown, for load balancers to see it and stop sending requests
+	// before the listeners close. Make it at least the health check
+	// interval times its unhealthy threshold, and keep it under the task's
+	// stop timeout
+	ShutdownDrainDelay time.Duration
+
+	// Timeout of the tile route and of pools that don't set their own
+	UpstreamTimeout time.Duration
+
+	// Connections to backends, see TransportConfig. Pools can set their own
+	// protocol and connections per backend
+	UpstreamTransport TransportConfig
+
+	// Path prefixes under /tiles/ where WebSocket upgrades are passed
+	// through when no pool serves tiles, like the websocket pool setting.
+	// Upgraded connections are closed after WebSocketMaxLifetime
+	WebSocketPaths       []string
+	WebSocketMaxLifetime time.Duration
+
+	// Responses served by the gateway itself, without any backend
+	StaticRoutes []StaticRouteConfig
+
+	// Serve the embedded tile viewer on /preview
+	Preview bool
+
+	// Secret that, sent in the X-Civil-Capture header, flags a request for
+	// capture on /admin/captures. Capturing is off when empty
+	CaptureSecret string
+
+	// Tile cache in front of the tile route and every pool with cache set.
+	// Disabled when the TTL is 0
+	CacheTTL         time.Duration
+	CacheMaxBytes    int64
+	CacheTTLJitter   float64
+	CacheRefreshBeta float64
+	// Responses larger than this stream straight through without being
+	// buffered, like COGs and exports
+	CacheMaxEntryBytes int64
+	// Which entries go first when the cache is full: lru, lfu, or arc
+	CacheEvictionPolicy string
+	// Bounds on the TTLs backends can ask for with X-Gateway-Cache-TTL.
+	// TTL hints are ignored when the max is 0
+	CacheHintMinTTL time.Duration
+	CacheHintMaxTTL time.Duration
+	// How long past expiry cached tiles are still served while their pool
+	// has no healthy backends, and kept in the shared tier for it. Disabled
+	// when 0
+	CacheOutageMaxStale time.Duration
+
+	// Concurrent identical GETs share one upstream request, for responses up
+	// to the max size. See Coalescer
+	Coalesce         bool
+	CoalesceMaxBytes int64
+
+	// Service level objectives, with the burn rate at which those that
+	// degrade have the tile cache serve entries up to the max staleness
+	// past expiry. See SLOTracker
+	SLOs                []SLOConfig
+	SLOBurnThreshold    float64
+	SLODegradedMaxStale time.Duration
+
+	// How long each middleware stage, like auth or cache, is expected to
+	// take on its own, on top of the defaults. See MiddlewareWatchdog
+	MiddlewareBudgets map[string]time.Duration
+
+	// How canaries are judged against their stable pools: over the window,
+	// on at least the min requests to each, failing on an error rate or
+	// p95 latency worse by more than the max deltas. See CanaryAnalyzer
+	CanaryWindow          time.Duration
+	CanaryMinRequests     int
+	CanaryMaxErrorDelta   float64
+	CanaryMaxLatencyDelta time.Duration
+
+	// Where the tile cache is saved on shutdown and restored from on
+	// startup, as a local path or blob URL such as s3://bucket/key. Entries
+	// older than the max age are not restored
+	CacheSnapshotURL    string
+	CacheSnapshotMaxAge time.Duration
+
+	// Redis or ElastiCache tier of the tile cache shared by every replica,
+	// off when the URL is empty. See SharedCacheConfig
+	SharedCacheURL          string
+	SharedCacheTTL          time.Duration
+	SharedCacheNearTTL      time.Duration
+	SharedCacheTimeout      time.Duration
+	SharedCacheWriteThrough bool
+
+	// Manifest of the tiles that have data, a local path or blob URL, from
+	// which tiles known to be empty are answered without a backend. Applies
+	// to the tile route and every pool with empty_tiles set
+	TileManifestURL        string
+	TileManifestRefresh    time.Duration
+	EmptyTileFalsePositive float64
+
+	// Layer manifest loaded at startup, a local path or blob URL. It can
+	// also be replaced through PUT /admin/layers
+	LayerManifestURL string
+
+	// Tile bucket that tiles rendered on demand are written behind to, as
+	// a blob URL. Applies to the tile route, pools with write_behind set,
+	// and layers that enable it
+	TileBucketURL      string
+	WriteBehindQueue   int
+	WriteBehindWorkers int
+
+	// CloudFront in front of the gateway. Tile responses are marked as
+	// cacheable at the edge for CDNSMaxAge, and admin purges also invalidate
+	// the distribution when its ID is set
+	CDNSMaxAge               time.Duration
+	CloudFrontDistributionID string
+
+	// CloudFront key pair that signed cookies and URLs are minted with on
+	// /cdn/credentials, valid for CDNCredentialsTTL. Minting is off unless
+	// the key, key pair ID, and CDN domain are all set
+	CloudFrontKeyPairID  string
+	CloudFrontPrivateKey string
+	CDNDomain            string
+	CDNCookieDomain      string
+	CDNCredentialsTTL    time.Duration
+
+	// Active health probing of every pool endpoint on ProbePath, off when
+	// the path is empty
+	ProbePath             string
+	ProbeInterval         time.Duration
+	ProbeTimeout          time.Duration
+	ProbeFailureThreshold int
+
+	// Endpoints failing EjectAfter requests in a row are ejected from
+	// rotation for at least EjectCooldown. Off when EjectAfter is 0
+	EjectAfter    int
+	EjectCooldown time.Duration
+
+	// Keeps each endpoint's ejection state and error rate in RedisAddr
+	// across restarts, for ReputationTTL after it was last seen. Endpoints
+	// with an error rate of ReputationSuspectErrorRate or more come back one
+	// failure from ejection. See ReputationStore
+	BackendReputation          bool
+	ReputationTTL              time.Duration
+	ReputationSaveInterval     time.Duration
+	ReputationSuspectErrorRate float64
+
+	// Failed GETs are retried up to RetryAttempts times on other endpoints
+	// of the pool. See RetryConfig
+	RetryAttempts       int
+	RetryAttemptTimeout time.Duration
+	RetryBudget         time.Duration
+
+	// Adaptive limits on the requests in flight to each pool, queueing
+	// fairly between tenants and shedding what the backends can't take. See
+	// ConcurrencyConfig
+	AdaptiveConcurrency         bool
+	ConcurrencyInitialLimit     int
+	ConcurrencyMinLimit         int
+	ConcurrencyMaxLimit         int
+	ConcurrencyLatencyTolerance float64
+	ConcurrencyQueueSize        int
+	ConcurrencyQueueTimeout     time.Duration
+	TenantWeights               map[string]float64
+
+	// A fixed limit on the requests the gateway serves at once, 0 for none,
+	// with up to InFlightQueueSize more waiting InFlightQueueTimeout for a
+	// slot. Shed requests are told to retry after InFlightRetryAfter. Pools
+	// can set a limit of their own with max_in_flight. See InFlightLimiter
+	MaxInFlight          int
+	InFlightQueueSize    int
+	InFlightQueueTimeout time.Duration
+	InFlightRetryAfter   time.Duration
+
+	// How saturated the gateway may get, as in InFlightState, before /readyz
+	// reports it not ready so the load balancer sends its traffic elsewhere.
+	// 0 keeps it ready however loaded
+	ReadyMaxSaturation float64
+
+	// Response transformers. The watermark transformer is only available
+	// when given a PNG to stamp, and the jpeg one converts at JPEGQuality.
+	// The tilejson one points tile URLs at PublicURL, the gateway's address
+	// as clients reach it, like https://maps.example.com
+	WatermarkImage string
+	JPEGQuality    int
+	PublicURL      string
+
+	// How the gateway identifies itself to backends, with {version} and
+	// {instance} filled in. See UpstreamIdentity
+	UpstreamUserAgent string
+	UpstreamVia       string
+	ClientUserAgent   string
+
+	// The verified claims forwarded to backends, by claim name, as the
+	// headers they are mapped to. See ClaimHeaders
+	ClaimHeaders map[string]string
+
+	// What backends get of the client's credentials: pass, strip, or
+	// internal, a JWT signed with InternalJWTKey, a PEM file or Secrets
+	// Manager ARN. See UpstreamAuth
+	UpstreamAuth      string
+	InternalJWTKey    string
+	InternalJWTIssuer string
+	InternalJWTTTL    time.Duration
+
+	// Which browser origins may call the API. See CORSConfig
+	CORS CORSConfig
+
+	// Compression of the responses backends send uncompressed. See
+	// CompressionConfig
+	Compression            bool
+	CompressionGzipLevel   int
+	CompressionBrotliLevel int
+	CompressionMinBytes    int64
+
+	// Data transfer cost estimates. See EgressConfig
+	EgressCostPerGB float64
+	EgressWindow    time.Duration
+	EgressTenants   []string
+
+	// Aggregated usage analytics, exported to AnalyticsBucketURL. Disabled
+	// when it is empty. See AnalyticsConfig
+	AnalyticsBucketURL string
+	AnalyticsInterval  time.Duration
+	AnalyticsGeoZoom   int
+	AnalyticsZoomBand  int
+	AnalyticsMinUsers  int
+
+	// The tile access log finance bills from, uploaded to BillingBucketURL
+	// through a spool in BillingSpoolDir. Disabled when the bucket is
+	// empty. See BillingLog
+	BillingBucketURL         string
+	BillingSpoolDir          string
+	BillingFlushInterval     time.Duration
+	BillingBatchSize         int
+	BillingTenantGroupPrefix string
+
+	// One line per request, in json or text
+	AccessLog       bool
+	AccessLogFormat string
+
+	// Translations of the gateway's error bodies, by language then error
+	// code, and the language for clients asking for none of them. See
+	// SetErrorTemplates
+	ErrorTemplates string
+	ErrorLanguage  string
+
+	// Names of the compiled in plugins to run, in order. See Plugin
+	Plugins []string
+
+	// WASM filter modules, run as plugins named wasm:<name> after the ones
+	// above unless Plugins places them. Each is held to the WASM limits
+	WASMModules      []WASMModuleConfig
+	WASMMemoryMB     int
+	WASMTimeout      time.Duration
+	WASMMaxInstances int
+
+	// Token buckets per authenticated user, keyed on the token subject, and
+	// per client address on the routes that don't need a token. A rate of 0
+	// turns either off
+	UserRateLimit   float64
+	UserRateBurst   int
+	ClientRateLimit float64
+	ClientRateBurst int
+
+	// Redis the rate limits and one-time signed URLs are shared through,
+	// host:port or a redis:// URL, so they hold across replicas. Checks
+	// taking longer than the timeout fall back to the local buckets
+	RedisAddr             string
+	RateLimitRedisTimeout time.Duration
+
+	// How long checking a one-time signed URL's nonce in Redis may take
+	// before the URL is refused
+	ReplayRedisTimeout time.Duration
+
+	// Memory the cache, rate limit buckets and captures may hold between
+	// them, by default half the container's memory limit. Each also has a
+	// limit of its own. MemoryReportInterval, when set, logs their usage that often,
+	// for soak tests
+	MemoryBudget         int64
+	RateLimitMaxBytes    int64
+	CaptureMaxBytes      int64
+	MemoryReportInterval time.Duration
 }
 
 func LoadConfig(logger *slog.Logger) (*Config, error) {
+	// The config file's settings fill in for unset environment variables,
+	// so they are applied before anything is read
+	var routes []PoolConfig
+	if path := os.Getenv("CIVIL_CONFIG_FILE"); path != "" {
+		file, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := file.applySettings(); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		routes = file.Routes
+	}
+
 	// Define the list of required environment variables
 	required := []string{
-		"CIVIL_AUTH_SERVER",
-		"CIVIL_IDP_HOST",
 		"CIVIL_TILE_SERVER_HOST",
 		"CIVIL_ALLOWED_CLIENT_IDS",
 		"CIVIL_DB_READER_HOST",
@@ -41,33 +475,587 @@ func LoadConfig(logger *slog.Logger) (*Config, error) {
 		}
 	}
 
+	// The issuer can be given either way
+	if os.Getenv("CIVIL_OIDC_ISSUER") == "" && os.Getenv("CIVIL_AUTH_SERVER") == "" {
+		missing = append(missing, "CIVIL_OIDC_ISSUER or CIVIL_AUTH_SERVER")
+	}
+
 	// If any are missing, return a detailed error
 	if len(missing) > 0 {
 		return nil, fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
 	}
 
+	if os.Getenv("CIVIL_CLOUD_MAP_NAMESPACE") != "" && os.Getenv("CIVIL_CLOUD_MAP_SERVICE") == "" {
+		return nil, fmt.Errorf("CIVIL_CLOUD_MAP_SERVICE is required when CIVIL_CLOUD_MAP_NAMESPACE is set")
+	}
+
+	if jitter := getFloatEnv("CIVIL_DISCOVERY_JITTER", 0.1, logger); jitter < 0 || jitter > 0.5 {
+		return nil, fmt.Errorf("CIVIL_DISCOVERY_JITTER must be between 0 and 0.5")
+	}
+
+	if os.Getenv("CIVIL_CONFIG_WATCH_INTERVAL") != "" && os.Getenv("CIVIL_CONFIG_FILE") == "" {
+		return nil, fmt.Errorf("CIVIL_CONFIG_FILE is required when CIVIL_CONFIG_WATCH_INTERVAL is set")
+	}
+
+	switch os.Getenv("CIVIL_WAKEUP_ACTION") {
+	case "":
+	case "ecs":
+		if os.Getenv("CIVIL_WAKEUP_ECS_CLUSTER") == "" || os.Getenv("CIVIL_WAKEUP_ECS_SERVICE") == "" {
+			return nil, fmt.Errorf("CIVIL_WAKEUP_ECS_CLUSTER and CIVIL_WAKEUP_ECS_SERVICE are required for the ecs wake-up action")
+		}
+	case "sns":
+		if os.Getenv("CIVIL_WAKEUP_SNS_TOPIC_ARN") == "" {
+			return nil, fmt.Errorf("CIVIL_WAKEUP_SNS_TOPIC_ARN is required for the sns wake-up action")
+		}
+	default:
+		return nil, fmt.Errorf("CIVIL_WAKEUP_ACTION must be one of: ecs, sns")
+	}
+
+	switch os.Getenv("CIVIL_DISCOVERY_EMPTY_POLICY") {
+	case "", emptyDiscoveryKeepLastKnown, emptyDiscoveryClear:
+	default:
+		return nil, fmt.Errorf("CIVIL_DISCOVERY_EMPTY_POLICY must be one of: %s, %s", emptyDiscoveryKeepLastKnown, emptyDiscoveryClear)
+	}
+
+	if (os.Getenv("CIVIL_TLS_CERT") == "") != (os.Getenv("CIVIL_TLS_KEY") == "") {
+		return nil, fmt.Errorf("CIVIL_TLS_CERT and CIVIL_TLS_KEY must be set together")
+	}
+
+	pools, err := getPoolsEnv(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pools without a timeout of their own get the default, and every
+	// route has to time out before the server gives up on writing
+	serverReadTimeout := getDurationEnv("CIVIL_SERVER_READ_TIMEOUT", time.Minute, logger)
+	serverWriteTimeout := getDurationEnv("CIVIL_SERVER_WRITE_TIMEOUT", 2*time.Minute, logger)
+	upstreamTimeout := getDurationEnv("CIVIL_UPSTREAM_TIMEOUT", time.Minute, logger)
+	for i, pool := range pools {
+		if pool.Timeout == "" && upstreamTimeout > 0 {
+			pools[i].Timeout = upstreamTimeout.String()
+		}
+		if serverWriteTimeout > 0 && pools[i].RequestTimeout() >= serverWriteTimeout {
+			return nil, fmt.Errorf("pool %s: timeout must be shorter than CIVIL_SERVER_WRITE_TIMEOUT", pool.Name)
+		}
+	}
+	if serverWriteTimeout > 0 && upstreamTimeout >= serverWriteTimeout {
+		return nil, fmt.Errorf("CIVIL_UPSTREAM_TIMEOUT must be shorter than CIVIL_SERVER_WRITE_TIMEOUT")
+	}
+
+	wafRules, err := getWAFRulesEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := getBoolEnv("CIVIL_FINGERPRINT", false, logger)
+
+	for _, rule := range wafRules {
+		if rule.RateKey == "fingerprint" && !fingerprint {
+			return nil, fmt.Errorf("waf rule %s: rate_key fingerprint requires CIVIL_FINGERPRINT", rule.Name)
+		}
+	}
+
+	honeypotPaths, err := getHoneypotPathsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := getCIDRsEnv("CIVIL_TRUSTED_PROXIES")
+	if err != nil {
+		return nil, err
+	}
+
+	staticRoutes, err := getStaticRoutesEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	plugins, err := getPluginsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	webSocketPaths, err := getWebSocketPathsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	wasmModules, err := getWASMModulesEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	tenantWeights, err := getTenantWeightsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	allowedClientIDs := getAllowedClientIdsEnv()
+	issuers, err := getIssuersEnv(IssuerConfig{
+		Issuer:    getOIDCIssuerEnv(),
+		JWKSURL:   getJWKSURLEnv(),
+		ClientIDs: allowedClientIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backendCIDRs, err := getCIDRsEnv("CIVIL_BACKEND_ALLOWED_CIDRS")
+	if err != nil {
+		return nil, err
+	}
+
+	cors, err := getCORSEnv(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	claimHeaders := defaultClaimHeaders
+	if value := os.Getenv("CIVIL_CLAIM_HEADERS"); value != "" {
+		claimHeaders = map[string]string{}
+		if err := json.Unmarshal([]byte(value), &claimHeaders); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_CLAIM_HEADERS: %w", err)
+		}
+	}
+
+	if getBoolEnv("CIVIL_BACKEND_REPUTATION", false, logger) && os.Getenv("CIVIL_REDIS_ADDR") == "" {
+		return nil, fmt.Errorf("CIVIL_BACKEND_REPUTATION requires CIVIL_REDIS_ADDR")
+	}
+
+	if os.Getenv("CIVIL_ADMIN_PORT") != "" && os.Getenv("CIVIL_ADMIN_TOKEN") == "" {
+		return nil, fmt.Errorf("CIVIL_ADMIN_PORT requires CIVIL_ADMIN_TOKEN")
+	}
+
+	if os.Getenv("CIVIL_READY_MAX_SATURATION") != "" && os.Getenv("CIVIL_MAX_IN_FLIGHT") == "" {
+		return nil, fmt.Errorf("CIVIL_READY_MAX_SATURATION requires CIVIL_MAX_IN_FLIGHT")
+	}
+
+	switch os.Getenv("CIVIL_UPSTREAM_PROTOCOL") {
+	case "", upstreamProtocolHTTP1:
+	case upstreamProtocolH2C:
+		// WebSocket upgrades only exist in HTTP/1
+		if os.Getenv("CIVIL_WEBSOCKET_PATHS") != "" {
+			return nil, fmt.Errorf("CIVIL_WEBSOCKET_PATHS requires CIVIL_UPSTREAM_PROTOCOL http1")
+		}
+	default:
+		return nil, fmt.Errorf("CIVIL_UPSTREAM_PROTOCOL must be one of: http1, h2c")
+	}
+
+	if publicURL := os.Getenv("CIVIL_PUBLIC_URL"); publicURL != "" {
+		if u, err := url.Parse(publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("CIVIL_PUBLIC_URL must be an http or https URL")
+		}
+	}
+
+	switch os.Getenv("CIVIL_CLIENT_USER_AGENT") {
+	case "", clientUserAgentForward, clientUserAgentPreserve, clientUserAgentStrip:
+	default:
+		return nil, fmt.Errorf("CIVIL_CLIENT_USER_AGENT must be one of: forward, preserve, strip")
+	}
+
+	switch os.Getenv("CIVIL_UPSTREAM_AUTH") {
+	case "", upstreamAuthPass, upstreamAuthStrip:
+	case upstreamAuthInternal:
+		if os.Getenv("CIVIL_INTERNAL_JWT_KEY") == "" {
+			return nil, fmt.Errorf("CIVIL_UPSTREAM_AUTH internal requires CIVIL_INTERNAL_JWT_KEY")
+		}
+	default:
+		return nil, fmt.Errorf("CIVIL_UPSTREAM_AUTH must be one of: pass, strip, internal")
+	}
+
+	if value := os.Getenv("CIVIL_CANARY_WINDOW"); value != "" {
+		if window, err := time.ParseDuration(value); err != nil || window < time.Minute || window > canaryBuckets*time.Minute {
+			return nil, fmt.Errorf("CIVIL_CANARY_WINDOW must be between 1m and 1h")
+		}
+	}
+
+	egressTenants, err := getEgressTenantsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	middlewareBudgets, err := getMiddlewareBudgetsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	slos, err := getSLOsEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	// Return the populated config struct
 	// You can also set defaults here for optional vars (like Port)
 	return &Config{
 		Verbose:             getVerboseEnv(),
+		LeakCheck:           getBoolEnv("CIVIL_LEAK_CHECK", false, logger),
+		RequireFIPS:         getBoolEnv("CIVIL_REQUIRE_FIPS", false, logger),
 		Port:                getPortEnv("CIVIL_PORT", 8080, logger),
 		AuthServer:          os.Getenv("CIVIL_AUTH_SERVER"),
 		IDPHost:             os.Getenv("CIVIL_IDP_HOST"),
+		OIDCIssuer:          getOIDCIssuerEnv(),
+		JWKSURL:             getJWKSURLEnv(),
 		TileServerHost:      os.Getenv("CIVIL_TILE_SERVER_HOST"),
 		DBReaderHost:        os.Getenv("CIVIL_DB_READER_HOST"),
 		DexGrpcAddress:      os.Getenv("CIVIL_DEX_GRPC_ADDRESS"),
-		AllowedClientsIds:   getAllowedClientIdsEnv(),
+		AllowedClientsIds:   allowedClientIDs,
+		Issuers:             issuers,
+		JWKSRefresh:         getDurationEnv("CIVIL_JWKS_REFRESH", 15*time.Minute, logger),
+		APIKeys:             os.Getenv("CIVIL_API_KEYS"),
+		APIKeysReload:       getDurationEnv("CIVIL_API_KEYS_RELOAD", 5*time.Minute, logger),
+		SignedURLKeys:       os.Getenv("CIVIL_SIGNED_URL_KEYS"),
+		SignedURLTTL:        getDurationEnv("CIVIL_SIGNED_URL_TTL", 15*time.Minute, logger),
+		SignedURLMaxTTL:     getDurationEnv("CIVIL_SIGNED_URL_MAX_TTL", 24*time.Hour, logger),
 		InstanceMetadataUrl: os.Getenv("CIVIL_INSTANCE_METADATA_URL"),
+		AdminToken:          os.Getenv("CIVIL_ADMIN_TOKEN"),
+		AdminPort:           getPortEnv("CIVIL_ADMIN_PORT", 0, logger),
+		AdminLocalhostOnly:  getBoolEnv("CIVIL_ADMIN_LOCALHOST_ONLY", false, logger),
+		ConfigFile:          os.Getenv("CIVIL_CONFIG_FILE"),
+		ConfigWatchInterval: getDurationEnv("CIVIL_CONFIG_WATCH_INTERVAL", 0, logger),
+
+		CloudMapNamespace:          os.Getenv("CIVIL_CLOUD_MAP_NAMESPACE"),
+		CloudMapService:            os.Getenv("CIVIL_CLOUD_MAP_SERVICE"),
+		DiscoveryInterval:          getDurationEnv("CIVIL_DISCOVERY_INTERVAL", 30*time.Second, logger),
+		DiscoveryPageSize:          getIntEnv("CIVIL_DISCOVERY_PAGE_SIZE", 100, logger),
+		DiscoveryMaxInstances:      getIntEnv("CIVIL_DISCOVERY_MAX_INSTANCES", 1000, logger),
+		DiscoveryEmptyPolicy:       getEnv("CIVIL_DISCOVERY_EMPTY_POLICY", emptyDiscoveryKeepLastKnown),
+		DiscoveryEmptyMaxStaleness: getDurationEnv("CIVIL_DISCOVERY_EMPTY_MAX_STALENESS", 10*time.Minute, logger),
+		CapabilitiesPath:           getEnv("CIVIL_CAPABILITIES_PATH", "/capabilities"),
+		ZoneAware:                  getBoolEnv("CIVIL_ZONE_AWARE", true, logger),
+		ZoneMinEndpoints:           getIntEnv("CIVIL_ZONE_MIN_ENDPOINTS", 2, logger),
+		BackendAllowedCIDRs:        backendCIDRs,
+		Pools:                      pools,
+
+		DiscoveryEventsTopicArn:         os.Getenv("CIVIL_DISCOVERY_EVENTS_TOPIC_ARN"),
+		DiscoveryEventsFallbackInterval: getDurationEnv("CIVIL_DISCOVERY_EVENTS_FALLBACK_INTERVAL", 5*time.Minute, logger),
+		DiscoveryJitter:                 getFloatEnv("CIVIL_DISCOVERY_JITTER", 0.1, logger),
+		DiscoveryMaxBackoff:             getDurationEnv("CIVIL_DISCOVERY_MAX_BACKOFF", 5*time.Minute, logger),
+
+		CloudWatchNamespace:      os.Getenv("CIVIL_CLOUDWATCH_NAMESPACE"),
+		CloudWatchInterval:       getDurationEnv("CIVIL_CLOUDWATCH_INTERVAL", time.Minute, logger),
+		SaturationTargetInFlight: getFloatEnv("CIVIL_SATURATION_TARGET_INFLIGHT", 4, logger),
+		SaturationTargetP95:      getDurationEnv("CIVIL_SATURATION_TARGET_P95", 500*time.Millisecond, logger),
+
+		WakeUpAction:          os.Getenv("CIVIL_WAKEUP_ACTION"),
+		WakeUpPool:            getEnv("CIVIL_WAKEUP_POOL", "tiles"),
+		WakeUpECSCluster:      os.Getenv("CIVIL_WAKEUP_ECS_CLUSTER"),
+		WakeUpECSService:      os.Getenv("CIVIL_WAKEUP_ECS_SERVICE"),
+		WakeUpECSDesiredCount: int32(getIntEnv("CIVIL_WAKEUP_ECS_DESIRED_COUNT", 1, logger)),
+		WakeUpSNSTopicArn:     os.Getenv("CIVIL_WAKEUP_SNS_TOPIC_ARN"),
+		WakeUpWait:            getDurationEnv("CIVIL_WAKEUP_WAIT", 10*time.Second, logger),
+		WakeUpCooldown:        getDurationEnv("CIVIL_WAKEUP_COOLDOWN", time.Minute, logger),
+		WakeUpRetryAfter:      getDurationEnv("CIVIL_WAKEUP_RETRY_AFTER", 30*time.Second, logger),
+
+		WAFRules: wafRules,
+
+		HoneypotPaths:   honeypotPaths,
+		IPBlockDuration: getDurationEnv("CIVIL_IP_BLOCK_DURATION", time.Hour, logger),
+		TrustedProxies:  trustedProxies,
+
+		Fingerprint: fingerprint,
+
+		GRPCHealthPort: getPortEnv("CIVIL_GRPC_HEALTH_PORT", 0, logger),
+
+		TLSPort:           getPortEnv("CIVIL_TLS_PORT", 8443, logger),
+		TLSCert:           os.Getenv("CIVIL_TLS_CERT"),
+		TLSKey:            os.Getenv("CIVIL_TLS_KEY"),
+		TLSReload:         getDurationEnv("CIVIL_TLS_RELOAD", 5*time.Minute, logger),
+		HTTPSRedirectPort: getPortEnv("CIVIL_HTTPS_REDIRECT_PORT", 0, logger),
+
+		ServerReadHeaderTimeout: getDurationEnv("CIVIL_SERVER_READ_HEADER_TIMEOUT", 10*time.Second, logger),
+		ServerReadTimeout:       serverReadTimeout,
+		ServerWriteTimeout:      serverWriteTimeout,
+		ServerIdleTimeout:       getDurationEnv("CIVIL_SERVER_IDLE_TIMEOUT", 2*time.Minute, logger),
+		ShutdownDrainDelay:      getDurationEnv("CIVIL_SHUTDOWN_DRAIN_DELAY", 10*time.Second, logger),
+
+		UpstreamTimeout: upstreamTimeout,
+
+		UpstreamTransport: TransportConfig{
+			Protocol:            getEnv("CIVIL_UPSTREAM_PROTOCOL", upstreamProtocolHTTP1),
+			MaxIdleConns:        getIntEnv("CIVIL_UPSTREAM_MAX_IDLE_CONNS", 1024, logger),
+			MaxIdleConnsPerHost: getIntEnv("CIVIL_UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 64, logger),
+			MaxConnsPerHost:     getIntEnv("CIVIL_UPSTREAM_MAX_CONNS_PER_HOST", 0, logger),
+			IdleConnTimeout:     getDurationEnv("CIVIL_UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second, logger),
+			DialTimeout:         getDurationEnv("CIVIL_UPSTREAM_DIAL_TIMEOUT", 5*time.Second, logger),
+			KeepAlive:           getDurationEnv("CIVIL_UPSTREAM_KEEP_ALIVE", 30*time.Second, logger),
+		},
+
+		WebSocketPaths:       webSocketPaths,
+		WebSocketMaxLifetime: getDurationEnv("CIVIL_WEBSOCKET_MAX_LIFETIME", time.Hour, logger),
+
+		StaticRoutes: staticRoutes,
+
+		Preview: getBoolEnv("CIVIL_PREVIEW", false, logger),
+
+		CaptureSecret: os.Getenv("CIVIL_CAPTURE_SECRET"),
+
+		CacheTTL:         getDurationEnv("CIVIL_CACHE_TTL", 0, logger),
+		CacheMaxBytes:    int64(getIntEnv("CIVIL_CACHE_MAX_BYTES", 128<<20, logger)),
+		CacheTTLJitter:   getFloatEnv("CIVIL_CACHE_TTL_JITTER", 0.1, logger),
+		CacheRefreshBeta: getFloatEnv("CIVIL_CACHE_EARLY_REFRESH_BETA", 1, logger),
+
+		CacheMaxEntryBytes: int64(getIntEnv("CIVIL_CACHE_MAX_ENTRY_BYTES", defaultMaxCacheEntryBytes, logger)),
+
+		CacheEvictionPolicy: getEnv("CIVIL_CACHE_EVICTION_POLICY", "lru"),
+
+		CacheHintMinTTL: getDurationEnv("CIVIL_CACHE_HINT_MIN_TTL", time.Second, logger),
+		CacheHintMaxTTL: getDurationEnv("CIVIL_CACHE_HINT_MAX_TTL", 24*time.Hour, logger),
+
+		CacheOutageMaxStale: getDurationEnv("CIVIL_CACHE_OUTAGE_MAX_STALENESS", 6*time.Hour, logger),
+
+		Coalesce:         getBoolEnv("CIVIL_COALESCE", true, logger),
+		CoalesceMaxBytes: int64(getIntEnv("CIVIL_COALESCE_MAX_BYTES", defaultMaxCacheEntryBytes, logger)),
+
+		SLOs:                slos,
+		SLOBurnThreshold:    getFloatEnv("CIVIL_SLO_BURN_THRESHOLD", 14.4, logger),
+		SLODegradedMaxStale: getDurationEnv("CIVIL_SLO_DEGRADED_MAX_STALENESS", time.Hour, logger),
+
+		MiddlewareBudgets: middlewareBudgets,
+
+		CanaryWindow:          getDurationEnv("CIVIL_CANARY_WINDOW", 10*time.Minute, logger),
+		CanaryMinRequests:     getIntEnv("CIVIL_CANARY_MIN_REQUESTS", 200, logger),
+		CanaryMaxErrorDelta:   getFloatEnv("CIVIL_CANARY_MAX_ERROR_DELTA", 0.01, logger),
+		CanaryMaxLatencyDelta: getDurationEnv("CIVIL_CANARY_MAX_LATENCY_DELTA", 100*time.Millisecond, logger),
+
+		CacheSnapshotURL:    os.Getenv("CIVIL_CACHE_SNAPSHOT_URL"),
+		CacheSnapshotMaxAge: getDurationEnv("CIVIL_CACHE_SNAPSHOT_MAX_AGE", time.Hour, logger),
+
+		SharedCacheURL:          os.Getenv("CIVIL_SHARED_CACHE_URL"),
+		SharedCacheTTL:          getDurationEnv("CIVIL_SHARED_CACHE_TTL", 0, logger),
+		SharedCacheNearTTL:      getDurationEnv("CIVIL_SHARED_CACHE_NEAR_TTL", 30*time.Second, logger),
+		SharedCacheTimeout:      getDurationEnv("CIVIL_SHARED_CACHE_TIMEOUT", 50*time.Millisecond, logger),
+		SharedCacheWriteThrough: getBoolEnv("CIVIL_SHARED_CACHE_WRITE_THROUGH", false, logger),
+
+		TileManifestURL:        os.Getenv("CIVIL_TILE_MANIFEST_URL"),
+		TileManifestRefresh:    getDurationEnv("CIVIL_TILE_MANIFEST_REFRESH", time.Hour, logger),
+		EmptyTileFalsePositive: getFloatEnv("CIVIL_EMPTY_TILE_FALSE_POSITIVE_RATE", 0.01, logger),
+
+		LayerManifestURL: os.Getenv("CIVIL_LAYER_MANIFEST_URL"),
+
+		TileBucketURL:      os.Getenv("CIVIL_TILE_BUCKET_URL"),
+		WriteBehindQueue:   getIntEnv("CIVIL_WRITE_BEHIND_QUEUE", 1000, logger),
+		WriteBehindWorkers: getIntEnv("CIVIL_WRITE_BEHIND_WORKERS", 4, logger),
+
+		CDNSMaxAge:               getDurationEnv("CIVIL_CDN_S_MAXAGE", 0, logger),
+		CloudFrontDistributionID: os.Getenv("CIVIL_CLOUDFRONT_DISTRIBUTION_ID"),
+
+		CloudFrontKeyPairID:  os.Getenv("CIVIL_CLOUDFRONT_KEY_PAIR_ID"),
+		CloudFrontPrivateKey: os.Getenv("CIVIL_CLOUDFRONT_PRIVATE_KEY"),
+		CDNDomain:            os.Getenv("CIVIL_CDN_DOMAIN"),
+		CDNCookieDomain:      os.Getenv("CIVIL_CDN_COOKIE_DOMAIN"),
+		CDNCredentialsTTL:    getDurationEnv("CIVIL_CDN_CREDENTIALS_TTL", 10*time.Minute, logger),
+
+		ProbePath:             os.Getenv("CIVIL_PROBE_PATH"),
+		ProbeInterval:         getDurationEnv("CIVIL_PROBE_INTERVAL", 5*time.Second, logger),
+		ProbeTimeout:          getDurationEnv("CIVIL_PROBE_TIMEOUT", 2*time.Second, logger),
+		ProbeFailureThreshold: getIntEnv("CIVIL_PROBE_FAILURE_THRESHOLD", 3, logger),
+
+		EjectAfter:    getIntEnv("CIVIL_EJECT_AFTER_FAILURES", 5, logger),
+		EjectCooldown: getDurationEnv("CIVIL_EJECT_COOLDOWN", 30*time.Second, logger),
+
+		BackendReputation:          getBoolEnv("CIVIL_BACKEND_REPUTATION", false, logger),
+		ReputationTTL:              getDurationEnv("CIVIL_REPUTATION_TTL", 24*time.Hour, logger),
+		ReputationSaveInterval:     getDurationEnv("CIVIL_REPUTATION_SAVE_INTERVAL", 30*time.Second, logger),
+		ReputationSuspectErrorRate: getFloatEnv("CIVIL_REPUTATION_SUSPECT_ERROR_RATE", 0.2, logger),
+
+		RetryAttempts:       getIntEnv("CIVIL_RETRY_ATTEMPTS", 2, logger),
+		RetryAttemptTimeout: getDurationEnv("CIVIL_RETRY_ATTEMPT_TIMEOUT", 10*time.Second, logger),
+		RetryBudget:         getDurationEnv("CIVIL_RETRY_BUDGET", 30*time.Second, logger),
+
+		AdaptiveConcurrency:         getBoolEnv("CIVIL_ADAPTIVE_CONCURRENCY", false, logger),
+		ConcurrencyInitialLimit:     getIntEnv("CIVIL_CONCURRENCY_INITIAL_LIMIT", 20, logger),
+		ConcurrencyMinLimit:         getIntEnv("CIVIL_CONCURRENCY_MIN_LIMIT", 4, logger),
+		ConcurrencyMaxLimit:         getIntEnv("CIVIL_CONCURRENCY_MAX_LIMIT", 500, logger),
+		ConcurrencyLatencyTolerance: getFloatEnv("CIVIL_CONCURRENCY_LATENCY_TOLERANCE", 2, logger),
+		ConcurrencyQueueSize:        getIntEnv("CIVIL_CONCURRENCY_QUEUE_SIZE", 100, logger),
+		ConcurrencyQueueTimeout:     getDurationEnv("CIVIL_CONCURRENCY_QUEUE_TIMEOUT", time.Second, logger),
+		TenantWeights:               tenantWeights,
+
+		MaxInFlight:          getIntEnv("CIVIL_MAX_IN_FLIGHT", 0, logger),
+		InFlightQueueSize:    getIntEnv("CIVIL_IN_FLIGHT_QUEUE_SIZE", 100, logger),
+		InFlightQueueTimeout: getDurationEnv("CIVIL_IN_FLIGHT_QUEUE_TIMEOUT", 500*time.Millisecond, logger),
+		InFlightRetryAfter:   getDurationEnv("CIVIL_IN_FLIGHT_RETRY_AFTER", time.Second, logger),
+		ReadyMaxSaturation:   getFloatEnv("CIVIL_READY_MAX_SATURATION", 0, logger),
+
+		WatermarkImage: os.Getenv("CIVIL_WATERMARK_IMAGE"),
+		JPEGQuality:    getIntEnv("CIVIL_JPEG_QUALITY", 85, logger),
+		PublicURL:      os.Getenv("CIVIL_PUBLIC_URL"),
+
+		UpstreamUserAgent: getEnv("CIVIL_UPSTREAM_USER_AGENT", "civil-gateway/{version} ({instance})"),
+		UpstreamVia:       getEnv("CIVIL_UPSTREAM_VIA", "1.1 {instance} (civil-gateway/{version})"),
+		ClientUserAgent:   getEnv("CIVIL_CLIENT_USER_AGENT", clientUserAgentForward),
+
+		ClaimHeaders: claimHeaders,
+
+		UpstreamAuth:      getEnv("CIVIL_UPSTREAM_AUTH", upstreamAuthPass),
+		InternalJWTKey:    os.Getenv("CIVIL_INTERNAL_JWT_KEY"),
+		InternalJWTIssuer: getEnv("CIVIL_INTERNAL_JWT_ISSUER", "civil-gateway"),
+		InternalJWTTTL:    getDurationEnv("CIVIL_INTERNAL_JWT_TTL", time.Minute, logger),
+
+		CORS: cors,
+
+		Compression:            getBoolEnv("CIVIL_COMPRESSION", true, logger),
+		CompressionGzipLevel:   getIntEnv("CIVIL_COMPRESSION_GZIP_LEVEL", 6, logger),
+		CompressionBrotliLevel: getIntEnv("CIVIL_COMPRESSION_BROTLI_LEVEL", 4, logger),
+		CompressionMinBytes:    int64(getIntEnv("CIVIL_COMPRESSION_MIN_BYTES", 1024, logger)),
+
+		EgressCostPerGB: getFloatEnv("CIVIL_EGRESS_COST_PER_GB", 0.045, logger),
+		EgressWindow:    getDurationEnv("CIVIL_EGRESS_WINDOW", 24*time.Hour, logger),
+		EgressTenants:   egressTenants,
+
+		AnalyticsBucketURL: os.Getenv("CIVIL_ANALYTICS_BUCKET_URL"),
+		AnalyticsInterval:  getDurationEnv("CIVIL_ANALYTICS_INTERVAL", time.Hour, logger),
+		AnalyticsGeoZoom:   getIntEnv("CIVIL_ANALYTICS_GEO_ZOOM", 6, logger),
+		AnalyticsZoomBand:  getIntEnv("CIVIL_ANALYTICS_ZOOM_BAND", 4, logger),
+		AnalyticsMinUsers:  getIntEnv("CIVIL_ANALYTICS_MIN_USERS", 10, logger),
+
+		BillingBucketURL:         os.Getenv("CIVIL_BILLING_BUCKET_URL"),
+		BillingSpoolDir:          getEnv("CIVIL_BILLING_SPOOL_DIR", "/var/spool/civil-gateway/billing"),
+		BillingFlushInterval:     getDurationEnv("CIVIL_BILLING_FLUSH_INTERVAL", 10*time.Second, logger),
+		BillingBatchSize:         getIntEnv("CIVIL_BILLING_BATCH_SIZE", 10000, logger),
+		BillingTenantGroupPrefix: getEnv("CIVIL_BILLING_TENANT_GROUP_PREFIX", "tenant:"),
+
+		AccessLog:       getBoolEnv("CIVIL_ACCESS_LOG", true, logger),
+		AccessLogFormat: getEnv("CIVIL_ACCESS_LOG_FORMAT", "json"),
+
+		ErrorTemplates: os.Getenv("CIVIL_ERROR_TEMPLATES"),
+		ErrorLanguage:  getEnv("CIVIL_ERROR_LANGUAGE", "en"),
+
+		Plugins: plugins,
+
+		WASMModules:      wasmModules,
+		WASMMemoryMB:     getIntEnv("CIVIL_WASM_MEMORY_MB", 64, logger),
+		WASMTimeout:      getDurationEnv("CIVIL_WASM_TIMEOUT", 50*time.Millisecond, logger),
+		WASMMaxInstances: getIntEnv("CIVIL_WASM_MAX_INSTANCES", 8, logger),
+
+		UserRateLimit:   getFloatEnv("CIVIL_USER_RATE_LIMIT", 0, logger),
+		UserRateBurst:   getIntEnv("CIVIL_USER_RATE_BURST", 0, logger),
+		ClientRateLimit: getFloatEnv("CIVIL_CLIENT_RATE_LIMIT", 0, logger),
+		ClientRateBurst: getIntEnv("CIVIL_CLIENT_RATE_BURST", 0, logger),
+
+		RedisAddr:             os.Getenv("CIVIL_REDIS_ADDR"),
+		RateLimitRedisTimeout: getDurationEnv("CIVIL_RATE_LIMIT_REDIS_TIMEOUT", 50*time.Millisecond, logger),
+		ReplayRedisTimeout:    getDurationEnv("CIVIL_REPLAY_REDIS_TIMEOUT", 200*time.Millisecond, logger),
+
+		MemoryBudget:         getMemoryBudgetEnv(logger),
+		RateLimitMaxBytes:    int64(getIntEnv("CIVIL_RATE_LIMIT_MAX_BYTES", 16<<20, logger)),
+		CaptureMaxBytes:      int64(getIntEnv("CIVIL_CAPTURE_MAX_BYTES", 8<<20, logger)),
+		MemoryReportInterval: getDurationEnv("CIVIL_MEMORY_REPORT_INTERVAL", 0, logger),
 	}, nil
 }
 
+// PoolConfig describes a backend pool discovered through its own Cloud Map
+// namespace and the path prefix it is served under. RoleArn, when set, is
+// assumed for discovery so the namespace can be in another AWS account.
+// Cache puts the pool behind the tile cache, EmptyTiles answers the tiles
+// missing from the tile manifest without asking the pool, and WriteBehind
+// persists the tiles it renders to the tile bucket. Strategy picks the
+// endpoint for each request: round_robin (default), least_outstanding,
+// random, or consistent_hash, which keeps each tile on one backend. Auth
+// is required unless set to none, Groups limits the pool to users in one of
+// them, and Timeout bounds each request, as a duration like 30s.
+// Transforms names the registered response transformers to run over the
+// pool's responses, in order. ClientUserAgent overrides how the client's
+// User-Agent is passed to the pool, see UpstreamIdentity, and UpstreamAuth
+// what it gets of the client's credentials, see UpstreamAuth. WebSocket lists
+// the path prefixes where WebSocket upgrades are passed through to the pool.
+type PoolConfig struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+
+	// How the backends are discovered: cloudmap, the default, dns,
+	// kubernetes, or static. Service is the Cloud Map service, the DNS name,
+	// or the Kubernetes service, and Namespace the Cloud Map or Kubernetes
+	// namespace. DNS names are looked up as SRV records, or as A and AAAA
+	// records when Port is set. Port also picks the port of Kubernetes
+	// endpoints, which otherwise serve on their first, and of Cloud Map
+	// instances registered without one. AddressFamily picks the addresses
+	// of dual-stack Cloud Map instances and DNS names: v4, v6, or
+	// prefer-v6. Static pools serve Backends, a fixed list of backend URLs.
+	Discovery     string   `json:"discovery,omitempty"`
+	Namespace     string   `json:"namespace"`
+	Service       string   `json:"service"`
+	Port          int      `json:"port,omitempty"`
+	AddressFamily string   `json:"address_family,omitempty"`
+	Backends      []string `json:"backends,omitempty"`
+	RoleArn       string   `json:"role_arn"`
+	ExternalID    string   `json:"external_id"`
+
+	Cache       bool   `json:"cache"`
+	EmptyTiles  bool   `json:"empty_tiles"`
+	WriteBehind bool   `json:"write_behind"`
+	Strategy    string `json:"strategy"`
+
+	Auth    string   `json:"auth"`
+	Groups  []string `json:"groups,omitempty"`
+	Timeout string   `json:"timeout,omitempty"`
+
+	// Lets users in one of these groups, like editors, skip the tile cache
+	// by asking with Cache-Control: no-cache or X-Bypass-Cache, and adds
+	// cache_bust_param to what they ask the pool. See CacheBypass
+	CacheBypass    []string `json:"cache_bypass,omitempty"`
+	CacheBustParam string   `json:"cache_bust_param,omitempty"`
+
+	Transforms []string `json:"transforms,omitempty"`
+
+	ClientUserAgent string `json:"client_user_agent,omitempty"`
+	UpstreamAuth    string `json:"upstream_auth,omitempty"`
+
+	WebSocket []string `json:"websocket,omitempty"`
+
+	// Overrides CIVIL_UPSTREAM_PROTOCOL, http1 or h2c, and the connections
+	// kept and allowed per backend. See TransportConfig
+	Protocol            string `json:"protocol,omitempty"`
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost     int    `json:"max_conns_per_host,omitempty"`
+
+	// Caps the requests to the pool served at once, queueing and shedding
+	// the rest like CIVIL_MAX_IN_FLIGHT does for the whole gateway
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// Makes the pool the canary of the pool named, taking canary_weight
+	// percent of its requests during a rollout. A canary has no prefix of
+	// its own. See CanaryAnalyzer
+	CanaryOf     string `json:"canary_of,omitempty"`
+	CanaryWeight int    `json:"canary_weight,omitempty"`
+}
+
+// discoversWithCloudMap reports whether the pool's backends are discovered
+// through Cloud Map
+func (pc PoolConfig) discoversWithCloudMap() bool {
+	return pc.Discovery == "" || pc.Discovery == discoveryCloudMap
+}
+
+// RequestTimeout is the pool's parsed Timeout, 0 when unset
+func (pc PoolConfig) RequestTimeout() time.Duration {
+	timeout, _ := time.ParseDuration(pc.Timeout)
+	return timeout
+}
+
+// WAFRuleConfig is one gateway WAF rule. A rule matches when every condition
+// it sets holds: the path regex, the header being present (and matching
+// header_match, if given), the client address being in one of the CIDRs, and
+// the client going over rate_limit requests per second.
+type WAFRuleConfig struct {
+	Name        string   `json:"name"`
+	Action      string   `json:"action"` // allow, block, or count
+	Path        string   `json:"path"`
+	Header      string   `json:"header"`
+	HeaderMatch string   `json:"header_match"`
+	CIDRs       []string `json:"cidrs"`
+	RateLimit   float64  `json:"rate_limit"`
+	RateBurst   int      `json:"rate_burst"`
+	RateKey     string   `json:"rate_key"` // ip (default) or fingerprint
+}
+
 // Helper for optional variables
-// func getEnv(key, fallback string) string {
-// 	if value, exists := os.LookupEnv(key); exists {
-// 		return value
-// 	}
-// 	return fallback
-// }
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
 
 func getVerboseEnv() bool {
 	if value, exists := os.LookupEnv("CIVIL_VERBOSE"); exists {
@@ -84,6 +1072,21 @@ func getVerboseEnv() bool {
 	return false
 }
 
+func getBoolEnv(key string, fallback bool, logger *slog.Logger) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		boolValue, err := strconv.ParseBool(value)
+
+		if err != nil {
+			logger.Warn("Failure in parsing boolean. Falling back to default", slog.String("key", key), slog.Any("error", err), slog.Bool("applied_default", fallback))
+			return fallback
+		}
+
+		return boolValue
+	}
+
+	return fallback
+}
+
 func getPortEnv(key string, fallback uint16, logger *slog.Logger) uint16 {
 	if value, exists := os.LookupEnv(key); exists {
 		var intValue, err = strconv.ParseUint(value, 10, 16)
@@ -100,6 +1103,645 @@ func getPortEnv(key string, fallback uint16, logger *slog.Logger) uint16 {
 
 }
 
+// getPoolsEnv reads the pools from CIVIL_BACKEND_POOLS, a JSON array of
+// PoolConfig, followed by the routes of the config file. The single-namespace
+// CIVIL_CLOUD_MAP_* settings are kept as shorthand for a pool named "tiles"
+// served under /tiles/. For local development, CIVIL_STATIC_BACKENDS serves
+// that pool from a comma-separated list of backend URLs instead of Cloud Map.
+func getPoolsEnv(routes []PoolConfig) ([]PoolConfig, error) {
+	var pools []PoolConfig
+
+	if value := os.Getenv("CIVIL_BACKEND_POOLS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &pools); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_BACKEND_POOLS: %w", err)
+		}
+	}
+	pools = append(pools, routes...)
+
+	if namespace := os.Getenv("CIVIL_CLOUD_MAP_NAMESPACE"); namespace != "" {
+		pools = append([]PoolConfig{{
+			Name:        "tiles",
+			Prefix:      "/tiles/",
+			Namespace:   namespace,
+			Service:     os.Getenv("CIVIL_CLOUD_MAP_SERVICE"),
+			RoleArn:     os.Getenv("CIVIL_CLOUD_MAP_ROLE_ARN"),
+			ExternalID:  os.Getenv("CIVIL_CLOUD_MAP_EXTERNAL_ID"),
+			Cache:       true,
+			EmptyTiles:  true,
+			WriteBehind: true,
+		}}, pools...)
+	}
+
+	if value := os.Getenv("CIVIL_STATIC_BACKENDS"); value != "" {
+		if os.Getenv("CIVIL_CLOUD_MAP_NAMESPACE") != "" {
+			return nil, fmt.Errorf("CIVIL_STATIC_BACKENDS and CIVIL_CLOUD_MAP_NAMESPACE both define the tiles pool, set only one")
+		}
+
+		backends, err := parseStaticBackends(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_STATIC_BACKENDS: %w", err)
+		}
+
+		pools = append([]PoolConfig{{
+			Name:      "tiles",
+			Prefix:    "/tiles/",
+			Discovery: discoveryStatic,
+			Backends:  backends,
+			Cache:     true,
+		}}, pools...)
+	}
+
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+
+	for i, pool := range pools {
+		if pool.Name == "" || (pool.Service == "" && pool.Discovery != discoveryStatic) {
+			return nil, fmt.Errorf("every pool and route needs a name and service")
+		}
+
+		switch pool.Discovery {
+		case "", discoveryCloudMap:
+			if pool.Namespace == "" {
+				return nil, fmt.Errorf("pool %s: Cloud Map discovery needs a namespace", pool.Name)
+			}
+		case discoveryDNS, discoveryKubernetes:
+			if pool.RoleArn != "" {
+				return nil, fmt.Errorf("pool %s: role_arn only applies to Cloud Map discovery", pool.Name)
+			}
+		case discoveryStatic:
+			if pool.RoleArn != "" {
+				return nil, fmt.Errorf("pool %s: role_arn only applies to Cloud Map discovery", pool.Name)
+			}
+			if len(pool.Backends) == 0 {
+				return nil, fmt.Errorf("pool %s: static discovery needs backends", pool.Name)
+			}
+			backends := make([]string, 0, len(pool.Backends))
+			for _, raw := range pool.Backends {
+				backend, err := parseStaticBackend(raw)
+				if err != nil {
+					return nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+				}
+				backends = append(backends, backend)
+			}
+			pools[i].Backends = backends
+		default:
+			return nil, fmt.Errorf("pool %s: discovery must be one of: cloudmap, dns, kubernetes, static", pool.Name)
+		}
+
+		if len(pool.Backends) > 0 && pool.Discovery != discoveryStatic {
+			return nil, fmt.Errorf("pool %s: backends only apply to static discovery", pool.Name)
+		}
+
+		if pool.Port < 0 || pool.Port > 65535 {
+			return nil, fmt.Errorf("pool %s: port must be between 1 and 65535", pool.Name)
+		}
+
+		switch pool.AddressFamily {
+		case "":
+		case addressFamilyV4, addressFamilyV6, addressFamilyPreferV6:
+			if pool.Discovery != "" && pool.Discovery != discoveryCloudMap && pool.Discovery != discoveryDNS {
+				return nil, fmt.Errorf("pool %s: address_family only applies to Cloud Map and DNS discovery", pool.Name)
+			}
+		default:
+			return nil, fmt.Errorf("pool %s: address_family must be one of: v4, v6, prefer-v6", pool.Name)
+		}
+
+		if pool.CanaryOf != "" {
+			if pool.Prefix != "" {
+				return nil, fmt.Errorf("pool %s: a canary is served under the prefix of its stable pool, leave prefix unset", pool.Name)
+			}
+			if pool.CanaryWeight < 1 || pool.CanaryWeight > 100 {
+				return nil, fmt.Errorf("pool %s: canary_weight must be between 1 and 100", pool.Name)
+			}
+		} else if pool.CanaryWeight != 0 {
+			return nil, fmt.Errorf("pool %s: canary_weight requires canary_of", pool.Name)
+		} else if !strings.HasPrefix(pool.Prefix, "/") || !strings.HasSuffix(pool.Prefix, "/") {
+			return nil, fmt.Errorf("pool %s: prefix must start and end with /", pool.Name)
+		}
+
+		if pool.MaxInFlight < 0 {
+			return nil, fmt.Errorf("pool %s: max_in_flight must not be negative", pool.Name)
+		}
+
+		if slices.Contains(pool.Transforms, "tilejson") && os.Getenv("CIVIL_PUBLIC_URL") == "" {
+			return nil, fmt.Errorf("pool %s: the tilejson transform requires CIVIL_PUBLIC_URL", pool.Name)
+		}
+
+		if pool.MaxIdleConnsPerHost < 0 || pool.MaxConnsPerHost < 0 {
+			return nil, fmt.Errorf("pool %s: max_idle_conns_per_host and max_conns_per_host must not be negative", pool.Name)
+		}
+
+		switch cmp.Or(pool.Protocol, os.Getenv("CIVIL_UPSTREAM_PROTOCOL")) {
+		case "", upstreamProtocolHTTP1:
+		case upstreamProtocolH2C:
+			if len(pool.WebSocket) > 0 {
+				return nil, fmt.Errorf("pool %s: websocket requires protocol http1", pool.Name)
+			}
+		default:
+			return nil, fmt.Errorf("pool %s: protocol must be one of: http1, h2c", pool.Name)
+		}
+
+		switch pool.Strategy {
+		case "", "round_robin", "least_outstanding", "random", "consistent_hash":
+		default:
+			return nil, fmt.Errorf("pool %s: strategy must be one of: round_robin, least_outstanding, random, consistent_hash", pool.Name)
+		}
+
+		switch pool.Auth {
+		case "", "required", "none":
+		default:
+			return nil, fmt.Errorf("pool %s: auth must be one of: required, none", pool.Name)
+		}
+
+		if len(pool.Groups) > 0 && pool.Auth == "none" {
+			return nil, fmt.Errorf("pool %s: groups require auth", pool.Name)
+		}
+
+		if len(pool.CacheBypass) > 0 && (!pool.Cache || pool.Auth == "none") {
+			return nil, fmt.Errorf("pool %s: cache_bypass requires cache and auth", pool.Name)
+		}
+		if pool.CacheBustParam != "" && len(pool.CacheBypass) == 0 {
+			return nil, fmt.Errorf("pool %s: cache_bust_param requires cache_bypass", pool.Name)
+		}
+
+		switch pool.ClientUserAgent {
+		case "", clientUserAgentForward, clientUserAgentPreserve, clientUserAgentStrip:
+		default:
+			return nil, fmt.Errorf("pool %s: client_user_agent must be one of: forward, preserve, strip", pool.Name)
+		}
+
+		switch pool.UpstreamAuth {
+		case "", upstreamAuthPass, upstreamAuthStrip:
+		case upstreamAuthInternal:
+			if os.Getenv("CIVIL_INTERNAL_JWT_KEY") == "" {
+				return nil, fmt.Errorf("pool %s: upstream_auth internal requires CIVIL_INTERNAL_JWT_KEY", pool.Name)
+			}
+		default:
+			return nil, fmt.Errorf("pool %s: upstream_auth must be one of: pass, strip, internal", pool.Name)
+		}
+
+		if pool.Timeout != "" {
+			if timeout, err := time.ParseDuration(pool.Timeout); err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("pool %s: timeout must be a positive duration like 30s", pool.Name)
+			}
+		}
+
+		if pool.ExternalID != "" && pool.RoleArn == "" {
+			return nil, fmt.Errorf("pool %s: external_id requires role_arn", pool.Name)
+		}
+
+		if names[pool.Name] {
+			return nil, fmt.Errorf("pool %s is defined more than once", pool.Name)
+		}
+
+		if pool.CanaryOf == "" && prefixes[pool.Prefix] {
+			return nil, fmt.Errorf("pool %s: prefix %s is already served by another pool", pool.Name, pool.Prefix)
+		}
+
+		names[pool.Name] = true
+		if pool.CanaryOf == "" {
+			prefixes[pool.Prefix] = true
+		}
+	}
+
+	// Each stable pool has at most one canary, which can't have its own
+	canaries := map[string]string{}
+	for _, pool := range pools {
+		if pool.CanaryOf == "" {
+			continue
+		}
+		stable := slices.IndexFunc(pools, func(pc PoolConfig) bool { return pc.Name == pool.CanaryOf })
+		if stable < 0 {
+			return nil, fmt.Errorf("pool %s: canary_of %s is not a pool", pool.Name, pool.CanaryOf)
+		}
+		if pools[stable].CanaryOf != "" {
+			return nil, fmt.Errorf("pool %s: canary_of %s is itself a canary", pool.Name, pool.CanaryOf)
+		}
+		if other, ok := canaries[pool.CanaryOf]; ok {
+			return nil, fmt.Errorf("pool %s: %s already has canary %s", pool.Name, pool.CanaryOf, other)
+		}
+		canaries[pool.CanaryOf] = pool.Name
+	}
+
+	return pools, nil
+}
+
+// getWAFRulesEnv reads the WAF rules from CIVIL_WAF_RULES, a JSON array of
+// WAFRuleConfig evaluated in order
+func getWAFRulesEnv() ([]WAFRuleConfig, error) {
+	var rules []WAFRuleConfig
+
+	if value := os.Getenv("CIVIL_WAF_RULES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_WAF_RULES: %w", err)
+		}
+	}
+
+	names := map[string]bool{}
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("every rule in CIVIL_WAF_RULES needs a name")
+		}
+
+		switch rule.Action {
+		case "allow", "block", "count":
+		default:
+			return nil, fmt.Errorf("waf rule %s: action must be one of: allow, block, count", rule.Name)
+		}
+
+		if rule.Path == "" && rule.Header == "" && len(rule.CIDRs) == 0 && rule.RateLimit <= 0 {
+			return nil, fmt.Errorf("waf rule %s: needs at least one of path, header, cidrs, or rate_limit", rule.Name)
+		}
+
+		switch rule.RateKey {
+		case "", "ip", "fingerprint":
+		default:
+			return nil, fmt.Errorf("waf rule %s: rate_key must be one of: ip, fingerprint", rule.Name)
+		}
+
+		if rule.HeaderMatch != "" && rule.Header == "" {
+			return nil, fmt.Errorf("waf rule %s: header_match requires header", rule.Name)
+		}
+
+		if names[rule.Name] {
+			return nil, fmt.Errorf("waf rule %s is defined more than once", rule.Name)
+		}
+
+		names[rule.Name] = true
+	}
+
+	return rules, nil
+}
+
+// getHoneypotPathsEnv reads the decoy paths from CIVIL_HONEYPOT_PATHS, a JSON
+// array like ["/wp-admin/", "/.env"]
+func getHoneypotPathsEnv() ([]string, error) {
+	var paths []string
+
+	if value := os.Getenv("CIVIL_HONEYPOT_PATHS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &paths); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_HONEYPOT_PATHS: %w", err)
+		}
+	}
+
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("honeypot path %q must start with /", path)
+		}
+	}
+
+	return paths, nil
+}
+
+// getPluginsEnv reads the plugins to run from CIVIL_PLUGINS, a JSON array
+// like ["request-id"]
+func getPluginsEnv() ([]string, error) {
+	var plugins []string
+
+	if value := os.Getenv("CIVIL_PLUGINS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &plugins); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_PLUGINS: %w", err)
+		}
+	}
+
+	return plugins, nil
+}
+
+// getWebSocketPathsEnv reads the path prefixes WebSocket upgrades are passed
+// through on from CIVIL_WEBSOCKET_PATHS, a JSON array of strings
+func getWebSocketPathsEnv() ([]string, error) {
+	var paths []string
+
+	if value := os.Getenv("CIVIL_WEBSOCKET_PATHS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &paths); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_WEBSOCKET_PATHS: %w", err)
+		}
+	}
+
+	return paths, nil
+}
+
+// getTenantWeightsEnv reads the share of each pool's admission queue tenants
+// get from CIVIL_TENANT_WEIGHTS, a JSON object of weights by subject
+func getTenantWeightsEnv() (map[string]float64, error) {
+	var weights map[string]float64
+
+	if value := os.Getenv("CIVIL_TENANT_WEIGHTS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &weights); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_TENANT_WEIGHTS: %w", err)
+		}
+	}
+
+	for subject, weight := range weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("tenant %q needs a weight above 0", subject)
+		}
+	}
+
+	return weights, nil
+}
+
+// getCIDRsEnv reads CIDRs from key, a JSON array like ["10.0.0.0/16"], as
+// used by CIVIL_BACKEND_ALLOWED_CIDRS and CIVIL_TRUSTED_PROXIES
+func getCIDRsEnv(key string) ([]netip.Prefix, error) {
+	var cidrs []string
+
+	if value := os.Getenv(key); value != "" {
+		if err := json.Unmarshal([]byte(value), &cidrs); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+	}
+
+	prefixes, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return prefixes, nil
+}
+
+// getCORSEnv reads the CORS policy, starting from defaultCORSConfig.
+// CIVIL_CORS_ORIGINS, CIVIL_CORS_METHODS, CIVIL_CORS_HEADERS, and
+// CIVIL_CORS_EXPOSE_HEADERS are JSON arrays of strings, CIVIL_CORS_MAX_AGE a
+// duration, and CIVIL_CORS_ALLOW_CREDENTIALS a boolean.
+func getCORSEnv(logger *slog.Logger) (CORSConfig, error) {
+	cors := defaultCORSConfig
+
+	lists := []struct {
+		key   string
+		value *[]string
+	}{
+		{"CIVIL_CORS_ORIGINS", &cors.Origins},
+		{"CIVIL_CORS_METHODS", &cors.Methods},
+		{"CIVIL_CORS_HEADERS", &cors.Headers},
+		{"CIVIL_CORS_EXPOSE_HEADERS", &cors.ExposeHeaders},
+	}
+	for _, list := range lists {
+		if value := os.Getenv(list.key); value != "" {
+			var parsed []string
+			if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+				return CORSConfig{}, fmt.Errorf("failed to parse %s: %w", list.key, err)
+			}
+			*list.value = parsed
+		}
+	}
+
+	cors.MaxAge = getDurationEnv("CIVIL_CORS_MAX_AGE", cors.MaxAge, logger)
+	cors.AllowCredentials = getBoolEnv("CIVIL_CORS_ALLOW_CREDENTIALS", cors.AllowCredentials, logger)
+
+	return cors, nil
+}
+
+// getEgressTenantsEnv reads the subjects whose traffic is broken out in the
+// egress metrics from CIVIL_EGRESS_TENANTS, a JSON array of strings
+func getEgressTenantsEnv() ([]string, error) {
+	var tenants []string
+
+	if value := os.Getenv("CIVIL_EGRESS_TENANTS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &tenants); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_EGRESS_TENANTS: %w", err)
+		}
+	}
+
+	return tenants, nil
+}
+
+// getMiddlewareBudgetsEnv reads the middleware stage budgets from
+// CIVIL_MIDDLEWARE_BUDGETS, a JSON object of durations like {"auth": "100ms"}
+func getMiddlewareBudgetsEnv() (map[string]time.Duration, error) {
+	budgets := map[string]time.Duration{}
+
+	value := os.Getenv("CIVIL_MIDDLEWARE_BUDGETS")
+	if value == "" {
+		return budgets, nil
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse CIVIL_MIDDLEWARE_BUDGETS: %w", err)
+	}
+	for stage, budget := range raw {
+		parsed, err := time.ParseDuration(budget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIVIL_MIDDLEWARE_BUDGETS budget for %s: %w", stage, err)
+		}
+		budgets[stage] = parsed
+	}
+	return budgets, nil
+}
+
+// getSLOsEnv reads the service level objectives from CIVIL_SLOS, a JSON
+// array of SLOConfig
+func getSLOsEnv() ([]SLOConfig, error) {
+	var slos []SLOConfig
+
+	if value := os.Getenv("CIVIL_SLOS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &slos); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_SLOS: %w", err)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, slo := range slos {
+		if slo.Name == "" || !strings.HasPrefix(slo.Prefix, "/") {
+			return nil, fmt.Errorf("every SLO needs a name and a prefix starting with /")
+		}
+		if names[slo.Name] {
+			return nil, fmt.Errorf("SLO %q is listed twice", slo.Name)
+		}
+		names[slo.Name] = true
+
+		if slo.Objective <= 0 || slo.Objective >= 1 {
+			return nil, fmt.Errorf("SLO %s: objective must be between 0 and 1, like 0.999", slo.Name)
+		}
+		if slo.Latency != "" && slo.LatencyThreshold() <= 0 {
+			return nil, fmt.Errorf("SLO %s: latency must be a positive duration like 300ms", slo.Name)
+		}
+	}
+
+	return slos, nil
+}
+
+// getWASMModulesEnv reads the filter modules to load from CIVIL_WASM_MODULES,
+// a JSON array of WASMModuleConfig
+func getWASMModulesEnv() ([]WASMModuleConfig, error) {
+	var modules []WASMModuleConfig
+
+	if value := os.Getenv("CIVIL_WASM_MODULES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &modules); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_WASM_MODULES: %w", err)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, module := range modules {
+		if module.Name == "" || module.URL == "" {
+			return nil, fmt.Errorf("wasm modules need a name and a url")
+		}
+		if names[module.Name] {
+			return nil, fmt.Errorf("wasm module %q is listed twice", module.Name)
+		}
+		names[module.Name] = true
+	}
+
+	return modules, nil
+}
+
+// getStaticRoutesEnv reads the static routes from CIVIL_STATIC_ROUTES, a JSON
+// array of StaticRouteConfig
+func getStaticRoutesEnv() ([]StaticRouteConfig, error) {
+	var routes []StaticRouteConfig
+
+	if value := os.Getenv("CIVIL_STATIC_ROUTES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &routes); err != nil {
+			return nil, fmt.Errorf("failed to parse CIVIL_STATIC_ROUTES: %w", err)
+		}
+	}
+
+	paths := map[string]bool{}
+
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return nil, fmt.Errorf("static route %q: path must start with /", route.Path)
+		}
+
+		if route.Body != "" && route.File != "" {
+			return nil, fmt.Errorf("static route %s: set body or file, not both", route.Path)
+		}
+
+		if route.Status != 0 && (route.Status < 100 || route.Status > 599) {
+			return nil, fmt.Errorf("static route %s: invalid status %d", route.Path, route.Status)
+		}
+
+		if paths[route.Path] {
+			return nil, fmt.Errorf("static route %s is defined more than once", route.Path)
+		}
+
+		paths[route.Path] = true
+	}
+
+	return routes, nil
+}
+
+func getDurationEnv(key string, fallback time.Duration, logger *slog.Logger) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		duration, err := time.ParseDuration(value)
+
+		if err != nil || duration <= 0 {
+			logger.Warn("Failure in parsing duration. Falling back to default", slog.String("key", key), slog.Any("error", err), slog.Duration("applied_default", fallback))
+			return fallback
+		}
+
+		return duration
+	}
+
+	return fallback
+}
+
+func getIntEnv(key string, fallback int, logger *slog.Logger) int {
+	if value, exists := os.LookupEnv(key); exists {
+		intValue, err := strconv.Atoi(value)
+
+		if err != nil || intValue < 0 {
+			logger.Warn("Failure in parsing integer. Falling back to default", slog.String("key", key), slog.Any("error", err), slog.Int("applied_default", fallback))
+			return fallback
+		}
+
+		return intValue
+	}
+
+	return fallback
+}
+
+func getFloatEnv(key string, fallback float64, logger *slog.Logger) float64 {
+	if value, exists := os.LookupEnv(key); exists {
+		floatValue, err := strconv.ParseFloat(value, 64)
+
+		if err != nil {
+			logger.Warn("Failure in parsing float. Falling back to default", slog.String("key", key), slog.Any("error", err), slog.Float64("applied_default", fallback))
+			return fallback
+		}
+
+		return floatValue
+	}
+
+	return fallback
+}
+
+// getMemoryBudgetEnv reads the memory budget in bytes from
+// CIVIL_MEMORY_BUDGET, falling back to half the cgroup memory limit, and to
+// no budget outside a container with a limit
+func getMemoryBudgetEnv(logger *slog.Logger) int64 {
+	if _, exists := os.LookupEnv("CIVIL_MEMORY_BUDGET"); exists {
+		return int64(getIntEnv("CIVIL_MEMORY_BUDGET", 0, logger))
+	}
+
+	data, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err != nil {
+		return 0
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		// "max" when the container has no limit
+		return 0
+	}
+	return limit / 2
+}
+
+// getOIDCIssuerEnv reads the issuer URL from CIVIL_OIDC_ISSUER, falling back
+// to CIVIL_AUTH_SERVER, which is https:// unless it names a scheme
+func getOIDCIssuerEnv() string {
+	if issuer := os.Getenv("CIVIL_OIDC_ISSUER"); issuer != "" {
+		return issuer
+	}
+
+	authServer := os.Getenv("CIVIL_AUTH_SERVER")
+	if strings.HasPrefix(authServer, "http://") || strings.HasPrefix(authServer, "https://") {
+		return authServer
+	}
+	return "https://" + authServer
+}
+
+// getIssuersEnv reads the accepted issuers from CIVIL_OIDC_ISSUERS, a JSON
+// array of IssuerConfig, or else accepts single, the issuer of
+// CIVIL_OIDC_ISSUER, CIVIL_JWKS_URL, and CIVIL_ALLOWED_CLIENT_IDS
+func getIssuersEnv(single IssuerConfig) ([]IssuerConfig, error) {
+	value := os.Getenv("CIVIL_OIDC_ISSUERS")
+	if value == "" {
+		return []IssuerConfig{single}, nil
+	}
+
+	var issuers []IssuerConfig
+	if err := json.Unmarshal([]byte(value), &issuers); err != nil {
+		return nil, fmt.Errorf("failed to parse CIVIL_OIDC_ISSUERS: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for _, issuer := range issuers {
+		if issuer.Issuer == "" || len(issuer.ClientIDs) == 0 {
+			return nil, fmt.Errorf("every issuer in CIVIL_OIDC_ISSUERS needs an issuer and client_ids")
+		}
+		if seen[issuer.Issuer] {
+			return nil, fmt.Errorf("issuer %s is defined more than once", issuer.Issuer)
+		}
+		seen[issuer.Issuer] = true
+	}
+
+	return issuers, nil
+}
+
+// getJWKSURLEnv reads the internal JWKS URL from CIVIL_JWKS_URL, falling back
+// to the /keys endpoint of CIVIL_IDP_HOST. Empty means OIDC discovery.
+func getJWKSURLEnv() string {
+	if url := os.Getenv("CIVIL_JWKS_URL"); url != "" {
+		return url
+	}
+	if host := os.Getenv("CIVIL_IDP_HOST"); host != "" {
+		return "http://" + host + "/keys"
+	}
+	return ""
+}
+
 func getAllowedClientIdsEnv() []string {
 	if value, exists := os.LookupEnv("CIVIL_ALLOWED_CLIENT_IDS"); exists {
 		var clientIds []string
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// FileConfig is the config file named by CIVIL_CONFIG_FILE, written in YAML
+// or JSON. Routes are backend pools like those in CIVIL_BACKEND_POOLS, each
+// mapping a path prefix to a Cloud Map service, and are served alongside
+// them. Settings stand in for the CIVIL_* environment variables, named
+// without the prefix in lower case, like cache_ttl: 5m. Lists and objects
+// are given as YAML rather than JSON strings. A variable set in the
+// environment wins over its setting.
+type FileConfig struct {
+	Routes   []PoolConfig   `json:"routes,omitempty"`
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+var settingNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// appliedSettings are the environment variables set from the config file,
+// which a reload sets again from the file as it is then
+var appliedSettings = map[string]bool{}
+
+// settingEnvName is the environment variable a setting stands in for
+func settingEnvName(name string) string {
+	return "CIVIL_" + strings.ToUpper(name)
+}
+
+// applySettings sets the environment variable of every setting not already
+// set, so the settings are read like the environment. The variables set by
+// an earlier load are unset first, so settings changed or removed since
+// then don't linger.
+func (f *FileConfig) applySettings() error {
+	for key := range appliedSettings {
+		os.Unsetenv(key)
+		delete(appliedSettings, key)
+	}
+
+	for name, value := range f.Settings {
+		if !settingNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid setting %q: settings are named in lower case, like cache_ttl", name)
+		}
+		if name == "config_file" {
+			return fmt.Errorf("the config file can't name another config file")
+		}
+
+		key := settingEnvName(name)
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+
+		var env string
+		switch v := value.(type) {
+		case string:
+			env = v
+		case nil:
+			continue
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("invalid setting %s: %w", name, err)
+			}
+			env = string(data)
+		}
+
+		if err := os.Setenv(key, env); err != nil {
+			return fmt.Errorf("failed to apply setting %s: %w", name, err)
+		}
+		appliedSettings[key] = true
+	}
+
+	return nil
+}
+
+// loadConfigFile reads the config file at path. Files ending in .json are
+// parsed as JSON and anything else as YAML. YAML is converted to JSON before
+// decoding, so both use the same json field names.
+func loadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if filepath.Ext(path) != ".json" {
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	var config FileConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return &config, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CORSConfig is the cross-origin policy of the API routes. Origins are the
+// origins browsers may call from, like https://maps.example.com, where
+// https://*.example.com allows every subdomain and * any origin. With
+// AllowCredentials set, browsers send cookies and auth headers along, which
+// needs every origin spelled out.
+type CORSConfig struct {
+	Origins          []string      `json:"origins"`
+	Methods          []string      `json:"methods"`
+	Headers          []string      `json:"headers"`
+	ExposeHeaders    []string      `json:"expose_headers"`
+	MaxAge           time.Duration `json:"max_age"`
+	AllowCredentials bool          `json:"allow_credentials"`
+}
+
+// defaultCORSConfig lets any origin call the API without credentials, with
+// the headers Connect and gRPC-Web clients send and read
+var defaultCORSConfig = CORSConfig{
+	Origins: []string{"*"},
+	Methods: []string{"POST", "GET", "OPTIONS"},
+	Headers: []string{
+		"Authorization",
+		"Content-Type",
+		"Connect-Protocol-Version",
+		"Connect-Timeout-Ms",
+		"Connect-Accept-Encoding",
+		"Connect-Content-Encoding",
+		"Grpc-Timeout",
+		"X-Grpc-Web",
+		"X-User-Agent",
+		"X-API-Key",
+	},
+	ExposeHeaders: []string{
+		"Connect-Protocol-Version",
+		"Connect-Timeout-Ms",
+		"Grpc-Status",
+		"Grpc-Message",
+		"Grpc-Status-Details-Bin",
+	},
+	MaxAge: 2 * time.Hour,
+}
+
+// corsOrigin is one allowed origin. A wildcard origin matches any host
+// ending in suffix, with the scheme and port given.
+type corsOrigin struct {
+	scheme string
+	host   string
+	port   string
+	suffix string
+}
+
+func parseCORSOrigin(origin string) (corsOrigin, error) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return corsOrigin{}, fmt.Errorf("invalid CORS origin %q, expected scheme://host", origin)
+	}
+
+	parsed := corsOrigin{scheme: strings.ToLower(u.Scheme), port: u.Port()}
+	host := strings.ToLower(u.Hostname())
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		if suffix == "" || strings.Contains(suffix, "*") {
+			return corsOrigin{}, fmt.Errorf("invalid CORS origin %q, wildcards only cover subdomains", origin)
+		}
+		parsed.suffix = "." + suffix
+	} else if strings.Contains(host, "*") {
+		return corsOrigin{}, fmt.Errorf("invalid CORS origin %q, wildcards only cover subdomains", origin)
+	} else {
+		parsed.host = host
+	}
+	return parsed, nil
+}
+
+func (o corsOrigin) matches(u *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, o.scheme) || u.Port() != o.port {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if o.suffix != "" {
+		return strings.HasSuffix(host, o.suffix)
+	}
+	return host == o.host
+}
+
+// CORSPolicy answers preflights and sets the CORS headers of API responses
+// for the origins it allows, echoing the origin back rather than *
+type CORSPolicy struct {
+	rules  atomic.Pointer[corsRules]
+	logger *slog.Logger
+}
+
+// corsRules are the parsed origins of a CORSConfig
+type corsRules struct {
+	config    CORSConfig
+	anyOrigin bool
+	origins   []corsOrigin
+}
+
+func NewCORSPolicy(config CORSConfig, logger *slog.Logger) (*CORSPolicy, error) {
+	policy := &CORSPolicy{logger: logger}
+	if err := policy.Update(config); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Update swaps in config for the requests that come after it. An invalid
+// config leaves the policy as it was.
+func (p *CORSPolicy) Update(config CORSConfig) error {
+	commit, err := p.Prepare(config)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare checks config, and returns the function that swaps it in
+func (p *CORSPolicy) Prepare(config CORSConfig) (func(), error) {
+	rules := &corsRules{config: config}
+
+	for _, origin := range config.Origins {
+		if origin == "*" {
+			rules.anyOrigin = true
+			continue
+		}
+		parsed, err := parseCORSOrigin(origin)
+		if err != nil {
+			return nil, err
+		}
+		rules.origins = append(rules.origins, parsed)
+	}
+
+	if rules.anyOrigin && config.AllowCredentials {
+		return nil, fmt.Errorf("CORS credentials can't be allowed for any origin, list the origins instead of *")
+	}
+
+	return func() { p.rules.Store(rules) }, nil
+}
+
+// allowed reports whether browsers may call from origin
+func (r *corsRules) allowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if r.anyOrigin {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(r.origins, func(o corsOrigin) bool { return o.matches(u) })
+}
+
+// Middleware sets the CORS headers for allowed origins and answers
+// preflights. Other origins get no CORS headers, which browsers enforce.
+func (p *CORSPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+
+		// The headers depend on the origin, so caches must keep them apart
+		h.Add("Vary", "Origin")
+
+		rules := p.rules.Load()
+		if rules.allowed(origin) {
+			config := rules.config
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Methods", strings.Join(config.Methods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(config.Headers, ", "))
+			if len(config.ExposeHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(config.ExposeHeaders, ", "))
+			}
+			if config.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+			}
+			if config.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		} else if origin != "" {
+			p.logger.Debug("origin not allowed by CORS policy", slog.String("origin", origin), slog.String("path", r.URL.Path))
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
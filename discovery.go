@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+)
+
+// Discoverer finds the healthy instances of a pool's backends, in Cloud
+// Map, DNS, Kubernetes, or a static list. See newDiscoverer
+type Discoverer interface {
+	Discover(ctx context.Context, limits discoveryLimits) ([]DiscoveredInstance, error)
+}
+
+// DiscoveredInstance is one healthy instance, at Address as host:port. Its
+// Weight, 1 when left at 0, sizes its share of the traffic, and Zone is the
+// availability zone it runs in, if known.
+type DiscoveredInstance struct {
+	Address string
+	Weight  int
+	Zone    string
+}
+
+// discoveryLimits bound how much one poll discovers, and how much it asks
+// for at a time where the provider pages
+type discoveryLimits struct {
+	pageSize     int
+	maxInstances int
+}
+
+// credentialRecoverer is a Discoverer that can recover from its credentials
+// going bad
+type credentialRecoverer interface {
+	recoverCredentials(ctx context.Context, failures int)
+}
+
+// newDiscoverer builds the Discoverer pc.Discovery names: cloudmap, the
+// default, dns, kubernetes, or static
+func newDiscoverer(ctx context.Context, pc PoolConfig, logger *slog.Logger) (Discoverer, error) {
+	switch pc.Discovery {
+	case "", discoveryCloudMap:
+		return newCloudMapDiscoverer(ctx, pc, logger)
+	case discoveryDNS:
+		return newDNSDiscoverer(pc), nil
+	case discoveryKubernetes:
+		return newKubernetesDiscoverer(pc)
+	case discoveryStatic:
+		return newStaticDiscoverer(pc), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery provider %q", pc.Discovery)
+	}
+}
+
+// What a poll that finds no healthy instances does to the endpoints already
+// discovered. See DiscoveryConfig
+const (
+	emptyDiscoveryKeepLastKnown = "keep-last-known"
+	emptyDiscoveryClear         = "clear-immediately"
+)
+
+// The providers pools discover their backends with
+const (
+	discoveryCloudMap   = "cloudmap"
+	discoveryDNS        = "dns"
+	discoveryKubernetes = "kubernetes"
+	discoveryStatic     = "static"
+)
+
+// Which addresses of dual-stack backends are used: only IPv4, only IPv6,
+// or IPv6 where there is one. Cloud Map pools default to IPv4, and DNS pools
+// to every address the name has
+const (
+	addressFamilyV4       = "v4"
+	addressFamilyV6       = "v6"
+	addressFamilyPreferV6 = "prefer-v6"
+)
+
+// staleAfterIntervals is how many poll intervals may pass without a
+// successful discovery before the pool's endpoints are reported as stale
+const staleAfterIntervals = 3
+
+var (
+	discoveryErrors = NewCounter(
+		"civil_gateway_discovery_errors_total",
+		"Failed discovery calls by failure reason",
+		"pool", "reason",
+	)
+	discoveryConsecutiveFailures = NewGauge(
+		"civil_gateway_discovery_consecutive_failures",
+		"Failed discovery calls since the last success",
+		"pool",
+	)
+	discoveryLastSuccess = NewGauge(
+		"civil_gateway_discovery_last_success_timestamp_seconds",
+		"Unix time of the last successful discovery call",
+		"pool",
+	)
+	discoveryTruncated = NewCounter(
+		"civil_gateway_discovery_truncated_total",
+		"Discovery calls that found as many instances as the pool takes, possibly leaving some out",
+		"pool",
+	)
+	discoveryServingStale = NewGauge(
+		"civil_gateway_discovery_serving_stale",
+		"1 while the pool serves the endpoints it last knew of because discovery finds no healthy instances",
+		"pool",
+	)
+	discoveryEndpoints = NewGauge(
+		"civil_gateway_discovery_endpoints",
+		"Endpoints currently in the pool's rotation",
+		"pool",
+	)
+)
+
+// classifyDiscoveryError buckets a discovery failure. Credential
+// failures are split out because retrying them with the same client rarely
+// helps, while the rest are usually transient.
+func classifyDiscoveryError(err error) string {
+	// The signer wraps any failure to retrieve credentials (expired task
+	// role, IMDS or container endpoint hiccups, failed AssumeRole)
+	var signingErr *v4.SigningError
+	if errors.As(err, &signingErr) {
+		return "credentials"
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ExpiredToken", "ExpiredTokenException", "InvalidClientTokenId", "UnrecognizedClientException", "InvalidSignatureException":
+			return "credentials"
+		case "AccessDenied", "AccessDeniedException":
+			return "access_denied"
+		case "ThrottlingException", "Throttling", "RequestLimitExceeded", "TooManyRequestsException":
+			return "throttled"
+		}
+		return "api"
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "canceled"
+	}
+
+	return "transport"
+}
+
+// discoveryDelay is how long until the next poll, see DiscoveryConfig
+func (bm *BackendManager) discoveryDelay(error) time.Duration {
+	bm.mu.RLock()
+	interval, failures := bm.interval, bm.consecutiveFailures
+	jitter, maxBackoff := bm.discoveryJitter, bm.maxBackoff
+	bm.mu.RUnlock()
+
+	if failures == 0 {
+		return time.Duration(float64(interval) * (1 + jitter*(2*rand.Float64()-1)))
+	}
+
+	backoff := interval
+	for range failures {
+		if backoff >= maxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	backoff = max(min(backoff, maxBackoff), interval)
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+func (bm *BackendManager) recordDiscoverySuccess() {
+	now := time.Now()
+
+	bm.mu.Lock()
+	recovered := bm.consecutiveFailures > 0
+	failures := bm.consecutiveFailures
+	bm.consecutiveFailures = 0
+	bm.lastSuccess = now
+	bm.mu.Unlock()
+
+	if recovered {
+		bm.logger.Info("discovery recovered", slog.Int("failed_attempts", failures))
+	}
+
+	discoveryConsecutiveFailures.Set(0, bm.pool)
+	discoveryLastSuccess.Set(float64(now.Unix()), bm.pool)
+}
+
+func (bm *BackendManager) recordDiscoveryFailure(ctx context.Context, err error) {
+	reason := classifyDiscoveryError(err)
+
+	bm.mu.Lock()
+	bm.consecutiveFailures++
+	failures := bm.consecutiveFailures
+	lastSuccess := bm.lastSuccess
+	interval := bm.interval
+	bm.mu.Unlock()
+
+	discoveryErrors.Inc(bm.pool, reason)
+	discoveryConsecutiveFailures.Set(float64(failures), bm.pool)
+
+	if reason == "credentials" {
+		bm.logger.Error("discovery failed to obtain valid AWS credentials",
+			slog.Int("consecutive_failures", failures),
+			slog.Any("error", err),
+		)
+		if recoverer, ok := bm.discoverer.(credentialRecoverer); ok {
+			recoverer.recoverCredentials(ctx, failures)
+		}
+	} else {
+		bm.logger.Warn("error discovering instances",
+			slog.String("reason", reason),
+			slog.Int("consecutive_failures", failures),
+			slog.Any("error", err),
+		)
+	}
+
+	// Make serving from an old endpoint list loud rather than silent
+	if interval > 0 && !lastSuccess.IsZero() && time.Since(lastSuccess) > staleAfterIntervals*interval {
+		bm.logger.Error("serving stale endpoints, discovery has not succeeded recently",
+			slog.Duration("since_last_success", time.Since(lastSuccess).Round(time.Second)),
+			slog.Int("endpoints", bm.EndpointCount()),
+		)
+	}
+}
+
+// DiscoveryConfig sets how pools discover their backends. Every Interval, up
+// to MaxInstances healthy instances are discovered. DiscoverInstances
+// answers with at most discoverMaxResults and can't be paged, so services
+// that may have more are listed PageSize instances at a time instead.
+//
+// When discovery finds no healthy instances, EmptyPolicy either keeps the
+// endpoints last known, for up to EmptyMaxStaleness or forever if 0, or
+// clears them so requests are turned away until instances are back.
+//
+// Newly discovered endpoints are asked for their capabilities on
+// CapabilitiesPath, unless it is empty.
+//
+// When Zone, the gateway's availability zone, is known, requests go to the
+// endpoints in the same zone while at least ZoneMinEndpoints of them are
+// healthy.
+//
+// With AllowedCIDRs set, instances whose addresses are outside all of them
+// are left out of the pool.
+//
+// Each wait between polls is Jitter of Interval shorter or longer, so
+// replicas don't poll in lockstep. After consecutive failures, like
+// throttling, the waits double from twice Interval up to MaxBackoff, and
+// are anywhere between half and all of that.
+type DiscoveryConfig struct {
+	Interval          time.Duration
+	PageSize          int
+	MaxInstances      int
+	EmptyPolicy       string
+	EmptyMaxStaleness time.Duration
+	CapabilitiesPath  string
+	Zone              string
+	ZoneMinEndpoints  int
+	AllowedCIDRs      []netip.Prefix
+	Jitter            float64
+	MaxBackoff        time.Duration
+}
+
+// applyEmptyDiscovery decides what happens to the endpoints once discovery
+// has found no healthy instances. bm.mu must be held.
+func (bm *BackendManager) applyEmptyDiscovery(now time.Time) {
+	if len(bm.endpoints) == 0 {
+		return
+	}
+
+	stale := now.Sub(bm.lastDiscovered)
+	if bm.emptyPolicy == emptyDiscoveryKeepLastKnown && (bm.emptyMaxStaleness <= 0 || stale <= bm.emptyMaxStaleness) {
+		if !bm.servingStale {
+			bm.servingStale = true
+			bm.logger.Warn("discovery found no healthy instances, serving the endpoints last known",
+				slog.Int("endpoints", len(bm.endpoints)),
+				slog.Duration("max_staleness", bm.emptyMaxStaleness),
+			)
+		}
+		discoveryServingStale.Set(1, bm.pool)
+		return
+	}
+
+	bm.logger.Error("discovery found no healthy instances, clearing the endpoints",
+		slog.String("policy", bm.emptyPolicy),
+		slog.Int("endpoints", len(bm.endpoints)),
+		slog.Duration("since_last_discovered", stale.Round(time.Second)),
+	)
+	bm.servingStale = false
+	discoveryServingStale.Set(0, bm.pool)
+	bm.endpoints = []string{}
+	bm.updateRotation()
+}
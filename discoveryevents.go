@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// discoveryEventsRetry is how long the consumer waits after failing to
+	// receive from the queue before it tries again
+	discoveryEventsRetry = 5 * time.Second
+
+	// discoveryQueuePrefix starts the name of each replica's queue, which
+	// the task role may create and delete
+	discoveryQueuePrefix = "civil-gateway-discovery-"
+
+	// discoveryQueueRetention is how long events are kept in a replica's
+	// queue, the least SQS allows: events older than that are covered by
+	// the fallback poll, and the queues of replicas that died without
+	// deleting them don't pile them up
+	discoveryQueueRetention = "60"
+)
+
+// invalidQueueNameChars are the characters SQS queue names can't hold
+var invalidQueueNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// discoveryEventNames are the Cloud Map API calls that change which
+// instances a service has, or whether they are healthy
+var discoveryEventNames = []string{
+	"RegisterInstance",
+	"DeregisterInstance",
+	"UpdateInstanceCustomHealthStatus",
+}
+
+var discoveryEvents = NewCounter(
+	"civil_gateway_discovery_events_total",
+	"Cloud Map change events received from the discovery queue, by what they led to",
+	"result",
+)
+
+// discoveryEventsAPI is the part of the SQS client the consumer uses
+type discoveryEventsAPI interface {
+	CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+	SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error)
+	DeleteQueue(ctx context.Context, params *sqs.DeleteQueueInput, optFns ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+}
+
+// discoveryTopicAPI is the part of the SNS client the consumer uses
+type discoveryTopicAPI interface {
+	Subscribe(ctx context.Context, params *sns.SubscribeInput, optFns ...func(*sns.Options)) (*sns.SubscribeOutput, error)
+	Unsubscribe(ctx context.Context, params *sns.UnsubscribeInput, optFns ...func(*sns.Options)) (*sns.UnsubscribeOutput, error)
+}
+
+// discoveryEvent is the part of an EventBridge event the consumer reads.
+// Cloud Map calls come through CloudTrail, with the service in the request.
+type discoveryEvent struct {
+	Source     string `json:"source"`
+	DetailType string `json:"detail-type"`
+	Detail     struct {
+		EventName         string `json:"eventName"`
+		RequestParameters struct {
+			ServiceID string `json:"serviceId"`
+		} `json:"requestParameters"`
+	} `json:"detail"`
+}
+
+// DiscoveryEvents rediscovers a Cloud Map pool as soon as its instances
+// change, instead of at its next poll. An EventBridge rule matching the
+// servicediscovery.amazonaws.com calls in discoveryEventNames, as recorded
+// by CloudTrail, sends them to the SNS topic at topicArn. Every replica has
+// to see every event, so each creates a queue of its own, named after its
+// instance ID, subscribes it to the topic, and deletes both when it stops.
+// Polling goes on at a slow interval as a safety net for lost or late
+// events, like those sent while a replica was starting.
+type DiscoveryEvents struct {
+	topicArn        string
+	queueURL        string
+	subscriptionArn string
+	client          discoveryEventsAPI
+	topic           discoveryTopicAPI
+	pools           *BackendPools
+	scheduler       *Scheduler
+	logger          *slog.Logger
+}
+
+// NewDiscoveryEvents subscribes a queue of the replica's own to the topic,
+// and consumes it on stage until it stops
+func NewDiscoveryEvents(ctx context.Context, stage *Stage, topicArn string, pools *BackendPools, scheduler *Scheduler, logger *slog.Logger) (*DiscoveryEvents, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	e := &DiscoveryEvents{
+		topicArn:  topicArn,
+		client:    sqs.NewFromConfig(cfg),
+		topic:     sns.NewFromConfig(cfg),
+		pools:     pools,
+		scheduler: scheduler,
+		logger:    logger,
+	}
+	if err := e.subscribe(ctx, detectInstanceID()); err != nil {
+		return nil, err
+	}
+	stage.Go("discovery-events", e.consume)
+	stage.OnStop("discovery-events-queue", e.unsubscribe)
+	return e, nil
+}
+
+// subscribe creates the queue of the replica called instance, lets the
+// topic send to it, and subscribes it. A replica restarting under the same
+// name takes its queue back.
+func (e *DiscoveryEvents) subscribe(ctx context.Context, instance string) error {
+	name := discoveryQueuePrefix + invalidQueueNameChars.ReplaceAllString(instance, "-")
+	name = name[:min(len(name), 80)]
+
+	queue, err := e.client.CreateQueue(ctx, &sqs.CreateQueueInput{
+		QueueName: aws.String(name),
+		Attributes: map[string]string{
+			string(types.QueueAttributeNameMessageRetentionPeriod): discoveryQueueRetention,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create discovery events queue %s: %w", name, err)
+	}
+	e.queueURL = aws.ToString(queue.QueueUrl)
+
+	attributes, err := e.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       queue.QueueUrl,
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up discovery events queue %s: %w", name, err)
+	}
+	queueArn := attributes.Attributes[string(types.QueueAttributeNameQueueArn)]
+
+	policy, err := json.Marshal(iamPolicy{
+		Version: "2012-10-17",
+		Statement: []iamStatement{{
+			Sid:       "DiscoveryEventsTopic",
+			Effect:    "Allow",
+			Principal: map[string]string{"Service": "sns.amazonaws.com"},
+			Action:    []string{"sqs:SendMessage"},
+			Resource:  []string{queueArn},
+			Condition: map[string]map[string]string{
+				"ArnEquals": {"aws:SourceArn": e.topicArn},
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl: queue.QueueUrl,
+		Attributes: map[string]string{
+			string(types.QueueAttributeNamePolicy): string(policy),
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to let the topic send to discovery events queue %s: %w", name, err)
+	}
+
+	// Raw delivery leaves the EventBridge event as the message body
+	subscription, err := e.topic.Subscribe(ctx, &sns.SubscribeInput{
+		TopicArn:              aws.String(e.topicArn),
+		Protocol:              aws.String("sqs"),
+		Endpoint:              aws.String(queueArn),
+		Attributes:            map[string]string{"RawMessageDelivery": "true"},
+		ReturnSubscriptionArn: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe discovery events queue %s: %w", name, err)
+	}
+	e.subscriptionArn = aws.ToString(subscription.SubscriptionArn)
+
+	e.logger.Info("subscribed to discovery events",
+		slog.String("topic", e.topicArn),
+		slog.String("queue", e.queueURL),
+	)
+	return nil
+}
+
+// unsubscribe takes the replica's queue off the topic and deletes it
+func (e *DiscoveryEvents) unsubscribe(ctx context.Context) error {
+	if _, err := e.topic.Unsubscribe(ctx, &sns.UnsubscribeInput{
+		SubscriptionArn: aws.String(e.subscriptionArn),
+	}); err != nil {
+		return fmt.Errorf("failed to unsubscribe discovery events queue: %w", err)
+	}
+	if _, err := e.client.DeleteQueue(ctx, &sqs.DeleteQueueInput{
+		QueueUrl: aws.String(e.queueURL),
+	}); err != nil {
+		return fmt.Errorf("failed to delete discovery events queue: %w", err)
+	}
+	return nil
+}
+
+// consume long-polls the queue until ctx ends
+func (e *DiscoveryEvents) consume(ctx context.Context) error {
+	for ctx.Err() == nil {
+		out, err := e.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(e.queueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			e.logger.Warn("failed to receive discovery events, polling carries on", slog.Any("error", err))
+			select {
+			case <-ctx.Done():
+			case <-time.After(discoveryEventsRetry):
+			}
+			continue
+		}
+		if len(out.Messages) == 0 {
+			continue
+		}
+
+		refresh := map[string]bool{}
+		entries := make([]types.DeleteMessageBatchRequestEntry, 0, len(out.Messages))
+		for i, message := range out.Messages {
+			for _, pool := range e.pools.changedBy(e.parse(aws.ToString(message.Body))) {
+				refresh[pool] = true
+			}
+			entries = append(entries, types.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(fmt.Sprint(i)),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+		}
+
+		// Events that arrive together rediscover each pool once
+		for pool := range refresh {
+			e.logger.Debug("rediscovering pool on change event", slog.String("pool", pool))
+			e.scheduler.Trigger("discovery:" + pool)
+		}
+
+		// The queue is this replica's alone, so an event left in it would
+		// only come back to refresh again
+		if _, err := e.client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(e.queueURL),
+			Entries:  entries,
+		}); err != nil && ctx.Err() == nil {
+			e.logger.Warn("failed to delete discovery events", slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
+// parse reads the Cloud Map service an event changed. ok is false for
+// events that don't change instances.
+func (e *DiscoveryEvents) parse(body string) (serviceID string, ok bool) {
+	var event discoveryEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		discoveryEvents.Inc("invalid")
+		e.logger.Warn("invalid discovery event", slog.Any("error", err))
+		return "", false
+	}
+	if event.Source != "aws.servicediscovery" || !slices.Contains(discoveryEventNames, event.Detail.EventName) {
+		discoveryEvents.Inc("ignored")
+		return "", false
+	}
+	discoveryEvents.Inc("change")
+	return event.Detail.RequestParameters.ServiceID, true
+}
+
+// changedBy names the Cloud Map pools an event for serviceID may have
+// changed: the pool of that service, or those whose service isn't known
+// yet. An event without a service changes them all.
+func (p *BackendPools) changedBy(serviceID string, ok bool) []string {
+	if !ok {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var matched, unresolved []string
+	for name, backends := range p.pools {
+		d, cloudMap := backends.discoverer.(*cloudMapDiscoverer)
+		if !cloudMap {
+			continue
+		}
+		switch id := d.serviceID(); {
+		case serviceID == "" || id == serviceID:
+			matched = append(matched, name)
+		case id == "":
+			unresolved = append(unresolved, name)
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	}
+	return unresolved
+}
+
+// serviceID is the ID of the Cloud Map service, once discovery has looked
+// it up
+func (d *cloudMapDiscoverer) serviceID() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.service.id
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dnsDiscoverer finds a pool's backends in DNS: the targets of the SRV
+// records of name, or the addresses of its A and AAAA records when the pool
+// has a port, of the pool's address family. DNS doesn't know about health,
+// so failing backends are left to the health probes and outlier ejection.
+type dnsDiscoverer struct {
+	name     string
+	port     int
+	family   string
+	resolver *net.Resolver
+}
+
+func newDNSDiscoverer(pc PoolConfig) *dnsDiscoverer {
+	return &dnsDiscoverer{
+		name:     pc.Service,
+		port:     pc.Port,
+		family:   pc.AddressFamily,
+		resolver: net.DefaultResolver,
+	}
+}
+
+func (d *dnsDiscoverer) Discover(ctx context.Context, limits discoveryLimits) ([]DiscoveredInstance, error) {
+	if d.port != 0 {
+		return d.lookupAddresses(ctx)
+	}
+	return d.lookupSRV(ctx)
+}
+
+func (d *dnsDiscoverer) lookupAddresses(ctx context.Context) ([]DiscoveredInstance, error) {
+	addrs, err := d.resolver.LookupIPAddr(ctx, d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipv4, ipv6 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+
+	switch d.family {
+	case addressFamilyV4:
+		addrs = ipv4
+	case addressFamilyV6:
+		addrs = ipv6
+	case addressFamilyPreferV6:
+		addrs = ipv4
+		if len(ipv6) > 0 {
+			addrs = ipv6
+		}
+	}
+
+	port := strconv.Itoa(d.port)
+	instances := make([]DiscoveredInstance, 0, len(addrs))
+	for _, addr := range addrs {
+		instances = append(instances, DiscoveredInstance{Address: net.JoinHostPort(addr.IP.String(), port)})
+	}
+	return instances, nil
+}
+
+// lookupSRV takes the records of the most preferred priority, the rest
+// being backups, weighted as the records are
+func (d *dnsDiscoverer) lookupSRV(ctx context.Context) ([]DiscoveredInstance, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []DiscoveredInstance
+	for _, record := range records {
+		if record.Priority != records[0].Priority {
+			continue
+		}
+		instances = append(instances, DiscoveredInstance{
+			Address: net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))),
+			Weight:  min(max(int(record.Weight), 1), maxEndpointWeight),
+		})
+	}
+	return instances, nil
+}
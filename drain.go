@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Drain takes the endpoint at addr, a host:port, out of rotation so it gets
+// no new requests, or puts it back when drained is false. Requests already
+// sent to it finish. An endpoint stays drained until undrained or no longer
+// discovered. Reports whether the pool has the endpoint.
+func (bm *BackendManager) Drain(addr string, drained bool) bool {
+	endpoint := "http://" + addr
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if !slices.Contains(bm.endpoints, endpoint) {
+		return false
+	}
+
+	if drained {
+		if bm.drained == nil {
+			bm.drained = map[string]bool{}
+		}
+		bm.drained[endpoint] = true
+	} else {
+		delete(bm.drained, endpoint)
+	}
+	bm.updateRotation()
+	return true
+}
+
+// BackendPools are the pools operators can see, rediscover, and drain the
+// endpoints of through the admin API
+type BackendPools struct {
+	mu    sync.Mutex
+	pools map[string]*BackendManager
+}
+
+func NewBackendPools() *BackendPools {
+	return &BackendPools{pools: map[string]*BackendManager{}}
+}
+
+// Add makes a pool's endpoints drainable under its name
+func (p *BackendPools) Add(name string, backends *BackendManager) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pools[name] = backends
+}
+
+// BackendsHandler serves the state of every pool's endpoints as JSON, by pool
+func (p *BackendPools) BackendsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		states := map[string]BackendState{}
+		for name, backends := range p.pools {
+			states[name] = backends.State()
+		}
+		p.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(states)
+	}
+}
+
+// RefreshHandler has the discovery of the {pool} path value, or of every
+// pool without one, run right away instead of at its next interval. The
+// refresh happens in the background, so it answers 202.
+func (p *BackendPools) RefreshHandler(scheduler *Scheduler, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pool := r.PathValue("pool")
+
+		p.mu.Lock()
+		var pools []string
+		for name := range p.pools {
+			if pool == "" || pool == name {
+				pools = append(pools, name)
+			}
+		}
+		p.mu.Unlock()
+
+		if len(pools) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		for _, name := range pools {
+			scheduler.Trigger("discovery:" + name)
+		}
+
+		logger.Info("discovery refresh requested by operator", slog.Any("pools", pools))
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// DrainHandler drains the endpoint at the {addr} path value on POST, and
+// undrains it on DELETE, in every pool that has it
+func (p *BackendPools) DrainHandler(logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := r.PathValue("addr")
+		drained := r.Method == http.MethodPost
+
+		p.mu.Lock()
+		var pools []string
+		for name, backends := range p.pools {
+			if backends.Drain(addr, drained) {
+				pools = append(pools, name)
+			}
+		}
+		p.mu.Unlock()
+
+		if len(pools) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		logger.Info("endpoint drained by operator",
+			slog.String("endpoint", addr),
+			slog.Bool("drained", drained),
+			slog.Any("pools", pools),
+		)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const dryRunContextKey contextKey = "dryRun"
+
+// echoPrefix is where the dry-run route lives on the admin mux. Whatever
+// follows it is the path being tried, e.g. /admin/echo/tiles/3/1/2.pbf
+const echoPrefix = "/admin/echo"
+
+// echoAuthorizationHeader carries the end-user Authorization header through
+// the echo route, whose own Authorization header holds the admin token
+const echoAuthorizationHeader = "X-Echo-Authorization"
+
+// DryRunUpstream is the request the gateway would have sent upstream
+type DryRunUpstream struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Host    string      `json:"host"`
+	Backend string      `json:"backend,omitempty"`
+	Headers http.Header `json:"headers"`
+}
+
+// DryRunReport is what the echo route answers with
+type DryRunReport struct {
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Route    string          `json:"route"`
+	Proxied  bool            `json:"proxied"`
+	Policies []string        `json:"policies"`
+	Status   int             `json:"status,omitempty"`
+	Body     string          `json:"body,omitempty"`
+	Upstream *DryRunUpstream `json:"upstream,omitempty"`
+}
+
+type dryRun struct {
+	mu       sync.Mutex
+	upstream *DryRunUpstream
+}
+
+func isDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(dryRunContextKey).(*dryRun)
+	return ok
+}
+
+// dryRunTransport captures requests marked as dry runs instead of sending
+// them, so they go through every middleware and the Director unchanged
+type dryRunTransport struct {
+	next http.RoundTripper
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	run, ok := req.Context().Value(dryRunContextKey).(*dryRun)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	upstream := &DryRunUpstream{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Host:    req.Host,
+		Headers: req.Header.Clone(),
+	}
+	if endpoint, ok := endpointFromContext(req.Context()); ok {
+		upstream.Backend = endpoint
+	}
+
+	run.mu.Lock()
+	run.upstream = upstream
+	run.mu.Unlock()
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// EchoHandler shows what the gateway would do with a request: the route it
+// matches, the edge policies that apply to it, and for proxied routes the
+// exact upstream request, without proxying anything
+type EchoHandler struct {
+	mux      *http.ServeMux
+	proxied  map[string]bool
+	waf      *WAF
+	honeypot *Honeypot
+}
+
+// NewEchoHandler takes the main mux and the patterns of the routes that
+// proxy upstream. Only those are run, since other handlers act for real.
+func NewEchoHandler(mux *http.ServeMux, proxied []string, waf *WAF, honeypot *Honeypot) *EchoHandler {
+	h := &EchoHandler{
+		mux:      mux,
+		proxied:  map[string]bool{},
+		waf:      waf,
+		honeypot: honeypot,
+	}
+
+	for _, pattern := range proxied {
+		h.proxied[pattern] = true
+	}
+
+	return h
+}
+
+func (h *EchoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	run := &dryRun{}
+
+	req := r.Clone(context.WithValue(r.Context(), dryRunContextKey, run))
+	req.URL.Path = strings.TrimPrefix(r.URL.Path, echoPrefix)
+	req.URL.RawPath = ""
+	req.RequestURI = req.URL.RequestURI()
+
+	req.Header.Del("Authorization")
+	if authorization := req.Header.Get(echoAuthorizationHeader); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+		req.Header.Del(echoAuthorizationHeader)
+	}
+
+	_, pattern := h.mux.Handler(req)
+
+	report := DryRunReport{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Route:    pattern,
+		Proxied:  h.proxied[pattern],
+		Policies: h.policies(req),
+	}
+
+	if report.Proxied {
+		recorder := httptest.NewRecorder()
+		h.mux.ServeHTTP(recorder, req)
+
+		run.mu.Lock()
+		report.Upstream = run.upstream
+		run.mu.Unlock()
+
+		// Without an upstream request the gateway answered by itself,
+		// e.g. auth rejected the token or the pool had no backends
+		report.Status = recorder.Code
+		if report.Upstream == nil {
+			body, _ := io.ReadAll(io.LimitReader(recorder.Body, 4096))
+			report.Body = string(body)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *EchoHandler) policies(r *http.Request) []string {
+	policies := []string{}
+
+	if h.honeypot != nil && h.honeypot.isDecoy(r.URL.Path) {
+		policies = append(policies, "honeypot")
+	}
+
+	if h.waf != nil {
+		policies = append(policies, h.waf.Explain(r)...)
+	}
+
+	return policies
+}
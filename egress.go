@@ -0,0 +1,228 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const trafficContextKey contextKey = "traffic"
+
+// egressBuckets is how many buckets the egress window is kept in
+const egressBuckets = 60
+
+// ByteBuckets are histogram buckets for request and response sizes, from
+// 256 bytes to 64MB
+var ByteBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+var (
+	requestBytes = NewHistogram(
+		"civil_gateway_request_bytes",
+		"Size of request bodies, by route and layer",
+		ByteBuckets,
+		"route", "layer",
+	)
+	responseBytes = NewHistogram(
+		"civil_gateway_response_bytes",
+		"Size of response bodies as sent to clients, by route and layer",
+		ByteBuckets,
+		"route", "layer",
+	)
+	egressBytes = NewCounter(
+		"civil_gateway_egress_bytes_total",
+		"Response bytes sent to clients, by route, layer, and tenant",
+		"route", "layer", "tenant",
+	)
+	egressCost = NewGauge(
+		"civil_gateway_egress_cost_dollars",
+		"Estimated data transfer cost of the responses sent over the egress window, by layer and tenant",
+		"layer", "tenant",
+	)
+)
+
+// EgressConfig prices the gateway's responses. CostPerGB is what a GB sent
+// to clients costs in NAT and load balancer data transfer, and Window how
+// far back the cost estimate reaches. Tenants are the subjects broken out
+// in the metrics, everyone else being counted as other.
+type EgressConfig struct {
+	CostPerGB float64
+	Window    time.Duration
+	Tenants   []string
+}
+
+// trafficEntry collects what handlers further down learn about a request
+// that its traffic is attributed to
+type trafficEntry struct {
+	route  string
+	layer  string
+	tenant string
+	groups []string
+
+	// The tile requested, if it was one
+	tile    bool
+	z, x, y int
+}
+
+type egressKey struct {
+	layer  string
+	tenant string
+}
+
+// egressBucket counts the bytes of one span of the window
+type egressBucket struct {
+	span  int64
+	bytes int64
+}
+
+// EgressMeter measures the size of requests and responses and estimates
+// what sending the responses costs, so the data transfer bill can be split
+// by route, layer, and tenant
+type EgressMeter struct {
+	config  EgressConfig
+	span    time.Duration
+	tenants map[string]bool
+
+	mu      sync.Mutex
+	windows map[egressKey]*[egressBuckets]egressBucket
+}
+
+func NewEgressMeter(config EgressConfig) *EgressMeter {
+	tenants := map[string]bool{}
+	for _, tenant := range config.Tenants {
+		tenants[tenant] = true
+	}
+
+	return &EgressMeter{
+		config:  config,
+		span:    max(config.Window/egressBuckets, time.Second),
+		tenants: tenants,
+		windows: map[egressKey]*[egressBuckets]egressBucket{},
+	}
+}
+
+// Middleware measures each request once it has been answered
+func (m *EgressMeter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &trafficEntry{}
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), trafficContextKey, entry)))
+
+		// Bodies the handlers didn't read were still sent
+		m.record(time.Now(), entry, max(body.bytes, r.ContentLength), recorder.bytes)
+	})
+}
+
+func (m *EgressMeter) record(now time.Time, entry *trafficEntry, in, out int64) {
+	route := cmp.Or(entry.route, "none")
+	layer := cmp.Or(entry.layer, "none")
+
+	tenant := "anonymous"
+	if entry.tenant != "" {
+		tenant = "other"
+		if m.tenants[entry.tenant] {
+			tenant = entry.tenant
+		}
+	}
+
+	requestBytes.Observe(float64(in), route, layer)
+	responseBytes.Observe(float64(out), route, layer)
+	egressBytes.Add(float64(out), route, layer, tenant)
+
+	span := now.UnixNano() / int64(m.span)
+	key := egressKey{layer: layer, tenant: tenant}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	window, ok := m.windows[key]
+	if !ok {
+		window = &[egressBuckets]egressBucket{}
+		m.windows[key] = window
+	}
+	bucket := &window[span%egressBuckets]
+	if bucket.span != span {
+		*bucket = egressBucket{span: span}
+	}
+	bucket.bytes += out
+}
+
+// Update refreshes the cost estimates from the bytes sent over the window.
+// Run by the scheduler every bucket span, so buckets falling out of the
+// window are no longer counted even without traffic.
+func (m *EgressMeter) Update(ctx context.Context) error {
+	current := time.Now().UnixNano() / int64(m.span)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, window := range m.windows {
+		var bytes int64
+		for _, bucket := range window {
+			if bucket.span > current-egressBuckets && bucket.span <= current {
+				bytes += bucket.bytes
+			}
+		}
+		egressCost.Set(float64(bytes)/1e9*m.config.CostPerGB, key.layer, key.tenant)
+	}
+	return nil
+}
+
+// Span is how often Update should run
+func (m *EgressMeter) Span() time.Duration {
+	return m.span
+}
+
+// RecordRoute notes the pattern mux routes each request by. It must wrap
+// the mux itself, which sets the pattern on the request it is given.
+func RecordRoute(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+
+		if entry, ok := r.Context().Value(trafficContextKey).(*trafficEntry); ok {
+			entry.route = cmp.Or(r.Pattern, "unmatched")
+		}
+	})
+}
+
+// recordTrafficLayer attributes a request's traffic to the layer it is for
+func recordTrafficLayer(ctx context.Context, layer string) {
+	if entry, ok := ctx.Value(trafficContextKey).(*trafficEntry); ok {
+		entry.layer = layer
+	}
+}
+
+// recordTrafficTile attributes a request's traffic to the tile it is for
+func recordTrafficTile(ctx context.Context, z, x, y int) {
+	if entry, ok := ctx.Value(trafficContextKey).(*trafficEntry); ok {
+		entry.tile = true
+		entry.z, entry.x, entry.y = z, x, y
+	}
+}
+
+// recordTrafficTenant attributes a request's traffic to who made it
+func recordTrafficTenant(ctx context.Context, claims Claims) {
+	if entry, ok := ctx.Value(trafficContextKey).(*trafficEntry); ok {
+		entry.tenant = claims.Subject
+		entry.groups = claims.Groups
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
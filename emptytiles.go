@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gocloud.dev/blob"
+)
+
+var emptyTileAnswers = NewCounter(
+	"civil_gateway_empty_tiles_total",
+	"Tile requests answered as empty from the tileset manifest",
+)
+
+// EmptyTiles answers requests for tiles the tileset is known not to have,
+// before they reach the cache or the backends.
+//
+// The tileset manifest lists the z/x/y of every tile that has data, one per
+// line. Those go into a bloom filter, and a tile the filter has definitely
+// not seen is empty. Filtering the empty tiles instead would take far more
+// memory for a dataset that is mostly empty, and every false positive would
+// blank a real tile; this way a false positive only costs a trip to the
+// backend. Zoom levels the manifest doesn't cover are always passed on.
+type EmptyTiles struct {
+	uri               string
+	falsePositiveRate float64
+	logger            *slog.Logger
+
+	mu      sync.RWMutex
+	filter  *bloomFilter
+	minZoom int
+	maxZoom int
+}
+
+func NewEmptyTiles(uri string, falsePositiveRate float64, logger *slog.Logger) *EmptyTiles {
+	return &EmptyTiles{
+		uri:               uri,
+		falsePositiveRate: min(max(falsePositiveRate, 1e-6), 0.5),
+		logger:            logger,
+	}
+}
+
+// Load reads the manifest and swaps in a filter built from it. Until the
+// first load succeeds every request is passed on.
+func (e *EmptyTiles) Load(ctx context.Context) error {
+	bucketURL, key, err := splitBlobURL(e.uri)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return fmt.Errorf("failed to open tile manifest bucket: %w", err)
+	}
+	defer bucket.Close()
+
+	attrs, err := bucket.Attributes(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read tile manifest: %w", err)
+	}
+
+	r, err := bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read tile manifest: %w", err)
+	}
+	defer r.Close()
+
+	// Size the filter from the manifest's length; every line is at least
+	// "z/x/y\n", so this overestimates the tile count, which only lowers
+	// the false positive rate
+	filter := newBloomFilter(max(int(attrs.Size/6), 1), e.falsePositiveRate)
+	minZoom, maxZoom := math.MaxInt, -1
+	tiles := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		z, x, y, ok := parseTileCoords(line)
+		if !ok {
+			return fmt.Errorf("invalid tile %q in tile manifest", line)
+		}
+
+		filter.add(tileKey(z, x, y))
+		minZoom, maxZoom = min(minZoom, z), max(maxZoom, z)
+		tiles++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read tile manifest: %w", err)
+	}
+
+	e.mu.Lock()
+	e.filter = filter
+	e.minZoom, e.maxZoom = minZoom, maxZoom
+	e.mu.Unlock()
+
+	e.logger.Info("loaded tile manifest",
+		slog.String("url", e.uri),
+		slog.Int("tiles", tiles),
+		slog.Int("min_zoom", minZoom),
+		slog.Int("max_zoom", maxZoom),
+		slog.Int("filter_bytes", len(filter.bits)*8),
+	)
+
+	return nil
+}
+
+// IsEmpty reports whether the tile at path is certainly empty
+func (e *EmptyTiles) IsEmpty(path string) bool {
+	z, x, y, ok := parseTileCoords(path)
+	if !ok {
+		return false
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.filter == nil || z < e.minZoom || z > e.maxZoom {
+		return false
+	}
+
+	return !e.filter.mayContain(tileKey(z, x, y))
+}
+
+// Middleware answers empty tiles with 204 No Content
+func (e *EmptyTiles) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || isDryRun(r.Context()) || !e.IsEmpty(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		emptyTileAnswers.Inc()
+
+		w.Header().Set("X-Cache", "EMPTY")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// parseTileCoords takes z/x/y from the end of a tile path such as
+// /tiles/14/2620/6331.pbf, ignoring any extension
+func parseTileCoords(path string) (z, x, y int, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 {
+		return 0, 0, 0, false
+	}
+	parts = parts[len(parts)-3:]
+
+	last, _, _ := strings.Cut(parts[2], ".")
+
+	z, err := strconv.Atoi(parts[0])
+	if err != nil || z < 0 || z > 30 {
+		return 0, 0, 0, false
+	}
+	if x, err = strconv.Atoi(parts[1]); err != nil || x < 0 {
+		return 0, 0, 0, false
+	}
+	if y, err = strconv.Atoi(last); err != nil || y < 0 {
+		return 0, 0, 0, false
+	}
+
+	return z, x, y, true
+}
+
+func tileKey(z, x, y int) uint64 {
+	return uint64(z)<<58 | uint64(x)<<29 | uint64(y)
+}
+
+// bloomFilter is a fixed-size bloom filter over uint64 keys
+type bloomFilter struct {
+	bits   []uint64
+	hashes int
+}
+
+// newBloomFilter sizes a filter for n keys at the given false positive rate
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := max(1, int(math.Round(m/float64(n)*math.Ln2)))
+
+	return &bloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: k,
+	}
+}
+
+// locations derives the key's bit positions by double hashing
+func (f *bloomFilter) locations(key uint64, fn func(bit uint64)) {
+	h := fnv.New64a()
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = byte(key >> (8 * i))
+	}
+	h.Write(buf[:])
+	sum := h.Sum64()
+
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	size := uint64(len(f.bits)) * 64
+
+	for i := range uint64(f.hashes) {
+		fn((h1 + i*h2) % size)
+	}
+}
+
+func (f *bloomFilter) add(key uint64) {
+	f.locations(key, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (f *bloomFilter) mayContain(key uint64) bool {
+	found := true
+	f.locations(key, func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
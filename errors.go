@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/text/language"
+)
+
+// defaultErrorMessages are the English bodies of the errors the gateway
+// answers with itself, by error code. Templates can use .Status, .Code, and
+// .Detail, which some errors fill in, like the layer of an invalid tile.
+var defaultErrorMessages = map[string]string{
+	"missing_token":          "Unauthorized: Missing or invalid Bearer token",
+	"invalid_token":          "Unauthorized: Invalid or expired token",
+	"expired_token":          "Unauthorized: Token expired",
+	"unknown_client":         "Unauthorized: Unrecognized client application",
+	"invalid_api_key":        "Unauthorized: Invalid API key",
+	"invalid_signed_url":     "Unauthorized: Invalid or expired signed URL",
+	"signed_url_used":        "Unauthorized: Signed URL already used",
+	"invalid_claims":         "Internal Error: Failed to parse identity claims",
+	"missing_claims":         "Unauthorized: Missing identity claims",
+	"group_forbidden":        "Forbidden: Not in a group allowed on this route",
+	"route_forbidden":        "Forbidden: API key not allowed on this route",
+	"layer_forbidden":        "Forbidden: Not allowed on this layer",
+	"client_blocked":         "Forbidden: Client blocked",
+	"request_blocked":        "Forbidden: Request blocked",
+	"rate_limited":           "Too Many Requests: Rate limit exceeded",
+	"no_healthy_backends":    "Service Unavailable: no healthy backends",
+	"backends_at_capacity":   "Service Unavailable: Backends at capacity",
+	"gateway_at_capacity":    "Service Unavailable: Gateway at capacity",
+	"backends_starting":      "Service Unavailable: backends are starting up",
+	"invalid_tile":           "Bad Request: invalid tile for layer {{.Detail}}",
+	"invalid_request":        "Bad Request: {{.Detail}}",
+	"websocket_disabled":     "Bad Request: WebSocket is not enabled on this route",
+	"method_not_allowed":     "Method Not Allowed",
+	"cdn_credentials_failed": "Internal Error: Failed to mint CDN credentials",
+	"signed_url_failed":      "Internal Error: Failed to sign URL",
+	"signed_url_unchecked":   "Service Unavailable: Signed URL could not be checked",
+	"upstream_timeout":       "Gateway Timeout: upstream did not answer in time",
+	"upstream_refused":       "Bad Gateway: upstream refused the connection",
+	"upstream_failed":        "{{.Detail}}",
+	"plugin_rejected":        "{{.Detail}}",
+}
+
+// errorClasses group the error codes by what failed, so dashboards and
+// clients can tell a pool without backends from an expired token without
+// matching every code. Codes missing here are internal.
+var errorClasses = map[string]string{
+	"missing_token":          "auth_missing",
+	"invalid_token":          "auth_invalid",
+	"unknown_client":         "auth_invalid",
+	"invalid_api_key":        "auth_invalid",
+	"invalid_signed_url":     "auth_invalid",
+	"signed_url_used":        "auth_invalid",
+	"missing_claims":         "auth_invalid",
+	"expired_token":          "auth_expired",
+	"group_forbidden":        "forbidden",
+	"route_forbidden":        "forbidden",
+	"layer_forbidden":        "forbidden",
+	"client_blocked":         "blocked",
+	"request_blocked":        "blocked",
+	"rate_limited":           "quota_exceeded",
+	"no_healthy_backends":    "discovery_unavailable",
+	"backends_starting":      "discovery_unavailable",
+	"backends_at_capacity":   "overloaded",
+	"gateway_at_capacity":    "overloaded",
+	"invalid_tile":           "bad_request",
+	"invalid_request":        "bad_request",
+	"websocket_disabled":     "bad_request",
+	"method_not_allowed":     "bad_request",
+	"signed_url_unchecked":   "store_unavailable",
+	"upstream_timeout":       "upstream_timeout",
+	"upstream_refused":       "upstream_refused",
+	"upstream_failed":        "upstream_error",
+	"plugin_rejected":        "plugin_rejected",
+	"shared_cache_failed":    "cache_error",
+	"cdn_credentials_failed": "internal",
+	"signed_url_failed":      "internal",
+	"invalid_claims":         "internal",
+}
+
+var gatewayErrors = NewCounter(
+	"civil_gateway_errors_total",
+	"Failures by class and error code, whether answered with an error or worked around",
+	"class", "code",
+)
+
+// errorClass is the class of an error code
+func errorClass(code string) string {
+	if class, ok := errorClasses[code]; ok {
+		return class
+	}
+	return "internal"
+}
+
+// recordError counts a failure the gateway worked around rather than
+// answering with
+func recordError(code string) {
+	gatewayErrors.Inc(errorClass(code), code)
+}
+
+// problem is an error body as RFC 9457 application/problem+json, with the
+// error's code and class alongside
+type problem struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code"`
+	Class  string `json:"class"`
+}
+
+// errorTemplates holds the error bodies in every language, set at startup
+// by SetErrorTemplates
+var errorTemplates atomic.Pointer[errorCatalog]
+
+// errorCatalog is the parsed error templates by language. The first
+// language is the fallback for clients asking for none of the others.
+type errorCatalog struct {
+	languages []language.Tag
+	matcher   language.Matcher
+	templates []map[string]*template.Template
+}
+
+// errorData is what error templates are executed with
+type errorData struct {
+	Status int
+	Code   string
+	Detail string
+}
+
+// newErrorCatalog parses the templates, by language and then error code, on
+// top of the English defaults. fallback is the language of clients whose
+// Accept-Language matches none of them.
+func newErrorCatalog(messages map[string]map[string]string, fallback string) (*errorCatalog, error) {
+	fallbackTag, err := language.Parse(fallback)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback error language %q: %w", fallback, err)
+	}
+
+	byLanguage := map[language.Tag]map[string]string{language.English: defaultErrorMessages}
+	for lang, codes := range messages {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error template language %q: %w", lang, err)
+		}
+		for code := range codes {
+			if _, ok := defaultErrorMessages[code]; !ok {
+				return nil, fmt.Errorf("error templates for %s: unknown error code %q", lang, code)
+			}
+		}
+		byLanguage[tag] = codes
+	}
+
+	if _, ok := byLanguage[fallbackTag]; !ok {
+		return nil, fmt.Errorf("no error templates for the fallback language %s", fallback)
+	}
+
+	catalog := &errorCatalog{}
+	add := func(tag language.Tag, codes map[string]string) error {
+		parsed := map[string]*template.Template{}
+		for code, text := range codes {
+			tmpl, err := template.New(code).Parse(text)
+			if err != nil {
+				return fmt.Errorf("error template %s for %s: %w", code, tag, err)
+			}
+			parsed[code] = tmpl
+		}
+		catalog.languages = append(catalog.languages, tag)
+		catalog.templates = append(catalog.templates, parsed)
+		return nil
+	}
+
+	if err := add(fallbackTag, byLanguage[fallbackTag]); err != nil {
+		return nil, err
+	}
+	for tag, codes := range byLanguage {
+		if tag == fallbackTag {
+			continue
+		}
+		if err := add(tag, codes); err != nil {
+			return nil, err
+		}
+	}
+
+	catalog.matcher = language.NewMatcher(catalog.languages)
+	return catalog, nil
+}
+
+// render is the body of the error in the language r asks for, along with
+// that language. Codes missing from the language fall back to the fallback
+// language, then to English.
+func (c *errorCatalog) render(r *http.Request, data errorData) (string, language.Tag) {
+	wanted, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, index, confidence := c.matcher.Match(wanted...)
+	if confidence == language.No {
+		index = 0
+	}
+
+	for _, i := range []int{index, 0} {
+		if tmpl, ok := c.templates[i][data.Code]; ok {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, data); err == nil {
+				return b.String(), c.languages[i]
+			}
+		}
+	}
+
+	tmpl := template.Must(template.New(data.Code).Parse(defaultErrorMessages[data.Code]))
+	var b strings.Builder
+	tmpl.Execute(&b, data)
+	return b.String(), language.English
+}
+
+// SetErrorTemplates loads error templates from a JSON or YAML file mapping
+// languages to error codes to templates, like {"fr": {"rate_limited":
+// "..."}}. English is built in. fallback is the language answered in when
+// the client asks for none the file has.
+func SetErrorTemplates(path, fallback string) error {
+	messages := map[string]map[string]string{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read error templates: %w", err)
+		}
+
+		if filepath.Ext(path) == ".json" {
+			err = json.Unmarshal(data, &messages)
+		} else {
+			err = yaml.Unmarshal(data, &messages)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse error templates %s: %w", path, err)
+		}
+	}
+
+	catalog, err := newErrorCatalog(messages, fallback)
+	if err != nil {
+		return err
+	}
+	errorTemplates.Store(catalog)
+	return nil
+}
+
+// writeError answers with one of the gateway's own errors as problem+json,
+// its detail in the language the client prefers out of those there are
+// templates for. detail fills in the templates that use it.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	data := errorData{Status: status, Code: code, Detail: detail}
+
+	catalog := errorTemplates.Load()
+	if catalog == nil {
+		catalog, _ = newErrorCatalog(nil, "en")
+		errorTemplates.CompareAndSwap(nil, catalog)
+	}
+
+	message, lang := catalog.render(r, data)
+	class := errorClass(code)
+	gatewayErrors.Inc(class, code)
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Add("Vary", "Accept-Language")
+	h.Set("Content-Language", lang.String())
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: message,
+		Code:   code,
+		Class:  class,
+	})
+}
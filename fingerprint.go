@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const fingerprintContextKey contextKey = "clientFingerprint"
+
+// ClientFingerprint identifies a client by how it talks rather than where it
+// connects from, to tell apart scraping farms that rotate IPs
+type ClientFingerprint struct {
+	UserAgent string
+	// Hash of the header names sent. net/http does not keep the order
+	// headers arrived in, so the set of names stands in for it.
+	HeaderHash string
+	// JA3 hash of the TLS ClientHello, only when the gateway terminates TLS
+	JA3 string
+	// ID combines all of the above into one key
+	ID string
+}
+
+// FingerprintMiddleware computes the fingerprint of every request and
+// attaches it to the context for logging and rate limiting further down
+func FingerprintMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fp := fingerprintRequest(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), fingerprintContextKey, fp)))
+	})
+}
+
+func fingerprintFromContext(ctx context.Context) (ClientFingerprint, bool) {
+	fp, ok := ctx.Value(fingerprintContextKey).(ClientFingerprint)
+	return fp, ok
+}
+
+// fingerprintAttr is the request's fingerprint as a log attribute, empty when
+// fingerprinting is off
+func fingerprintAttr(ctx context.Context) slog.Attr {
+	fp, ok := fingerprintFromContext(ctx)
+	if !ok {
+		return slog.Attr{}
+	}
+
+	return slog.Group("fingerprint",
+		slog.String("id", fp.ID),
+		slog.String("header_hash", fp.HeaderHash),
+		slog.String("ja3", fp.JA3),
+	)
+}
+
+func fingerprintRequest(r *http.Request) ClientFingerprint {
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	slices.Sort(names)
+
+	headerSum := sha256.Sum256([]byte(strings.Join(names, ",")))
+
+	fp := ClientFingerprint{
+		UserAgent:  r.UserAgent(),
+		HeaderHash: hex.EncodeToString(headerSum[:8]),
+	}
+
+	if holder, ok := r.Context().Value(ja3ContextKey).(*ja3Holder); ok {
+		fp.JA3 = holder.get()
+	}
+
+	idSum := sha256.Sum256([]byte(fp.UserAgent + "\n" + fp.HeaderHash + "\n" + fp.JA3))
+	fp.ID = hex.EncodeToString(idSum[:8])
+
+	return fp
+}
+
+const ja3ContextKey contextKey = "ja3"
+
+// ja3Holder carries a connection's JA3 hash from the TLS handshake, which
+// runs after the connection context is created, to its requests
+type ja3Holder struct {
+	mu   sync.Mutex
+	hash string
+}
+
+func (h *ja3Holder) get() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hash
+}
+
+// JA3Recorder records the JA3 hash of each TLS connection. Hook ConnContext
+// into the http.Server and GetConfigForClient into its tls.Config.
+type JA3Recorder struct {
+	conns sync.Map // net.Conn -> *ja3Holder
+}
+
+func (j *JA3Recorder) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+
+	holder := &ja3Holder{}
+	j.conns.Store(tlsConn.NetConn(), holder)
+
+	return context.WithValue(ctx, ja3ContextKey, holder)
+}
+
+// ConnState forgets closed connections
+func (j *JA3Recorder) ConnState(c net.Conn, state http.ConnState) {
+	if tlsConn, ok := c.(*tls.Conn); ok && (state == http.StateClosed || state == http.StateHijacked) {
+		j.conns.Delete(tlsConn.NetConn())
+	}
+}
+
+// GetConfigForClient records the hello and keeps the server's config
+func (j *JA3Recorder) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if value, ok := j.conns.Load(hello.Conn); ok {
+		holder := value.(*ja3Holder)
+		holder.mu.Lock()
+		holder.hash = ja3Hash(hello)
+		holder.mu.Unlock()
+	}
+
+	return nil, nil
+}
+
+// ja3Hash is the MD5 of SSLVersion,Ciphers,Extensions,EllipticCurves,
+// EllipticCurvePointFormats with GREASE values left out. The legacy version
+// field isn't exposed, so it's derived from the supported versions; every
+// modern client sends TLS 1.2 there.
+func ja3Hash(hello *tls.ClientHelloInfo) string {
+	version := uint16(tls.VersionTLS10)
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) {
+			version = max(version, min(v, tls.VersionTLS12))
+		}
+	}
+
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, p := range hello.SupportedPoints {
+		points = append(points, uint16(p))
+	}
+
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinJA3(hello.CipherSuites),
+		joinJA3(hello.Extensions),
+		joinJA3(curves),
+		joinJA3(points),
+	}, ",")
+
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+func joinJA3(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports the reserved 0x?a?a values clients send to keep servers
+// tolerant of unknown values (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ecsStopTimeout covers the gateway's shutdown after its drain delay: up to
+// 15s draining requests and then 10s stopping background work. Fargate
+// allows at most ecsMaxStopTimeout in all.
+const (
+	ecsStopTimeout    = 30
+	ecsMaxStopTimeout = 120
+)
+
+// ecsTaskDefinition is the part of an ECS task definition the gateway knows
+// how to fill in, in the JSON that aws ecs register-task-definition
+// --cli-input-json takes
+type ecsTaskDefinition struct {
+	Family                  string                   `json:"family"`
+	NetworkMode             string                   `json:"networkMode"`
+	RequiresCompatibilities []string                 `json:"requiresCompatibilities"`
+	CPU                     string                   `json:"cpu"`
+	Memory                  string                   `json:"memory"`
+	ContainerDefinitions    []ecsContainerDefinition `json:"containerDefinitions"`
+}
+
+type ecsContainerDefinition struct {
+	Name             string               `json:"name"`
+	Image            string               `json:"image"`
+	Essential        bool                 `json:"essential"`
+	PortMappings     []ecsPortMapping     `json:"portMappings"`
+	HealthCheck      ecsHealthCheck       `json:"healthCheck"`
+	Environment      []ecsKeyValue        `json:"environment"`
+	Secrets          []ecsSecret          `json:"secrets,omitempty"`
+	StopTimeout      int                  `json:"stopTimeout"`
+	LogConfiguration *ecsLogConfiguration `json:"logConfiguration,omitempty"`
+}
+
+type ecsPortMapping struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+type ecsHealthCheck struct {
+	Command     []string `json:"command"`
+	Interval    int      `json:"interval"`
+	Timeout     int      `json:"timeout"`
+	Retries     int      `json:"retries"`
+	StartPeriod int      `json:"startPeriod"`
+}
+
+type ecsKeyValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ecsSecret struct {
+	Name      string `json:"name"`
+	ValueFrom string `json:"valueFrom"`
+}
+
+type ecsLogConfiguration struct {
+	LogDriver string            `json:"logDriver"`
+	Options   map[string]string `json:"options"`
+}
+
+// runGenerate is the generate command, which renders deployment files from
+// the config loaded from the environment
+func runGenerate(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "ecs-taskdef":
+			return runGenerateTaskDefinition(args[1:])
+		case "iam-policy":
+			return runGenerateIAMPolicy(args[1:])
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "usage: generate ecs-taskdef|iam-policy [flags]")
+	return 2
+}
+
+func runGenerateTaskDefinition(args []string) int {
+	flags := flag.NewFlagSet("generate ecs-taskdef", flag.ExitOnError)
+	output := flags.String("o", "", "write the task definition here instead of to stdout")
+	family := flags.String("family", "civil-gateway", "task definition family, also the container name")
+	image := flags.String("image", "civil-gateway:latest", "container image")
+	cpu := flags.String("cpu", "512", "task CPU units")
+	memory := flags.String("memory", "1024", "task memory in MiB")
+	secretPrefix := flags.String("secret-arn-prefix", "", "ARN prefix the names of secret variables are appended to, like arn:aws:ssm:us-east-1:123456789012:parameter/civil-gateway/")
+	flags.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	config, err := LoadConfig(logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate ecs-taskdef: %v\n", err)
+		return 1
+	}
+
+	taskDef := buildTaskDefinition(config, os.Environ(), *family, *image, *cpu, *memory, *secretPrefix)
+	if code := writeGenerated(*output, taskDef, "generate ecs-taskdef"); code != 0 {
+		return code
+	}
+
+	printTaskRoleActions(os.Stderr, config)
+	return 0
+}
+
+func runGenerateIAMPolicy(args []string) int {
+	flags := flag.NewFlagSet("generate iam-policy", flag.ExitOnError)
+	output := flags.String("o", "", "write the policy here instead of to stdout")
+	account := flags.String("account", "*", "AWS account ID for the ARNs that need one")
+	region := flags.String("region", "*", "AWS region for the ARNs that need one")
+	flags.Parse(args)
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	config, err := LoadConfig(logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate iam-policy: %v\n", err)
+		return 1
+	}
+
+	return writeGenerated(*output, buildIAMPolicy(config, *account, *region), "generate iam-policy")
+}
+
+// writeGenerated writes v as indented JSON to path, or to stdout if empty
+func writeGenerated(path string, v any, command string) int {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return 1
+	}
+	data = append(data, '\n')
+
+	if path == "" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(path, data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+// buildTaskDefinition renders a Fargate task definition running the gateway
+// with the CIVIL_* variables of environ. Variables holding credentials are
+// referenced as secrets instead, under secretPrefix.
+func buildTaskDefinition(config *Config, environ []string, family, image, cpu, memory, secretPrefix string) ecsTaskDefinition {
+	container := ecsContainerDefinition{
+		Name:      family,
+		Image:     image,
+		Essential: true,
+		PortMappings: []ecsPortMapping{
+			{Name: "http", ContainerPort: int(config.Port), Protocol: "tcp"},
+		},
+		// The image is Alpine based, so busybox wget is there to ask /readyz
+		HealthCheck: ecsHealthCheck{
+			Command:     []string{"CMD-SHELL", "wget -q -O /dev/null http://localhost:" + strconv.Itoa(int(config.Port)) + "/readyz || exit 1"},
+			Interval:    10,
+			Timeout:     5,
+			Retries:     3,
+			StartPeriod: 30,
+		},
+		StopTimeout: min(ecsStopTimeout+int(config.ShutdownDrainDelay.Seconds()), ecsMaxStopTimeout),
+	}
+
+	if config.GRPCHealthPort != 0 {
+		container.PortMappings = append(container.PortMappings, ecsPortMapping{Name: "grpc-health", ContainerPort: int(config.GRPCHealthPort), Protocol: "tcp"})
+	}
+
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, "CIVIL_") {
+			continue
+		}
+
+		if isSecretSetting(key, value) {
+			valueFrom := secretPrefix + key
+			if secretPrefix == "" {
+				valueFrom = "<ARN of the secret holding " + key + ">"
+			}
+			container.Secrets = append(container.Secrets, ecsSecret{Name: key, ValueFrom: valueFrom})
+			continue
+		}
+		container.Environment = append(container.Environment, ecsKeyValue{Name: key, Value: value})
+	}
+	slices.SortFunc(container.Environment, func(a, b ecsKeyValue) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(container.Secrets, func(a, b ecsSecret) int { return strings.Compare(a.Name, b.Name) })
+
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		container.LogConfiguration = &ecsLogConfiguration{
+			LogDriver: "awslogs",
+			Options: map[string]string{
+				"awslogs-group":         "/ecs/" + family,
+				"awslogs-region":        region,
+				"awslogs-stream-prefix": family,
+				"awslogs-create-group":  "true",
+			},
+		}
+	}
+
+	return ecsTaskDefinition{
+		Family:                  family,
+		NetworkMode:             "awsvpc",
+		RequiresCompatibilities: []string{"FARGATE"},
+		CPU:                     cpu,
+		Memory:                  memory,
+		ContainerDefinitions:    []ecsContainerDefinition{container},
+	}
+}
+
+func printTaskRoleActions(w io.Writer, config *Config) {
+	actions := buildIAMPolicy(config, "*", "*").actions()
+	if len(actions) == 0 {
+		fmt.Fprintln(w, "The task role needs no AWS permissions for this config.")
+		return
+	}
+
+	fmt.Fprintln(w, "The task role needs these AWS actions for this config, see generate iam-policy:")
+	for _, action := range actions {
+		fmt.Fprintf(w, "  %s\n", action)
+	}
+}
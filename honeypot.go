@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var securityEvents = NewCounter(
+	"civil_gateway_security_events_total",
+	"High-priority security events by kind",
+	"event",
+)
+
+// Honeypot answers decoy paths that no legitimate client asks for, such as
+// /wp-admin or /.env. They are never proxied and always 404, but the caller
+// is reported and blocked. A path ending in / covers everything under it.
+type Honeypot struct {
+	exact     map[string]bool
+	prefixes  []string
+	blocklist *IPBlocklist
+	blockFor  time.Duration
+	logger    *slog.Logger
+}
+
+func NewHoneypot(paths []string, blocklist *IPBlocklist, blockFor time.Duration, logger *slog.Logger) *Honeypot {
+	h := &Honeypot{
+		exact:     map[string]bool{},
+		blocklist: blocklist,
+		blockFor:  blockFor,
+		logger:    logger,
+	}
+
+	for _, path := range paths {
+		if strings.HasSuffix(path, "/") {
+			h.prefixes = append(h.prefixes, path)
+		} else {
+			h.exact[path] = true
+		}
+	}
+
+	return h
+}
+
+func (h *Honeypot) isDecoy(path string) bool {
+	if h.exact[path] {
+		return true
+	}
+
+	for _, prefix := range h.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware intercepts requests for decoy paths before they are routed
+func (h *Honeypot) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isDecoy(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr := clientAddr(r)
+
+		securityEvents.Inc("honeypot")
+
+		h.logger.Error("security event: honeypot path requested",
+			slog.String("event", "honeypot"),
+			slog.String("path", r.URL.Path),
+			slog.String("method", r.Method),
+			slog.String("client", addr.String()),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("referer", r.Referer()),
+			slog.String("forwarded_for", r.Header.Get("X-Forwarded-For")),
+			fingerprintAttr(r.Context()),
+		)
+
+		h.blocklist.Block(addr, "honeypot "+r.URL.Path, h.blockFor)
+
+		http.NotFound(w, r)
+	})
+}
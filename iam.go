@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// iamPolicy is an IAM policy document
+type iamPolicy struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+type iamStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Principal map[string]string            `json:"Principal,omitempty"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// buildIAMPolicy is the least the task role needs for the features the
+// config enables, scoped to the resources the config names. Account and
+// region fill in ARNs that need them, and may be * when not known.
+func buildIAMPolicy(config *Config, account, region string) iamPolicy {
+	policy := iamPolicy{Version: "2012-10-17"}
+	allow := func(sid string, actions []string, resources ...string) *iamStatement {
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:      sid,
+			Effect:   "Allow",
+			Action:   actions,
+			Resource: resources,
+		})
+		return &policy.Statement[len(policy.Statement)-1]
+	}
+
+	// DiscoverInstances can't be scoped to a namespace, and the listing
+	// that stands in for it on big services looks the namespace up by name
+	if slices.ContainsFunc(config.Pools, func(pc PoolConfig) bool { return pc.discoversWithCloudMap() }) {
+		allow("CloudMapDiscovery", []string{
+			"servicediscovery:DiscoverInstances",
+			"servicediscovery:ListNamespaces",
+			"servicediscovery:ListServices",
+			"servicediscovery:ListInstances",
+			"servicediscovery:GetInstancesHealthStatus",
+		}, "*")
+	}
+
+	// Each replica creates and deletes a queue of its own on the topic
+	if config.DiscoveryEventsTopicArn != "" {
+		allow("DiscoveryEventsQueues", []string{
+			"sqs:CreateQueue",
+			"sqs:GetQueueAttributes",
+			"sqs:SetQueueAttributes",
+			"sqs:DeleteQueue",
+			"sqs:ReceiveMessage",
+			"sqs:DeleteMessage",
+		}, "arn:aws:sqs:"+region+":"+account+":"+discoveryQueuePrefix+"*")
+		allow("DiscoveryEventsTopic", []string{"sns:Subscribe", "sns:Unsubscribe"}, config.DiscoveryEventsTopicArn)
+	}
+
+	var roles []string
+	for _, pc := range config.Pools {
+		if pc.RoleArn != "" && !slices.Contains(roles, pc.RoleArn) {
+			roles = append(roles, pc.RoleArn)
+		}
+	}
+	if len(roles) > 0 {
+		allow("AssumePoolDiscoveryRoles", []string{"sts:AssumeRole"}, roles...)
+	}
+
+	// PutMetricData can only be scoped through the namespace condition
+	if config.CloudWatchNamespace != "" {
+		statement := allow("SaturationMetrics", []string{"cloudwatch:PutMetricData"}, "*")
+		statement.Condition = map[string]map[string]string{
+			"StringEquals": {"cloudwatch:namespace": config.CloudWatchNamespace},
+		}
+	}
+
+	switch config.WakeUpAction {
+	case "ecs":
+		allow("WakeUpECSService", []string{"ecs:UpdateService"},
+			"arn:aws:ecs:"+region+":"+account+":service/"+config.WakeUpECSCluster+"/"+config.WakeUpECSService)
+	case "sns":
+		allow("WakeUpSNSTopic", []string{"sns:Publish"}, config.WakeUpSNSTopicArn)
+	}
+
+	if config.CloudFrontDistributionID != "" {
+		allow("CDNInvalidation", []string{"cloudfront:CreateInvalidation"},
+			"arn:aws:cloudfront::"+account+":distribution/"+config.CloudFrontDistributionID)
+	}
+
+	var secrets []string
+	for _, source := range []string{config.TLSCert, config.TLSKey} {
+		if strings.HasPrefix(source, secretsManagerARNPrefix) && !slices.Contains(secrets, source) {
+			secrets = append(secrets, source)
+		}
+	}
+	if len(secrets) > 0 {
+		allow("TLSCertificateSecrets", []string{"secretsmanager:GetSecretValue"}, secrets...)
+	}
+	if strings.HasPrefix(config.APIKeys, secretsManagerARNPrefix) {
+		allow("APIKeySecret", []string{"secretsmanager:GetSecretValue"}, config.APIKeys)
+	}
+	if strings.HasPrefix(config.SignedURLKeys, secretsManagerARNPrefix) {
+		allow("SignedURLKeysSecret", []string{"secretsmanager:GetSecretValue"}, config.SignedURLKeys)
+	}
+	if strings.HasPrefix(config.InternalJWTKey, secretsManagerARNPrefix) {
+		allow("InternalJWTKeySecret", []string{"secretsmanager:GetSecretValue"}, config.InternalJWTKey)
+	}
+
+	reads := []string{config.InstanceMetadataUrl, config.TileManifestURL, config.LayerManifestURL, config.CacheSnapshotURL}
+	for _, module := range config.WASMModules {
+		reads = append(reads, module.URL)
+	}
+	if objects := s3ObjectARNs(reads...); len(objects) > 0 {
+		allow("ReadObjects", []string{"s3:GetObject"}, objects...)
+	}
+
+	writes := s3ObjectARNs(config.CacheSnapshotURL)
+	if isS3URL(config.TileBucketURL) {
+		writes = append(writes, s3BucketARN(config.TileBucketURL))
+	}
+	if isS3URL(config.AnalyticsBucketURL) {
+		writes = append(writes, s3BucketARN(config.AnalyticsBucketURL))
+	}
+	if isS3URL(config.BillingBucketURL) {
+		writes = append(writes, s3BucketARN(config.BillingBucketURL))
+	}
+	if len(writes) > 0 {
+		allow("WriteObjects", []string{"s3:PutObject"}, writes...)
+	}
+
+	return policy
+}
+
+// actions lists every action the policy allows
+func (p iamPolicy) actions() []string {
+	var actions []string
+	for _, statement := range p.Statement {
+		actions = append(actions, statement.Action...)
+	}
+	return actions
+}
+
+func isS3URL(uri string) bool {
+	return strings.HasPrefix(uri, "s3://")
+}
+
+// s3ObjectARNs are the ARNs of the objects among the URLs that are in S3
+func s3ObjectARNs(uris ...string) []string {
+	var arns []string
+	for _, uri := range uris {
+		if !isS3URL(uri) {
+			continue
+		}
+		bucketURL, key, err := splitBlobURL(uri)
+		if err != nil {
+			continue
+		}
+		u, err := url.Parse(bucketURL)
+		if err != nil {
+			continue
+		}
+
+		arn := "arn:aws:s3:::" + u.Host + "/" + key
+		if !slices.Contains(arns, arn) {
+			arns = append(arns, arn)
+		}
+	}
+	return arns
+}
+
+// s3BucketARN covers every object of a bucket URL, or those under its prefix
+// parameter
+func s3BucketARN(bucketURL string) string {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return ""
+	}
+	return "arn:aws:s3:::" + u.Host + "/" + u.Query().Get("prefix") + "*"
+}
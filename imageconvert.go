@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+)
+
+// jpegConverter re-encodes PNG tiles as JPEG, which is far smaller for
+// imagery. JPEG has no transparency, so transparent pixels become white.
+type jpegConverter struct {
+	quality int
+}
+
+func (c jpegConverter) Transform(r *http.Request, header http.Header, body io.Reader) (io.Reader, error) {
+	data, err := readTransformBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	tile, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return bytes.NewReader(data), nil
+	}
+
+	bounds := tile.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, tile, bounds.Min, draw.Over)
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, flat, &jpeg.Options{Quality: c.quality}); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Type", "image/jpeg")
+
+	return &out, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inFlightShedWindow is how many seconds of shed requests the shed rate is
+// averaged over
+const inFlightShedWindow = 10
+
+// inFlightExempt are the paths the global in-flight limit never sheds, so
+// an overloaded gateway still answers its health checks and operators
+var inFlightExempt = []string{"/health", "/readyz", "/metrics", "/admin/"}
+
+var (
+	inFlightRequests = NewGauge(
+		"civil_gateway_in_flight_requests",
+		"Requests being served under each in-flight limit, global or by route",
+		"route",
+	)
+	inFlightQueued = NewGauge(
+		"civil_gateway_in_flight_queued",
+		"Requests waiting for a slot under each in-flight limit",
+		"route",
+	)
+	inFlightShed = NewCounter(
+		"civil_gateway_in_flight_shed_total",
+		"Requests shed with a 503 for going over an in-flight limit, by route and why",
+		"route", "reason",
+	)
+)
+
+// InFlightConfig is a fixed limit on requests served at once. Up to
+// QueueSize requests over it wait up to QueueTimeout for a slot, and the
+// rest are shed with a 503 telling the client to retry after RetryAfter.
+type InFlightConfig struct {
+	Limit        int
+	QueueSize    int
+	QueueTimeout time.Duration
+	RetryAfter   time.Duration
+}
+
+// InFlightLimiter caps how many requests are served at once, gateway-wide
+// or on one route, so a burst is shed at the door instead of every request
+// in it holding buffers until the gateway runs out of memory. Unlike the
+// adaptive limiter, which protects a pool's backends, the limit is fixed:
+// it is what the gateway itself can hold.
+type InFlightLimiter struct {
+	route  string
+	config InFlightConfig
+
+	// slots holds a token per request being served, and the waiters queue
+	// for one in the order they came. Without a limit there are none, and
+	// requests are only counted in serving.
+	slots   chan struct{}
+	serving atomic.Int64
+
+	mu     sync.Mutex
+	queued int
+	shed   [inFlightShedWindow]struct{ second, n int64 }
+}
+
+// InFlightState is how loaded a limiter is: the requests being served and
+// waiting, the requests shed per second lately, and those served and waiting
+// as a share of the limit, over 1 while requests queue and 0 without a limit
+type InFlightState struct {
+	InFlight   int64   `json:"in_flight"`
+	Limit      int     `json:"limit"`
+	Queued     int     `json:"queued"`
+	ShedRate   float64 `json:"shed_per_second"`
+	Saturation float64 `json:"saturation"`
+}
+
+func NewInFlightLimiter(route string, config InFlightConfig) *InFlightLimiter {
+	if config.QueueTimeout <= 0 {
+		config.QueueSize = 0
+	}
+	l := &InFlightLimiter{
+		route:  route,
+		config: config,
+	}
+	if config.Limit > 0 {
+		l.slots = make(chan struct{}, config.Limit)
+	}
+	return l
+}
+
+// Middleware sheds the requests over the limit, and counts the rest
+func (l *InFlightLimiter) Middleware(next http.Handler) http.Handler {
+	retryAfter := strconv.Itoa(int(math.Ceil(max(l.config.RetryAfter, time.Second).Seconds())))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason, ok := l.acquire(r)
+		if !ok {
+			// Nobody is waiting for the answer of a client that went away
+			if r.Context().Err() != nil {
+				return
+			}
+
+			inFlightShed.Inc(l.route, reason)
+			l.recordShed(time.Now())
+			w.Header().Set("Retry-After", retryAfter)
+			writeError(w, r, http.StatusServiceUnavailable, "gateway_at_capacity", "")
+			return
+		}
+		defer l.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes a slot, waiting in the queue if there is none free, or else
+// reports why it couldn't
+func (l *InFlightLimiter) acquire(r *http.Request) (string, bool) {
+	if l.slots == nil {
+		inFlightRequests.Set(float64(l.serving.Add(1)), l.route)
+		return "", true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		inFlightRequests.Set(float64(l.serving.Add(1)), l.route)
+		return "", true
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.config.QueueSize {
+		l.mu.Unlock()
+		if l.config.QueueSize == 0 {
+			return "limit", false
+		}
+		return "queue_full", false
+	}
+	l.queued++
+	inFlightQueued.Set(float64(l.queued), l.route)
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		inFlightQueued.Set(float64(l.queued), l.route)
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		inFlightRequests.Set(float64(l.serving.Add(1)), l.route)
+		return "", true
+	case <-r.Context().Done():
+		return "cancelled", false
+	case <-timer.C:
+		return "queue_timeout", false
+	}
+}
+
+func (l *InFlightLimiter) release() {
+	inFlightRequests.Set(float64(l.serving.Add(-1)), l.route)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *InFlightLimiter) recordShed(now time.Time) {
+	second := now.Unix()
+
+	l.mu.Lock()
+	bucket := &l.shed[second%inFlightShedWindow]
+	if bucket.second != second {
+		bucket.second, bucket.n = second, 0
+	}
+	bucket.n++
+	l.mu.Unlock()
+}
+
+// State is how loaded the limiter is now
+func (l *InFlightLimiter) State() InFlightState {
+	current := time.Now().Unix()
+
+	l.mu.Lock()
+	state := InFlightState{
+		InFlight: l.serving.Load(),
+		Limit:    l.config.Limit,
+		Queued:   l.queued,
+	}
+	var shed int64
+	for _, bucket := range l.shed {
+		if bucket.second > current-inFlightShedWindow && bucket.second <= current {
+			shed += bucket.n
+		}
+	}
+	l.mu.Unlock()
+
+	state.ShedRate = float64(shed) / inFlightShedWindow
+	if state.Limit > 0 {
+		state.Saturation = float64(state.InFlight+int64(state.Queued)) / float64(state.Limit)
+	}
+	return state
+}
+
+// exemptFromInFlight lets the health checks, metrics, and admin endpoints
+// past limiter, and sends the rest through it
+func exemptFromInFlight(limiter func(http.Handler) http.Handler, next http.Handler) http.Handler {
+	limited := limiter(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range inFlightExempt {
+			if r.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
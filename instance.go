@@ -5,9 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"net/url"
-	"path/filepath"
-	"strings"
 
 	"connectrpc.com/connect"
 	instancev1 "github.com/civil-labs/civil-api-go/civil/public/instance/v1"
@@ -37,29 +34,12 @@ func (s *InstanceServer) GetInstanceMetadata(
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("instance metadata URL is not configured"))
 	}
 
-	u, err := url.Parse(uriStr)
+	bucketURL, key, err := splitBlobURL(uriStr)
 	if err != nil {
 		s.logger.Error("failed to parse InstanceMetadataUrl", slog.String("uri", uriStr), slog.Any("error", err))
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("invalid instance metadata URL configuration"))
 	}
 
-	var bucketURL string
-	var key string
-
-	if u.Scheme == "" {
-		bucketURL = "file://" + filepath.Dir(uriStr)
-		key = filepath.Base(uriStr)
-	} else if u.Scheme == "file" {
-		bucketURL = "file://" + filepath.Dir(u.Path)
-		key = filepath.Base(u.Path)
-	} else {
-		bucketURL = u.Scheme + "://" + u.Host
-		if u.RawQuery != "" {
-			bucketURL += "?" + u.RawQuery
-		}
-		key = strings.TrimPrefix(u.Path, "/")
-	}
-
 	s.logger.Debug("opening bucket for metadata", slog.String("bucketURL", bucketURL), slog.String("key", key))
 
 	bucket, err := blob.OpenBucket(ctx, bucketURL)
@@ -87,14 +67,9 @@ func (s *InstanceServer) GetInstanceMetadata(
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("failed to construct metadata response"))
 	}
 
-	authIssuerURL := s.config.AuthServer
-	if authIssuerURL != "" && !strings.HasPrefix(authIssuerURL, "http://") && !strings.HasPrefix(authIssuerURL, "https://") {
-		authIssuerURL = "https://" + authIssuerURL
-	}
-
 	res := &instancev1.GetInstanceMetadataResponse{
 		Metadata:      structValue,
-		AuthIssuerUrl: authIssuerURL,
+		AuthIssuerUrl: s.config.OIDCIssuer,
 	}
 
 	return connect.NewResponse(res), nil
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMinRefreshInterval bounds how often a token signed by an unknown key
+// can make the cache refetch the key set, so a flood of forged tokens can't
+// turn into a flood of requests to the IDP
+const jwksMinRefreshInterval = 30 * time.Second
+
+// jwksFetchTimeout bounds a fetch of the key set
+const jwksFetchTimeout = 10 * time.Second
+
+var (
+	jwksRefreshes = NewCounter(
+		"civil_gateway_jwks_refreshes_total",
+		"Fetches of the IDP's signing keys, by result",
+		"result",
+	)
+	tokenVerifyDuration = NewHistogram(
+		"civil_gateway_token_verification_seconds",
+		"How long verifying a bearer token takes, by result",
+		DefaultLatencyBuckets,
+		"result",
+	)
+)
+
+// JWKSCache holds the IDP's signing keys so tokens are verified without a
+// round trip to the IDP. The keys are refreshed in the background, and on
+// demand when a token names a key the cache doesn't have yet, which is how
+// a key rotation shows up.
+type JWKSCache struct {
+	url        string
+	algorithms []jose.SignatureAlgorithm
+	client     *http.Client
+	logger     *slog.Logger
+
+	keys atomic.Pointer[jose.JSONWebKeySet]
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+
+	// Tokens naming an unknown key at once wait on one refetch
+	unknownKey singleflight.Group
+}
+
+// NewJWKSCache caches the keys at url, for tokens signed with one of the
+// given algorithms
+func NewJWKSCache(url string, algorithms []string, logger *slog.Logger) *JWKSCache {
+	c := &JWKSCache{
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		logger: logger,
+	}
+	for _, alg := range algorithms {
+		c.algorithms = append(c.algorithms, jose.SignatureAlgorithm(alg))
+	}
+	return c
+}
+
+// Refresh fetches the key set, replacing the cached one
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	return c.refresh(ctx)
+}
+
+// refresh must be called with refreshMu held
+func (c *JWKSCache) refresh(ctx context.Context) error {
+	c.lastRefresh = time.Now()
+
+	keys, err := c.fetch(ctx)
+	if err != nil {
+		jwksRefreshes.Inc("failed")
+		return err
+	}
+
+	jwksRefreshes.Inc("ok")
+	c.keys.Store(keys)
+	c.logger.Debug("refreshed signing keys", slog.String("url", c.url), slog.Int("keys", len(keys.Keys)))
+
+	return nil
+}
+
+func (c *JWKSCache) fetch(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing keys: %s", resp.Status)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("failed to parse signing keys: %w", err)
+	}
+
+	return &keys, nil
+}
+
+// refreshForUnknownKey refetches the key set unless that happened within
+// jwksMinRefreshInterval. Reports whether it refetched. The fetch is shared
+// by every token waiting on it and doesn't end with the request that
+// started it; each caller stops waiting when its own ctx ends.
+func (c *JWKSCache) refreshForUnknownKey(ctx context.Context) bool {
+	result := c.unknownKey.DoChan("", func() (any, error) {
+		c.refreshMu.Lock()
+		defer c.refreshMu.Unlock()
+
+		if time.Since(c.lastRefresh) < jwksMinRefreshInterval {
+			return false, nil
+		}
+
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+		defer cancel()
+
+		if err := c.refresh(fetchCtx); err != nil {
+			c.logger.Warn("failed to refresh signing keys", slog.Any("error", err))
+			return false, nil
+		}
+		return true, nil
+	})
+
+	select {
+	case r := <-result:
+		return r.Val.(bool)
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// VerifySignature implements oidc.KeySet
+func (c *JWKSCache) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, c.algorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %w", err)
+	}
+
+	keyID := jws.Signatures[0].Header.KeyID
+
+	if payload, ok := c.verify(jws, keyID); ok {
+		return payload, nil
+	}
+
+	// The IDP may have rotated to a key not fetched yet
+	if c.refreshForUnknownKey(ctx) {
+		if payload, ok := c.verify(jws, keyID); ok {
+			return payload, nil
+		}
+	}
+
+	return nil, errors.New("token not signed by a known key")
+}
+
+func (c *JWKSCache) verify(jws *jose.JSONWebSignature, keyID string) ([]byte, bool) {
+	keys := c.keys.Load()
+	if keys == nil {
+		return nil, false
+	}
+
+	candidates := keys.Keys
+	if keyID != "" {
+		candidates = keys.Key(keyID)
+	}
+
+	for _, key := range candidates {
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
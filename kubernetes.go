@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesDiscoverer finds a pool's backends in the EndpointSlices of a
+// Kubernetes service, through the API server of the cluster the gateway
+// runs in. Only ready endpoints are discovered, so Kubernetes readiness
+// probes decide which pods take traffic.
+type kubernetesDiscoverer struct {
+	apiServer string
+	namespace string
+	service   string
+	port      int
+	client    *http.Client
+}
+
+// endpointSliceList is the part of a list of EndpointSlices discovery reads
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+			Zone string `json:"zone"`
+		} `json:"endpoints"`
+		Ports []struct {
+			Port int `json:"port"`
+		} `json:"ports"`
+	} `json:"items"`
+}
+
+// newKubernetesDiscoverer reaches the API server the way in-cluster clients
+// do, with the pod's service account. The namespace defaults to the pod's.
+func newKubernetesDiscoverer(pc PoolConfig) (*kubernetesDiscoverer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("kubernetes discovery needs to run in a cluster, KUBERNETES_SERVICE_HOST is not set")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid cluster CA in %s/ca.crt", serviceAccountDir)
+	}
+
+	namespace := pc.Namespace
+	if namespace == "" {
+		own, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pod's namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(own))
+	}
+
+	return &kubernetesDiscoverer{
+		apiServer: "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		service:   pc.Service,
+		port:      pc.Port,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+func (d *kubernetesDiscoverer) Discover(ctx context.Context, limits discoveryLimits) ([]DiscoveredInstance, error) {
+	// Service account tokens are rotated, so the file is read each time
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account token: %w", err)
+	}
+
+	query := url.Values{"labelSelector": {"kubernetes.io/service-name=" + d.service}}
+	endpoint := d.apiServer + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(d.namespace) + "/endpointslices?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("listing endpoint slices answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var slices endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&slices); err != nil {
+		return nil, fmt.Errorf("invalid endpoint slices: %w", err)
+	}
+
+	var instances []DiscoveredInstance
+	for _, slice := range slices.Items {
+		port := d.port
+		if port == 0 && len(slice.Ports) > 0 {
+			port = slice.Ports[0].Port
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A missing condition means ready
+			if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				instances = append(instances, DiscoveredInstance{
+					Address: net.JoinHostPort(address, strconv.Itoa(port)),
+					Zone:    endpoint.Zone,
+				})
+			}
+		}
+	}
+
+	return instances, nil
+}
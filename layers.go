@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+const layerContextKey contextKey = "tileLayer"
+
+// maxLayerManifestBytes bounds a manifest uploaded through the admin API
+const maxLayerManifestBytes = 1 << 20
+
+// LayerManifest describes the tile layers the gateway serves. Tile
+// validation, routing, caching, and empty-tile answers all look up the
+// layer a request belongs to here, so a layer's behaviour is set in one
+// place rather than on each route.
+type LayerManifest struct {
+	Layers []LayerConfig `json:"layers"`
+}
+
+// LayerConfig is one layer, served under Path as {z}/{x}/{y}.{format}. Path
+// must be under a tile route, /tiles/ or a pool's prefix. Bounds are west,
+// south, east, north in degrees; tiles outside them are empty. Pool, when
+// set, routes the layer to that backend pool. Groups, when set, limits the
+// layer to users in one of them wherever access is granted per layer, such
+// as signed CDN credentials.
+type LayerConfig struct {
+	Name        string            `json:"name"`
+	Path        string            `json:"path"`
+	MinZoom     int               `json:"min_zoom"`
+	MaxZoom     int               `json:"max_zoom"`
+	Formats     []string          `json:"formats"`
+	Bounds      []float64         `json:"bounds,omitempty"`
+	Pool        string            `json:"pool,omitempty"`
+	Cache       *LayerCacheConfig `json:"cache,omitempty"`
+	EmptyTiles  bool              `json:"empty_tiles"`
+	WriteBehind bool              `json:"write_behind"`
+	Groups      []string          `json:"groups,omitempty"`
+}
+
+// LayerCacheConfig overrides the tile cache for a layer. Without it the
+// layer is cached with the cache's TTL.
+type LayerCacheConfig struct {
+	Disabled bool   `json:"disabled"`
+	TTL      string `json:"ttl,omitempty"`
+}
+
+// Layer is a validated LayerConfig
+type Layer struct {
+	Name        string
+	Path        string
+	MinZoom     int
+	MaxZoom     int
+	Formats     []string
+	Bounds      []float64
+	Pool        string
+	Cache       bool
+	CacheTTL    time.Duration
+	EmptyTiles  bool
+	WriteBehind bool
+	Groups      []string
+}
+
+// Layers holds the current manifest. A new manifest replaces the old one
+// atomically, so requests see one or the other and never a mix.
+type Layers struct {
+	logger *slog.Logger
+
+	current atomic.Pointer[layerSet]
+
+	mu    sync.Mutex
+	pools map[string]http.Handler
+}
+
+type layerSet struct {
+	manifest LayerManifest
+	// Longest path first, so the most specific layer wins
+	layers []*Layer
+}
+
+func NewLayers(logger *slog.Logger) *Layers {
+	layers := &Layers{
+		logger: logger,
+		pools:  map[string]http.Handler{},
+	}
+	layers.current.Store(&layerSet{})
+	return layers
+}
+
+// AddPool makes a pool's handler available for layers to route to
+func (l *Layers) AddPool(name string, handler http.Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pools[name] = handler
+}
+
+func (l *Layers) pool(name string) (http.Handler, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	handler, ok := l.pools[name]
+	return handler, ok
+}
+
+// Load validates the manifest and swaps it in. On error the current
+// manifest is kept.
+func (l *Layers) Load(manifest LayerManifest) error {
+	set := &layerSet{manifest: manifest}
+	names := map[string]bool{}
+	paths := map[string]bool{}
+
+	for _, lc := range manifest.Layers {
+		layer, err := l.compile(lc)
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", lc.Name, err)
+		}
+
+		if names[layer.Name] {
+			return fmt.Errorf("duplicate layer name %q", layer.Name)
+		}
+		if paths[layer.Path] {
+			return fmt.Errorf("duplicate layer path %q", layer.Path)
+		}
+		names[layer.Name] = true
+		paths[layer.Path] = true
+
+		set.layers = append(set.layers, layer)
+	}
+
+	slices.SortFunc(set.layers, func(a, b *Layer) int {
+		return len(b.Path) - len(a.Path)
+	})
+
+	l.current.Store(set)
+
+	l.logger.Info("loaded layer manifest", slog.Int("layers", len(set.layers)))
+
+	return nil
+}
+
+func (l *Layers) compile(lc LayerConfig) (*Layer, error) {
+	if lc.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if !strings.HasPrefix(lc.Path, "/") || !strings.HasSuffix(lc.Path, "/") {
+		return nil, fmt.Errorf("path must start and end with /")
+	}
+	if lc.MinZoom < 0 || lc.MaxZoom > 30 || lc.MinZoom > lc.MaxZoom {
+		return nil, fmt.Errorf("zoom range %d-%d is invalid", lc.MinZoom, lc.MaxZoom)
+	}
+	if len(lc.Formats) == 0 {
+		return nil, fmt.Errorf("at least one format is required")
+	}
+
+	if lc.Bounds != nil {
+		if len(lc.Bounds) != 4 {
+			return nil, fmt.Errorf("bounds must be [west, south, east, north]")
+		}
+		west, south, east, north := lc.Bounds[0], lc.Bounds[1], lc.Bounds[2], lc.Bounds[3]
+		if west < -180 || east > 180 || west >= east || south < -90 || north > 90 || south >= north {
+			return nil, fmt.Errorf("bounds %v are invalid", lc.Bounds)
+		}
+	}
+
+	if lc.Pool != "" {
+		if _, ok := l.pool(lc.Pool); !ok {
+			return nil, fmt.Errorf("unknown pool %q", lc.Pool)
+		}
+	}
+
+	layer := &Layer{
+		Name:        lc.Name,
+		Path:        lc.Path,
+		MinZoom:     lc.MinZoom,
+		MaxZoom:     lc.MaxZoom,
+		Bounds:      lc.Bounds,
+		Pool:        lc.Pool,
+		Cache:       true,
+		EmptyTiles:  lc.EmptyTiles,
+		WriteBehind: lc.WriteBehind,
+		Groups:      lc.Groups,
+	}
+
+	for _, format := range lc.Formats {
+		layer.Formats = append(layer.Formats, strings.ToLower(strings.TrimPrefix(format, ".")))
+	}
+
+	if lc.Cache != nil {
+		layer.Cache = !lc.Cache.Disabled
+		if lc.Cache.TTL != "" {
+			ttl, err := time.ParseDuration(lc.Cache.TTL)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("cache ttl %q is invalid", lc.Cache.TTL)
+			}
+			layer.CacheTTL = ttl
+		}
+	}
+
+	return layer, nil
+}
+
+// LoadFile reads a manifest from a local path or blob URL and loads it
+func (l *Layers) LoadFile(ctx context.Context, uri string) error {
+	bucketURL, key, err := splitBlobURL(uri)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return fmt.Errorf("failed to open layer manifest bucket: %w", err)
+	}
+	defer bucket.Close()
+
+	data, err := bucket.ReadAll(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read layer manifest: %w", err)
+	}
+
+	var manifest LayerManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse layer manifest: %w", err)
+	}
+
+	return l.Load(manifest)
+}
+
+// Match returns the layer serving path, if any
+func (l *Layers) Match(path string) (*Layer, bool) {
+	for _, layer := range l.current.Load().layers {
+		if strings.HasPrefix(path, layer.Path) {
+			return layer, true
+		}
+	}
+	return nil, false
+}
+
+// All returns every layer
+func (l *Layers) All() []*Layer {
+	return l.current.Load().layers
+}
+
+// Allows reports whether the user may access the layer
+func (layer *Layer) Allows(claims Claims) bool {
+	if len(layer.Groups) == 0 {
+		return true
+	}
+
+	for _, group := range claims.Groups {
+		if slices.Contains(layer.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the layer by name
+func (l *Layers) Lookup(name string) (*Layer, bool) {
+	for _, layer := range l.current.Load().layers {
+		if layer.Name == name {
+			return layer, true
+		}
+	}
+	return nil, false
+}
+
+func layerFromContext(ctx context.Context) (*Layer, bool) {
+	layer, ok := ctx.Value(layerContextKey).(*Layer)
+	return layer, ok
+}
+
+// Middleware validates requests for tiles of a known layer, attaches the
+// layer to the context, and routes it to the layer's pool if it has one.
+// Layers limited to groups answer 403 to users in none of them. Paths no
+// layer covers are passed on untouched.
+func (l *Layers) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		layer, ok := l.Match(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, _ := r.Context().Value(userContextKey).(Claims)
+		if !layer.Allows(claims) {
+			writeError(w, r, http.StatusForbidden, "layer_forbidden", "")
+			return
+		}
+
+		rest := strings.TrimPrefix(r.URL.Path, layer.Path)
+		z, x, y, format, ok := parseLayerTile(rest)
+		if !ok || x >= 1<<z || y >= 1<<z || !slices.Contains(layer.Formats, format) {
+			writeError(w, r, http.StatusBadRequest, "invalid_tile", layer.Name)
+			return
+		}
+
+		if z < layer.MinZoom || z > layer.MaxZoom {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Nothing to render outside the layer's bounds
+		if layer.Bounds != nil && !tileIntersects(z, x, y, layer.Bounds) {
+			w.Header().Set("X-Cache", "EMPTY")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), layerContextKey, layer))
+		recordTrafficLayer(r.Context(), layer.Name)
+		recordTrafficTile(r.Context(), z, x, y)
+
+		if layer.Pool != "" {
+			if pool, ok := l.pool(layer.Pool); ok {
+				pool.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ManifestHandler serves the current manifest on GET and replaces it on PUT
+func (l *Layers) ManifestHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var manifest LayerManifest
+			if err := json.NewDecoder(io.LimitReader(r.Body, maxLayerManifestBytes)).Decode(&manifest); err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+
+			if err := l.Load(manifest); err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+
+			l.logger.Info("layer manifest replaced by operator", slog.Int("layers", len(manifest.Layers)))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(l.current.Load().manifest)
+	}
+}
+
+func cachedLayer(layer *Layer) bool      { return layer.Cache }
+func emptyTilesLayer(layer *Layer) bool  { return layer.EmptyTiles }
+func writeBehindLayer(layer *Layer) bool { return layer.WriteBehind }
+
+// layerGate applies mw to requests whose layer enables it, as decided by
+// enabled, and to requests outside any layer when the route does
+func layerGate(enabled func(*Layer) bool, routeDefault bool, mw func(http.Handler) http.Handler, next http.Handler) http.Handler {
+	wrapped := mw(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		on := routeDefault
+		if layer, ok := layerFromContext(r.Context()); ok {
+			on = enabled(layer)
+		}
+
+		if on {
+			wrapped.ServeHTTP(w, r)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// parseLayerTile splits "z/x/y.format"
+func parseLayerTile(rest string) (z, x, y int, format string, ok bool) {
+	if strings.Count(rest, "/") != 2 {
+		return 0, 0, 0, "", false
+	}
+
+	base, format, found := strings.Cut(rest[strings.LastIndex(rest, "/")+1:], ".")
+	if !found || base == "" {
+		return 0, 0, 0, "", false
+	}
+
+	z, x, y, ok = parseTileCoords(rest)
+	return z, x, y, strings.ToLower(format), ok
+}
+
+// tileIntersects reports whether the web mercator tile overlaps bounds
+func tileIntersects(z, x, y int, bounds []float64) bool {
+	n := math.Exp2(float64(z))
+
+	west := float64(x)/n*360 - 180
+	east := float64(x+1)/n*360 - 180
+	north := tileLatitude(float64(y), n)
+	south := tileLatitude(float64(y+1), n)
+
+	return west < bounds[2] && east > bounds[0] && south < bounds[3] && north > bounds[1]
+}
+
+func tileLatitude(y, n float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultStopTimeout is how long a stage has to stop unless it sets its own
+const defaultStopTimeout = 5 * time.Second
+
+var (
+	lifecycleGoroutines = NewGauge(
+		"civil_gateway_lifecycle_goroutines",
+		"Background goroutines running in each lifecycle stage",
+		"stage",
+	)
+	lifecycleStopDuration = NewGauge(
+		"civil_gateway_lifecycle_stage_stop_seconds",
+		"How long each lifecycle stage took to stop at shutdown",
+		"stage",
+	)
+	lifecycleStops = NewCounter(
+		"civil_gateway_lifecycle_stage_stops_total",
+		"Lifecycle stages stopped at shutdown, by whether they stopped cleanly, failed, or timed out",
+		"stage", "result",
+	)
+)
+
+// Lifecycle owns every background goroutine in the gateway. Goroutines are
+// started in named stages, and stages are shut down in the reverse of the
+// order they were created, so later stages can depend on earlier ones.
+// Stages that must stop before others created after them say so with
+// StopBefore.
+type Lifecycle struct {
+	mu     sync.Mutex
+	stages []*Stage
+	logger *slog.Logger
+}
+
+// Stage is a group of goroutines that are stopped together
+type Stage struct {
+	name   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  errgroup.Group
+	logger *slog.Logger
+
+	// Set up before anything runs in the stage, see StopBefore and
+	// StopTimeout
+	before      []string
+	stopTimeout time.Duration
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+func NewLifecycle(logger *slog.Logger) *Lifecycle {
+	return &Lifecycle{
+		logger: logger,
+	}
+}
+
+// Stage creates a new stage. It is shut down before every stage created
+// earlier.
+func (l *Lifecycle) Stage(name string) *Stage {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stage := &Stage{
+		name:    name,
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  l.logger.With(slog.String("stage", name)),
+		running: map[string]int{},
+
+		stopTimeout: defaultStopTimeout,
+	}
+
+	l.mu.Lock()
+	l.stages = append(l.stages, stage)
+	l.mu.Unlock()
+
+	return stage
+}
+
+// StopBefore has the stage stop before the stages matching patterns, like
+// scheduler or pool:*, whenever they were created. Patterns matching no
+// stage are ignored, so the stages needn't all be configured.
+func (s *Stage) StopBefore(patterns ...string) *Stage {
+	s.before = append(s.before, patterns...)
+	return s
+}
+
+// StopTimeout is how long the stage has to stop before shutdown moves on
+// without it
+func (s *Stage) StopTimeout(timeout time.Duration) *Stage {
+	s.stopTimeout = timeout
+	return s
+}
+
+// OnStop runs fn when the stage stops, with the stage's stop timeout
+func (s *Stage) OnStop(name string, fn func(ctx context.Context) error) {
+	s.Go(name, func(ctx context.Context) error {
+		<-ctx.Done()
+		stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.stopTimeout)
+		defer cancel()
+		return fn(stopCtx)
+	})
+}
+
+// mustStopBefore reports whether s has to stop before other
+func (s *Stage) mustStopBefore(other *Stage) bool {
+	return slices.ContainsFunc(s.before, func(pattern string) bool {
+		matched, _ := path.Match(pattern, other.name)
+		return matched
+	})
+}
+
+// Go runs fn in the stage. fn must return once its context is cancelled.
+func (s *Stage) Go(name string, fn func(ctx context.Context) error) {
+	s.track(name, 1)
+
+	s.group.Go(func() error {
+		defer s.track(name, -1)
+
+		err := fn(s.ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			s.logger.Error("background goroutine failed", slog.String("goroutine", name), slog.Any("error", err))
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *Stage) track(name string, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running[name] += delta
+	if s.running[name] <= 0 {
+		delete(s.running, name)
+	}
+	lifecycleGoroutines.Add(float64(delta), s.name)
+}
+
+// Running lists the goroutines of the stage that have not returned yet
+func (s *Stage) Running() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.running))
+	for name, count := range s.running {
+		if count > 1 {
+			name = fmt.Sprintf("%s (x%d)", name, count)
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Shutdown stops the stages one at a time in stopOrder, waiting for each to
+// drain before moving on. A stage that doesn't stop within its timeout is
+// reported and left behind. Returns early if ctx expires.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	stages := slices.Clone(l.stages)
+	l.mu.Unlock()
+
+	var errs []error
+
+	for _, stage := range stopOrder(stages) {
+		start := time.Now()
+		stage.cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- stage.group.Wait()
+		}()
+
+		timer := time.NewTimer(stage.stopTimeout)
+		result := "ok"
+		select {
+		case err := <-done:
+			if err != nil {
+				result = "error"
+				errs = append(errs, err)
+			}
+		case <-timer.C:
+			result = "timeout"
+			errs = append(errs, fmt.Errorf("stage %s did not stop within %s (still running: %s)", stage.name, stage.stopTimeout, strings.Join(stage.Running(), ", ")))
+		case <-ctx.Done():
+			timer.Stop()
+			lifecycleStops.Inc(stage.name, "timeout")
+			return errors.Join(append(errs, fmt.Errorf("stage %s did not stop in time (still running: %s): %w", stage.name, strings.Join(stage.Running(), ", "), ctx.Err()))...)
+		}
+		timer.Stop()
+
+		elapsed := time.Since(start)
+		lifecycleStopDuration.Set(elapsed.Seconds(), stage.name)
+		lifecycleStops.Inc(stage.name, result)
+		l.logger.Debug("stage stopped", slog.String("stage", stage.name), slog.String("result", result), slog.Duration("duration", elapsed))
+	}
+
+	return errors.Join(errs...)
+}
+
+// stopOrder is the order stages stop in: newest first, except that a stage
+// waits for every stage that has to stop before it. Stages caught in a
+// cycle of StopBefore fall back to newest first.
+func stopOrder(stages []*Stage) []*Stage {
+	remaining := slices.Clone(stages)
+	order := make([]*Stage, 0, len(stages))
+
+	for len(remaining) > 0 {
+		next := len(remaining) - 1
+		for i := len(remaining) - 1; i >= 0; i-- {
+			waiting := slices.ContainsFunc(remaining, func(other *Stage) bool {
+				return other != remaining[i] && other.mustStopBefore(remaining[i])
+			})
+			if !waiting {
+				next = i
+				break
+			}
+		}
+
+		order = append(order, remaining[next])
+		remaining = slices.Delete(remaining, next, next+1)
+	}
+	return order
+}
+
+// LeakCheck reports any goroutine started through the lifecycle that is still
+// running. Meant to be called after Shutdown, e.g. from tests or with
+// CIVIL_LEAK_CHECK enabled, where a non-nil error means something ignored its
+// context.
+func (l *Lifecycle) LeakCheck() error {
+	l.mu.Lock()
+	stages := slices.Clone(l.stages)
+	l.mu.Unlock()
+
+	var leaks []string
+	for _, stage := range stages {
+		for _, name := range stage.Running() {
+			leaks = append(leaks, stage.name+"/"+name)
+		}
+	}
+
+	if len(leaks) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("goroutines still running after shutdown: %s", strings.Join(leaks, ", "))
+}
+
+// goroutineDump returns the stacks of every goroutine in the process, to
+// pinpoint where leaked goroutines are blocked
+func goroutineDump() string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	return buf.String()
+}
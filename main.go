@@ -4,13 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"slices"
 	"syscall"
 	"time"
 
@@ -35,15 +35,33 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "migrate" {
+		os.Exit(runConfigMigrate(os.Args[3:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		os.Exit(runGenerate(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelftest(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
 	// Create context, logger, and config first
-	_, cancelApp := context.WithCancel(context.Background())
+	appCtx, cancelApp := context.WithCancel(context.Background())
 	defer cancelApp()
 
 	var programLevel = new(slog.LevelVar)
 
 	programLevel.Set(slog.LevelInfo)
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	// Recent lines are also kept for support bundles
+	recentLogs := newLogRing(supportLogLines)
+	logger := slog.New(slog.NewJSONHandler(io.MultiWriter(os.Stdout, recentLogs), &slog.HandlerOptions{
 		Level: programLevel,
 	}))
 
@@ -59,56 +77,129 @@ func main() {
 
 	logger.Info("Starting proxy", slog.Any("address", config.TileServerHost))
 
-	// Create the Reverse Proxy for the Tile Server with a custom Director
-	proxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
+	// Government deployments must not run on anything but FIPS-validated
+	// crypto, so refuse to start rather than silently fall back
+	build := currentVersion()
+	logger.Info("running build",
+		slog.String("version", build.Version),
+		slog.String("platform", build.Platform),
+		slog.String("crypto", build.Crypto.Mode),
+	)
+	if config.RequireFIPS && build.Crypto.Mode == "standard" {
+		logger.Error("FIPS 140-3 mode is required but not enabled, build with GOFIPS140 or run with GODEBUG=fips140=on")
+		os.Exit(1)
+	}
+	recordBuildInfo()
 
-			originalHost := req.Host
+	if err := SetErrorTemplates(config.ErrorTemplates, config.ErrorLanguage); err != nil {
+		logger.Error("failed to load error templates", slog.Any("error", err))
+		os.Exit(1)
+	}
+	SetTrustedProxies(config.TrustedProxies)
 
-			if originalHost == "" {
-				originalHost = req.URL.Host // Fallback
-			}
+	// Every background goroutine is owned by the lifecycle. Once the servers
+	// have drained, the spools flush, then the pools stop discovering, then
+	// the scheduler stops, and the caches and stores close last
+	lifecycle := NewLifecycle(logger)
 
-			// Rewrite the request to target the tile server
-			req.URL.Scheme = "http"
-			req.URL.Host = config.TileServerHost
+	// Tracing is set up in the first stage so it stops last, flushing the
+	// spans of everything stopped before it
+	if err := setupTracing(appCtx, lifecycle.Stage("tracing"), logger); err != nil {
+		logger.Error("failed to set up tracing", slog.Any("error", err))
+		os.Exit(1)
+	}
 
-			// Update the Host header so the tile server accepts it
-			req.Host = config.TileServerHost
+	// Scheduled jobs use the caches and stores, so they stop first
+	schedulerStage := lifecycle.Stage("scheduler").StopBefore("cache", "replay", "ratelimit", "reputation")
+	cacheStage := lifecycle.Stage("cache")
 
-			// TELL THE BACKEND THE TRUTH
-			// "The real host"
-			req.Header.Set("X-Forwarded-Host", originalHost)
+	// All periodic background work runs as named jobs on the scheduler
+	scheduler := NewScheduler(logger)
+	scheduler.Start(schedulerStage)
 
-			// "The user is using HTTPS (even if we are talking HTTP right now)"
-			req.Header.Set("X-Forwarded-Proto", "https")
+	// The middleware stages are timed on their own, so a slow one is
+	// logged by name
+	watchdog := NewMiddlewareWatchdog(config.MiddlewareBudgets, logger)
 
-			// The user's real IP (Optional but good for logs)
-			// Safely extract JUST the IP address, dropping the ephemeral port
-			ip, _, err := net.SplitHostPort(req.RemoteAddr)
-			if err == nil {
-				req.Header.Set("X-Real-IP", ip)
-			} else {
-				// Fallback if RemoteAddr was somehow just an IP without a port
-				req.Header.Set("X-Real-IP", req.RemoteAddr)
-			}
+	// Issuers, CORS, rate limits, and the pools' auth can be changed
+	// without a restart, on SIGHUP or when the config file changes
+	reloader := NewReloader(config, logger)
 
-		},
+	issuers, err := NewIssuers(config.Issuers, scheduler, config.JWKSRefresh, logger)
+	if err != nil {
+		logger.Error("failed to set up authentication", slog.Any("error", err))
+		os.Exit(1)
+	}
+	reloader.Add("issuers", func(c *Config) (func(), error) { return issuers.Prepare(c.Issuers) })
+	auth := issuers.RequireAuth
 
-		// This is needed to strip off any conflicting header details that the Tile Server attaches
-		ModifyResponse: func(r *http.Response) error {
+	// Callers that can't do an OIDC flow authenticate with an API key
+	if config.APIKeys != "" {
+		apiKeys, err := NewAPIKeyStore(appCtx, config.APIKeys, logger)
+		if err != nil {
+			logger.Error("failed to load API keys", slog.Any("error", err))
+			os.Exit(1)
+		}
+		scheduler.Add("auth:apikeys", config.APIKeysReload, apiKeys.Reload)
+		auth = apiKeys.Middleware(auth)
+	}
 
-			// The Middleware already set these headers.
-			// We MUST delete any versions sent by the backend to avoid the "Multiple Values" error.
-			r.Header.Del("Access-Control-Allow-Origin")
-			r.Header.Del("Access-Control-Allow-Methods")
-			r.Header.Del("Access-Control-Allow-Headers")
+	// The stateful parts share one memory budget so together they can't
+	// outgrow the task
+	memory := NewMemoryAccountant(config.MemoryBudget, logger)
+	rateLimitMemory := memory.Register("ratelimit", config.RateLimitMaxBytes)
+	if config.MemoryReportInterval > 0 {
+		scheduler.Add("memory:report", config.MemoryReportInterval, memory.Report)
+	}
 
-			return nil
-		},
+	// Embeds that can't send headers, like <img> tags, authenticate with
+	// signed URLs instead. One-time URLs are remembered in Redis when there
+	// is one, so they hold across replicas.
+	var signedURLs *SignedURLs
+	if config.SignedURLKeys != "" {
+		replay, err := NewSharedReplayGuard(lifecycle.Stage("replay"), config.RedisAddr, config.ReplayRedisTimeout, logger)
+		if err != nil {
+			logger.Error("failed to set up replay Redis", slog.Any("error", err))
+			os.Exit(1)
+		}
+		replay.SetMemoryPool(memory.Register("replay", 0))
+		scheduler.Add("auth:replay-prune", time.Minute, replay.Prune)
+
+		signedURLs, err = NewSignedURLs(appCtx, config.SignedURLKeys, config.SignedURLTTL, config.SignedURLMaxTTL, replay, logger)
+		if err != nil {
+			logger.Error("failed to load signed URL keys", slog.Any("error", err))
+			os.Exit(1)
+		}
+		auth = signedURLs.Middleware(auth)
+	}
+
+	// Heavy consumers are throttled per user once authenticated, and per
+	// client address on the routes without auth
+	rateLimiter := NewRateLimiter(config.UserRateLimit, config.UserRateBurst, config.ClientRateLimit, config.ClientRateBurst, logger)
+	rateLimiter.SetMemoryPool(rateLimitMemory)
+	scheduler.Add("ratelimit:prune", time.Minute, rateLimiter.Prune)
+	reloader.Add("ratelimit", func(c *Config) (func(), error) {
+		return func() { rateLimiter.SetRates(c.UserRateLimit, c.UserRateBurst, c.ClientRateLimit, c.ClientRateBurst) }, nil
+	})
+
+	// Replicas share their buckets through Redis so the limits don't
+	// multiply with the replica count. Limits turned on by a reload stay
+	// local to each replica until a restart.
+	if config.RedisAddr != "" && (config.UserRateLimit > 0 || config.ClientRateLimit > 0) {
+		redisLimiter, err := NewRedisRateLimiter(appCtx, lifecycle.Stage("ratelimit"), config.RedisAddr, config.RateLimitRedisTimeout, logger)
+		if err != nil {
+			logger.Error("failed to set up rate limit Redis", slog.Any("error", err))
+			os.Exit(1)
+		}
+		rateLimiter.SetRedis(redisLimiter)
 	}
 
-	auth, err := RequireAuth(config.AuthServer, config.IDPHost, config.AllowedClientsIds, logger)
+	requireAuth := watchdog.Stage("auth", auth)
+	userLimit := watchdog.Stage("ratelimit", rateLimiter.UserMiddleware)
+	clientLimit := watchdog.Stage("ratelimit", rateLimiter.ClientMiddleware)
+	auth = func(next http.Handler) http.Handler {
+		return requireAuth(userLimit(next))
+	}
 
 	dbReaderAddress := "http://" + config.DBReaderHost
 
@@ -132,6 +223,14 @@ func main() {
 		dbReaderAddress,
 	)
 
+	// Browsers may call the API from the origins the CORS policy allows
+	cors, err := NewCORSPolicy(config.CORS, logger)
+	if err != nil {
+		logger.Error("failed to create CORS policy", slog.Any("error", err))
+		os.Exit(1)
+	}
+	reloader.Add("cors", func(c *Config) (func(), error) { return cors.Prepare(c.CORS) })
+
 	mux := http.NewServeMux()
 
 	parcelsServer := &ParcelServer{
@@ -144,7 +243,7 @@ func main() {
 		connect.WithInterceptors(validate.NewInterceptor()),
 	)
 
-	mux.Handle(parcelsPath, CORSMiddleware(auth(parcelsHandler), logger))
+	mux.Handle(parcelsPath, cors.Middleware(auth(parcelsHandler)))
 
 	instanceServer := &InstanceServer{
 		config: *config,
@@ -156,7 +255,7 @@ func main() {
 		connect.WithInterceptors(validate.NewInterceptor()),
 	)
 
-	mux.Handle(instancePath, CORSMiddleware(instanceHandler, logger))
+	mux.Handle(instancePath, cors.Middleware(clientLimit(instanceHandler)))
 
 	improvementsServer := &ImprovementServer{
 		dbReaderClient: meshImprovementsClient,
@@ -168,7 +267,7 @@ func main() {
 		connect.WithInterceptors(validate.NewInterceptor()),
 	)
 
-	mux.Handle(improvementsPath, CORSMiddleware(auth(improvementsHandler), logger))
+	mux.Handle(improvementsPath, cors.Middleware(auth(improvementsHandler)))
 
 	landUsesServer := &LandUseServer{
 		dbReaderClient: meshLandUsesClient,
@@ -180,7 +279,7 @@ func main() {
 		connect.WithInterceptors(validate.NewInterceptor()),
 	)
 
-	mux.Handle(landUsesPath, CORSMiddleware(auth(landUsesHandler), logger))
+	mux.Handle(landUsesPath, cors.Middleware(auth(landUsesHandler)))
 
 	zoningServer := &ZoningServer{
 		dbReaderClient: meshZoningClient,
@@ -192,7 +291,7 @@ func main() {
 		connect.WithInterceptors(validate.NewInterceptor()),
 	)
 
-	mux.Handle(zoningPath, CORSMiddleware(auth(zoningHandler), logger))
+	mux.Handle(zoningPath, cors.Middleware(auth(zoningHandler)))
 
 	// Create gRPC connection to Dex if an address is provided
 	if config.DexGrpcAddress != "" {
@@ -218,23 +317,686 @@ func main() {
 				connect.WithInterceptors(validate.NewInterceptor()),
 			)
 
-			mux.Handle(dexPath, CORSMiddleware(auth(dexHandler), logger))
+			mux.Handle(dexPath, cors.Middleware(auth(dexHandler)))
+		}
+
+	}
+
+	// Readiness backs /readyz and the gRPC health service alike
+	readiness := NewReadiness(parcelsv1connect.ParcelsServiceName)
+	support := NewSupportBundle(config, recentLogs, readiness, logger)
+
+	// Serve each discovered pool under its own prefix. Tiles fall back to the
+	// single TileServerHost when no pool claims /tiles/
+	tilesServed := false
+
+	// Routes that proxy upstream, which the admin echo route can dry-run
+	var proxiedRoutes []string
+
+	// Cache misses for the same tile at once go upstream as one request
+	var coalescer *Coalescer
+	if config.Coalesce {
+		coalescer = NewCoalescer(config.CoalesceMaxBytes)
+	}
+
+	// Requests are measured against the SLOs, and those burning their error
+	// budget too fast have the cache serve stale tiles
+	slos := NewSLOTracker(config.SLOs, config.SLOBurnThreshold, logger)
+	if len(config.SLOs) > 0 {
+		scheduler.Add("slo:evaluate", 15*time.Second, slos.Evaluate)
+	}
+
+	// One tile cache is shared by every cached route, keyed by full path
+	var tileCache *TileCache
+	if config.CacheTTL > 0 {
+		tileCache, err = NewTileCache(cacheStage, config.CacheTTL, config.CacheMaxBytes, config.CacheMaxEntryBytes, config.CacheEvictionPolicy, config.CacheTTLJitter, config.CacheRefreshBeta, logger)
+		if err != nil {
+			logger.Error("failed to create tile cache", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		tileCache.SetMemoryPool(memory.Register("cache", config.CacheMaxBytes))
+
+		// Backends can tune the TTL of what they send, within bounds
+		tileCache.SetCacheHintBounds(config.CacheHintMinTTL, config.CacheHintMaxTTL)
+		tileCache.SetDegradation(slos.Degraded, config.SLODegradedMaxStale)
+		tileCache.SetOutageStaleness(config.CacheOutageMaxStale)
+
+		// Replicas share what they have fetched through Redis
+		if config.SharedCacheURL != "" {
+			shared, err := NewSharedCache(appCtx, cacheStage, SharedCacheConfig{
+				URL:          config.SharedCacheURL,
+				TTL:          config.SharedCacheTTL,
+				NearTTL:      config.SharedCacheNearTTL,
+				Timeout:      config.SharedCacheTimeout,
+				WriteThrough: config.SharedCacheWriteThrough,
+				Retain:       config.CacheOutageMaxStale,
+			}, tileCache.purgeLocal, logger)
+			if err != nil {
+				logger.Error("failed to connect to shared cache", slog.Any("error", err))
+				os.Exit(1)
+			}
+			tileCache.SetSharedCache(shared)
 		}
 
+		// Carry the cache over restarts so deploys don't start cold
+		if config.CacheSnapshotURL != "" {
+			startCacheSnapshots(cacheStage, tileCache, config.CacheSnapshotURL, config.CacheSnapshotMaxAge, logger)
+		}
+	}
+
+	// Tiles missing from the manifest are answered before the cache
+	var emptyTiles *EmptyTiles
+	if config.TileManifestURL != "" {
+		emptyTiles = NewEmptyTiles(config.TileManifestURL, config.EmptyTileFalsePositive, logger)
+
+		cacheStage.Go("tile-manifest", func(ctx context.Context) error {
+			if err := emptyTiles.Load(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				logger.Error("failed to load tile manifest", slog.Any("error", err))
+			}
+			return nil
+		})
+		scheduler.Add("tiles:manifest", config.TileManifestRefresh, emptyTiles.Load)
+	}
+
+	// Tiles rendered on demand are persisted to the tile bucket
+	var writeBehind *TileWriteBehind
+	if config.TileBucketURL != "" {
+		writeBehindStage := lifecycle.Stage("write-behind").StopBefore("pool:*", "scheduler").StopTimeout(writeBehindDrainTimeout + time.Second)
+		writeBehind, err = NewTileWriteBehind(appCtx, writeBehindStage, config.TileBucketURL, config.WriteBehindQueue, config.WriteBehindWorkers, logger)
+		if err != nil {
+			logger.Error("failed to start tile write-behind", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// The layer manifest decides caching and empty-tile answers for the
+	// paths its layers cover, with the route settings below for the rest
+	layers := NewLayers(logger)
+
+	// Edge caching headers and purging for the CDN in front of the gateway
+	var cdn *CDN
+	if config.CDNSMaxAge > 0 || config.CloudFrontDistributionID != "" {
+		cdn, err = NewCDN(appCtx, config.CDNSMaxAge, config.CloudFrontDistributionID, tileCache, layers, logger)
+		if err != nil {
+			logger.Error("failed to create CDN integration", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// Endpoints are probed actively and ejected when failing requests, rather
+	// than waiting on Cloud Map
+	probe := ProbeConfig{
+		Path:             config.ProbePath,
+		Interval:         config.ProbeInterval,
+		Timeout:          config.ProbeTimeout,
+		FailureThreshold: config.ProbeFailureThreshold,
+		EjectAfter:       config.EjectAfter,
+		EjectCooldown:    config.EjectCooldown,
+	}
+
+	// What endpoints were ejected for outlives the process, so a deploy
+	// doesn't hand a flaky endpoint full traffic again
+	var reputation *ReputationStore
+	if config.BackendReputation {
+		reputation, err = NewReputationStore(lifecycle.Stage("reputation"), config.RedisAddr, ReputationConfig{
+			TTL:              config.ReputationTTL,
+			SuspectErrorRate: config.ReputationSuspectErrorRate,
+			Timeout:          5 * time.Second,
+		}, logger)
+		if err != nil {
+			logger.Error("failed to set up reputation Redis", slog.Any("error", err))
+			os.Exit(1)
+		}
+		scheduler.Add("reputation:save", config.ReputationSaveInterval, reputation.Save)
+	}
+
+	// Transformers pools can run over their responses
+	if config.PublicURL != "" {
+		publicURL, _ := url.Parse(config.PublicURL)
+		RegisterTransformer("tilejson", []string{"application/json"}, tileJSONRewriter(publicURL))
+	}
+	RegisterTransformer("jpeg", []string{"image/png"}, jpegConverter{quality: config.JPEGQuality})
+	if config.WatermarkImage != "" {
+		watermark, err := NewWatermark(config.WatermarkImage)
+		if err != nil {
+			logger.Error("failed to load watermark", slog.Any("error", err))
+			os.Exit(1)
+		}
+		RegisterTransformer("watermark", []string{"image/png", "image/jpeg"}, watermark)
+	}
+
+	// WASM filter modules run as plugins too, after the compiled in ones
+	// unless placed among them
+	plugins := slices.Clone(config.Plugins)
+	if len(config.WASMModules) > 0 {
+		wasmStage := lifecycle.Stage("wasm")
+		limits := WASMLimits{
+			MemoryMB:     max(config.WASMMemoryMB, 1),
+			Timeout:      config.WASMTimeout,
+			MaxInstances: max(config.WASMMaxInstances, 1),
+		}
+
+		for _, mc := range config.WASMModules {
+			module, err := LoadWASMModule(appCtx, wasmStage, mc, limits, logger)
+			if err != nil {
+				logger.Error("failed to load wasm module", slog.Any("error", err))
+				os.Exit(1)
+			}
+
+			plugin := module.Plugin()
+			RegisterPlugin(plugin)
+			if !slices.Contains(plugins, plugin.Name) {
+				plugins = append(plugins, plugin.Name)
+			}
+			logger.Info("loaded wasm module", slog.String("name", mc.Name), slog.String("url", mc.URL))
+		}
+	}
+
+	// Compiled in plugins run in the order configured
+	if err := EnablePlugins(plugins, logger); err != nil {
+		logger.Error("failed to enable plugins", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// Idempotent requests failing on one endpoint are retried on another
+	retry := RetryConfig{
+		Attempts:       config.RetryAttempts,
+		AttemptTimeout: config.RetryAttemptTimeout,
+		Budget:         config.RetryBudget,
+	}
+
+	// Pools follow their Cloud Map services however big they get
+	// Requests stay within the gateway's availability zone where they can
+	var zone string
+	if config.ZoneAware {
+		zone = detectZone(appCtx, logger)
+		if zone != "" {
+			logger.Info("preferring backends in the gateway's availability zone", slog.String("zone", zone))
+		}
+	}
+
+	discovery := DiscoveryConfig{
+		Interval:          config.DiscoveryInterval,
+		PageSize:          config.DiscoveryPageSize,
+		MaxInstances:      config.DiscoveryMaxInstances,
+		EmptyPolicy:       config.DiscoveryEmptyPolicy,
+		EmptyMaxStaleness: config.DiscoveryEmptyMaxStaleness,
+		CapabilitiesPath:  config.CapabilitiesPath,
+		Zone:              zone,
+		ZoneMinEndpoints:  config.ZoneMinEndpoints,
+		AllowedCIDRs:      config.BackendAllowedCIDRs,
+		Jitter:            config.DiscoveryJitter,
+		MaxBackoff:        config.DiscoveryMaxBackoff,
+	}
+
+	// With change events, Cloud Map pools are rediscovered as they change
+	// and only polled as a safety net
+	poolDiscovery := func(pc PoolConfig) DiscoveryConfig {
+		if config.DiscoveryEventsTopicArn == "" || !pc.discoversWithCloudMap() {
+			return discovery
+		}
+		slow := discovery
+		slow.Interval = config.DiscoveryEventsFallbackInterval
+		return slow
+	}
+
+	// Each pool finds how much load its backends sustain
+	concurrency := ConcurrencyConfig{
+		Adaptive:      config.AdaptiveConcurrency,
+		InitialLimit:  config.ConcurrencyInitialLimit,
+		MinLimit:      config.ConcurrencyMinLimit,
+		MaxLimit:      config.ConcurrencyMaxLimit,
+		Tolerance:     config.ConcurrencyLatencyTolerance,
+		QueueSize:     config.ConcurrencyQueueSize,
+		QueueTimeout:  config.ConcurrencyQueueTimeout,
+		TenantWeights: config.TenantWeights,
+		Memory:        memory.Register("tenants", 0),
+	}
+
+	// The gateway sheds what it can't hold, as a whole and on pools with a
+	// limit of their own
+	inFlight := InFlightConfig{
+		Limit:        config.MaxInFlight,
+		QueueSize:    config.InFlightQueueSize,
+		QueueTimeout: config.InFlightQueueTimeout,
+		RetryAfter:   config.InFlightRetryAfter,
+	}
+
+	// Backends can tell the gateway's requests from direct ones, and who
+	// they are for
+	identity := newUpstreamIdentity(config.UpstreamUserAgent, config.UpstreamVia, detectInstanceID(), config.ClientUserAgent)
+	claimHeaders, err := NewClaimHeaders(config.ClaimHeaders)
+	if err != nil {
+		logger.Error("invalid claim headers", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// Backends verify the internal JWTs standing in for the client's
+	// credentials against the key served here
+	upstreamAuth := UpstreamAuth{Mode: config.UpstreamAuth}
+	if config.InternalJWTKey != "" {
+		upstreamAuth.Signer, err = NewInternalTokenSigner(appCtx, config.InternalJWTKey, config.InternalJWTIssuer, config.InternalJWTTTL)
+		if err != nil {
+			logger.Error("failed to set up internal JWTs", slog.Any("error", err))
+			os.Exit(1)
+		}
+		mux.HandleFunc("GET /internal/jwks.json", upstreamAuth.Signer.JWKSHandler())
+	}
+
+	backendPools := NewBackendPools()
+	if config.DiscoveryEventsTopicArn != "" {
+		if _, err := NewDiscoveryEvents(appCtx, lifecycle.Stage("discovery-events").StopBefore("pool:*"), config.DiscoveryEventsTopicArn, backendPools, scheduler, logger); err != nil {
+			logger.Error("failed to set up discovery events", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// Canaries take a share of their stable pool's requests, under its
+	// prefix, and are judged against it for the deployment pipeline
+	canaries := NewCanaryAnalyzer(CanaryThresholds{
+		Window:          config.CanaryWindow,
+		MaxErrorDelta:   config.CanaryMaxErrorDelta,
+		MaxLatencyDelta: config.CanaryMaxLatencyDelta,
+		MinRequests:     int64(config.CanaryMinRequests),
+	})
+	canaryPools := map[string]*Pool{}
+	canaryWeights := map[string]int{}
+	for _, pc := range config.Pools {
+		if pc.CanaryOf == "" {
+			continue
+		}
+		pool, err := NewPool(appCtx, lifecycle.Stage("pool:"+pc.Name).StopBefore("scheduler"), pc, scheduler, poolDiscovery(pc), probe, retry, concurrency, config.UpstreamTransport, identity, claimHeaders, upstreamAuth, logger)
+		if err != nil {
+			logger.Error("failed to create backend pool", slog.Any("error", err))
+			os.Exit(1)
+		}
+		canaryPools[pc.CanaryOf] = pool
+		canaryWeights[pc.CanaryOf] = pc.CanaryWeight
+
+		support.AddPool(pool.Name, pool.Backends)
+		backendPools.Add(pool.Name, pool.Backends)
+		if reputation != nil {
+			reputation.Track(appCtx, pool.Name, pool.Backends)
+		}
+		startCloudWatchPublisher(appCtx, scheduler, config, pool.Name, pool.Tracker, pool.Backends.EndpointCount, logger)
+	}
+	if len(canaryPools) > 0 {
+		scheduler.Add("canary:evaluate", 15*time.Second, canaries.Evaluate)
+	}
+
+	// A reload swaps the pools' auth requirements in place
+	poolAuths := map[string]*PoolAuth{}
+	for _, pc := range config.Pools {
+		if pc.CanaryOf != "" {
+			continue
+		}
+		pool, err := NewPool(appCtx, lifecycle.Stage("pool:"+pc.Name).StopBefore("scheduler"), pc, scheduler, poolDiscovery(pc), probe, retry, concurrency, config.UpstreamTransport, identity, claimHeaders, upstreamAuth, logger)
+		if err != nil {
+			logger.Error("failed to create backend pool", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		handler := pool.Handler
+		if canary, ok := canaryPools[pool.Name]; ok {
+			handler = canaries.Split(pool.Name, handler, canary.Name, canary.Handler, canaryWeights[pool.Name])
+		}
+		if coalescer != nil {
+			handler = coalescer.Middleware(handler)
+		}
+
+		// Optionally wake a scaled-to-zero pool instead of failing outright
+		if pool.Name == config.WakeUpPool {
+			wakeUpAction, err := NewWakeUpAction(appCtx, config, pool.Name)
+			if err != nil {
+				logger.Error("failed to create wake-up action", slog.Any("error", err))
+				os.Exit(1)
+			}
+
+			if wakeUpAction != nil {
+				gate := NewWakeUpGate(pool.Stage, pool.Backends, wakeUpAction, config.WakeUpWait, config.WakeUpCooldown, config.WakeUpRetryAfter, logger)
+				handler = gate.Middleware(handler)
+			}
+		}
+
+		if writeBehind != nil {
+			handler = layerGate(writeBehindLayer, pc.WriteBehind, writeBehind.Middleware, handler)
+		}
+		if tileCache != nil {
+			handler = layerGate(cachedLayer, pc.Cache, watchdog.Stage("cache", tileCache.Middleware), handler)
+			if len(pc.CacheBypass) > 0 {
+				handler = CacheBypass(pool.Name, pc.CacheBypass, pc.CacheBustParam, handler)
+			}
+
+			// A pool that wakes up on demand is left to wake rather than
+			// have its tiles served stale
+			if pool.Name != config.WakeUpPool || config.WakeUpAction == "" {
+				handler = markPoolDown(pool.Backends, handler)
+			}
+		}
+		if emptyTiles != nil {
+			handler = layerGate(emptyTilesLayer, pc.EmptyTiles, emptyTiles.Middleware, handler)
+		}
+		if cdn != nil {
+			handler = cdn.Middleware(handler)
+		}
+
+		routed := handler
+		handler = layers.Middleware(handler)
+
+		// WebSocket upgrades skip the layers above, which only make sense
+		// for plain responses
+		handler = WebSocketRoutes(pool.Name, pc.WebSocket, webSocketLifetime(config.WebSocketMaxLifetime, pool.Upstream), handler)
+
+		// Each pool sets its own auth requirements
+		poolAuth := NewPoolAuth(pc, auth, clientLimit, handler)
+		poolAuths[pool.Name] = poolAuth
+		handler = poolAuth
+
+		// Layers served under other prefixes reach the pool through its
+		// requirements too
+		layers.AddPool(pool.Name, poolAuth.Routed(routed))
+
+		if pc.MaxInFlight > 0 {
+			poolInFlight := inFlight
+			poolInFlight.Limit = pc.MaxInFlight
+			handler = NewInFlightLimiter(pool.Name, poolInFlight).Middleware(handler)
+		}
+
+		// A pool that wakes up on demand is expected to sit empty, so it
+		// doesn't count against readiness
+		if pool.Name != config.WakeUpPool || config.WakeUpAction == "" {
+			readiness.Add("pool:"+pool.Name, poolReadyCheck(pool.Backends))
+		}
+		support.AddPool(pool.Name, pool.Backends)
+		backendPools.Add(pool.Name, pool.Backends)
+		if reputation != nil {
+			reputation.Track(appCtx, pool.Name, pool.Backends)
+		}
+
+		mux.Handle(pool.Prefix, cors.Middleware(handler))
+		proxiedRoutes = append(proxiedRoutes, pool.Prefix)
+
+		if pool.Prefix == "/tiles/" {
+			tilesServed = true
+		}
+
+		// Export the pool's saturation so its ASG can scale on it
+		startCloudWatchPublisher(appCtx, scheduler, config, pool.Name, pool.Tracker, pool.Backends.EndpointCount, logger)
+	}
+
+	reloader.Add("pools", func(c *Config) (func(), error) {
+		return func() {
+			for _, pc := range c.Pools {
+				if poolAuth, ok := poolAuths[pc.Name]; ok {
+					poolAuth.Update(pc)
+				}
+			}
+		}, nil
+	})
+
+	if !tilesServed {
+		tileTracker := NewSaturationTracker()
+		tileAuth := upstreamAuth
+		tileAuth.Audience = "tiles"
+		upstream := NewUpstreamProxy(config.TileServerHost, NewUpstreamTransport("tiles", config.UpstreamTransport), tileTracker, identity, claimHeaders, tileAuth)
+		var proxy http.Handler = upstream
+		if config.UpstreamTimeout > 0 {
+			proxy = requestTimeout(config.UpstreamTimeout, proxy)
+		}
+		if coalescer != nil {
+			proxy = coalescer.Middleware(proxy)
+		}
+
+		if writeBehind != nil {
+			proxy = layerGate(writeBehindLayer, true, writeBehind.Middleware, proxy)
+		}
+		if tileCache != nil {
+			proxy = layerGate(cachedLayer, true, watchdog.Stage("cache", tileCache.Middleware), proxy)
+		}
+		if emptyTiles != nil {
+			proxy = layerGate(emptyTilesLayer, true, emptyTiles.Middleware, proxy)
+		}
+		if cdn != nil {
+			proxy = cdn.Middleware(proxy)
+		}
+
+		// The tile route always requires auth, as do the layers routed to it
+		tilesAuth := NewPoolAuth(PoolConfig{Name: "tiles"}, auth, clientLimit, proxy)
+		layers.AddPool("tiles", tilesAuth.Routed(proxy))
+		proxy = layers.Middleware(proxy)
+		proxy = WebSocketRoutes("tiles", config.WebSocketPaths, webSocketLifetime(config.WebSocketMaxLifetime, upstream), proxy)
+
+		mux.Handle("/tiles/", cors.Middleware(auth(proxy)))
+		proxiedRoutes = append(proxiedRoutes, "/tiles/")
+
+		startCloudWatchPublisher(appCtx, scheduler, config, "tiles", tileTracker, func() int { return 1 }, logger)
+	}
+
+	if config.LayerManifestURL != "" {
+		if err := layers.LoadFile(appCtx, config.LayerManifestURL); err != nil {
+			logger.Error("failed to load layer manifest", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// Signed CloudFront credentials let authenticated users fetch their
+	// layers from the CDN directly
+	if config.CloudFrontPrivateKey != "" && config.CloudFrontKeyPairID != "" && config.CDNDomain != "" {
+		signer, err := NewCloudFrontSigner([]byte(config.CloudFrontPrivateKey), config.CloudFrontKeyPairID, config.CDNDomain, config.CDNCookieDomain, config.CDNCredentialsTTL, layers, logger)
+		if err != nil {
+			logger.Error("failed to create CloudFront signer", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		mux.Handle("/cdn/credentials", cors.Middleware(auth(signer.Handler())))
+	}
+
+	if signedURLs != nil {
+		mux.Handle("/signed-urls", cors.Middleware(auth(signedURLs.Handler(layers, proxiedRoutes))))
+	}
+
+	for _, rc := range config.StaticRoutes {
+		route, err := NewStaticRoute(rc)
+		if err != nil {
+			logger.Error("failed to create static route", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		mux.Handle("GET "+rc.Path, clientLimit(route))
+	}
+
+	if config.Preview {
+		mux.HandleFunc("GET /preview", PreviewHandler())
 	}
 
-	mux.Handle("/tiles/", CORSMiddleware(auth(proxy), logger))
 	mux.HandleFunc("/health", HealthCheckHandler())
+	mux.HandleFunc("GET /version", VersionHandler())
+	mux.HandleFunc("/readyz", readiness.Handler())
+	mux.HandleFunc("/metrics", MetricsHandler())
+
+	// Client addresses flagged as abusive are blocked for a while
+	blocklist := NewIPBlocklist(logger)
+	blocklist.SetMemoryPool(memory.Register("blocklist", 0))
+
+	// Plugins see each request before it is routed, after the WAF and the
+	// blocklist below. The WAF wraps the whole mux so rules are evaluated
+	// before auth
+	var handler http.Handler = PluginMiddleware(RecordRoute(mux))
+
+	var waf *WAF
+	if len(config.WAFRules) > 0 {
+		waf, err = NewWAF(config.WAFRules, logger)
+		if err != nil {
+			logger.Error("failed to create waf", slog.Any("error", err))
+			os.Exit(1)
+		}
 
-	// Pass the fully qualified name of the service so the health check
-	// can report on this specific service, as well as the global server status.
-	checker := grpchealth.NewStaticChecker(
-		parcelsv1connect.ParcelsServiceName,
-	)
+		waf.SetMemoryPool(rateLimitMemory)
+		handler = watchdog.Stage("waf", waf.Middleware)(handler)
+		scheduler.Add("waf:prune", time.Minute, waf.Prune)
+	}
+
+	// Decoy paths feed the blocklist, which turns blocked clients away
+	// before anything else runs
+	var honeypot *Honeypot
+	if len(config.HoneypotPaths) > 0 {
+		honeypot = NewHoneypot(config.HoneypotPaths, blocklist, config.IPBlockDuration, logger)
+		handler = honeypot.Middleware(handler)
+	}
+
+	// Past the blocklist, the gateway serves only so many requests at once,
+	// and /readyz tells the load balancer how close it is to its limit
+	globalInFlight := NewInFlightLimiter("global", inFlight)
+	handler = exemptFromInFlight(globalInFlight.Middleware, handler)
+	readiness.SetLoad(globalInFlight.State)
+	if config.ReadyMaxSaturation > 0 {
+		readiness.Add("saturation", saturationReadyCheck(globalInFlight, config.ReadyMaxSaturation))
+	}
+
+	handler = watchdog.Stage("blocklist", blocklist.Middleware)(handler)
+	scheduler.Add("blocklist:prune", time.Minute, blocklist.Prune)
 
-	healthPath, healthHandler := grpchealth.NewHandler(checker)
+	// Individual requests can be flagged for capture. Captures are read
+	// through the admin endpoints, so there is no point without them
+	var captures *CaptureStore
+	if config.CaptureSecret != "" && config.AdminToken != "" {
+		captures = NewCaptureStore(config.CaptureSecret, logger)
+		captures.SetMemoryPool(memory.Register("captures", config.CaptureMaxBytes))
+		handler = captures.Middleware(handler)
+	}
+
+	handler = slos.Middleware(handler)
+
+	// Responses are compressed once, on the way out, so the cache keeps
+	// them as the backends sent them
+	if config.Compression {
+		compressor, err := NewCompressor(CompressionConfig{
+			GzipLevel:   config.CompressionGzipLevel,
+			BrotliLevel: config.CompressionBrotliLevel,
+			MinBytes:    config.CompressionMinBytes,
+		})
+		if err != nil {
+			logger.Error("failed to create compressor", slog.Any("error", err))
+			os.Exit(1)
+		}
+		handler = compressor.Middleware(handler)
+	}
+
+	// Usage analytics only ever leave the gateway aggregated
+	if config.AnalyticsBucketURL != "" {
+		analyticsStage := lifecycle.Stage("analytics").StopBefore("pool:*", "scheduler").StopTimeout(analyticsFlushTimeout + time.Second)
+		analytics, err := NewUsageAnalytics(appCtx, analyticsStage, AnalyticsConfig{
+			BucketURL: config.AnalyticsBucketURL,
+			Interval:  config.AnalyticsInterval,
+			GeoZoom:   config.AnalyticsGeoZoom,
+			ZoomBand:  config.AnalyticsZoomBand,
+			MinUsers:  config.AnalyticsMinUsers,
+		}, logger)
+		if err != nil {
+			logger.Error("failed to set up analytics", slog.Any("error", err))
+			os.Exit(1)
+		}
+		handler = analytics.Middleware(handler)
+	}
+
+	// Billable tile serves are recorded one by one, and kept on disk until
+	// they are safely in the bucket
+	if config.BillingBucketURL != "" {
+		billingStage := lifecycle.Stage("billing").StopBefore("pool:*", "scheduler").StopTimeout(analyticsFlushTimeout + time.Second)
+		billing, err := NewBillingLog(appCtx, billingStage, BillingConfig{
+			BucketURL:         config.BillingBucketURL,
+			SpoolDir:          config.BillingSpoolDir,
+			FlushInterval:     config.BillingFlushInterval,
+			BatchSize:         config.BillingBatchSize,
+			TenantGroupPrefix: config.BillingTenantGroupPrefix,
+		}, logger)
+		if err != nil {
+			logger.Error("failed to set up billing log", slog.Any("error", err))
+			os.Exit(1)
+		}
+		handler = billing.Middleware(handler)
+	}
+
+	// Traffic is measured as sent to clients, so it is what the data
+	// transfer bill is for
+	egress := NewEgressMeter(EgressConfig{
+		CostPerGB: config.EgressCostPerGB,
+		Window:    config.EgressWindow,
+		Tenants:   config.EgressTenants,
+	})
+	handler = egress.Middleware(handler)
+	scheduler.Add("egress:update", egress.Span(), egress.Update)
+
+	// Access lines go to stdout next to the application logs, after the
+	// fingerprint is computed so they can carry it
+	if config.AccessLog {
+		handler = AccessLogMiddleware(handler, NewAccessLogger(os.Stdout, config.AccessLogFormat))
+	}
+
+	if config.Fingerprint {
+		handler = FingerprintMiddleware(handler)
+	}
+
+	// The server span is outermost so it covers every middleware
+	handler = TracingMiddleware(handler)
+
+	// Operator endpoints, only served when an admin token is configured,
+	// next to the public routes or on a listener of their own
+	var adminHandler http.Handler
+	if config.AdminToken != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("GET /admin/jobs", scheduler.JobsHandler())
+		adminMux.HandleFunc("GET /admin/memory", memory.UsageHandler())
+		adminMux.HandleFunc("GET /admin/slos", slos.StatusHandler())
+		adminMux.HandleFunc("GET /admin/support-bundle", support.Handler())
+		adminMux.HandleFunc("GET /admin/blocks", blocklist.BlocksHandler())
+		adminMux.HandleFunc("DELETE /admin/blocks/{addr}", blocklist.UnblockHandler())
+		adminMux.HandleFunc("GET /admin/backends", backendPools.BackendsHandler())
+		adminMux.HandleFunc("POST /admin/backends/{addr}/drain", backendPools.DrainHandler(logger))
+		adminMux.HandleFunc("DELETE /admin/backends/{addr}/drain", backendPools.DrainHandler(logger))
+		adminMux.HandleFunc("POST /admin/discovery/refresh", backendPools.RefreshHandler(scheduler, logger))
+		adminMux.HandleFunc("POST /admin/discovery/{pool}/refresh", backendPools.RefreshHandler(scheduler, logger))
+		adminMux.HandleFunc("GET /admin/config", ConfigHandler(reloader.Current))
+		adminMux.HandleFunc("POST /admin/config/reload", reloader.Handler())
+		adminMux.HandleFunc("GET /admin/log-level", LogLevelHandler(programLevel, logger))
+		adminMux.HandleFunc("PUT /admin/log-level", LogLevelHandler(programLevel, logger))
+		adminMux.HandleFunc("GET /admin/canary", canaries.JudgmentsHandler())
+		adminMux.HandleFunc("GET /admin/canary/{pool}", canaries.JudgmentHandler())
+		adminMux.Handle(echoPrefix+"/", NewEchoHandler(mux, proxiedRoutes, waf, honeypot))
+
+		adminMux.HandleFunc("GET /admin/layers", layers.ManifestHandler())
+		adminMux.HandleFunc("PUT /admin/layers", layers.ManifestHandler())
+
+		if cdn != nil {
+			adminMux.HandleFunc("POST /admin/purge", cdn.PurgeHandler())
+		}
+		if tileCache != nil {
+			adminMux.HandleFunc("GET /admin/cache/stats", tileCache.StatsHandler())
+		}
+		if captures != nil {
+			adminMux.HandleFunc("GET /admin/captures", captures.CapturesHandler())
+			adminMux.HandleFunc("GET /admin/captures/{id}", captures.CaptureHandler())
+		}
+
+		adminHandler = RequireAdmin(config.AdminToken, adminMux, logger)
+		if config.AdminPort == 0 {
+			mux.Handle("/admin/", adminHandler)
+		}
+	}
+
+	// The gRPC health service reports the same readiness as /readyz, for
+	// the whole server and for the parcels service by name
+	healthPath, healthHandler := grpchealth.NewHandler(readiness)
 	mux.Handle(healthPath, healthHandler)
 
+	if config.GRPCHealthPort != 0 {
+		healthStage := lifecycle.Stage("grpc-health")
+		healthStage.Go("grpc-health-server", func(ctx context.Context) error {
+			return serveGRPCHealth(ctx, config.GRPCHealthPort, readiness, logger)
+		})
+	}
+
 	listenPort := fmt.Sprintf(":%d", config.Port)
 
 	p := new(http.Protocols)
@@ -244,14 +1006,82 @@ func main() {
 	p.SetUnencryptedHTTP2(true)
 	httpSrv := http.Server{
 		Addr:      listenPort,
-		Handler:   mux,
+		Handler:   handler,
 		Protocols: p,
 	}
 
+	servers := []*http.Server{&httpSrv}
+
+	// HTTPS is served next to plain HTTP when a certificate is configured.
+	// Terminating TLS here also gives fingerprints the JA3 hash
+	var httpsSrv, redirectSrv *http.Server
+	if config.TLSCert != "" {
+		certificates, err := NewCertificateStore(appCtx, config.TLSCert, config.TLSKey, logger)
+		if err != nil {
+			logger.Error("failed to load TLS certificate", slog.Any("error", err))
+			os.Exit(1)
+		}
+		scheduler.Add("tls:reload", config.TLSReload, certificates.Reload)
+
+		tlsProtocols := new(http.Protocols)
+		tlsProtocols.SetHTTP1(true)
+		tlsProtocols.SetHTTP2(true)
+
+		ja3 := &JA3Recorder{}
+		httpsSrv = &http.Server{
+			Addr:        fmt.Sprintf(":%d", config.TLSPort),
+			Handler:     handler,
+			Protocols:   tlsProtocols,
+			TLSConfig:   NewTLSConfig(certificates, ja3),
+			ConnContext: ja3.ConnContext,
+			ConnState:   ja3.ConnState,
+		}
+		servers = append(servers, httpsSrv)
+
+		if config.HTTPSRedirectPort != 0 {
+			redirectSrv = &http.Server{
+				Addr:    fmt.Sprintf(":%d", config.HTTPSRedirectPort),
+				Handler: HTTPSRedirectHandler(config.TLSPort),
+			}
+			servers = append(servers, redirectSrv)
+		}
+	}
+
+	var adminSrv *http.Server
+	if adminHandler != nil && config.AdminPort != 0 {
+		adminAddr := fmt.Sprintf(":%d", config.AdminPort)
+		if config.AdminLocalhostOnly {
+			adminAddr = fmt.Sprintf("127.0.0.1:%d", config.AdminPort)
+		}
+		adminSrv = &http.Server{
+			Addr:    adminAddr,
+			Handler: adminHandler,
+		}
+		servers = append(servers, adminSrv)
+	}
+
+	// A slow or stalled client can't hold a connection open forever.
+	// WebSocket upgrades clear the deadlines of their connection.
+	for _, srv := range servers {
+		srv.ReadHeaderTimeout = config.ServerReadHeaderTimeout
+		srv.ReadTimeout = config.ServerReadTimeout
+		srv.WriteTimeout = config.ServerWriteTimeout
+		srv.IdleTimeout = config.ServerIdleTimeout
+	}
+
 	shutdownSig := make(chan os.Signal, 1)
 	signal.Notify(shutdownSig, os.Interrupt, syscall.SIGTERM)
 
-	serverErr := make(chan error, 1)
+	reloadSig := make(chan os.Signal, 1)
+	signal.Notify(reloadSig, syscall.SIGHUP)
+	lifecycle.Stage("reload").Go("reload", func(ctx context.Context) error {
+		return reloader.Watch(ctx, reloadSig)
+	})
+	if config.ConfigWatchInterval > 0 {
+		scheduler.Add("config:watch", config.ConfigWatchInterval, reloader.WatchFile)
+	}
+
+	serverErr := make(chan error, len(servers))
 
 	// Start the HTTP server in a background goroutine
 	go func() {
@@ -259,6 +1089,27 @@ func main() {
 		serverErr <- httpSrv.ListenAndServe()
 	}()
 
+	if httpsSrv != nil {
+		go func() {
+			logger.Info("starting TLS server", slog.Int("port", int(config.TLSPort)))
+			serverErr <- httpsSrv.ListenAndServeTLS("", "")
+		}()
+	}
+
+	if redirectSrv != nil {
+		go func() {
+			logger.Info("starting HTTPS redirect server", slog.Int("port", int(config.HTTPSRedirectPort)))
+			serverErr <- redirectSrv.ListenAndServe()
+		}()
+	}
+
+	if adminSrv != nil {
+		go func() {
+			logger.Info("starting admin server", slog.String("addr", adminSrv.Addr))
+			serverErr <- adminSrv.ListenAndServe()
+		}()
+	}
+
 	// This is inited by default to go's int zero value, zero
 	var exitCode int
 
@@ -274,12 +1125,22 @@ func main() {
 		// Graceful shutdown signal received
 		logger.Info("received shutdown signal", slog.String("signal", sig.String()))
 
+		// Fail readiness first so load balancers stop routing here, and keep
+		// serving until their health checks have seen it
+		readiness.Drain()
+		if config.ShutdownDrainDelay > 0 {
+			logger.Info("draining before shutdown", slog.Duration("delay", config.ShutdownDrainDelay))
+			time.Sleep(config.ShutdownDrainDelay)
+		}
+
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
 		defer shutdownCancel()
 
-		if err := httpSrv.Shutdown(shutdownCtx); err != nil {
-			logger.Error("HTTP graceful shutdown failed", slog.Any("error", err))
-			exitCode = 1
+		for _, srv := range servers {
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				logger.Error("HTTP graceful shutdown failed", slog.String("addr", srv.Addr), slog.Any("error", err))
+				exitCode = 1
+			}
 		}
 	}
 
@@ -287,46 +1148,21 @@ func main() {
 	slog.Info("stopping background workers...")
 	cancelApp()
 
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 20*time.Second)
+	if err := lifecycle.Shutdown(stopCtx); err != nil {
+		logger.Error("background workers did not stop cleanly", slog.Any("error", err))
+		exitCode = 1
+	}
+	stopCancel()
+
+	if config.LeakCheck {
+		if err := lifecycle.LeakCheck(); err != nil {
+			logger.Error("goroutine leak detected", slog.Any("error", err), slog.String("goroutines", goroutineDump()))
+			exitCode = 1
+		}
+	}
+
 	slog.Info("teardown complete. exiting.")
 	os.Exit(exitCode)
 
 }
-
-func CORSMiddleware(next http.Handler, logger *slog.Logger) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		logger.Info("CORS middleware activated")
-
-		// 1. ALWAYS set headers (Success, Failure, or Preflight)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", strings.Join([]string{
-			"Authorization",
-			"Content-Type",
-			"Connect-Protocol-Version",
-			"Connect-Timeout-Ms",
-			"Connect-Accept-Encoding",
-			"Connect-Content-Encoding",
-			"Grpc-Timeout",
-			"X-Grpc-Web",
-			"X-User-Agent",
-		}, ", "))
-		w.Header().Set("Access-Control-Expose-Headers", strings.Join([]string{
-			"Connect-Protocol-Version",
-			"Connect-Timeout-Ms",
-			"Grpc-Status",
-			"Grpc-Message",
-			"Grpc-Status-Details-Bin",
-		}, ", "))
-		w.Header().Set("Access-Control-Max-Age", "7200")
-
-		// 2. Handle Preflight
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		// 3. Pass to next handler
-		next.ServeHTTP(w, r)
-	})
-}
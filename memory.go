@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	memoryBudget = NewGauge(
+		"civil_gateway_memory_budget_bytes",
+		"Memory the gateway's stateful parts may hold between them, 0 if unbounded",
+	)
+	memoryUsed = NewGauge(
+		"civil_gateway_memory_used_bytes",
+		"Memory held by each stateful part of the gateway, as it accounts for it",
+		"pool",
+	)
+	memoryLimit = NewGauge(
+		"civil_gateway_memory_limit_bytes",
+		"Memory each stateful part of the gateway may hold on its own, 0 if only the budget applies",
+		"pool",
+	)
+	memoryRejections = NewCounter(
+		"civil_gateway_memory_rejections_total",
+		"Reservations refused for going over a pool's limit or the budget",
+		"pool",
+	)
+)
+
+// MemoryAccountant holds the gateway's stateful parts, like the tile cache,
+// rate limit buckets and captures, to one memory budget so that together
+// they can't outgrow the task. Each part registers a pool, which can also
+// have a limit of its own, and accounts for what it keeps in it. The sizes
+// are estimates of what the part holds, not measurements of the heap.
+//
+// Parts that can drop what they hold, like the cache, set an evictor. A
+// reservation the budget would refuse has them make room first, so the
+// cache filling the budget doesn't starve per-client state.
+type MemoryAccountant struct {
+	budget int64
+	used   atomic.Int64
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	pools []*MemoryPool
+}
+
+// MemoryPool is one part's share of the budget. A nil pool accounts for
+// nothing and refuses nothing, for parts running without an accountant.
+type MemoryPool struct {
+	name       string
+	limit      int64
+	used       atomic.Int64
+	accountant *MemoryAccountant
+	evict      atomic.Pointer[func(n int64)]
+}
+
+// NewMemoryAccountant enforces budget across every pool, or only their own
+// limits if budget is 0
+func NewMemoryAccountant(budget int64, logger *slog.Logger) *MemoryAccountant {
+	memoryBudget.Set(float64(max(budget, 0)))
+	return &MemoryAccountant{
+		budget: max(budget, 0),
+		logger: logger,
+	}
+}
+
+// Register adds a pool limited to limit bytes, or only by the budget if
+// limit is 0
+func (a *MemoryAccountant) Register(name string, limit int64) *MemoryPool {
+	pool := &MemoryPool{
+		name:       name,
+		limit:      max(limit, 0),
+		accountant: a,
+	}
+	memoryLimit.Set(float64(pool.limit), name)
+	memoryUsed.Set(0, name)
+
+	a.mu.Lock()
+	a.pools = append(a.pools, pool)
+	a.mu.Unlock()
+
+	return pool
+}
+
+// Reserve accounts for n more bytes if that keeps the pool within its limit
+// and the budget, and reports whether it did
+func (p *MemoryPool) Reserve(n int64) bool {
+	if p == nil {
+		return true
+	}
+
+	if p.exceeds(n) && (p.overLimit(n) || !p.accountant.makeRoom(p, n)) {
+		memoryRejections.Inc(p.name)
+		return false
+	}
+
+	p.add(n)
+	return true
+}
+
+// SetEvictor has evict called to free about n bytes when another pool needs
+// room in the budget
+func (p *MemoryPool) SetEvictor(evict func(n int64)) {
+	if p != nil {
+		p.evict.Store(&evict)
+	}
+}
+
+// Release gives back n bytes reserved earlier
+func (p *MemoryPool) Release(n int64) {
+	if p != nil {
+		p.add(-n)
+	}
+}
+
+// Set accounts for n bytes in all, for parts that track their own size
+func (p *MemoryPool) Set(n int64) {
+	if p != nil {
+		p.add(n - p.used.Load())
+	}
+}
+
+// Over reports whether the pool or the budget is exceeded, so a part that
+// evicts can tell it should make room
+func (p *MemoryPool) Over() bool {
+	return p != nil && p.exceeds(0)
+}
+
+func (p *MemoryPool) exceeds(n int64) bool {
+	if p.overLimit(n) {
+		return true
+	}
+
+	a := p.accountant
+	return a.budget > 0 && a.used.Load()+n > a.budget
+}
+
+// overLimit reports whether n more bytes would take the pool over its own
+// limit
+func (p *MemoryPool) overLimit(n int64) bool {
+	return p.limit > 0 && p.used.Load()+n > p.limit
+}
+
+// makeRoom has the other pools' evictors free what n more bytes for pool
+// need of the budget, and reports whether they did
+func (a *MemoryAccountant) makeRoom(pool *MemoryPool, n int64) bool {
+	a.mu.Lock()
+	pools := slices.Clone(a.pools)
+	a.mu.Unlock()
+
+	for _, other := range pools {
+		evict := other.evict.Load()
+		if other == pool || evict == nil {
+			continue
+		}
+		(*evict)(a.used.Load() + n - a.budget)
+		if a.used.Load()+n <= a.budget {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *MemoryPool) add(n int64) {
+	memoryUsed.Set(float64(p.used.Add(n)), p.name)
+	p.accountant.used.Add(n)
+}
+
+// MemoryPoolUsage is what a pool holds, for /admin/memory
+type MemoryPoolUsage struct {
+	Name  string `json:"name"`
+	Used  int64  `json:"used_bytes"`
+	Limit int64  `json:"limit_bytes,omitempty"`
+}
+
+// MemoryUsage is what the accountant knows, next to what the Go runtime
+// says the heap holds, to check the estimates against
+type MemoryUsage struct {
+	Budget    int64             `json:"budget_bytes,omitempty"`
+	Used      int64             `json:"used_bytes"`
+	HeapInUse uint64            `json:"heap_in_use_bytes"`
+	Pools     []MemoryPoolUsage `json:"pools"`
+}
+
+func (a *MemoryAccountant) Usage() MemoryUsage {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	usage := MemoryUsage{
+		Budget:    a.budget,
+		Used:      a.used.Load(),
+		HeapInUse: stats.HeapInuse,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, pool := range a.pools {
+		usage.Pools = append(usage.Pools, MemoryPoolUsage{
+			Name:  pool.name,
+			Used:  pool.used.Load(),
+			Limit: pool.limit,
+		})
+	}
+	return usage
+}
+
+// Report logs the usage. Run as a scheduled job in soak tests to see how the
+// estimates track the heap over time.
+func (a *MemoryAccountant) Report(ctx context.Context) error {
+	usage := a.Usage()
+
+	attrs := []any{
+		slog.Int64("budget_bytes", usage.Budget),
+		slog.Int64("used_bytes", usage.Used),
+		slog.Uint64("heap_in_use_bytes", usage.HeapInUse),
+	}
+	for _, pool := range usage.Pools {
+		attrs = append(attrs, slog.Int64(pool.Name+"_bytes", pool.Used))
+	}
+
+	a.logger.Info("memory usage", attrs...)
+	return nil
+}
+
+// UsageHandler serves the usage as JSON
+func (a *MemoryAccountant) UsageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(a.Usage())
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal metrics registry rendered in the Prometheus text exposition
+// format. Metrics are declared as package level variables next to the code
+// that updates them, and every one of them is served from /metrics.
+
+var defaultRegistry = &metricsRegistry{}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(b *strings.Builder)
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metric %s registered twice", m.name()))
+		}
+	}
+
+	r.metrics = append(r.metrics, m)
+}
+
+// MetricsHandler serves every registered metric
+func MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(renderMetrics()))
+	}
+}
+
+// renderMetrics renders every registered metric in the text format
+func renderMetrics() string {
+	defaultRegistry.mu.Lock()
+	metrics := slices.Clone(defaultRegistry.metrics)
+	defaultRegistry.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	return b.String()
+}
+
+// labelSet renders label pairs like {pool="tiles",reason="throttled"}
+func labelSet(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		pairs = append(pairs, n+"="+strconv.Quote(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// vec holds one value per distinct combination of label values
+type vec[T any] struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	newValue   func() T
+
+	mu     sync.Mutex
+	values map[string]T
+	keys   map[string][]string
+}
+
+func (v *vec[T]) name() string {
+	return v.metricName
+}
+
+func (v *vec[T]) with(labelValues []string) T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.metricName, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	value, ok := v.values[key]
+	if !ok {
+		value = v.newValue()
+		v.values[key] = value
+		v.keys[key] = slices.Clone(labelValues)
+	}
+
+	return value
+}
+
+// each visits the values in a stable order so scrapes are diffable
+func (v *vec[T]) each(fn func(labelValues []string, value T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	type entry struct {
+		labelValues []string
+		value       T
+	}
+	entries := make([]entry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, entry{v.keys[k], v.values[k]})
+	}
+	v.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.labelValues, e.value)
+	}
+}
+
+func (v *vec[T]) header(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, v.kind)
+}
+
+func newVec[T any](name, help, kind string, labels []string, newValue func() T) *vec[T] {
+	return &vec[T]{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		newValue:   newValue,
+		values:     map[string]T{},
+		keys:       map[string][]string{},
+	}
+}
+
+type floatValue struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (f *floatValue) add(delta float64) {
+	f.mu.Lock()
+	f.v += delta
+	f.mu.Unlock()
+}
+
+func (f *floatValue) set(value float64) {
+	f.mu.Lock()
+	f.v = value
+	f.mu.Unlock()
+}
+
+func (f *floatValue) get() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.v
+}
+
+// Counter is a monotonically increasing value per label combination
+type Counter struct {
+	*vec[*floatValue]
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels, func() *floatValue { return &floatValue{} })}
+	defaultRegistry.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.with(labelValues).add(1)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.with(labelValues).add(delta)
+}
+
+// Value returns the current count for the label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.with(labelValues).get()
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.header(b)
+	c.each(func(labelValues []string, value *floatValue) {
+		fmt.Fprintf(b, "%s%s %s\n", c.metricName, labelSet(c.labels, labelValues), formatValue(value.get()))
+	})
+}
+
+// Gauge is a value per label combination that can go up and down
+type Gauge struct {
+	*vec[*floatValue]
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels, func() *floatValue { return &floatValue{} })}
+	defaultRegistry.register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.with(labelValues).set(value)
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.with(labelValues).add(delta)
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.with(labelValues).add(1)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.with(labelValues).add(-1)
+}
+
+// Value returns the current value for the label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.with(labelValues).get()
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.header(b)
+	g.each(func(labelValues []string, value *floatValue) {
+		fmt.Fprintf(b, "%s%s %s\n", g.metricName, labelSet(g.labels, labelValues), formatValue(value.get()))
+	})
+}
+
+// DefaultLatencyBuckets suit request latencies measured in seconds
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogramValue struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogramValue) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Histogram counts observations into cumulative buckets per label combination
+type Histogram struct {
+	*vec[*histogramValue]
+	buckets []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	h := &Histogram{
+		vec: newVec(name, help, "histogram", labels, func() *histogramValue {
+			return &histogramValue{buckets: buckets, counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+	defaultRegistry.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.with(labelValues).observe(value)
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.header(b)
+	h.each(func(labelValues []string, value *histogramValue) {
+		value.mu.Lock()
+		defer value.mu.Unlock()
+
+		for i, upper := range value.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.metricName, labelSet(h.labels, labelValues, "le", formatValue(upper)), value.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.metricName, labelSet(h.labels, labelValues, "le", "+Inf"), value.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.metricName, labelSet(h.labels, labelValues), formatValue(value.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.metricName, labelSet(h.labels, labelValues), value.count)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// secretSettingMarkers flag the variables that hold credentials, which are
+// left in the environment rather than written to the config file
+var secretSettingMarkers = []string{"TOKEN", "SECRET", "PRIVATE_KEY", "PASSWORD"}
+
+// runConfigMigrate is the config migrate command. It writes a config file
+// equivalent to the CIVIL_* environment it runs in, merged over the file of
+// CIVIL_CONFIG_FILE if there is one, so a deployment configured through the
+// environment can move to the file without writing it by hand.
+func runConfigMigrate(args []string) int {
+	flags := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	output := flags.String("o", "", "write the config file here instead of to stdout")
+	flags.Parse(args)
+
+	file, secrets, err := migrateEnv(os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config migrate: %v\n", err)
+		return 1
+	}
+
+	data, err := marshalConfigFile(file, secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config migrate: %v\n", err)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "config migrate: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// migrateEnv builds the config file for the environment, returning it with
+// the names of the secrets left out of it
+func migrateEnv(environ []string) (*FileConfig, []string, error) {
+	file := &FileConfig{}
+
+	env := map[string]string{}
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, "CIVIL_") {
+			env[key] = value
+		}
+	}
+
+	if path := env["CIVIL_CONFIG_FILE"]; path != "" {
+		existing, err := loadConfigFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		file = existing
+	}
+	delete(env, "CIVIL_CONFIG_FILE")
+
+	if value := env["CIVIL_BACKEND_POOLS"]; value != "" {
+		var pools []PoolConfig
+		if err := json.Unmarshal([]byte(value), &pools); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CIVIL_BACKEND_POOLS: %w", err)
+		}
+		file.Routes = append(pools, file.Routes...)
+	}
+	delete(env, "CIVIL_BACKEND_POOLS")
+
+	if file.Settings == nil {
+		file.Settings = map[string]any{}
+	}
+
+	var secrets []string
+	for key, value := range env {
+		if isSecretSetting(key, value) {
+			secrets = append(secrets, key)
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimPrefix(key, "CIVIL_"))
+		file.Settings[name] = settingValue(value)
+	}
+	slices.Sort(secrets)
+
+	return file, secrets, nil
+}
+
+// isSecretSetting reports whether a variable holds a credential, going by its
+// name or by a URL with a password in it
+func isSecretSetting(key, value string) bool {
+	for _, marker := range secretSettingMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return true
+		}
+	}
+	return false
+}
+
+// settingValue turns the JSON lists and objects of variables like
+// CIVIL_WAF_RULES into YAML, leaving everything else a string
+func settingValue(value string) any {
+	trimmed := strings.TrimSpace(value)
+	if !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "{") {
+		return value
+	}
+
+	var decoded any
+	if err := json.Unmarshal([]byte(trimmed), &decoded); err != nil {
+		return value
+	}
+	return decoded
+}
+
+// marshalConfigFile writes the file as YAML, with a header naming the secrets
+// that stay in the environment. It goes through JSON so the YAML keys are
+// the json names the file is read with.
+func marshalConfigFile(file *FileConfig, secrets []string) ([]byte, error) {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by civil-gateway config migrate. Point CIVIL_CONFIG_FILE here;\n")
+	buf.WriteString("# variables still set in the environment override these settings.\n")
+	if len(secrets) > 0 {
+		buf.WriteString("#\n# Left in the environment as they hold credentials:\n")
+		for _, key := range secrets {
+			fmt.Fprintf(&buf, "#   %s\n", key)
+		}
+	}
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var (
+	outlierEjections = NewCounter(
+		"civil_gateway_outlier_ejections_total",
+		"Endpoints ejected from rotation after consecutive failed requests",
+		"pool",
+	)
+	outlierEjectedEndpoints = NewGauge(
+		"civil_gateway_outlier_ejected_endpoints",
+		"Endpoints currently ejected from rotation for failing requests",
+		"pool",
+	)
+)
+
+// outlierTransport reports the outcome of each request to the endpoint it
+// was sent to, so endpoints answering with errors can be ejected
+type outlierTransport struct {
+	next     http.RoundTripper
+	backends *BackendManager
+}
+
+func (t *outlierTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+
+	endpoint, ok := endpointFromContext(req.Context())
+	if !ok || isDryRun(req.Context()) {
+		return resp, err
+	}
+
+	switch {
+	case err != nil:
+		// A client hanging up says nothing about the endpoint, but an
+		// attempt cut off for taking too long does
+		if req.Context().Err() == nil || errors.Is(context.Cause(req.Context()), errAttemptTimeout) {
+			t.backends.recordResult(endpoint, false)
+		}
+	default:
+		t.backends.recordResult(endpoint, resp.StatusCode < 500)
+	}
+
+	return resp, err
+}
+
+// recordResult counts a request's outcome against the endpoint, ejecting it
+// from rotation for EjectCooldown after EjectAfter failures in a row. Once
+// the cooldown is over the endpoint returns on its next successful probe,
+// or right away when probing is off.
+func (bm *BackendManager) recordResult(endpoint string, ok bool) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if bm.probe.EjectAfter <= 0 {
+		return
+	}
+
+	state, found := bm.probes[endpoint]
+	if !found {
+		if ok || !slices.Contains(bm.endpoints, endpoint) {
+			return
+		}
+		state = &endpointProbe{}
+		bm.probes[endpoint] = state
+	}
+
+	if ok {
+		state.errorRate *= 1 - reputationAlpha
+		state.requestFailures = 0
+		return
+	}
+
+	state.errorRate = state.errorRate*(1-reputationAlpha) + reputationAlpha
+	state.requestFailures++
+	if state.ejected || state.requestFailures < bm.probe.EjectAfter {
+		return
+	}
+
+	state.ejected = true
+	state.ejectedUntil = time.Now().Add(bm.probe.EjectCooldown)
+	state.ejections++
+	state.lastEjected = time.Now()
+	outlierEjections.Inc(bm.pool)
+	bm.logger.Warn("endpoint failing requests, ejected from rotation",
+		slog.String("endpoint", endpoint),
+		slog.Int("failures", state.requestFailures),
+		slog.Duration("cooldown", bm.probe.EjectCooldown),
+	)
+
+	if bm.probe.Path == "" {
+		time.AfterFunc(bm.probe.EjectCooldown, func() { bm.readmit(endpoint) })
+	}
+
+	bm.updateRotation()
+}
+
+// readmit puts an ejected endpoint back in rotation, once its cooldown is
+// over. Must not be called with mu held.
+func (bm *BackendManager) readmit(endpoint string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	state, ok := bm.probes[endpoint]
+	if !ok || !state.readmittable(time.Now()) {
+		return
+	}
+
+	state.readmit()
+	bm.logger.Info("ejected endpoint back in rotation", slog.String("endpoint", endpoint))
+	bm.updateRotation()
+}
+
+// readmittable reports whether the endpoint is ejected and its cooldown is
+// over
+func (p *endpointProbe) readmittable(now time.Time) bool {
+	return p.ejected && !now.Before(p.ejectedUntil)
+}
+
+func (p *endpointProbe) readmit() {
+	p.ejected = false
+	p.requestFailures = 0
+}
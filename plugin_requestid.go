@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// maxRequestIDLength caps the X-Request-ID taken from clients. Longer ones
+// are replaced.
+const maxRequestIDLength = 128
+
+// The request-id plugin is the example plugin: it gives every request an
+// X-Request-ID, keeping the client's if it sent one, passes it to the
+// backend, echoes it on the backend's response, and logs it with failed
+// requests. Responses from the cache, or shared by coalesced requests, were
+// for another request and don't carry it.
+func init() {
+	RegisterPlugin(Plugin{
+		Name: "request-id",
+		OnRequest: func(r *http.Request) error {
+			if id := r.Header.Get("X-Request-ID"); id == "" || len(id) > maxRequestIDLength {
+				r.Header.Set("X-Request-ID", newRequestID())
+			}
+			return nil
+		},
+		OnResponse: func(resp *http.Response) error {
+			if resp.Request != nil {
+				resp.Header.Set("X-Request-ID", resp.Request.Header.Get("X-Request-ID"))
+			}
+			return nil
+		},
+		OnError: func(r *http.Request, err error) {
+			PluginLogger("request-id").Info("request failed",
+				slog.String("request_id", r.Header.Get("X-Request-ID")),
+				slog.String("path", r.URL.Path),
+				slog.Any("error", err),
+			)
+		},
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
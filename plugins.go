@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var upstreamTimeouts = NewCounter(
+	"civil_gateway_upstream_timeouts_total",
+	"Requests answered with a 504 because the route's upstream timeout ran out",
+)
+
+var pluginRejections = NewCounter(
+	"civil_gateway_plugin_rejections_total",
+	"Requests stopped by a plugin hook, by plugin and hook",
+	"plugin", "hook",
+)
+
+// Plugin extends the request lifecycle with custom policies compiled into
+// the gateway. Every hook is optional. Plugins register themselves with
+// RegisterPlugin, usually from init, and run only once named in
+// CIVIL_PLUGINS.
+//
+// For each request the hooks run in lifecycle order: OnRequest before
+// routing, OnAuth once a bearer token is verified on routes requiring one,
+// OnUpstreamSelect once a pool picked an endpoint, then OnResponse with the
+// backend's response, or OnError if the request failed or was rejected.
+// Within a hook, plugins run in the order CIVIL_PLUGINS lists them, except
+// OnResponse and OnError which run in reverse, so the first plugin sees the
+// request first and the response last.
+//
+// A hook returning an error stops the request there, and the plugins after
+// it are not run for that hook. Return a *PluginReject to choose the status
+// the client gets; any other error is a 500, or a 502 from OnResponse.
+// Hooks log through PluginLogger.
+type Plugin struct {
+	Name string
+
+	// OnRequest may change the request's headers before it is routed
+	OnRequest func(r *http.Request) error
+	// OnAuth is given the verified claims of the request
+	OnAuth func(r *http.Request, claims Claims) error
+	// OnUpstreamSelect returns the endpoint of the pool to send the request
+	// to, which is the one picked by the pool unless the plugin overrides it.
+	// Retries pick their own endpoints.
+	OnUpstreamSelect func(r *http.Request, pool string, endpoint string) (string, error)
+	// OnResponse may change the backend's response before it is sent on
+	OnResponse func(resp *http.Response) error
+	// OnError is told why a request failed. It can't change the response.
+	OnError func(r *http.Request, err error)
+}
+
+// PluginReject is returned by a hook to answer the request with Status
+type PluginReject struct {
+	Status  int
+	Message string
+}
+
+func (e *PluginReject) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+var (
+	registeredPluginsMu sync.RWMutex
+	registeredPlugins   = map[string]Plugin{}
+
+	// enabledPlugins is the plugins of CIVIL_PLUGINS, in order
+	enabledPlugins atomic.Pointer[[]Plugin]
+
+	// pluginLogger is the gateway's logger, set by EnablePlugins
+	pluginLogger atomic.Pointer[slog.Logger]
+)
+
+// RegisterPlugin makes a plugin available to CIVIL_PLUGINS under its name
+func RegisterPlugin(plugin Plugin) {
+	registeredPluginsMu.Lock()
+	defer registeredPluginsMu.Unlock()
+
+	registeredPlugins[plugin.Name] = plugin
+}
+
+// EnablePlugins turns on the named plugins, in the order given, logging
+// through logger
+func EnablePlugins(names []string, logger *slog.Logger) error {
+	registeredPluginsMu.RLock()
+	defer registeredPluginsMu.RUnlock()
+
+	var plugins []Plugin
+	for _, name := range names {
+		plugin, ok := registeredPlugins[name]
+		if !ok {
+			return fmt.Errorf("unknown plugin %q", name)
+		}
+		plugins = append(plugins, plugin)
+	}
+
+	enabledPlugins.Store(&plugins)
+	pluginLogger.Store(logger)
+	return nil
+}
+
+// PluginLogger is the logger for the plugin called name to log with
+func PluginLogger(name string) *slog.Logger {
+	logger := pluginLogger.Load()
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With(slog.String("plugin", name))
+}
+
+func loadPlugins() []Plugin {
+	if plugins := enabledPlugins.Load(); plugins != nil {
+		return *plugins
+	}
+	return nil
+}
+
+// PluginMiddleware runs the OnRequest hooks before passing the request on
+func PluginMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, plugin := range loadPlugins() {
+			if plugin.OnRequest == nil {
+				continue
+			}
+			if err := plugin.OnRequest(r); err != nil {
+				rejectForPlugin(w, r, plugin.Name, "request", err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runAuthHooks runs the OnAuth hooks, answering the request and reporting
+// false if one stops it
+func runAuthHooks(w http.ResponseWriter, r *http.Request, claims Claims) bool {
+	for _, plugin := range loadPlugins() {
+		if plugin.OnAuth == nil {
+			continue
+		}
+		if err := plugin.OnAuth(r, claims); err != nil {
+			rejectForPlugin(w, r, plugin.Name, "auth", err)
+			return false
+		}
+	}
+	return true
+}
+
+// runUpstreamSelectHooks runs the OnUpstreamSelect hooks, answering the
+// request and reporting false if one stops it
+func runUpstreamSelectHooks(w http.ResponseWriter, r *http.Request, pool string, endpoint string) (string, bool) {
+	for _, plugin := range loadPlugins() {
+		if plugin.OnUpstreamSelect == nil {
+			continue
+		}
+		selected, err := plugin.OnUpstreamSelect(r, pool, endpoint)
+		if err != nil {
+			rejectForPlugin(w, r, plugin.Name, "upstream_select", err)
+			return "", false
+		}
+		if selected != "" {
+			endpoint = selected
+		}
+	}
+	return endpoint, true
+}
+
+// runResponseHooks runs the OnResponse hooks, last plugin first. An error
+// fails the response, which the proxy's error handler then answers.
+func runResponseHooks(resp *http.Response) error {
+	plugins := loadPlugins()
+	for _, plugin := range slices.Backward(plugins) {
+		if plugin.OnResponse == nil {
+			continue
+		}
+		if err := plugin.OnResponse(resp); err != nil {
+			pluginRejections.Inc(plugin.Name, "response")
+			return fmt.Errorf("plugin %s: %w", plugin.Name, err)
+		}
+	}
+	return nil
+}
+
+// runErrorHooks tells every plugin, last first, that the request failed
+func runErrorHooks(r *http.Request, err error) {
+	plugins := loadPlugins()
+	for _, plugin := range slices.Backward(plugins) {
+		if plugin.OnError != nil {
+			plugin.OnError(r, err)
+		}
+	}
+}
+
+// rejectForPlugin answers a request stopped by a hook, with the status of
+// its PluginReject or else a 500
+func rejectForPlugin(w http.ResponseWriter, r *http.Request, plugin, hook string, err error) {
+	pluginRejections.Inc(plugin, hook)
+	runErrorHooks(r, fmt.Errorf("plugin %s: %w", plugin, err))
+
+	status := http.StatusInternalServerError
+	message := http.StatusText(status)
+	var reject *PluginReject
+	if errors.As(err, &reject) {
+		status = reject.Status
+		message = reject.Message
+	}
+
+	writeError(w, r, status, "plugin_rejected", message)
+}
+
+// proxyErrorHandler answers requests the proxy failed to complete, telling
+// the plugins why
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Warn("proxy error", slog.String("path", r.URL.Path), slog.Any("error", err))
+	runErrorHooks(r, err)
+
+	// The route's timeout ran out, or the retry budget or the last
+	// attempt's timeout did
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errAttemptTimeout) {
+		upstreamTimeouts.Inc()
+		writeError(w, r, http.StatusGatewayTimeout, "upstream_timeout", "")
+		return
+	}
+
+	// Nothing was listening, or the endpoint couldn't be reached at all
+	var opErr *net.OpError
+	if errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		writeError(w, r, http.StatusBadGateway, "upstream_refused", "")
+		return
+	}
+
+	status := http.StatusBadGateway
+	message := http.StatusText(status)
+	var reject *PluginReject
+	if errors.As(err, &reject) {
+		status = reject.Status
+		message = reject.Message
+	}
+
+	writeError(w, r, status, "upstream_failed", message)
+}
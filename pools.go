@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Pool is a discovered set of backends and the proxy serving it.
+// Upstream is the bare proxy, without the request timeout and concurrency
+// limit of Handler, for long-lived WebSocket connections. The pool's own
+// background work runs in Stage.
+type Pool struct {
+	Name     string
+	Prefix   string
+	Backends *BackendManager
+	Tracker  *SaturationTracker
+	Handler  http.Handler
+	Upstream http.Handler
+	Stage    *Stage
+}
+
+// NewPool starts discovery and probing for the pool and builds its proxy
+// handler, with connections to the backends as transport sets them up but
+// for what the pool overrides. Discovery and probing stop when stage does.
+func NewPool(ctx context.Context, stage *Stage, pc PoolConfig, scheduler *Scheduler, discovery DiscoveryConfig, probe ProbeConfig, retry RetryConfig, concurrency ConcurrencyConfig, transport TransportConfig, identity UpstreamIdentity, claimHeaders ClaimHeaders, upstreamAuth UpstreamAuth, logger *slog.Logger) (*Pool, error) {
+	backends, err := NewBackendManager(ctx, pc, logger)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pc.Name, err)
+	}
+
+	tracker := NewSaturationTracker()
+
+	strategy, err := newEndpointStrategy(pc.Strategy, tracker)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pc.Name, err)
+	}
+	backends.SetStrategy(strategy)
+
+	transport = transport.forPool(pc)
+	transport.AllowedCIDRs = discovery.AllowedCIDRs
+	upstreamTransport := NewUpstreamTransport(pc.Name, transport)
+
+	backends.StartPolling(ctx, scheduler, discovery)
+	backends.StartProbing(scheduler, probe)
+	stage.OnStop("pool", func(ctx context.Context) error {
+		scheduler.Remove("discovery:" + pc.Name)
+		scheduler.Remove("probe:" + pc.Name)
+		upstreamTransport.CloseIdleConnections()
+		logger.Info("pool stopped", slog.String("pool", pc.Name), slog.Int("endpoints", backends.EndpointCount()))
+		return nil
+	})
+
+	logger.Info("discovering pool backends",
+		slog.String("pool", pc.Name),
+		slog.String("prefix", pc.Prefix),
+		slog.String("discovery", cmp.Or(pc.Discovery, discoveryCloudMap)),
+		slog.String("namespace", pc.Namespace),
+		slog.String("service", pc.Service),
+		slog.String("role_arn", pc.RoleArn),
+		slog.String("protocol", transport.Protocol),
+	)
+
+	// Every request is given an endpoint by SelectEndpoint, so there is no fallback host
+	if pc.ClientUserAgent != "" {
+		identity.ClientUserAgent = pc.ClientUserAgent
+	}
+	if pc.UpstreamAuth != "" {
+		upstreamAuth.Mode = pc.UpstreamAuth
+	}
+	upstreamAuth.Audience = pc.Name
+	proxy := NewUpstreamProxy("", upstreamTransport, tracker, identity, claimHeaders, upstreamAuth)
+	transforms, err := newTransformChain(pc.Transforms)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pc.Name, err)
+	}
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := modifyResponse(resp); err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+		return transforms.apply(resp)
+	}
+
+	proxy.Transport = &retryTransport{
+		next:     &outlierTransport{next: proxy.Transport, backends: backends},
+		backends: backends,
+		config:   retry,
+	}
+
+	upstream := backends.SelectEndpoint(proxy)
+
+	handler := upstream
+	if timeout := pc.RequestTimeout(); timeout > 0 {
+		handler = requestTimeout(timeout, handler)
+	}
+
+	// Requests timing out count against the concurrency limit, so it goes
+	// outside the timeout
+	if concurrency.Adaptive {
+		limiter := NewAdaptiveLimiter(pc.Name, concurrency)
+		tracker.SetQueueDepthFunc(limiter.QueueDepth)
+		handler = limiter.Middleware(handler)
+	}
+
+	return &Pool{
+		Name:     pc.Name,
+		Prefix:   pc.Prefix,
+		Backends: backends,
+		Tracker:  tracker,
+		Handler:  handler,
+		Upstream: upstream,
+		Stage:    stage,
+	}, nil
+}
+
+// requestTimeout cancels requests to the pool still running after timeout
+func requestTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
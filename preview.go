@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed preview.html
+var previewPage []byte
+
+// PreviewHandler serves a bare MapLibre page that draws the gateway's own
+// tile routes, so QA can check a deployment without the main frontend. The
+// page holds no credentials; users paste a token into it.
+func PreviewHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(previewPage)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewUpstreamProxy creates the Reverse Proxy for a tile server pool with a
+// custom Director. Requests go to the endpoint chosen by the pool's
+// SelectEndpoint, or to fallbackHost when no endpoint was chosen, and carry
+// the gateway's identity, the caller's claims, and the credentials auth
+// lets through, over transport.
+func NewUpstreamProxy(fallbackHost string, transport http.RoundTripper, tracker *SaturationTracker, identity UpstreamIdentity, claimHeaders ClaimHeaders, auth UpstreamAuth) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport: &dryRunTransport{
+			next: &captureTransport{
+				next: &trackingTransport{
+					next:    &upstreamGzipTransport{next: tracingTransport(transport)},
+					tracker: tracker,
+				},
+			},
+		},
+
+		Director: func(req *http.Request) {
+
+			originalHost := req.Host
+
+			if originalHost == "" {
+				originalHost = req.URL.Host // Fallback
+			}
+
+			// Target the endpoint picked from the pool, if there is one
+			upstreamHost := fallbackHost
+			if endpoint, ok := endpointFromContext(req.Context()); ok {
+				if u, err := url.Parse(endpoint); err == nil {
+					upstreamHost = u.Host
+				}
+			}
+
+			// Rewrite the request to target the tile server
+			req.URL.Scheme = "http"
+			req.URL.Host = upstreamHost
+
+			// Update the Host header so the tile server accepts it
+			req.Host = upstreamHost
+			logAccessBackend(req.Context(), upstreamHost)
+
+			// TELL THE BACKEND THE TRUTH
+			// "The real host"
+			req.Header.Set("X-Forwarded-Host", originalHost)
+
+			// "The user is using HTTPS (even if we are talking HTTP right now)"
+			req.Header.Set("X-Forwarded-Proto", "https")
+
+			// The user's real IP (Optional but good for logs)
+			// Safely extract JUST the IP address, dropping the ephemeral port
+			ip, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err == nil {
+				req.Header.Set("X-Real-IP", ip)
+			} else {
+				// Fallback if RemoteAddr was somehow just an IP without a port
+				req.Header.Set("X-Real-IP", req.RemoteAddr)
+			}
+
+			identity.apply(req)
+			claimHeaders.apply(req)
+			auth.apply(req)
+		},
+
+		// This is needed to strip off any conflicting header details that the Tile Server attaches
+		ModifyResponse: func(r *http.Response) error {
+
+			// The Middleware already set these headers.
+			// We MUST delete any versions sent by the backend to avoid the "Multiple Values" error.
+			r.Header.Del("Access-Control-Allow-Origin")
+			r.Header.Del("Access-Control-Allow-Methods")
+			r.Header.Del("Access-Control-Allow-Headers")
+
+			return runResponseHooks(r)
+		},
+
+		ErrorHandler: proxyErrorHandler,
+	}
+}
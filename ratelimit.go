@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long a bucket is kept after its last request
+const rateLimitIdle = 10 * time.Minute
+
+var rateLimited = NewCounter(
+	"civil_gateway_rate_limited_total",
+	"Requests turned away for going over a rate limit",
+	"limit",
+)
+
+// RateLimiter throttles heavy consumers with a token bucket per user on the
+// routes behind RequireAuth, and per client address on the routes without
+// auth. Requests over the limit get a 429 saying when to come back. The
+// buckets are kept in memory, or in Redis once SetRedis is called.
+type RateLimiter struct {
+	users   *clientRateLimiter
+	clients *clientRateLimiter
+	redis   *RedisRateLimiter
+	logger  *slog.Logger
+}
+
+// NewRateLimiter limits users and clients to their rate in requests per
+// second, with bursts of up to burst requests. See SetRates.
+func NewRateLimiter(userRate float64, userBurst int, clientRate float64, clientBurst int, logger *slog.Logger) *RateLimiter {
+	limiter := &RateLimiter{
+		users:   newClientRateLimiter(0, 0),
+		clients: newClientRateLimiter(0, 0),
+		logger:  logger,
+	}
+	limiter.SetRates(userRate, userBurst, clientRate, clientBurst)
+	return limiter
+}
+
+// SetRates changes the limits of users and clients, keeping the buckets of
+// those already seen. A rate of 0 leaves that side unlimited, and a burst
+// of 0 is one second's worth of requests.
+func (l *RateLimiter) SetRates(userRate float64, userBurst int, clientRate float64, clientBurst int) {
+	l.users.setRates(rate.Limit(userRate), rateBurst(userRate, userBurst))
+	l.clients.setRates(rate.Limit(clientRate), rateBurst(clientRate, clientBurst))
+}
+
+// SetMemoryPool accounts for the buckets in pool. When it is full, the
+// buckets of the users and clients seen longest ago are dropped.
+func (l *RateLimiter) SetMemoryPool(pool *MemoryPool) {
+	l.users.memory = pool
+	l.clients.memory = pool
+}
+
+// SetRedis shares the buckets between replicas through Redis. The local
+// buckets take over whenever Redis fails.
+func (l *RateLimiter) SetRedis(redis *RedisRateLimiter) {
+	l.redis = redis
+}
+
+func rateBurst(limit float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return max(1, int(limit))
+}
+
+// UserMiddleware limits each user by the subject of their token. It must run
+// behind RequireAuth, which puts the claims in the context.
+func (l *RateLimiter) UserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit, _ := l.users.rates(); limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, ok := r.Context().Value(userContextKey).(Claims)
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, "missing_claims", "")
+			return
+		}
+
+		if l.limit(w, r, l.users, "user", claims.Subject) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// ClientMiddleware limits each client by its address, for the routes that
+// don't need a token. Behind trusted proxies that is the address they
+// forwarded for; a proxy's own requests aren't limited, or one bucket would
+// be shared by every client behind it.
+func (l *RateLimiter) ClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientAddr(r)
+		if limit, _ := l.clients.rates(); limit == 0 || isTrustedProxy(addr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if l.limit(w, r, l.clients, "client", addr.String()) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// limit takes a token for key, or else answers 429 and reports false
+func (l *RateLimiter) limit(w http.ResponseWriter, r *http.Request, limiter *clientRateLimiter, kind, key string) bool {
+	delay := l.delay(r.Context(), limiter, kind, key)
+	if delay <= 0 {
+		return true
+	}
+
+	rateLimited.Inc(kind)
+	l.logger.Debug("request over rate limit",
+		slog.String("limit", kind),
+		slog.String("key", key),
+		slog.String("path", r.URL.Path),
+		slog.Duration("retry_after", delay),
+	)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, "rate_limited", "")
+	return false
+}
+
+// delay takes a token from the shared bucket if there is one, or else from
+// the local one
+func (l *RateLimiter) delay(ctx context.Context, limiter *clientRateLimiter, kind, key string) time.Duration {
+	if l.redis != nil {
+		delay, err := l.redis.delay(ctx, kind, key, limiter)
+		if err == nil {
+			return delay
+		}
+
+		rateLimitRedisErrors.Inc(kind)
+		l.logger.Debug("rate limit Redis failed, limiting locally", slog.String("limit", kind), slog.Any("error", err))
+	}
+
+	return limiter.delay(key)
+}
+
+// Prune drops the buckets of users and clients that have gone quiet. Run as
+// a scheduled job so the state doesn't grow without bound.
+func (l *RateLimiter) Prune(ctx context.Context) error {
+	l.users.prune(rateLimitIdle)
+	l.clients.prune(rateLimitIdle)
+	return nil
+}
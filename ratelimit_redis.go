@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimitKeyPrefix namespaces the rate limit buckets in Redis
+const rateLimitKeyPrefix = "civil:ratelimit:"
+
+var rateLimitRedisErrors = NewCounter(
+	"civil_gateway_rate_limit_redis_errors_total",
+	"Rate limit checks that fell back to the local buckets as Redis failed",
+	"limit",
+)
+
+// tokenBucketScript takes a token from the bucket at KEYS[1], refilled at
+// ARGV[1] tokens a second up to ARGV[2], and returns how many seconds until
+// one is free, 0 if one was taken. It goes by the Redis clock so replicas
+// with skewed clocks agree. The delay is returned as a string since Lua
+// numbers come back as truncated integers otherwise.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local delay = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	delay = (1 - tokens) / rate
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return tostring(delay)
+`)
+
+// RedisRateLimiter keeps the rate limit buckets in Redis or ElastiCache, so
+// replicas share one budget per user or client instead of each granting the
+// full rate
+type RedisRateLimiter struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+// NewRedisRateLimiter connects to the Redis at addr, either host:port or a
+// URL like rediss://cache.example.com:6379/0, and closes the connection when
+// stage stops. An unreachable Redis is not an error, as the local buckets
+// stand in until it is back.
+func NewRedisRateLimiter(ctx context.Context, stage *Stage, addr string, timeout time.Duration, logger *slog.Logger) (*RedisRateLimiter, error) {
+	client, err := newRedisClient(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit Redis address: %w", err)
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		logger.Warn("failed to reach rate limit Redis, limiting locally until it is back", slog.String("addr", client.Options().Addr), slog.Any("error", err))
+	}
+
+	stage.Go("ratelimit-redis", func(ctx context.Context) error {
+		<-ctx.Done()
+		return client.Close()
+	})
+
+	return &RedisRateLimiter{
+		client:  client,
+		timeout: timeout,
+	}, nil
+}
+
+// newRedisClient is a client for the Redis at addr, either host:port or a
+// URL like rediss://cache.example.com:6379/0
+func newRedisClient(addr string) (*redis.Client, error) {
+	options := &redis.Options{Addr: addr}
+	if strings.Contains(addr, "://") {
+		parsed, err := redis.ParseURL(addr)
+		if err != nil {
+			return nil, err
+		}
+		options = parsed
+	}
+	return redis.NewClient(options), nil
+}
+
+// delay takes a token from the shared bucket of key, or else reports how
+// long until one is free
+func (rl *RedisRateLimiter) delay(ctx context.Context, kind, key string, limiter *clientRateLimiter) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, rl.timeout)
+	defer cancel()
+
+	keys := []string{rateLimitKeyPrefix + kind + ":" + key}
+	limit, burst := limiter.rates()
+	result, err := tokenBucketScript.Run(ctx, rl.client, keys, float64(limit), burst).Text()
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseFloat(result, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected rate limit script result %q: %w", result, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"connectrpc.com/connect"
+	"connectrpc.com/grpchealth"
+)
+
+// Readiness decides whether the gateway should be sent traffic. It backs
+// /readyz and the grpc.health.v1 service, so HTTP and gRPC-native load
+// balancers always agree.
+type Readiness struct {
+	mu       sync.RWMutex
+	checks   []readinessCheck
+	services []string
+	draining atomic.Bool
+	load     func() InFlightState
+}
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// ReadinessResponse is the JSON structure /readyz returns
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+	Load   *InFlightState    `json:"load,omitempty"`
+}
+
+// NewReadiness takes the gRPC service names the health service answers for,
+// on top of the empty name for the whole gateway
+func NewReadiness(services ...string) *Readiness {
+	return &Readiness{
+		services: services,
+	}
+}
+
+// Add registers a check. The gateway is ready only while every check
+// returns nil.
+func (r *Readiness) Add(name string, check func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks = append(r.checks, readinessCheck{name: name, check: check})
+}
+
+// SetLoad reports how loaded the gateway is with every /readyz answer, so
+// operators and load balancers can see a replica filling up before it sheds
+func (r *Readiness) SetLoad(load func() InFlightState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.load = load
+}
+
+// Drain marks the gateway not ready for good, so load balancers stop sending
+// traffic while in-flight requests finish
+func (r *Readiness) Drain() {
+	r.draining.Store(true)
+}
+
+// Evaluate runs every check and reports the failing ones by name
+func (r *Readiness) Evaluate() (bool, map[string]string) {
+	r.mu.RLock()
+	checks := slices.Clone(r.checks)
+	r.mu.RUnlock()
+
+	failures := map[string]string{}
+
+	if r.draining.Load() {
+		failures["shutdown"] = "draining"
+	}
+
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failures[c.name] = err.Error()
+		}
+	}
+
+	return len(failures) == 0, failures
+}
+
+// Handler serves /readyz, answering 503 with the failing checks when not ready
+func (r *Readiness) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ready, failures := r.Evaluate()
+
+		resp := ReadinessResponse{
+			Status: "OK",
+		}
+		status := http.StatusOK
+
+		if !ready {
+			resp.Status = "NOT_READY"
+			resp.Checks = failures
+			status = http.StatusServiceUnavailable
+		}
+
+		r.mu.RLock()
+		load := r.load
+		r.mu.RUnlock()
+		if load != nil {
+			state := load()
+			resp.Load = &state
+			w.Header().Set("X-Gateway-In-Flight", strconv.FormatInt(state.InFlight, 10))
+			w.Header().Set("X-Gateway-Queue-Depth", strconv.Itoa(state.Queued))
+			w.Header().Set("X-Gateway-Shed-Rate", strconv.FormatFloat(state.ShedRate, 'f', 2, 64))
+			w.Header().Set("X-Gateway-Saturation", strconv.FormatFloat(state.Saturation, 'f', 2, 64))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Check implements grpchealth.Checker with the same answer as /readyz
+func (r *Readiness) Check(ctx context.Context, req *grpchealth.CheckRequest) (*grpchealth.CheckResponse, error) {
+	if req.Service != "" && !slices.Contains(r.services, req.Service) {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("unknown service %s", req.Service))
+	}
+
+	if ready, _ := r.Evaluate(); !ready {
+		return &grpchealth.CheckResponse{Status: grpchealth.StatusNotServing}, nil
+	}
+
+	return &grpchealth.CheckResponse{Status: grpchealth.StatusServing}, nil
+}
+
+// saturationReadyCheck fails while the gateway is more saturated than threshold,
+// so the load balancer moves traffic off it before it has to shed
+func saturationReadyCheck(limiter *InFlightLimiter, threshold float64) func() error {
+	return func() error {
+		if state := limiter.State(); state.Saturation > threshold {
+			return fmt.Errorf("saturated: %.2f of the in-flight limit, over %.2f", state.Saturation, threshold)
+		}
+		return nil
+	}
+}
+
+// poolReadyCheck fails while the pool has no backends to route to
+func poolReadyCheck(pool *BackendManager) func() error {
+	return func() error {
+		if !pool.IsReady() {
+			return errors.New("no healthy backends")
+		}
+		return nil
+	}
+}
+
+// serveGRPCHealth serves only the gRPC health service on its own port, for
+// load balancers that probe a dedicated health port. Runs until ctx ends.
+func serveGRPCHealth(ctx context.Context, port uint16, readiness *Readiness, logger *slog.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle(grpchealth.NewHandler(readiness))
+
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	// gRPC needs HTTP/2, and health probes come in without TLS
+	p.SetUnencryptedHTTP2(true)
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   mux,
+		Protocols: p,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info("starting grpc health server", slog.Int("port", int(port)))
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// reloadableSettings are the Config fields a reload applies. A change to
+// any other field is logged as needing a restart.
+var reloadableSettings = []string{
+	"AuthServer", "IDPHost", "JWKSURL", "AllowedClientsIds", "Issuers",
+	"CORS",
+	"UserRateLimit", "UserRateBurst", "ClientRateLimit", "ClientRateBurst",
+}
+
+var configReloads = NewCounter(
+	"civil_gateway_config_reloads_total",
+	"Config reloads, by whether the new config was applied",
+	"result",
+)
+
+// ReloadHook readies the part of a new config it applies, and returns the
+// function that swaps it in. An error rejects the whole config.
+type ReloadHook func(config *Config) (func(), error)
+
+type reloadHook struct {
+	name string
+	hook ReloadHook
+}
+
+// ConfigReload is what a reload applied, as served on
+// /admin/config/reload
+type ConfigReload struct {
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// Reloader applies a changed config without dropping connections. The new
+// config is loaded and validated like at startup, and every hook readies
+// its part before any is swapped in, so a config that fails anywhere leaves
+// the gateway running as it was.
+type Reloader struct {
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	current *Config
+	hooks   []reloadHook
+	modTime time.Time
+}
+
+// NewReloader starts from config, the one the gateway started with
+func NewReloader(config *Config, logger *slog.Logger) *Reloader {
+	r := &Reloader{
+		logger:  logger,
+		current: config,
+	}
+	if config.ConfigFile != "" {
+		if info, err := os.Stat(config.ConfigFile); err == nil {
+			r.modTime = info.ModTime()
+		}
+	}
+	return r
+}
+
+// Add registers the hook applying one part of the config
+func (r *Reloader) Add(name string, hook ReloadHook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hooks = append(r.hooks, reloadHook{name: name, hook: hook})
+}
+
+// Current is the config the gateway runs with, including what reloads
+// applied
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.current
+}
+
+// Reload loads the config again and applies what can change at runtime
+func (r *Reloader) Reload() (ConfigReload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := LoadConfig(r.logger)
+	if err != nil {
+		configReloads.Inc("invalid")
+		return ConfigReload{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	commits := make([]func(), 0, len(r.hooks))
+	for _, h := range r.hooks {
+		commit, err := h.hook(config)
+		if err != nil {
+			configReloads.Inc("rejected")
+			return ConfigReload{}, fmt.Errorf("failed to apply %s: %w", h.name, err)
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+
+	result := ConfigReload{RestartRequired: restartRequired(r.current, config)}
+	r.current = appliedConfig(r.current, config)
+	configReloads.Inc("applied")
+
+	r.logger.Info("config reloaded")
+	if len(result.RestartRequired) > 0 {
+		r.logger.Warn("config changes that only apply after a restart", slog.Any("settings", result.RestartRequired))
+	}
+	return result, nil
+}
+
+// reload reloads on behalf of trigger, logging rather than returning a
+// failure, which keeps the config the gateway runs with
+func (r *Reloader) reload(trigger string) {
+	r.logger.Info("reloading config", slog.String("trigger", trigger))
+	if _, err := r.Reload(); err != nil {
+		r.logger.Error("config reload failed, keeping the current config", slog.Any("error", err))
+	}
+}
+
+// Watch reloads on every signal from signals until ctx ends
+func (r *Reloader) Watch(ctx context.Context, signals <-chan os.Signal) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case sig := <-signals:
+			r.reload(sig.String())
+		}
+	}
+}
+
+// WatchFile reloads when the config file has been modified since it was
+// last read. Run as a scheduled job.
+func (r *Reloader) WatchFile(ctx context.Context) error {
+	path := r.Current().ConfigFile
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat config file: %w", err)
+	}
+
+	r.mu.Lock()
+	changed := !info.ModTime().Equal(r.modTime)
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+
+	if changed {
+		r.reload("file")
+	}
+	return nil
+}
+
+// Handler serves POST /admin/config/reload, answering 422 with the reason
+// when the new config is rejected
+func (r *Reloader) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		result, err := r.Reload()
+		if err != nil {
+			r.logger.Error("config reload failed, keeping the current config", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// restartRequired names the settings that differ between old and config
+// and that a reload doesn't apply
+func restartRequired(old, config *Config) []string {
+	var names []string
+
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(config).Elem()
+	for i := range oldValue.NumField() {
+		name := oldValue.Type().Field(i).Name
+		if name == "Pools" || slices.Contains(reloadableSettings, name) {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+
+	// Only the auth and groups of the pools already served apply
+	if len(old.Pools) != len(config.Pools) {
+		return append(names, "Pools")
+	}
+	for i := range old.Pools {
+		before, after := old.Pools[i], config.Pools[i]
+		before.Auth, before.Groups = "", nil
+		after.Auth, after.Groups = "", nil
+		if !reflect.DeepEqual(before, after) {
+			return append(names, "Pools")
+		}
+	}
+	return names
+}
+
+// appliedConfig is old with the settings of config that a reload applies
+func appliedConfig(old, config *Config) *Config {
+	applied := *old
+
+	appliedValue, newValue := reflect.ValueOf(&applied).Elem(), reflect.ValueOf(config).Elem()
+	for _, name := range reloadableSettings {
+		appliedValue.FieldByName(name).Set(newValue.FieldByName(name))
+	}
+
+	applied.Pools = slices.Clone(old.Pools)
+	for i, pool := range applied.Pools {
+		j := slices.IndexFunc(config.Pools, func(pc PoolConfig) bool { return pc.Name == pool.Name })
+		if j >= 0 {
+			applied.Pools[i].Auth = config.Pools[j].Auth
+			applied.Pools[i].Groups = config.Pools[j].Groups
+		}
+	}
+	return &applied
+}
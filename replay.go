@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replayKeyPrefix namespaces the used nonces in Redis
+const replayKeyPrefix = "civil:nonce:"
+
+// replayNonceBytes is roughly what remembering a nonce locally costs
+// besides the nonce itself
+const replayNonceBytes = 64
+
+// errReplayMemory is returned for a nonce there is no room to remember
+var errReplayMemory = errors.New("no memory left to remember nonces")
+
+var replayChecks = NewCounter(
+	"civil_gateway_replay_checks_total",
+	"One-time nonces checked, by whether they were first used, replayed, or couldn't be checked",
+	"result",
+)
+
+// ReplayGuard enforces one-time use of nonces, like those of signed URLs for
+// sensitive layers, so a leaked URL is worthless once it has been used.
+// Each nonce is remembered until its URL expires, after which the URL is
+// refused anyway. With Redis the nonces are shared by every replica. Without
+// it they are only remembered locally, which only holds for a single
+// replica.
+type ReplayGuard struct {
+	redis   *redis.Client
+	timeout time.Duration
+	logger  *slog.Logger
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	memory *MemoryPool
+}
+
+// NewReplayGuard remembers nonces in client, or locally if it is nil.
+// timeout bounds each Redis round trip.
+func NewReplayGuard(client *redis.Client, timeout time.Duration, logger *slog.Logger) *ReplayGuard {
+	return &ReplayGuard{
+		redis:   client,
+		timeout: timeout,
+		logger:  logger,
+		seen:    map[string]time.Time{},
+	}
+}
+
+// NewSharedReplayGuard remembers nonces in the Redis at addr, closing the
+// connection when stage stops, or locally when addr is empty
+func NewSharedReplayGuard(stage *Stage, addr string, timeout time.Duration, logger *slog.Logger) (*ReplayGuard, error) {
+	if addr == "" {
+		return NewReplayGuard(nil, timeout, logger), nil
+	}
+
+	client, err := newRedisClient(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replay Redis address: %w", err)
+	}
+	stage.Go("replay-redis", func(ctx context.Context) error {
+		<-ctx.Done()
+		return client.Close()
+	})
+	return NewReplayGuard(client, timeout, logger), nil
+}
+
+// First reports whether nonce is being used for the first time, remembering
+// it until expires. With Redis unreachable it fails closed, as there is no
+// telling whether another replica has seen the nonce.
+func (g *ReplayGuard) First(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	if g.redis == nil {
+		return g.firstLocal(nonce, expires, time.Now())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	first, err := g.redis.SetArgs(ctx, replayKeyPrefix+nonce, 1, redis.SetArgs{
+		Mode:     "NX",
+		ExpireAt: expires,
+	}).Result()
+	if err == redis.Nil {
+		replayChecks.Inc("replayed")
+		return false, nil
+	}
+	if err != nil {
+		replayChecks.Inc("error")
+		g.logger.Warn("failed to check nonce in Redis", slog.Any("error", err))
+		return false, err
+	}
+
+	replayChecks.Inc("first")
+	return first == "OK", nil
+}
+
+// SetMemoryPool accounts for the nonces remembered locally in pool. Set it
+// before any are.
+func (g *ReplayGuard) SetMemoryPool(pool *MemoryPool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.memory = pool
+}
+
+// firstLocal is First without Redis. A nonce there is no room to remember
+// fails closed, like Redis being unreachable does.
+func (g *ReplayGuard) firstLocal(nonce string, expires, now time.Time) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if until, ok := g.seen[nonce]; ok {
+		if now.Before(until) {
+			replayChecks.Inc("replayed")
+			return false, nil
+		}
+		g.forget(nonce)
+	}
+
+	if !g.memory.Reserve(replayNonceBytes + int64(len(nonce))) {
+		replayChecks.Inc("error")
+		return false, errReplayMemory
+	}
+
+	g.seen[nonce] = expires
+	replayChecks.Inc("first")
+	return true, nil
+}
+
+// Prune forgets the local nonces whose URLs have expired. Run as a
+// scheduled job.
+func (g *ReplayGuard) Prune(ctx context.Context) error {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for nonce, expires := range g.seen {
+		if !now.Before(expires) {
+			g.forget(nonce)
+		}
+	}
+	return nil
+}
+
+// forget drops nonce. Called with mu held.
+func (g *ReplayGuard) forget(nonce string) {
+	g.memory.Release(replayNonceBytes + int64(len(nonce)))
+	delete(g.seen, nonce)
+}
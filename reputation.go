@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// reputationKeyPrefix namespaces the endpoint reputations in Redis, by pool
+// and endpoint
+const reputationKeyPrefix = "civil:reputation:"
+
+// reputationAlpha is how much each request moves an endpoint's error rate,
+// so it reflects roughly the last hundred requests
+const reputationAlpha = 0.02
+
+var reputationSeeded = NewCounter(
+	"civil_gateway_reputation_seeded_total",
+	"Endpoints whose outlier state was seeded from their stored reputation, by pool and what it started as",
+	"pool", "state",
+)
+
+// EndpointReputation is how an endpoint has behaved: its error rate as an
+// EWMA over recent requests, how often it was ejected, and until when it is
+// ejected, if it is
+type EndpointReputation struct {
+	ErrorRate    float64   `json:"error_rate"`
+	Ejections    int       `json:"ejections"`
+	LastEjected  time.Time `json:"last_ejected,omitzero"`
+	EjectedUntil time.Time `json:"ejected_until,omitzero"`
+}
+
+// ReputationConfig sets up persistent reputations. Each is kept for TTL
+// after it was last saved. Endpoints that come back with an error rate of
+// SuspectErrorRate or more start one failure away from ejection.
+type ReputationConfig struct {
+	TTL              time.Duration
+	SuspectErrorRate float64
+	Timeout          time.Duration
+}
+
+// ReputationStore keeps the endpoints' outlier state in Redis, so a
+// chronically flaky endpoint doesn't get a clean slate, and full traffic,
+// every time the gateway is deployed. Every replica saves what it has seen;
+// the last to save an endpoint wins.
+type ReputationStore struct {
+	redis  *redis.Client
+	config ReputationConfig
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	pools map[string]*BackendManager
+}
+
+// NewReputationStore keeps reputations in the Redis at addr. The stage saves
+// them one last time and closes the connection when it stops.
+func NewReputationStore(stage *Stage, addr string, config ReputationConfig, logger *slog.Logger) (*ReputationStore, error) {
+	client, err := newRedisClient(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reputation Redis address: %w", err)
+	}
+
+	s := &ReputationStore{
+		redis:  client,
+		config: config,
+		logger: logger,
+		pools:  map[string]*BackendManager{},
+	}
+
+	// A deploy is exactly when the reputation is needed next, so the
+	// latest is saved on the way out
+	stage.Go("reputation-redis", func(ctx context.Context) error {
+		<-ctx.Done()
+		saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return errors.Join(s.Save(saveCtx), client.Close())
+	})
+	return s, nil
+}
+
+// Track seeds the outlier state of the pool's endpoints from their stored
+// reputation, and saves it with the others from then on
+func (s *ReputationStore) Track(ctx context.Context, pool string, backends *BackendManager) {
+	s.mu.Lock()
+	s.pools[pool] = backends
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	prefix := reputationKeyPrefix + pool + ":"
+	reputations := map[string]EndpointReputation{}
+
+	iter := s.redis.Scan(ctx, 0, escapeRedisPattern(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		raw, err := s.redis.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var reputation EndpointReputation
+		if err := json.Unmarshal(raw, &reputation); err != nil {
+			continue
+		}
+		reputations[strings.TrimPrefix(iter.Val(), prefix)] = reputation
+	}
+	if err := iter.Err(); err != nil {
+		s.logger.Warn("failed to load endpoint reputations, starting with a clean slate", slog.String("pool", pool), slog.Any("error", err))
+		return
+	}
+
+	backends.seedReputation(reputations, s.config.SuspectErrorRate)
+}
+
+// Save stores the reputation of every tracked endpoint. Run as a scheduled
+// job.
+func (s *ReputationStore) Save(ctx context.Context) error {
+	s.mu.Lock()
+	pools := make(map[string]map[string]EndpointReputation, len(s.pools))
+	for name, backends := range s.pools {
+		pools[name] = backends.Reputation()
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	_, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for pool, reputations := range pools {
+			for endpoint, reputation := range reputations {
+				encoded, err := json.Marshal(reputation)
+				if err != nil {
+					return err
+				}
+				pipe.Set(ctx, reputationKeyPrefix+pool+":"+endpoint, encoded, s.config.TTL)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save endpoint reputations: %w", err)
+	}
+	return nil
+}
+
+// Reputation is how each endpoint that has failed a request lately behaved
+func (bm *BackendManager) Reputation() map[string]EndpointReputation {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	reputations := map[string]EndpointReputation{}
+	for endpoint, state := range bm.probes {
+		if state.errorRate == 0 && state.ejections == 0 {
+			continue
+		}
+		reputation := EndpointReputation{
+			ErrorRate:   state.errorRate,
+			Ejections:   state.ejections,
+			LastEjected: state.lastEjected,
+		}
+		if state.ejected {
+			reputation.EjectedUntil = state.ejectedUntil
+		}
+		reputations[endpoint] = reputation
+	}
+	return reputations
+}
+
+// seedReputation has endpoints start from their stored reputation when they
+// are discovered: still ejected if their ejection hadn't run out, and one
+// failure away from it if their error rate is suspect
+func (bm *BackendManager) seedReputation(reputations map[string]EndpointReputation, suspect float64) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	bm.seeds = reputations
+	bm.suspectErrorRate = suspect
+	bm.updateRotation()
+}
+
+// applySeeds seeds the discovered endpoints that have a stored reputation
+// and no state yet. Must be called with mu held.
+func (bm *BackendManager) applySeeds() {
+	if len(bm.seeds) == 0 || bm.probe.EjectAfter <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, endpoint := range bm.endpoints {
+		reputation, ok := bm.seeds[endpoint]
+		if !ok {
+			continue
+		}
+		delete(bm.seeds, endpoint)
+		if _, known := bm.probes[endpoint]; known {
+			continue
+		}
+
+		state := &endpointProbe{
+			errorRate:   reputation.ErrorRate,
+			ejections:   reputation.Ejections,
+			lastEjected: reputation.LastEjected,
+		}
+		bm.probes[endpoint] = state
+
+		switch {
+		case now.Before(reputation.EjectedUntil):
+			state.ejected = true
+			state.ejectedUntil = reputation.EjectedUntil
+			if bm.probe.Path == "" {
+				time.AfterFunc(reputation.EjectedUntil.Sub(now), func() { bm.readmit(endpoint) })
+			}
+			reputationSeeded.Inc(bm.pool, "ejected")
+			bm.logger.Info("endpoint still ejected from before the restart", slog.String("endpoint", endpoint), slog.Time("until", reputation.EjectedUntil))
+		case bm.suspectErrorRate > 0 && reputation.ErrorRate >= bm.suspectErrorRate:
+			state.requestFailures = bm.probe.EjectAfter - 1
+			reputationSeeded.Inc(bm.pool, "suspect")
+			bm.logger.Info("endpoint has a history of errors, one more ejects it", slog.String("endpoint", endpoint), slog.Float64("error_rate", reputation.ErrorRate))
+		default:
+			reputationSeeded.Inc(bm.pool, "clean")
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// errAttemptTimeout cancels an attempt that took longer than AttemptTimeout
+var errAttemptTimeout = errors.New("upstream attempt timed out")
+
+var upstreamRetries = NewCounter(
+	"civil_gateway_upstream_retries_total",
+	"Requests retried against another endpoint of the pool, by pool and outcome",
+	"pool", "result",
+)
+
+// RetryConfig sets up retrying failed requests on other endpoints. Attempts
+// is how many times a request may be retried, with 0 turning retries off.
+// Each attempt gets AttemptTimeout to return its headers, and all attempts
+// together get Budget.
+type RetryConfig struct {
+	Attempts       int
+	AttemptTimeout time.Duration
+	Budget         time.Duration
+}
+
+// retryTransport retries idempotent requests that fail to connect or get a
+// 502, 503, or 504, each time on an endpoint not yet tried. A transient
+// failure of one tile server is then invisible to the client as long as
+// another endpoint can answer.
+type retryTransport struct {
+	next     http.RoundTripper
+	backends *BackendManager
+	config   RetryConfig
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint, ok := endpointFromContext(req.Context())
+	if !ok || t.config.Attempts <= 0 || !isRetryable(req) || isDryRun(req.Context()) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	if t.config.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.config.Budget)
+		resp, err := t.attempts(ctx, req, endpoint)
+		return withCancel(resp, err, cancel)
+	}
+
+	return t.attempts(ctx, req, endpoint)
+}
+
+func (t *retryTransport) attempts(ctx context.Context, req *http.Request, endpoint string) (*http.Response, error) {
+	tried := []string{endpoint}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.attempt(ctx, req, endpoint)
+
+		if !shouldRetry(resp, err) || req.Context().Err() != nil {
+			if attempt > 0 {
+				upstreamRetries.Inc(t.backends.pool, retryResult(resp, err))
+			}
+			return resp, err
+		}
+
+		if attempt == t.config.Attempts || ctx.Err() != nil {
+			upstreamRetries.Inc(t.backends.pool, "exhausted")
+			return resp, err
+		}
+
+		next, nextErr := t.backends.NextEndpointExcluding(tried, affinityKey(req), requiredCapabilities(req))
+		if nextErr != nil {
+			// Nowhere else to go, so the failure stands
+			if attempt > 0 {
+				upstreamRetries.Inc(t.backends.pool, "exhausted")
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		endpoint = next
+		tried = append(tried, endpoint)
+	}
+}
+
+// attempt sends the request to endpoint, with AttemptTimeout to get the
+// response headers
+func (t *retryTransport) attempt(ctx context.Context, req *http.Request, endpoint string) (*http.Response, error) {
+	ctx = context.WithValue(ctx, endpointContextKey, endpoint)
+
+	// The timeout stops once the headers are in, so a large body can still
+	// take its time
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancel := func() { cancelCause(context.Canceled) }
+	if t.config.AttemptTimeout > 0 {
+		timer := time.AfterFunc(t.config.AttemptTimeout, func() { cancelCause(errAttemptTimeout) })
+		defer timer.Stop()
+	}
+
+	out := req.Clone(ctx)
+	if u, err := url.Parse(endpoint); err == nil {
+		out.URL.Host = u.Host
+		out.Host = u.Host
+		logAccessBackend(ctx, u.Host)
+	}
+
+	resp, err := t.next.RoundTrip(out)
+	return withCancel(resp, err, cancel)
+}
+
+// withCancel ties cancel to the response, calling it once the body is
+// closed so the body can still be read after RoundTrip returns
+func withCancel(resp *http.Response, err error, cancel context.CancelFunc) (*http.Response, error) {
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = keepWritable(resp.Body, &cancelBody{ReadCloser: resp.Body, cancel: cancel})
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// isRetryable reports whether the request can safely be sent again: a GET or
+// HEAD without a body
+func isRetryable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// shouldRetry reports whether an attempt failed in a way another endpoint
+// might not
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func retryResult(resp *http.Response, err error) string {
+	if shouldRetry(resp, err) {
+		return "failed"
+	}
+	return "recovered"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize is how many recent upstream latencies are kept for the
+// p95 calculation. Old samples are overwritten ring-buffer style.
+const latencyWindowSize = 1024
+
+// SaturationTracker records what the gateway observes about a backend pool:
+// requests currently in flight to each endpoint and recent upstream latencies.
+type SaturationTracker struct {
+	mu         sync.Mutex
+	inFlight   map[string]int64
+	latencies  []time.Duration
+	nextSample int
+
+	// queueDepth reports requests waiting for admission. Nil until an
+	// admission queue exists in front of the pool.
+	queueDepth func() int64
+}
+
+// SaturationSnapshot is a point-in-time view of a pool's saturation
+type SaturationSnapshot struct {
+	Backends           int
+	InFlight           int64
+	InFlightPerBackend float64
+	QueueDepth         int64
+	P95Latency         time.Duration
+}
+
+func NewSaturationTracker() *SaturationTracker {
+	return &SaturationTracker{
+		inFlight:  map[string]int64{},
+		latencies: make([]time.Duration, 0, latencyWindowSize),
+	}
+}
+
+// SetQueueDepthFunc registers the source of the pool's queue depth
+func (t *SaturationTracker) SetQueueDepthFunc(fn func() int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queueDepth = fn
+}
+
+// Begin marks a request as in flight to the given endpoint. The returned
+// function must be called exactly once when the upstream response completes.
+func (t *SaturationTracker) Begin(endpoint string) func() {
+	start := time.Now()
+
+	t.mu.Lock()
+	t.inFlight[endpoint]++
+	t.mu.Unlock()
+
+	return func() {
+		elapsed := time.Since(start)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.inFlight[endpoint]--
+		if t.inFlight[endpoint] <= 0 {
+			delete(t.inFlight, endpoint)
+		}
+
+		if len(t.latencies) < latencyWindowSize {
+			t.latencies = append(t.latencies, elapsed)
+		} else {
+			t.latencies[t.nextSample] = elapsed
+		}
+		t.nextSample = (t.nextSample + 1) % latencyWindowSize
+	}
+}
+
+// InFlight is how many requests are in flight to the endpoint
+func (t *SaturationTracker) InFlight(endpoint string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inFlight[endpoint]
+}
+
+// Snapshot computes the current saturation figures. backends is the number of
+// endpoints in the pool, which may include idle endpoints with nothing in flight.
+func (t *SaturationTracker) Snapshot(backends int) SaturationSnapshot {
+	t.mu.Lock()
+	var inFlight int64
+	for _, n := range t.inFlight {
+		inFlight += n
+	}
+	samples := slices.Clone(t.latencies)
+	queueDepth := t.queueDepth
+	t.mu.Unlock()
+
+	snap := SaturationSnapshot{
+		Backends: backends,
+		InFlight: inFlight,
+	}
+
+	if backends > 0 {
+		snap.InFlightPerBackend = float64(inFlight) / float64(backends)
+	}
+
+	if queueDepth != nil {
+		snap.QueueDepth = queueDepth()
+	}
+
+	if len(samples) > 0 {
+		slices.Sort(samples)
+		snap.P95Latency = samples[(len(samples)*95-1)/100]
+	}
+
+	return snap
+}
+
+// Score folds the snapshot into a single percentage against the configured
+// targets. 100 means the pool is running exactly at target on its most
+// saturated dimension, so autoscaling can track a plain target value.
+func (s SaturationSnapshot) Score(targetInFlight float64, targetP95 time.Duration) float64 {
+	var score float64
+
+	if targetInFlight > 0 {
+		// Queued requests count against capacity just like in-flight ones
+		perBackend := s.InFlightPerBackend
+		if s.Backends > 0 {
+			perBackend += float64(s.QueueDepth) / float64(s.Backends)
+		} else if s.QueueDepth > 0 {
+			perBackend += float64(s.QueueDepth)
+		}
+		score = max(score, perBackend/targetInFlight*100)
+	}
+
+	if targetP95 > 0 {
+		score = max(score, float64(s.P95Latency)/float64(targetP95)*100)
+	}
+
+	return score
+}
+
+// trackingTransport wraps an upstream transport so every proxied request is
+// recorded against the endpoint it was sent to
+type trackingTransport struct {
+	next    http.RoundTripper
+	tracker *SaturationTracker
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done := t.tracker.Begin(req.URL.Host)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	// The request stays in flight until the body has been fully relayed
+	resp.Body = keepWritable(resp.Body, &trackedBody{ReadCloser: resp.Body, done: done})
+
+	return resp, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
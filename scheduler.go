@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	jobRuns = NewCounter(
+		"civil_gateway_job_runs_total",
+		"Scheduled job runs by outcome",
+		"job", "result",
+	)
+	jobDuration = NewHistogram(
+		"civil_gateway_job_duration_seconds",
+		"How long scheduled job runs take",
+		DefaultLatencyBuckets,
+		"job",
+	)
+	jobLastSuccess = NewGauge(
+		"civil_gateway_job_last_success_timestamp_seconds",
+		"Unix time of the last successful run of each job",
+		"job",
+	)
+)
+
+// JobFunc is one run of a periodic job
+type JobFunc func(ctx context.Context) error
+
+// JobStatus is what the scheduler knows about a job, as served on /admin/jobs
+type JobStatus struct {
+	Name         string    `json:"name"`
+	Interval     string    `json:"interval"`
+	Running      bool      `json:"running"`
+	Runs         uint64    `json:"runs"`
+	Failures     uint64    `json:"failures"`
+	LastRun      time.Time `json:"last_run,omitzero"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastSuccess  time.Time `json:"last_success,omitzero"`
+	NextRun      time.Time `json:"next_run,omitzero"`
+}
+
+type job struct {
+	fn       JobFunc
+	interval time.Duration
+	status   JobStatus
+
+	// delay, when set, picks the wait before each run in place of
+	// interval, see AddPaced
+	delay func(err error) time.Duration
+
+	// trigger runs the job ahead of its next tick, see Trigger
+	trigger chan struct{}
+
+	// removed stops the job for good, see Remove
+	removed chan struct{}
+}
+
+// Scheduler owns the gateway's periodic background work, so every job has a
+// name, a visible last run, and a last error instead of being an anonymous
+// goroutine
+type Scheduler struct {
+	mu     sync.Mutex
+	jobs   []*job
+	stage  *Stage
+	logger *slog.Logger
+}
+
+func NewScheduler(logger *slog.Logger) *Scheduler {
+	return &Scheduler{
+		logger: logger,
+	}
+}
+
+// Start runs every registered job, and any added later, in the given
+// lifecycle stage until it shuts down
+func (s *Scheduler) Start(stage *Stage) {
+	s.mu.Lock()
+	s.stage = stage
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		stage.Go("job:"+j.status.Name, func(ctx context.Context) error {
+			return s.run(ctx, j)
+		})
+	}
+}
+
+// Add registers a job that runs every interval, starting one interval from now
+func (s *Scheduler) Add(name string, interval time.Duration, fn JobFunc) {
+	s.AddPaced(name, interval, nil, fn)
+}
+
+// AddPaced registers a job that waits delay before each run, given the error
+// of the run before, nil for the first. The job is listed as running every
+// interval. A nil delay waits interval every time.
+func (s *Scheduler) AddPaced(name string, interval time.Duration, delay func(err error) time.Duration, fn JobFunc) {
+	j := &job{
+		fn:       fn,
+		interval: interval,
+		delay:    delay,
+		trigger:  make(chan struct{}, 1),
+		removed:  make(chan struct{}),
+		status: JobStatus{
+			Name:     name,
+			Interval: interval.String(),
+		},
+	}
+
+	s.mu.Lock()
+	s.jobs = append(s.jobs, j)
+	stage := s.stage
+	s.mu.Unlock()
+
+	if stage != nil {
+		stage.Go("job:"+name, func(ctx context.Context) error {
+			return s.run(ctx, j)
+		})
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, j *job) error {
+	timer := time.NewTimer(s.schedule(j, nil))
+	defer timer.Stop()
+
+	for {
+		select {
+		// When the stage shuts down, ctx.Done() unblocks and the job stops
+		case <-ctx.Done():
+			return nil
+		case <-j.removed:
+			return nil
+		case <-timer.C:
+		case <-j.trigger:
+		}
+
+		err := s.runOnce(ctx, j)
+		timer.Reset(s.schedule(j, err))
+	}
+}
+
+// schedule is how long until the job runs next, after a run that returned
+// err
+func (s *Scheduler) schedule(j *job, err error) time.Duration {
+	wait := j.interval
+	if j.delay != nil {
+		wait = j.delay(err)
+	}
+
+	s.mu.Lock()
+	j.status.NextRun = time.Now().Add(wait)
+	s.mu.Unlock()
+
+	return wait
+}
+
+// Trigger runs the named job now rather than at its next tick, in the
+// background. A run already asked for isn't queued twice. Reports whether
+// there is such a job.
+func (s *Scheduler) Trigger(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.status.Name == name {
+			select {
+			case j.trigger <- struct{}{}:
+			default:
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Remove stops the named job after any run in progress, and forgets it
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs = slices.DeleteFunc(s.jobs, func(j *job) bool {
+		if j.status.Name != name {
+			return false
+		}
+		close(j.removed)
+		return true
+	})
+}
+
+func (s *Scheduler) runOnce(ctx context.Context, j *job) error {
+	s.mu.Lock()
+	j.status.Running = true
+	name := j.status.Name
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := j.fn(ctx)
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = elapsed.String()
+
+	jobDuration.Observe(elapsed.Seconds(), name)
+
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		jobRuns.Inc(name, "error")
+
+		s.logger.Debug("scheduled job failed", slog.String("job", name), slog.Any("error", err))
+		return err
+	}
+
+	j.status.LastError = ""
+	j.status.LastSuccess = start
+	jobRuns.Inc(name, "success")
+	jobLastSuccess.Set(float64(start.Unix()), name)
+	return nil
+}
+
+// Jobs returns the status of every registered job
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, j.status)
+	}
+	return statuses
+}
+
+// JobsHandler serves the job statuses as JSON
+func (s *Scheduler) JobsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(s.Jobs())
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// The self-test runs the gateway binary for real, against a fake tile
+// backend and a fake IdP it starts in-process, and sends a tile request with
+// a token the fake IdP signed through the whole middleware stack. It runs as
+// `civil-gateway selftest` and exits non-zero if anything on the way fails,
+// so a pipeline can smoke test the image before it ships.
+
+const (
+	selftestClientID = "civil-selftest"
+	selftestKeyID    = "selftest"
+	selftestTilePath = "/tiles/0/0/0.png"
+)
+
+// selftestTile is what the fake backend answers tile requests with
+var selftestTile = []byte("\x89PNG\r\n\x1a\nselftest")
+
+// selftestIdP is an OIDC issuer with discovery and a key set, able to sign
+// tokens for the self-test client
+type selftestIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+}
+
+func newSelftestIdP() (*selftestIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	idp := &selftestIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.server.URL,
+			"jwks_uri":                              idp.server.URL + "/keys",
+			"authorization_endpoint":                idp.server.URL + "/auth",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     selftestKeyID,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	})
+	idp.server = httptest.NewServer(mux)
+
+	return idp, nil
+}
+
+// token signs an ID token for the self-test client
+func (idp *selftestIdP) token() (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: idp.key, KeyID: selftestKeyID},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(map[string]any{
+		"iss":   idp.server.URL,
+		"aud":   selftestClientID,
+		"sub":   "selftest",
+		"email": "selftest@civil.invalid",
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.CompactSerialize()
+}
+
+// selftestBackend is a tile server recording the requests it gets
+type selftestBackend struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newSelftestBackend() *selftestBackend {
+	b := &selftestBackend{}
+	b.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		b.requests = append(b.requests, r)
+		b.mu.Unlock()
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(selftestTile)
+	}))
+	return b
+}
+
+func (b *selftestBackend) lastRequest() (*http.Request, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.requests) == 0 {
+		return nil, false
+	}
+	return b.requests[len(b.requests)-1], true
+}
+
+func runSelftest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print the gateway's logs even when every check passes")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long the gateway gets to become ready")
+	flags.Parse(args)
+
+	var logs bytes.Buffer
+	failed, err := selftest(*timeout, &logs)
+	if err != nil {
+		fmt.Printf("FAIL %v\n", err)
+		failed = true
+	}
+
+	if failed || *verbose {
+		fmt.Println("gateway logs:")
+		os.Stdout.Write(logs.Bytes())
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// selftest starts the gateway and runs the checks, printing a line for each.
+// The error is for failing to get as far as the checks.
+func selftest(timeout time.Duration, logs io.Writer) (bool, error) {
+	idp, err := newSelftestIdP()
+	if err != nil {
+		return false, fmt.Errorf("failed to start fake IdP: %w", err)
+	}
+	defer idp.server.Close()
+
+	backend := newSelftestBackend()
+	defer backend.server.Close()
+
+	port, err := freePort()
+	if err != nil {
+		return false, fmt.Errorf("failed to find a free port: %w", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+
+	// The gateway is configured from scratch, so whatever the environment
+	// it runs in sets doesn't change what is tested
+	var environ []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "CIVIL_") {
+			environ = append(environ, kv)
+		}
+	}
+	environ = append(environ,
+		"CIVIL_PORT="+strconv.Itoa(port),
+		"CIVIL_TILE_SERVER_HOST="+strings.TrimPrefix(backend.server.URL, "http://"),
+		"CIVIL_OIDC_ISSUER="+idp.server.URL,
+		`CIVIL_ALLOWED_CLIENT_IDS=["`+selftestClientID+`"]`,
+		"CIVIL_DB_READER_HOST=127.0.0.1:1",
+		"CIVIL_INSTANCE_METADATA_URL=file:///dev/null",
+	)
+
+	gateway := exec.Command(executable)
+	gateway.Env = environ
+	gateway.Stdout = logs
+	gateway.Stderr = logs
+	if err := gateway.Start(); err != nil {
+		return false, fmt.Errorf("failed to start gateway: %w", err)
+	}
+
+	// The logs are only complete once Wait returns, so the gateway is
+	// waited for however the checks end
+	var exitErr error
+	exited := make(chan struct{})
+	go func() {
+		exitErr = gateway.Wait()
+		close(exited)
+	}()
+	defer func() {
+		gateway.Process.Kill()
+		<-exited
+	}()
+
+	base := "http://127.0.0.1:" + strconv.Itoa(port)
+	client := &http.Client{Timeout: 5 * time.Second}
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			failed = true
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+
+	if err := waitReady(client, base+"/readyz", timeout, exited); err != nil {
+		check("gateway becomes ready", err)
+		return true, nil
+	}
+	check("gateway becomes ready", nil)
+
+	check("request without token is rejected", func() error {
+		resp, err := client.Get(base + selftestTilePath)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			return fmt.Errorf("got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+		return nil
+	}())
+
+	check("tile request with token reaches the backend", func() error {
+		token, err := idp.token()
+		if err != nil {
+			return fmt.Errorf("failed to sign token: %w", err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, base+selftestTilePath, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		if !bytes.Equal(body, selftestTile) {
+			return fmt.Errorf("got a body of %d bytes that isn't the backend's tile", len(body))
+		}
+
+		upstream, ok := backend.lastRequest()
+		if !ok {
+			return errors.New("backend was never asked for the tile")
+		}
+		if upstream.URL.Path != selftestTilePath {
+			return fmt.Errorf("backend was asked for %s", upstream.URL.Path)
+		}
+		return nil
+	}())
+
+	check("gateway shuts down cleanly", func() error {
+		if err := gateway.Process.Signal(syscall.SIGTERM); err != nil {
+			return err
+		}
+
+		select {
+		case <-exited:
+			return exitErr
+		case <-time.After(30 * time.Second):
+			return errors.New("still running 30s after SIGTERM")
+		}
+	}())
+
+	return failed, nil
+}
+
+// waitReady polls url until it answers 200, giving up after timeout or if
+// the gateway exits
+func waitReady(client *http.Client, url string, timeout time.Duration, exited <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-exited:
+			return errors.New("gateway exited before becoming ready")
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
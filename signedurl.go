@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// signedURLParam is the query parameter a signed URL carries its signature
+// in
+const signedURLParam = "sig"
+
+// minSignedURLKeyBytes is the shortest HMAC key accepted
+const minSignedURLKeyBytes = 32
+
+var signedURLAuth = NewCounter(
+	"civil_gateway_signed_url_auth_total",
+	"Requests authenticated by signed URL, and signed URLs issued, by result",
+	"result",
+)
+
+// signedURLClaims are what a signed URL grants: the paths under Path, until
+// Expires, as the user who asked for it. With a Nonce it works once.
+type signedURLClaims struct {
+	Path     string   `json:"p"`
+	Expires  int64    `json:"e"`
+	Subject  string   `json:"s"`
+	Username string   `json:"u,omitempty"`
+	Groups   []string `json:"g,omitempty"`
+	Nonce    string   `json:"n,omitempty"`
+}
+
+// SignedURLs issues and checks expiring tile URLs signed with HMAC-SHA256,
+// for clients that can't send an Authorization header, like <img> tags and
+// map plugins that only take a URL template. A signed URL covers a path
+// prefix, so one URL template serves every tile of a layer.
+type SignedURLs struct {
+	keys   [][]byte
+	ttl    time.Duration
+	maxTTL time.Duration
+	replay *ReplayGuard
+	logger *slog.Logger
+}
+
+// NewSignedURLs loads the HMAC keys, one per line, from a file or a Secrets
+// Manager ARN. The first key signs and every key verifies, so keys can be
+// rotated without breaking the URLs already out. URLs last ttl unless asked
+// for otherwise, and at most maxTTL. One-time URLs are checked with replay.
+func NewSignedURLs(ctx context.Context, keySource string, ttl, maxTTL time.Duration, replay *ReplayGuard, logger *slog.Logger) (*SignedURLs, error) {
+	var secrets *secretsmanager.Client
+	if strings.HasPrefix(keySource, secretsManagerARNPrefix) {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		secrets = secretsmanager.NewFromConfig(cfg)
+	}
+
+	data, err := readSecretSource(ctx, secrets, keySource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signed URL keys: %w", err)
+	}
+
+	var keys [][]byte
+	for line := range bytes.Lines(data) {
+		key := bytes.TrimSpace(line)
+		if len(key) == 0 {
+			continue
+		}
+		if len(key) < minSignedURLKeyBytes {
+			return nil, fmt.Errorf("signed URL keys must be at least %d bytes", minSignedURLKeyBytes)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signed URL keys in %s", keySource)
+	}
+
+	return &SignedURLs{
+		keys:   keys,
+		ttl:    ttl,
+		maxTTL: maxTTL,
+		replay: replay,
+		logger: logger,
+	}, nil
+}
+
+func signedURLMAC(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// sign is the signature parameter for claims: the claims and their MAC,
+// each base64url encoded
+func (s *SignedURLs) sign(claims signedURLClaims) (string, error) {
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(encoded)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signedURLMAC(s.keys[0], payload)), nil
+}
+
+// verify returns the claims of a signature parameter signed with any of
+// the keys, and whether it was
+func (s *SignedURLs) verify(value string) (signedURLClaims, bool) {
+	var claims signedURLClaims
+
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return claims, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return claims, false
+	}
+
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal(mac, signedURLMAC(key, payload)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return claims, false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(decoded, &claims) != nil {
+		return claims, false
+	}
+	return claims, true
+}
+
+// Middleware authenticates GET and HEAD requests carrying a signed URL
+// signature, and passes the rest on to bearer. The signature is dropped
+// from the query before the request goes on, so it reaches neither the
+// cache key nor the backend.
+func (s *SignedURLs) Middleware(bearer func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withToken := bearer(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			value := query.Get(signedURLParam)
+			if value == "" {
+				withToken.ServeHTTP(w, r)
+				return
+			}
+
+			claims, ok := s.verify(value)
+			if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.HasPrefix(r.URL.Path, claims.Path) {
+				signedURLAuth.Inc("invalid")
+				writeError(w, r, http.StatusUnauthorized, "invalid_signed_url", "")
+				s.logger.Debug("Unauthorized: Invalid signed URL", slog.String("path", r.URL.Path))
+				return
+			}
+
+			expires := time.Unix(claims.Expires, 0)
+			if !time.Now().Before(expires) {
+				signedURLAuth.Inc("expired")
+				writeError(w, r, http.StatusUnauthorized, "invalid_signed_url", "")
+				return
+			}
+
+			if claims.Nonce != "" {
+				first, err := s.replay.First(r.Context(), claims.Nonce, expires)
+				if err != nil {
+					signedURLAuth.Inc("error")
+					writeError(w, r, http.StatusServiceUnavailable, "signed_url_unchecked", "")
+					return
+				}
+				if !first {
+					signedURLAuth.Inc("replayed")
+					writeError(w, r, http.StatusUnauthorized, "signed_url_used", "")
+					return
+				}
+			}
+
+			signedURLAuth.Inc("ok")
+
+			query.Del(signedURLParam)
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = query.Encode()
+
+			serveAuthenticated(w, r, next, Claims{
+				Subject:           claims.Subject,
+				PreferredUsername: claims.Username,
+				Groups:            claims.Groups,
+			})
+		})
+	}
+}
+
+// signedURLRequest is a request for a signed URL for the paths under Path,
+// lasting TTL, like 1h, and usable once if Once is set
+type signedURLRequest struct {
+	Path string `json:"path"`
+	TTL  string `json:"ttl,omitempty"`
+	Once bool   `json:"once,omitempty"`
+}
+
+// Handler serves POST /signed-urls behind RequireAuth, issuing a signed URL
+// for the caller under one of routes, the proxied path prefixes. The URL
+// can only grant layers the caller is allowed on.
+func (s *SignedURLs) Handler(layers *Layers, routes []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "")
+			return
+		}
+
+		claims, ok := r.Context().Value(userContextKey).(Claims)
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, "missing_claims", "")
+			return
+		}
+
+		var req signedURLRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+			return
+		}
+
+		if req.Path != (&url.URL{Path: req.Path}).EscapedPath() || strings.Contains(req.Path, "..") ||
+			!slices.ContainsFunc(routes, func(route string) bool { return strings.HasPrefix(req.Path, route) }) {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "path must be under a tile route")
+			return
+		}
+
+		ttl := s.ttl
+		if req.TTL != "" {
+			parsed, err := time.ParseDuration(req.TTL)
+			if err != nil || parsed <= 0 || parsed > s.maxTTL {
+				writeError(w, r, http.StatusBadRequest, "invalid_request", "ttl must be a positive duration up to "+s.maxTTL.String())
+				return
+			}
+			ttl = parsed
+		}
+
+		// A URL for a whole route would cover every layer under it, so it
+		// is only issued to those allowed on all of them
+		for _, layer := range layers.All() {
+			if (strings.HasPrefix(req.Path, layer.Path) || strings.HasPrefix(layer.Path, req.Path)) && !layer.Allows(claims) {
+				writeError(w, r, http.StatusForbidden, "layer_forbidden", "")
+				return
+			}
+		}
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		signed := signedURLClaims{
+			Path:     req.Path,
+			Expires:  expires.Unix(),
+			Subject:  claims.Subject,
+			Username: claims.PreferredUsername,
+			Groups:   claims.Groups,
+		}
+		if req.Once {
+			signed.Nonce = rand.Text()
+		}
+
+		value, err := s.sign(signed)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "signed_url_failed", "")
+			return
+		}
+		signedURLAuth.Inc("issued")
+
+		query := url.Values{signedURLParam: {value}}.Encode()
+
+		s.logger.Debug("issued signed URL", slog.String("subject", claims.Subject), slog.String("path", req.Path), slog.Bool("once", req.Once))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			URL     string    `json:"url"`
+			Query   string    `json:"query"`
+			Expires time.Time `json:"expires"`
+		}{
+			URL:     req.Path + "?" + query,
+			Query:   query,
+			Expires: expires,
+		})
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"github.com/aws/smithy-go"
+)
+
+// The discovery simulation replays Cloud Map misbehaving (instances flapping,
+// throttling, empty answers, expiring credentials) against a real
+// BackendManager and checks what the gateway does about it: which endpoints
+// it serves, whether it reports ready, and what it exports as metrics. It
+// runs with go test, each scenario as a subtest of TestDiscoverySimulation,
+// so the image build catches resilience regressions.
+
+// discoveryStep is one scripted Cloud Map answer. instances are "ip:port"
+// pairs, those also in unhealthy failing their health checks, and err, when
+// set, is returned instead.
+type discoveryStep struct {
+	instances []string
+	unhealthy []string
+	// The WEIGHT and AVAILABILITY_ZONE attributes instances are
+	// registered with, if any
+	weights map[string]string
+	zones   map[string]string
+	// The AWS_INSTANCE_IPV6 address dual-stack instances register next
+	// to their IPv4 one
+	ipv6 map[string]string
+	err  error
+}
+
+// fakeDiscovery plays back its steps in order, repeating the last one once
+// the script runs out. Each DiscoverInstances call takes the next step, and
+// listing pages through the step it took last.
+type fakeDiscovery struct {
+	service string
+
+	mu      sync.Mutex
+	steps   []discoveryStep
+	calls   int
+	current discoveryStep
+}
+
+func (f *fakeDiscovery) DiscoverInstances(ctx context.Context, params *servicediscovery.DiscoverInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.DiscoverInstancesOutput, error) {
+	f.mu.Lock()
+	step := f.steps[min(f.calls, len(f.steps)-1)]
+	f.calls++
+	f.current = step
+	f.mu.Unlock()
+
+	if step.err != nil {
+		return nil, step.err
+	}
+
+	output := &servicediscovery.DiscoverInstancesOutput{}
+	for _, instance := range step.instances {
+		if len(output.Instances) == int(aws.ToInt32(params.MaxResults)) {
+			break
+		}
+		if slices.Contains(step.unhealthy, instance) {
+			continue
+		}
+		output.Instances = append(output.Instances, types.HttpInstanceSummary{
+			InstanceId: aws.String(instance),
+			Attributes: step.attributes(instance),
+		})
+	}
+
+	return output, nil
+}
+
+func (f *fakeDiscovery) ListNamespaces(ctx context.Context, params *servicediscovery.ListNamespacesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListNamespacesOutput, error) {
+	return &servicediscovery.ListNamespacesOutput{
+		Namespaces: []types.NamespaceSummary{{Id: aws.String("ns-simulated")}},
+	}, nil
+}
+
+func (f *fakeDiscovery) ListServices(ctx context.Context, params *servicediscovery.ListServicesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListServicesOutput, error) {
+	return &servicediscovery.ListServicesOutput{
+		Services: []types.ServiceSummary{{
+			Id:                      aws.String("srv-" + f.service),
+			Name:                    aws.String(f.service),
+			HealthCheckCustomConfig: &types.HealthCheckCustomConfig{},
+		}},
+	}, nil
+}
+
+func (f *fakeDiscovery) ListInstances(ctx context.Context, params *servicediscovery.ListInstancesInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.ListInstancesOutput, error) {
+	f.mu.Lock()
+	step := f.current
+	f.mu.Unlock()
+
+	page, next := fakePage(step.instances, params.NextToken, params.MaxResults)
+
+	output := &servicediscovery.ListInstancesOutput{NextToken: next}
+	for _, instance := range page {
+		output.Instances = append(output.Instances, types.InstanceSummary{
+			Id:         aws.String(instance),
+			Attributes: step.attributes(instance),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeDiscovery) GetInstancesHealthStatus(ctx context.Context, params *servicediscovery.GetInstancesHealthStatusInput, optFns ...func(*servicediscovery.Options)) (*servicediscovery.GetInstancesHealthStatusOutput, error) {
+	f.mu.Lock()
+	step := f.current
+	f.mu.Unlock()
+
+	page, next := fakePage(step.instances, params.NextToken, params.MaxResults)
+
+	output := &servicediscovery.GetInstancesHealthStatusOutput{
+		NextToken: next,
+		Status:    map[string]types.HealthStatus{},
+	}
+	for _, instance := range page {
+		output.Status[instance] = types.HealthStatusHealthy
+		if slices.Contains(step.unhealthy, instance) {
+			output.Status[instance] = types.HealthStatusUnhealthy
+		}
+	}
+	return output, nil
+}
+
+// attributes are those the instance is registered with in the step
+func (step discoveryStep) attributes(instance string) map[string]string {
+	ip, port, _ := strings.Cut(instance, ":")
+	attributes := map[string]string{
+		"AWS_INSTANCE_IPV4": ip,
+		"AWS_INSTANCE_PORT": port,
+	}
+	if weight, ok := step.weights[instance]; ok {
+		attributes[weightAttribute] = weight
+	}
+	if zone, ok := step.zones[instance]; ok {
+		attributes[zoneAttribute] = zone
+	}
+	if ipv6, ok := step.ipv6[instance]; ok {
+		attributes["AWS_INSTANCE_IPV6"] = ipv6
+	}
+	return attributes
+}
+
+// fakePage is the page of instances token points at, and the token of the
+// next, the offset into the instances standing in for a real one
+func fakePage(instances []string, token *string, maxResults *int32) ([]string, *string) {
+	start, _ := strconv.Atoi(aws.ToString(token))
+	end := min(start+int(aws.ToInt32(maxResults)), len(instances))
+
+	if end == len(instances) {
+		return instances[start:end], nil
+	}
+	return instances[start:end], aws.String(strconv.Itoa(end))
+}
+
+// fakeInstances is n instances, with every unhealthyEvery-th of them
+// unhealthy when it's above 0
+func fakeInstances(n, unhealthyEvery int) discoveryStep {
+	var step discoveryStep
+	for i := range n {
+		instance := fmt.Sprintf("10.%d.%d.%d:8080", i/65536, i/256%256, i%256)
+		step.instances = append(step.instances, instance)
+		if unhealthyEvery > 0 && i%unhealthyEvery == 0 {
+			step.unhealthy = append(step.unhealthy, instance)
+		}
+	}
+	return step
+}
+
+// healthy is the instances of the step that pass their health checks
+func (step discoveryStep) healthy() []string {
+	var healthy []string
+	for _, instance := range step.instances {
+		if !slices.Contains(step.unhealthy, instance) {
+			healthy = append(healthy, instance)
+		}
+	}
+	return healthy
+}
+
+var (
+	simulatedThrottle = &smithy.GenericAPIError{
+		Code:    "ThrottlingException",
+		Message: "Rate exceeded",
+	}
+	simulatedExpiredCredentials = &v4.SigningError{
+		Err: errors.New("failed to retrieve credentials: token expired"),
+	}
+)
+
+// simulation drives one scenario against a BackendManager backed by a
+// fakeDiscovery and collects failed expectations
+type simulation struct {
+	ctx      context.Context
+	pool     string
+	backends *BackendManager
+	failures []string
+}
+
+func newSimulation(ctx context.Context, name string, pc PoolConfig, steps []discoveryStep, logger *slog.Logger) (*simulation, error) {
+	pool := "sim-" + name
+	fake := &fakeDiscovery{service: name, steps: steps}
+
+	// Rebuilding the client after credential failures hands back the same
+	// fake, so the script carries on where it left off
+	newClient := func(ctx context.Context) (discoveryAPI, aws.CredentialsProvider, error) {
+		return fake, nil, nil
+	}
+
+	pc.Name = pool
+	pc.Prefix = "/" + pool + "/"
+	pc.Namespace = "simulated"
+	pc.Service = name
+
+	backends, err := newBackendManagerWithClient(ctx, pc, newClient, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &simulation{
+		ctx:      ctx,
+		pool:     pool,
+		backends: backends,
+	}, nil
+}
+
+// refresh runs one discovery poll, as the scheduler would
+func (s *simulation) refresh() {
+	s.backends.refreshEndpoints(s.ctx)
+}
+
+// elapse makes it as if d more has passed since instances were last
+// discovered
+func (s *simulation) elapse(d time.Duration) {
+	s.backends.mu.Lock()
+	s.backends.lastDiscovered = s.backends.lastDiscovered.Add(-d)
+	s.backends.mu.Unlock()
+}
+
+func (s *simulation) fail(format string, args ...any) {
+	s.failures = append(s.failures, fmt.Sprintf(format, args...))
+}
+
+func (s *simulation) expectEndpoints(want ...string) {
+	s.backends.mu.RLock()
+	got := slices.Clone(s.backends.endpoints)
+	s.backends.mu.RUnlock()
+
+	for i := range want {
+		want[i] = "http://" + want[i]
+	}
+
+	if !slices.Equal(got, want) {
+		s.fail("endpoints = %v, want %v", got, want)
+	}
+
+	if gauge := discoveryEndpoints.Value(s.pool); gauge != float64(len(want)) {
+		s.fail("%s = %v, want %d", "civil_gateway_discovery_endpoints", gauge, len(want))
+	}
+}
+
+func (s *simulation) expectReady(want bool) {
+	if got := s.backends.IsReady(); got != want {
+		s.fail("ready = %v, want %v", got, want)
+	}
+
+	// Requests are only turned away when there is nothing to route to
+	recorder := httptest.NewRecorder()
+	s.backends.SelectEndpoint(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+s.pool+"/0/0/0.pbf", nil))
+
+	wantStatus := http.StatusServiceUnavailable
+	if want {
+		wantStatus = http.StatusOK
+	}
+	if recorder.Code != wantStatus {
+		s.fail("request status = %d, want %d", recorder.Code, wantStatus)
+	}
+}
+
+func (s *simulation) expectErrors(reason string, want int) {
+	if got := discoveryErrors.Value(s.pool, reason); got != float64(want) {
+		s.fail("discovery errors{reason=%q} = %v, want %d", reason, got, want)
+	}
+}
+
+func (s *simulation) expectConsecutiveFailures(want int) {
+	if got := discoveryConsecutiveFailures.Value(s.pool); got != float64(want) {
+		s.fail("consecutive failures = %v, want %d", got, want)
+	}
+}
+
+func (s *simulation) expectRebuilds(want int) {
+	if got := discoveryClientRebuilds.Value(s.pool); got != float64(want) {
+		s.fail("client rebuilds = %v, want %d", got, want)
+	}
+}
+
+func (s *simulation) expectServingStale(want bool) {
+	wantGauge := 0.0
+	if want {
+		wantGauge = 1
+	}
+	if got := discoveryServingStale.Value(s.pool); got != wantGauge {
+		s.fail("serving stale = %v, want %v", got, wantGauge)
+	}
+}
+
+func (s *simulation) expectTruncated(want int) {
+	if got := discoveryTruncated.Value(s.pool); got != float64(want) {
+		s.fail("truncated discoveries = %v, want %d", got, want)
+	}
+}
+
+func (s *simulation) expectSkipped(reason string, want int) {
+	if got := discoverySkipped.Value(s.pool, reason); got != float64(want) {
+		s.fail("skipped instances{reason=%q} = %v, want %d", reason, got, want)
+	}
+}
+
+// expectShares picks an endpoint for n requests and checks how many each
+// got
+func (s *simulation) expectShares(n int, want map[string]int) {
+	got := map[string]int{}
+	for range n {
+		endpoint, err := s.backends.NextEndpoint("", nil)
+		if err != nil {
+			s.fail("picking an endpoint: %v", err)
+			return
+		}
+		got[strings.TrimPrefix(endpoint, "http://")]++
+	}
+
+	if !maps.Equal(got, want) {
+		s.fail("requests per endpoint = %v, want %v", got, want)
+	}
+}
+
+// discoveryScenario is a script of Cloud Map answers and what the gateway
+// is expected to do about them, for a pool set up like pool
+type discoveryScenario struct {
+	name  string
+	pool  PoolConfig
+	steps []discoveryStep
+	run   func(s *simulation)
+}
+
+var discoveryScenarios = []discoveryScenario{
+	{
+		// Instances come and go between polls, and the rotation follows
+		name: "flapping",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+			{instances: []string{"10.0.0.2:8080", "10.0.0.3:8080"}},
+			{instances: []string{"10.0.0.3:8080"}},
+			{instances: []string{"10.0.0.1:8080", "10.0.0.3:8080"}},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080", "10.0.0.2:8080")
+			s.refresh()
+			s.expectEndpoints("10.0.0.2:8080", "10.0.0.3:8080")
+			s.refresh()
+			s.expectEndpoints("10.0.0.3:8080")
+			s.expectReady(true)
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080", "10.0.0.3:8080")
+		},
+	},
+	{
+		// Instances get traffic in proportion to their WEIGHT attribute, and
+		// those without a valid one count as 1
+		name: "weighted-instances",
+		steps: []discoveryStep{
+			{
+				instances: []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"},
+				weights:   map[string]string{"10.0.0.1:8080": "4", "10.0.0.3:8080": "large"},
+			},
+			{
+				instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+				weights:   map[string]string{"10.0.0.2:8080": "2"},
+			},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.expectShares(600, map[string]int{"10.0.0.1:8080": 400, "10.0.0.2:8080": 100, "10.0.0.3:8080": 100})
+			s.refresh()
+			s.expectShares(300, map[string]int{"10.0.0.1:8080": 100, "10.0.0.2:8080": 200})
+		},
+	},
+	{
+		// Requests stay in the gateway's zone while it has enough endpoints,
+		// and spill over to the others once it doesn't
+		name: "zone-aware",
+		steps: []discoveryStep{
+			{
+				instances: []string{"10.0.0.1:8080", "10.0.1.1:8080", "10.0.0.2:8080"},
+				zones:     map[string]string{"10.0.0.1:8080": "us-east-1a", "10.0.0.2:8080": "us-east-1a", "10.0.1.1:8080": "us-east-1b"},
+			},
+			{
+				instances: []string{"10.0.0.1:8080", "10.0.1.1:8080"},
+				zones:     map[string]string{"10.0.0.1:8080": "us-east-1a", "10.0.1.1:8080": "us-east-1b"},
+			},
+		},
+		run: func(s *simulation) {
+			s.backends.configureDiscovery(DiscoveryConfig{
+				PageSize:         100,
+				MaxInstances:     100,
+				Zone:             "us-east-1a",
+				ZoneMinEndpoints: 2,
+			})
+			s.refresh()
+			s.expectShares(300, map[string]int{"10.0.0.1:8080": 150, "10.0.0.2:8080": 150})
+			s.refresh()
+			s.expectShares(300, map[string]int{"10.0.0.1:8080": 150, "10.0.1.1:8080": 150})
+		},
+	},
+	{
+		// An empty answer keeps the last known endpoints in rotation
+		name: "empty-response",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+			{},
+			{},
+			{instances: []string{"10.0.0.4:8080"}},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080", "10.0.0.2:8080")
+			s.expectReady(true)
+			s.expectServingStale(true)
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080", "10.0.0.2:8080")
+			s.refresh()
+			s.expectEndpoints("10.0.0.4:8080")
+			s.expectServingStale(false)
+		},
+	},
+	{
+		// Endpoints are kept through empty answers only until they are too
+		// stale
+		name: "empty-response-max-staleness",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080"}},
+			{},
+			{},
+			{instances: []string{"10.0.0.2:8080"}},
+		},
+		run: func(s *simulation) {
+			s.backends.configureDiscovery(DiscoveryConfig{
+				PageSize:          100,
+				MaxInstances:      100,
+				EmptyPolicy:       emptyDiscoveryKeepLastKnown,
+				EmptyMaxStaleness: 5 * time.Minute,
+			})
+			s.refresh()
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080")
+			s.expectServingStale(true)
+			s.elapse(6 * time.Minute)
+			s.refresh()
+			s.expectEndpoints()
+			s.expectReady(false)
+			s.expectServingStale(false)
+			s.refresh()
+			s.expectEndpoints("10.0.0.2:8080")
+		},
+	},
+	{
+		// Clearing right away stops routing to instances as soon as
+		// discovery stops finding them
+		name: "empty-response-clear",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080"}},
+			{},
+			{instances: []string{"10.0.0.2:8080"}},
+		},
+		run: func(s *simulation) {
+			s.backends.configureDiscovery(DiscoveryConfig{
+				PageSize:     100,
+				MaxInstances: 100,
+				EmptyPolicy:  emptyDiscoveryClear,
+			})
+			s.refresh()
+			s.refresh()
+			s.expectEndpoints()
+			s.expectReady(false)
+			s.expectServingStale(false)
+			s.refresh()
+			s.expectEndpoints("10.0.0.2:8080")
+			s.expectReady(true)
+		},
+	},
+	{
+		// Throttled polls serve stale endpoints and recover on the next success
+		name: "throttled",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080"}},
+			{err: simulatedThrottle},
+			{err: simulatedThrottle},
+			{instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.refresh()
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080")
+			s.expectReady(true)
+			s.expectErrors("throttled", 2)
+			s.expectConsecutiveFailures(2)
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080", "10.0.0.2:8080")
+			s.expectConsecutiveFailures(0)
+		},
+	},
+	{
+		// Expired credentials rebuild the client without dropping endpoints
+		name: "expired-credentials",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080"}},
+			{err: simulatedExpiredCredentials},
+			{err: simulatedExpiredCredentials},
+			{err: simulatedExpiredCredentials},
+			{instances: []string{"10.0.0.1:8080"}},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.refresh()
+			s.refresh()
+			s.expectRebuilds(0)
+			s.refresh()
+			s.expectRebuilds(1)
+			s.expectErrors("credentials", 3)
+			s.expectEndpoints("10.0.0.1:8080")
+			s.expectReady(true)
+			s.refresh()
+			s.expectConsecutiveFailures(0)
+		},
+	},
+	{
+		// A pool that has never discovered anything turns requests away
+		name: "cold-start-failure",
+		steps: []discoveryStep{
+			{err: simulatedThrottle},
+			{},
+			{instances: []string{"10.0.0.1:8080"}},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.expectReady(false)
+			s.expectErrors("throttled", 1)
+			s.refresh()
+			s.expectEndpoints()
+			s.expectReady(false)
+			s.refresh()
+			s.expectReady(true)
+		},
+	},
+	{
+		// Services bigger than DiscoverInstances answers for are listed a
+		// page at a time, leaving out the unhealthy instances
+		name:  "large-service",
+		steps: []discoveryStep{fakeInstances(1500, 100)},
+		run: func(s *simulation) {
+			s.backends.configureDiscovery(DiscoveryConfig{PageSize: 100, MaxInstances: 2000})
+			s.refresh()
+			s.expectEndpoints(fakeInstances(1500, 100).healthy()...)
+			s.expectTruncated(0)
+			s.expectReady(true)
+		},
+	},
+	{
+		// No more instances than the cap are taken, and reaching it is
+		// reported
+		name:  "capped-service",
+		steps: []discoveryStep{fakeInstances(300, 0)},
+		run: func(s *simulation) {
+			s.backends.configureDiscovery(DiscoveryConfig{PageSize: 100, MaxInstances: 250})
+			s.refresh()
+			s.expectEndpoints(fakeInstances(300, 0).instances[:250]...)
+			s.expectTruncated(1)
+		},
+	},
+	{
+		// Instances registered with garbage attributes are left out of the
+		// pool, counted by what is wrong with them
+		name: "malformed-instances",
+		steps: []discoveryStep{
+			{instances: []string{"10.0.0.1:8080", "web-1.internal:8080", "10.0.0.2:", "10.0.0.3:http", "10.0.0.4:70000"}},
+			{instances: []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080")
+			s.expectSkipped(skipInvalidIPv4, 1)
+			s.expectSkipped(skipMissingPort, 1)
+			s.expectSkipped(skipInvalidPort, 2)
+			s.refresh()
+			s.expectEndpoints("10.0.0.1:8080", "10.0.0.2:8080")
+			s.expectSkipped(skipMissingPort, 1)
+		},
+	},
+	{
+		// Dual-stack instances are reached over IPv6 and the rest over
+		// IPv4, and those registered without a port on the pool's
+		name: "dual-stack",
+		pool: PoolConfig{AddressFamily: addressFamilyPreferV6, Port: 9000},
+		steps: []discoveryStep{
+			{
+				instances: []string{"10.0.0.1:8080", "10.0.0.2:", "10.0.0.3:8080"},
+				ipv6:      map[string]string{"10.0.0.1:8080": "fd00::1", "10.0.0.2:": "fd00::2", "10.0.0.3:8080": "10.0.0.3"},
+			},
+		},
+		run: func(s *simulation) {
+			s.refresh()
+			s.expectEndpoints("[fd00::1]:8080", "[fd00::2]:9000")
+			s.expectSkipped(skipInvalidIPv6, 1)
+		},
+	},
+}
+
+// TestDiscoverySimulation runs every scenario. With -v the backend
+// manager logs what it does during each.
+func TestDiscoverySimulation(t *testing.T) {
+	level := slog.LevelError + 1
+	if testing.Verbose() {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	for _, scenario := range discoveryScenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			s, err := newSimulation(t.Context(), scenario.name, scenario.pool, scenario.steps, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			scenario.run(s)
+
+			for _, f := range s.failures {
+				t.Error(f)
+			}
+		})
+	}
+}
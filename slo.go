@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sloBuckets is how many minutes of requests each SLO keeps, enough for
+	// its longest burn rate window
+	sloBuckets = 360
+	// sloMinRequests is how many requests the short window needs before a
+	// burn rate can trip degradation, so a handful of errors at night
+	// doesn't
+	sloMinRequests = 20
+)
+
+// sloWindows are the windows burn rates are computed over. Degradation
+// trips when the long and short windows both burn too fast, which catches a
+// fast burn within minutes without flapping on a brief spike.
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{
+	{"5m", 5},
+	{"1h", 60},
+	{"6h", 360},
+}
+
+var (
+	sloRequests = NewCounter(
+		"civil_gateway_slo_requests_total",
+		"Requests counted against each SLO, by whether they met it",
+		"slo", "result",
+	)
+	sloBurnRate = NewGauge(
+		"civil_gateway_slo_burn_rate",
+		"How fast each SLO's error budget is being spent, 1 spending it exactly over the SLO period",
+		"slo", "window",
+	)
+	sloDegraded = NewGauge(
+		"civil_gateway_slo_degraded",
+		"1 while an SLO burning too fast has the gateway serving stale cache",
+	)
+)
+
+// SLOConfig is one service level objective. Objective is the share of the
+// requests under Prefix that must succeed, in under Latency if it is set,
+// like 0.999 of /tiles/ under 300ms. With Degrade set, the SLO burning its
+// budget too fast trips degradation mode.
+type SLOConfig struct {
+	Name      string  `json:"name"`
+	Prefix    string  `json:"prefix"`
+	Objective float64 `json:"objective"`
+	Latency   string  `json:"latency"`
+	Degrade   bool    `json:"degrade"`
+}
+
+// LatencyThreshold is the SLO's parsed Latency, 0 when unset
+func (c SLOConfig) LatencyThreshold() time.Duration {
+	latency, _ := time.ParseDuration(c.Latency)
+	return latency
+}
+
+// sloBucket counts a minute of requests
+type sloBucket struct {
+	minute int64
+	good   int64
+	bad    int64
+}
+
+// slo is one objective and the last sloBuckets minutes of requests
+type slo struct {
+	config  SLOConfig
+	latency time.Duration
+
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket
+}
+
+func (s *slo) record(now time.Time, good bool) {
+	minute := now.Unix() / 60
+
+	s.mu.Lock()
+	bucket := &s.buckets[minute%sloBuckets]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	if good {
+		bucket.good++
+	} else {
+		bucket.bad++
+	}
+	s.mu.Unlock()
+}
+
+// burnRate is the share of requests that failed the SLO over the last
+// minutes, divided by the share it allows to fail, along with how many
+// requests that was
+func (s *slo) burnRate(now time.Time, minutes int) (float64, int64) {
+	current := now.Unix() / 60
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var good, bad int64
+	for _, bucket := range s.buckets {
+		if bucket.minute > current-int64(minutes) && bucket.minute <= current {
+			good += bucket.good
+			bad += bucket.bad
+		}
+	}
+
+	total := good + bad
+	if total == 0 || s.config.Objective >= 1 {
+		return 0, total
+	}
+	return float64(bad) / float64(total) / (1 - s.config.Objective), total
+}
+
+// SLOTracker measures requests against the configured SLOs and exposes how
+// fast each spends its error budget. When an SLO that degrades burns faster
+// than the threshold over both the hour and the last five minutes, the
+// gateway goes into degradation mode, serving stale cached tiles rather than
+// adding to the load of backends already failing their objectives, until
+// the burn slows.
+type SLOTracker struct {
+	slos      []*slo
+	threshold float64
+	logger    *slog.Logger
+
+	degraded atomic.Bool
+}
+
+// NewSLOTracker tracks configs, degrading at a burn rate of threshold
+func NewSLOTracker(configs []SLOConfig, threshold float64, logger *slog.Logger) *SLOTracker {
+	t := &SLOTracker{
+		threshold: threshold,
+		logger:    logger,
+	}
+
+	for _, config := range configs {
+		t.slos = append(t.slos, &slo{
+			config:  config,
+			latency: config.LatencyThreshold(),
+		})
+	}
+	return t
+}
+
+// Middleware counts each request against the SLOs of its path
+func (t *SLOTracker) Middleware(next http.Handler) http.Handler {
+	if len(t.slos) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		elapsed := time.Since(start)
+
+		for _, s := range t.slos {
+			if !strings.HasPrefix(r.URL.Path, s.config.Prefix) {
+				continue
+			}
+
+			good := recorder.status < http.StatusInternalServerError && (s.latency == 0 || elapsed <= s.latency)
+			s.record(start, good)
+			if good {
+				sloRequests.Inc(s.config.Name, "good")
+			} else {
+				sloRequests.Inc(s.config.Name, "bad")
+			}
+		}
+	})
+}
+
+// Degraded reports whether the gateway is in degradation mode
+func (t *SLOTracker) Degraded() bool {
+	return t.degraded.Load()
+}
+
+// Evaluate updates the burn rates and trips or clears degradation mode. Run
+// as a scheduled job.
+func (t *SLOTracker) Evaluate(ctx context.Context) error {
+	now := time.Now()
+
+	var burning []string
+	for _, s := range t.slos {
+		rates := map[string]float64{}
+		var recent int64
+		for _, window := range sloWindows {
+			rate, total := s.burnRate(now, window.minutes)
+			rates[window.name] = rate
+			if window.name == "5m" {
+				recent = total
+			}
+			sloBurnRate.Set(rate, s.config.Name, window.name)
+		}
+
+		if s.config.Degrade && recent >= sloMinRequests && rates["5m"] > t.threshold && rates["1h"] > t.threshold {
+			burning = append(burning, s.config.Name)
+		}
+	}
+
+	degraded := len(burning) > 0
+	if t.degraded.Swap(degraded) == degraded {
+		return nil
+	}
+
+	if degraded {
+		sloDegraded.Set(1)
+		t.logger.Error("SLO error budget burning too fast, serving stale cache",
+			slog.Any("slos", burning),
+			slog.Float64("threshold", t.threshold),
+		)
+	} else {
+		sloDegraded.Set(0)
+		t.logger.Info("SLO burn rates back under threshold, leaving degradation mode")
+	}
+	return nil
+}
+
+// SLOStatus is one SLO's burn rates, for /admin/slos
+type SLOStatus struct {
+	Name      string             `json:"name"`
+	Prefix    string             `json:"prefix"`
+	Objective float64            `json:"objective"`
+	Latency   string             `json:"latency,omitempty"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+}
+
+// StatusHandler serves the SLOs and their burn rates as JSON
+func (t *SLOTracker) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		statuses := []SLOStatus{}
+		for _, s := range t.slos {
+			status := SLOStatus{
+				Name:      s.config.Name,
+				Prefix:    s.config.Prefix,
+				Objective: s.config.Objective,
+				Latency:   s.config.Latency,
+				BurnRates: map[string]float64{},
+			}
+			for _, window := range sloWindows {
+				status.BurnRates[window.name], _ = s.burnRate(now, window.minutes)
+			}
+			statuses = append(statuses, status)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"degraded": t.Degraded(),
+			"slos":     statuses,
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// StaticRouteConfig is a response the gateway answers itself, such as
+// robots.txt or a capabilities document. The body is either inline or read
+// from a file at startup.
+type StaticRouteConfig struct {
+	Path         string `json:"path"`
+	Status       int    `json:"status"`
+	ContentType  string `json:"content_type"`
+	Body         string `json:"body"`
+	File         string `json:"file"`
+	CacheControl string `json:"cache_control"`
+}
+
+// NewStaticRoute builds the handler for one static route
+func NewStaticRoute(rc StaticRouteConfig) (http.Handler, error) {
+	body := []byte(rc.Body)
+
+	if rc.File != "" {
+		var err error
+		body, err = os.ReadFile(rc.File)
+		if err != nil {
+			return nil, fmt.Errorf("static route %s: %w", rc.Path, err)
+		}
+	}
+
+	status := rc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	contentType := rc.ContentType
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rc.CacheControl != "" {
+			w.Header().Set("Cache-Control", rc.CacheControl)
+		}
+
+		// Bodyless statuses like 204 get no entity headers
+		if len(body) == 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+
+		if status == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+	}), nil
+}
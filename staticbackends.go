@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// staticDiscoverer serves a fixed list of backends, for running the gateway
+// locally without AWS credentials or Cloud Map. Health probes and outlier
+// ejection still take failing backends out of rotation.
+type staticDiscoverer struct {
+	instances []DiscoveredInstance
+}
+
+func newStaticDiscoverer(pc PoolConfig) *staticDiscoverer {
+	instances := make([]DiscoveredInstance, 0, len(pc.Backends))
+	for _, backend := range pc.Backends {
+		instances = append(instances, DiscoveredInstance{Address: backend})
+	}
+	return &staticDiscoverer{instances: instances}
+}
+
+func (d *staticDiscoverer) Discover(ctx context.Context, limits discoveryLimits) ([]DiscoveredInstance, error) {
+	return d.instances, nil
+}
+
+// parseStaticBackends reads a comma-separated list of backend URLs, like
+// http://localhost:8081,http://localhost:8082, into their host:port
+// addresses. The scheme may be left out.
+func parseStaticBackends(value string) ([]string, error) {
+	var backends []string
+	for raw := range strings.SplitSeq(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		backend, err := parseStaticBackend(raw)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// parseStaticBackend checks one backend is a plain http host and port, the
+// only kind of backend the pool proxy talks to
+func parseStaticBackend(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid backend %q: %w", raw, err)
+	}
+	if u.Scheme != "http" {
+		return "", fmt.Errorf("invalid backend %q: backends are reached over http", raw)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("invalid backend %q: only a host and port may be given", raw)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid backend %q: a host is required", raw)
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+	return u.Host, nil
+}
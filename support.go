@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces secrets in the config of support bundles
+const redacted = "REDACTED"
+
+// supportLogLines is how many of the most recent log lines support bundles
+// include
+const supportLogLines = 1000
+
+// secretConfigKeys are the parts of config key names that mark a secret,
+// compared case-insensitively
+var secretConfigKeys = []string{"secret", "token", "password", "privatekey", "externalid", "tlskey"}
+
+// logRing keeps the most recent log lines written through it, for support
+// bundles. Loggers write it alongside stdout.
+type logRing struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([][]byte, max(size, 1))}
+}
+
+// Write keeps p as one line. slog handlers write one record per call.
+func (l *logRing) Write(p []byte) (int, error) {
+	line := bytes.Clone(p)
+
+	l.mu.Lock()
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+
+	return len(p), nil
+}
+
+// contents are the lines kept, oldest first
+func (l *logRing) contents() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b bytes.Buffer
+	if l.full {
+		for _, line := range l.lines[l.next:] {
+			b.Write(line)
+		}
+	}
+	for _, line := range l.lines[:l.next] {
+		b.Write(line)
+	}
+	return b.Bytes()
+}
+
+// SupportBundle collects the gateway's state into one archive for bug
+// reports: its config with secrets redacted, recent logs, metrics, the
+// state of every pool's backends, readiness, and a goroutine dump.
+type SupportBundle struct {
+	config    *Config
+	logs      *logRing
+	readiness *Readiness
+	logger    *slog.Logger
+
+	mu    sync.Mutex
+	pools map[string]*BackendManager
+}
+
+func NewSupportBundle(config *Config, logs *logRing, readiness *Readiness, logger *slog.Logger) *SupportBundle {
+	return &SupportBundle{
+		config:    config,
+		logs:      logs,
+		readiness: readiness,
+		logger:    logger,
+		pools:     map[string]*BackendManager{},
+	}
+}
+
+// AddPool includes the state of the pool's backends in bundles
+func (b *SupportBundle) AddPool(name string, backends *BackendManager) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pools[name] = backends
+}
+
+// Handler serves a bundle as a gzipped tarball. Everything is collected
+// before anything is written, so the files describe the same moment.
+func (b *SupportBundle) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		files, err := b.collect()
+		if err != nil {
+			b.logger.Error("failed to collect support bundle", slog.Any("error", err))
+			http.Error(w, "Internal Server Error: failed to collect support bundle", http.StatusInternalServerError)
+			return
+		}
+
+		name := "civil-gateway-support-" + now.UTC().Format("20060102T150405Z")
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+		w.WriteHeader(http.StatusOK)
+
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for _, file := range files {
+			tw.WriteHeader(&tar.Header{
+				Name:    name + "/" + file.name,
+				Mode:    0o644,
+				Size:    int64(len(file.data)),
+				ModTime: now,
+			})
+			tw.Write(file.data)
+		}
+		tw.Close()
+		gz.Close()
+
+		b.logger.Info("served support bundle", slog.String("bundle", name))
+	}
+}
+
+type supportFile struct {
+	name string
+	data []byte
+}
+
+func (b *SupportBundle) collect() ([]supportFile, error) {
+	config, err := redactedConfig(b.config)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	backends := map[string]BackendState{}
+	for name, pool := range b.pools {
+		backends[name] = pool.State()
+	}
+	b.mu.Unlock()
+
+	ready, failures := b.readiness.Evaluate()
+
+	var goroutines bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+
+	return []supportFile{
+		{"config.json", config},
+		{"logs.jsonl", b.logs.contents()},
+		{"metrics.txt", []byte(renderMetrics())},
+		{"backends.json", indentJSON(backends)},
+		{"readiness.json", indentJSON(map[string]any{"ready": ready, "failures": failures})},
+		{"goroutines.txt", goroutines.Bytes()},
+	}, nil
+}
+
+// redactedConfig is config as JSON with every secret replaced, along with
+// the passwords of URLs
+func redactedConfig(config *Config) ([]byte, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	var tree any
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	return indentJSON(redact("", tree)), nil
+}
+
+func redact(key string, value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = redact(k, child)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = redact(key, child)
+		}
+		return v
+	case string:
+		if v == "" {
+			return v
+		}
+		lower := strings.ToLower(key)
+		if slices.ContainsFunc(secretConfigKeys, func(secret string) bool { return strings.Contains(lower, secret) }) {
+			return redacted
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func indentJSON(v any) []byte {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Appendf(nil, "failed to encode: %v\n", err)
+	}
+	return append(data, '\n')
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// tileJSONURLFields are the TileJSON fields holding URL templates
+var tileJSONURLFields = []string{"tiles", "grids", "data"}
+
+// tileJSONRewriter points the URLs in a TileJSON document, which the
+// backend writes with its own internal address, at publicURL, the gateway's
+// configured public address. The client's Host is never used: the document
+// is cached and served to every client. Other JSON passes through
+// unchanged.
+func tileJSONRewriter(publicURL *url.URL) TransformerFunc {
+	return func(r *http.Request, header http.Header, body io.Reader) (io.Reader, error) {
+		return rewriteTileJSON(publicURL, body)
+	}
+}
+
+func rewriteTileJSON(publicURL *url.URL, body io.Reader) (io.Reader, error) {
+	data, err := readTransformBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil || doc["tilejson"] == nil {
+		return bytes.NewReader(data), nil
+	}
+
+	basePath := strings.TrimSuffix(publicURL.Path, "/")
+
+	for _, field := range tileJSONURLFields {
+		urls, ok := doc[field].([]any)
+		if !ok {
+			continue
+		}
+
+		for i, value := range urls {
+			raw, ok := value.(string)
+			if !ok {
+				continue
+			}
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" {
+				continue
+			}
+
+			u.Scheme = publicURL.Scheme
+			u.Host = publicURL.Host
+			u.Path = basePath + u.Path
+			u.RawPath = ""
+			// Keep the {z}/{x}/{y} placeholders readable
+			rewritten, err := url.PathUnescape(u.String())
+			if err != nil {
+				rewritten = u.String()
+			}
+			urls[i] = rewritten
+		}
+	}
+
+	rewritten, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(rewritten), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+const secretsManagerARNPrefix = "arn:aws:secretsmanager:"
+
+var (
+	tlsCertificateReloads = NewCounter(
+		"civil_gateway_tls_certificate_reloads_total",
+		"Reloads of the TLS certificate, by result",
+		"result",
+	)
+	tlsCertificateExpiry = NewGauge(
+		"civil_gateway_tls_certificate_expiry_timestamp_seconds",
+		"When the TLS certificate being served expires, as a Unix time",
+	)
+)
+
+// CertificateStore holds the certificate the TLS listener serves, reloaded
+// from its source so a rotated certificate is picked up without a restart.
+// The certificate and key are each a PEM file path or the ARN of a Secrets
+// Manager secret holding the PEM.
+type CertificateStore struct {
+	certSource string
+	keySource  string
+	secrets    *secretsmanager.Client
+	logger     *slog.Logger
+
+	current atomic.Pointer[tls.Certificate]
+}
+
+// NewCertificateStore loads the certificate, failing if it can't be, since
+// there is nothing to serve TLS with otherwise
+func NewCertificateStore(ctx context.Context, certSource, keySource string, logger *slog.Logger) (*CertificateStore, error) {
+	store := &CertificateStore{
+		certSource: certSource,
+		keySource:  keySource,
+		logger:     logger,
+	}
+
+	if strings.HasPrefix(certSource, secretsManagerARNPrefix) || strings.HasPrefix(keySource, secretsManagerARNPrefix) {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		store.secrets = secretsmanager.NewFromConfig(cfg)
+	}
+
+	if err := store.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the certificate again and serves it from then on. A failed
+// reload keeps the certificate already loaded. Run as a scheduled job.
+func (s *CertificateStore) Reload(ctx context.Context) error {
+	certPEM, err := s.read(ctx, s.certSource)
+	if err != nil {
+		tlsCertificateReloads.Inc("error")
+		return fmt.Errorf("failed to read TLS certificate: %w", err)
+	}
+	keyPEM, err := s.read(ctx, s.keySource)
+	if err != nil {
+		tlsCertificateReloads.Inc("error")
+		return fmt.Errorf("failed to read TLS key: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		tlsCertificateReloads.Inc("error")
+		return fmt.Errorf("invalid TLS certificate: %w", err)
+	}
+
+	previous := s.current.Load()
+	if previous != nil && bytes.Equal(previous.Certificate[0], cert.Certificate[0]) {
+		tlsCertificateReloads.Inc("unchanged")
+		return nil
+	}
+
+	s.current.Store(&cert)
+	tlsCertificateReloads.Inc("ok")
+	tlsCertificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+
+	s.logger.Info("loaded TLS certificate",
+		slog.String("subject", cert.Leaf.Subject.String()),
+		slog.Any("dns_names", cert.Leaf.DNSNames),
+		slog.Time("not_after", cert.Leaf.NotAfter),
+		slog.Bool("rotated", previous != nil),
+	)
+	return nil
+}
+
+func (s *CertificateStore) read(ctx context.Context, source string) ([]byte, error) {
+	return readSecretSource(ctx, s.secrets, source)
+}
+
+// readSecretSource reads a file, or the Secrets Manager secret source is the
+// ARN of with secrets
+func readSecretSource(ctx context.Context, secrets *secretsmanager.Client, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, secretsManagerARNPrefix) {
+		return os.ReadFile(source)
+	}
+
+	out, err := secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(source),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.SecretString != nil {
+		return []byte(*out.SecretString), nil
+	}
+	return out.SecretBinary, nil
+}
+
+// GetCertificate serves the current certificate, for tls.Config
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load(), nil
+}
+
+// NewTLSConfig serves the store's certificate, recording the JA3 hash of
+// each handshake for fingerprinting
+func NewTLSConfig(store *CertificateStore, ja3 *JA3Recorder) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     store.GetCertificate,
+		GetConfigForClient: ja3.GetConfigForClient,
+	}
+}
+
+// HTTPSRedirectHandler sends every request to the same URL over HTTPS on
+// tlsPort
+func HTTPSRedirectHandler(tlsPort uint16) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(tlsPort)))
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/civil-labs/civil-gateway"
+
+// tracer starts the gateway's own spans. Until tracing is set up it is the
+// no-op tracer, so spans cost next to nothing when tracing is off.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// tracingEnabled reports whether the standard OTEL_* variables ask for traces
+// to be exported, which takes an OTLP endpoint
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	if strings.EqualFold(os.Getenv("OTEL_TRACES_EXPORTER"), "none") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing exports spans over OTLP when an endpoint is configured, and
+// flushes them when stage stops. Everything about the export, like the
+// endpoint, headers, protocol and sampler, comes from the standard OTEL_*
+// variables, so the gateway is configured like any other service.
+func setupTracing(ctx context.Context, stage *Stage, logger *slog.Logger) error {
+	// The W3C trace context is passed on to backends whether or not the
+	// gateway exports spans itself, so traces started by clients carry on
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !tracingEnabled() {
+		return nil
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol == "" {
+		protocol = "http/protobuf"
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch protocol {
+	case "http/protobuf":
+		exporter, err = otlptracehttp.New(ctx)
+	case "grpc":
+		exporter, err = otlptracegrpc.New(ctx)
+	default:
+		return fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the name
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName("civil-gateway")),
+		resource.Default(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to describe the tracing resource: %w", err)
+	}
+
+	// The sampler is read from OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	stage.Go("tracing", func(ctx context.Context) error {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return provider.Shutdown(shutdownCtx)
+	})
+
+	logger.Info("exporting traces over OTLP", slog.String("protocol", protocol))
+	return nil
+}
+
+// TracingMiddleware starts a server span for every inbound request,
+// continuing the trace of the client if it sent a traceparent
+func TracingMiddleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "civil-gateway",
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// tracingTransport makes every attempt at a backend a client span, and
+// passes the trace context on to the backend in traceparent
+func tracingTransport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next,
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return "upstream " + r.Method
+		}),
+	)
+}
+
+// traceID is the ID of the trace ctx is part of, to find it from the logs,
+// or empty if it isn't part of one
+func traceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// endSpan records err on span, if there was one, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxTransformBytes is the largest body a transformer is given. Bigger
+// responses pass through untouched.
+const maxTransformBytes = 16 << 20
+
+var responseTransforms = NewCounter(
+	"civil_gateway_response_transforms_total",
+	"Upstream responses rewritten by a transformer, by transformer and result",
+	"transformer", "result",
+)
+
+// ResponseTransformer rewrites upstream response bodies. It is given the
+// request sent upstream, the response header, which it may change, such as
+// to set a new Content-Type, and the decoded body, and returns the new body.
+type ResponseTransformer interface {
+	Transform(r *http.Request, header http.Header, body io.Reader) (io.Reader, error)
+}
+
+// TransformerFunc adapts a function to a ResponseTransformer
+type TransformerFunc func(r *http.Request, header http.Header, body io.Reader) (io.Reader, error)
+
+func (f TransformerFunc) Transform(r *http.Request, header http.Header, body io.Reader) (io.Reader, error) {
+	return f(r, header, body)
+}
+
+// registeredTransformer is a transformer and the content types it rewrites.
+// A content type ending in /* covers the whole type.
+type registeredTransformer struct {
+	name         string
+	contentTypes []string
+	transformer  ResponseTransformer
+}
+
+func (t registeredTransformer) handles(contentType string) bool {
+	kind, _, _ := strings.Cut(contentType, "/")
+	return slices.Contains(t.contentTypes, contentType) || slices.Contains(t.contentTypes, kind+"/*")
+}
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]registeredTransformer{}
+)
+
+// RegisterTransformer makes a transformer available to routes under name,
+// for responses of the given content types. Routes pick theirs in order
+// through the transforms of their PoolConfig.
+func RegisterTransformer(name string, contentTypes []string, transformer ResponseTransformer) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+
+	transformers[name] = registeredTransformer{
+		name:         name,
+		contentTypes: contentTypes,
+		transformer:  transformer,
+	}
+}
+
+// transformChain is the transformers of one route, applied in order
+type transformChain []registeredTransformer
+
+// newTransformChain looks up the named transformers
+func newTransformChain(names []string) (transformChain, error) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+
+	var chain transformChain
+	for _, name := range names {
+		t, ok := transformers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown response transformer %q", name)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// apply runs each transformer handling the response's content type over its
+// body. Gzipped bodies are decompressed first and sent on uncompressed. As
+// the new body's length isn't known, Content-Length is dropped, and so is
+// ETag, which named the old body.
+func (chain transformChain) apply(resp *http.Response) error {
+	if len(chain) == 0 || resp.StatusCode != http.StatusOK || resp.ContentLength > maxTransformBytes {
+		return nil
+	}
+
+	contentType := mediaType(resp.Header.Get("Content-Type"))
+	if !slices.ContainsFunc(chain, func(t registeredTransformer) bool { return t.handles(contentType) }) {
+		return nil
+	}
+
+	var body io.Reader = resp.Body
+	encoding := resp.Header.Get("Content-Encoding")
+	switch {
+	case strings.EqualFold(encoding, "gzip"):
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to decompress response to transform: %w", err)
+		}
+		body = zr
+	case encoding != "":
+		// Nothing to decode it with
+		return nil
+	}
+
+	original := resp.Body
+	changed := false
+
+	for _, t := range chain {
+		contentType := mediaType(resp.Header.Get("Content-Type"))
+		if !t.handles(contentType) {
+			continue
+		}
+
+		transformed, err := t.transformer.Transform(resp.Request, resp.Header, body)
+		if err != nil {
+			responseTransforms.Inc(t.name, "failed")
+			return fmt.Errorf("transformer %s: %w", t.name, err)
+		}
+		responseTransforms.Inc(t.name, "ok")
+
+		body = transformed
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, original}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("ETag")
+	resp.ContentLength = -1
+
+	return nil
+}
+
+// readTransformBody reads a body for transformers that need all of it
+func readTransformBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxTransformBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTransformBytes {
+		return nil, fmt.Errorf("body over %d bytes", maxTransformBytes)
+	}
+	return data, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The protocols backends can be spoken to in. They are reached over plain
+// HTTP, so HTTP/2 is h2c with prior knowledge: the backend must accept it
+// without an upgrade.
+const (
+	upstreamProtocolHTTP1 = "http1"
+	upstreamProtocolH2C   = "h2c"
+)
+
+var (
+	upstreamConnections = NewCounter(
+		"civil_gateway_upstream_connections_total",
+		"Connections requests to backends were sent on, by pool and whether the connection was reused or new",
+		"pool", "result",
+	)
+	upstreamOpenConnections = NewGauge(
+		"civil_gateway_upstream_open_connections",
+		"Connections to backends open now, by pool",
+		"pool",
+	)
+	upstreamDialErrors = NewCounter(
+		"civil_gateway_upstream_dial_errors_total",
+		"Connections to backends that failed to open, by pool",
+		"pool",
+	)
+)
+
+// TransportConfig is how connections to a pool's backends are opened and
+// kept. Keeping enough idle connections per backend is what spares them a
+// new connection for every tile under load: Go keeps only 2 by default.
+// MaxConnsPerHost caps the connections to each backend, 0 for no cap.
+// KeepAlive is the interval of TCP keep-alives, and of HTTP/2 pings on
+// connections that have gone quiet. With AllowedCIDRs, connections are only
+// opened to addresses inside them, checked against the address actually
+// dialled, so a hostname resolving elsewhere after discovery checked it is
+// still refused. Backends are then dialled directly, never through a proxy
+// from the environment.
+type TransportConfig struct {
+	Protocol            string
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration
+	AllowedCIDRs        []netip.Prefix
+}
+
+// forPool is the config with the protocol and connection limits pc
+// overrides
+func (c TransportConfig) forPool(pc PoolConfig) TransportConfig {
+	if pc.Protocol != "" {
+		c.Protocol = pc.Protocol
+	}
+	if pc.MaxIdleConnsPerHost > 0 {
+		c.MaxIdleConnsPerHost = pc.MaxIdleConnsPerHost
+	}
+	if pc.MaxConnsPerHost > 0 {
+		c.MaxConnsPerHost = pc.MaxConnsPerHost
+	}
+	return c
+}
+
+// NewUpstreamTransport opens the connections to the backends of pool, each
+// pool with its own, and counts how often they are reused
+func NewUpstreamTransport(pool string, config TransportConfig) *UpstreamTransport {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if len(config.AllowedCIDRs) > 0 {
+		dialer.Control = allowedDialControl(config.AllowedCIDRs)
+		proxy = nil
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           countingDialer(pool, dialer.DialContext),
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	// Only h2c is allowed, or plain HTTP URLs would be sent as HTTP/1
+	if config.Protocol == upstreamProtocolH2C {
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = &protocols
+		transport.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: config.KeepAlive,
+		}
+	}
+
+	return &UpstreamTransport{next: transport, pool: pool}
+}
+
+// allowedDialControl refuses connections to addresses outside allowed,
+// once they are resolved and just before they are dialled
+func allowedDialControl(allowed []netip.Prefix) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return err
+		}
+		addr := addrPort.Addr().Unmap()
+		if !slices.ContainsFunc(allowed, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return fmt.Errorf("%s is outside the allowed CIDRs", addr)
+		}
+		return nil
+	}
+}
+
+// countingDialer keeps count of the connections dial opens for pool, and of
+// those it fails to
+func countingDialer(pool string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			upstreamDialErrors.Inc(pool)
+			return nil, err
+		}
+		upstreamOpenConnections.Inc(pool)
+		return &countedConn{Conn: conn, pool: pool}, nil
+	}
+}
+
+// countedConn takes itself off the open connections when it is closed
+type countedConn struct {
+	net.Conn
+	pool string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { upstreamOpenConnections.Dec(c.pool) })
+	return c.Conn.Close()
+}
+
+// UpstreamTransport sends requests to a pool's backends, counting whether
+// each went out on a connection kept from an earlier one
+type UpstreamTransport struct {
+	next *http.Transport
+	pool string
+}
+
+func (t *UpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstreamConnections.Inc(t.pool, "reused")
+			} else {
+				upstreamConnections.Inc(t.pool, "new")
+			}
+		},
+	}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// CloseIdleConnections closes the connections not carrying a request
+func (t *UpstreamTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// What a route sends backends in place of the client's credentials. See
+// UpstreamAuth
+const (
+	upstreamAuthPass     = "pass"
+	upstreamAuthStrip    = "strip"
+	upstreamAuthInternal = "internal"
+)
+
+var internalTokensSigned = NewCounter(
+	"civil_gateway_internal_tokens_signed_total",
+	"Internal JWTs signed for upstream requests, by result",
+	"result",
+)
+
+// UpstreamAuth is what backends get of the client's credentials: the
+// Authorization and X-API-Key headers passed through as sent, stripped, or
+// replaced by a short-lived internal JWT the gateway signs for the caller,
+// so a compromised backend holds nothing it can replay against other
+// services for long
+type UpstreamAuth struct {
+	Mode   string
+	Signer *InternalTokenSigner
+
+	// Who internal JWTs are for, the pool's name
+	Audience string
+}
+
+// apply sets the request's upstream credentials by the mode
+func (a UpstreamAuth) apply(req *http.Request) {
+	if a.Mode == "" || a.Mode == upstreamAuthPass {
+		return
+	}
+
+	req.Header.Del("Authorization")
+	req.Header.Del("X-API-Key")
+
+	if a.Mode != upstreamAuthInternal || a.Signer == nil {
+		return
+	}
+	claims, ok := req.Context().Value(userContextKey).(Claims)
+	if !ok {
+		return
+	}
+
+	token, err := a.Signer.Sign(claims, a.Audience)
+	if err != nil {
+		internalTokensSigned.Inc("error")
+		return
+	}
+	internalTokensSigned.Inc("ok")
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// InternalTokenSigner signs the internal JWTs backends get in place of the
+// client's token, with a key the backends verify against the JWKS the
+// gateway serves
+type InternalTokenSigner struct {
+	issuer string
+	ttl    time.Duration
+	signer jose.Signer
+	public jose.JSONWebKeySet
+}
+
+// internalTokenClaims are the claims of an internal JWT: the caller's
+// identity, for the backend it is sent to
+type internalTokenClaims struct {
+	jwt.Claims
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     bool     `json:"email_verified,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// NewInternalTokenSigner loads the signing key, an EC P-256 or RSA private
+// key in PEM, from a file or a Secrets Manager ARN. Tokens are issued by
+// issuer and expire after ttl.
+func NewInternalTokenSigner(ctx context.Context, keySource, issuer string, ttl time.Duration) (*InternalTokenSigner, error) {
+	var secrets *secretsmanager.Client
+	if strings.HasPrefix(keySource, secretsManagerARNPrefix) {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		secrets = secretsmanager.NewFromConfig(cfg)
+	}
+
+	keyPEM, err := readSecretSource(ctx, secrets, keySource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read internal JWT key: %w", err)
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid internal JWT key: %w", err)
+	}
+
+	var algorithm jose.SignatureAlgorithm
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		if key.Curve.Params().Name != "P-256" {
+			return nil, fmt.Errorf("invalid internal JWT key: EC keys must be on P-256")
+		}
+		algorithm = jose.ES256
+	case *rsa.PrivateKey:
+		algorithm = jose.RS256
+	default:
+		return nil, fmt.Errorf("invalid internal JWT key: expected an EC or RSA key, got %T", key)
+	}
+
+	public := jose.JSONWebKey{Key: key.Public(), Algorithm: string(algorithm), Use: "sig"}
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	public.KeyID = fmt.Sprintf("%x", thumbprint[:8])
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: algorithm, Key: jose.JSONWebKey{Key: key, KeyID: public.KeyID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InternalTokenSigner{
+		issuer: issuer,
+		ttl:    ttl,
+		signer: signer,
+		public: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{public}},
+	}, nil
+}
+
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("expected a PKCS #8, SEC 1, or PKCS #1 private key")
+}
+
+// Sign issues an internal JWT for the caller, for the backends of audience
+func (s *InternalTokenSigner) Sign(claims Claims, audience string) (string, error) {
+	now := time.Now()
+	return jwt.Signed(s.signer).Claims(internalTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    s.issuer,
+			Subject:   claims.Subject,
+			Audience:  jwt.Audience{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now.Add(-5 * time.Second)),
+			Expiry:    jwt.NewNumericDate(now.Add(s.ttl)),
+		},
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Groups:            claims.Groups,
+	}).Serialize()
+}
+
+// JWKSHandler serves the public key backends verify internal JWTs with
+func (s *InternalTokenSigner) JWKSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(s.public)
+	}
+}
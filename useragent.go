@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// How a route passes the client's User-Agent upstream. See UpstreamIdentity
+const (
+	clientUserAgentForward  = "forward"
+	clientUserAgentPreserve = "preserve"
+	clientUserAgentStrip    = "strip"
+)
+
+// UpstreamIdentity is how the gateway identifies itself on the requests it
+// proxies, so backends can tell its traffic apart in their logs. UserAgent
+// replaces the client's User-Agent, which ClientUserAgent either forwards in
+// X-Forwarded-User-Agent (the default), preserves as the User-Agent, or
+// strips. Via is added to the Via header.
+type UpstreamIdentity struct {
+	UserAgent       string
+	Via             string
+	ClientUserAgent string
+}
+
+// newUpstreamIdentity fills {version} and {instance} into the configured
+// User-Agent and Via, for a route passing the client's User-Agent as
+// clientUserAgent says
+func newUpstreamIdentity(userAgent, via, instance, clientUserAgent string) UpstreamIdentity {
+	expand := strings.NewReplacer("{version}", version, "{instance}", instance)
+	return UpstreamIdentity{
+		UserAgent:       expand.Replace(userAgent),
+		Via:             expand.Replace(via),
+		ClientUserAgent: clientUserAgent,
+	}
+}
+
+// apply identifies the gateway on an outgoing request
+func (id UpstreamIdentity) apply(req *http.Request) {
+	if id.Via != "" {
+		if via := req.Header.Get("Via"); via != "" {
+			req.Header.Set("Via", via+", "+id.Via)
+		} else {
+			req.Header.Set("Via", id.Via)
+		}
+	}
+
+	switch id.ClientUserAgent {
+	case clientUserAgentPreserve:
+		return
+	case clientUserAgentStrip:
+		req.Header.Del("X-Forwarded-User-Agent")
+	default:
+		if client := req.Header.Get("User-Agent"); client != "" {
+			req.Header.Set("X-Forwarded-User-Agent", client)
+		}
+	}
+
+	// An empty User-Agent keeps the proxy from sending Go's own
+	req.Header.Set("User-Agent", id.UserAgent)
+}
+
+// probeUserAgent identifies the gateway's own health and capability probes
+func probeUserAgent() string {
+	return "civil-gateway-probe/" + version
+}
+
+// detectInstanceID names this gateway instance: CIVIL_INSTANCE_ID if set,
+// or else the hostname, which is the task's on ECS
+func detectInstanceID() string {
+	if id := os.Getenv("CIVIL_INSTANCE_ID"); id != "" {
+		return id
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return fmt.Sprintf("pid-%d", os.Getpid())
+}
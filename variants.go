@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxVariantChoices bounds how many distinct Accept headers have their
+// variant choice remembered. Client fleets send only a handful, so when the
+// map fills it is simply cleared.
+const maxVariantChoices = 1024
+
+// variantSeparator joins a cache key to the content type of one of its
+// variants. Keys are never split on it: a decoded path can hold one.
+const variantSeparator = "#"
+
+// acceptRange is one media range of an Accept header, like image/* or
+// image/webp;q=0.9
+type acceptRange struct {
+	mediaType string
+	subtype   string
+	q         float64
+}
+
+// parseAccept parses an Accept header, skipping malformed ranges. A missing
+// header accepts anything.
+func parseAccept(header string) []acceptRange {
+	if strings.TrimSpace(header) == "" {
+		return []acceptRange{{mediaType: "*", subtype: "*", q: 1}}
+	}
+
+	var ranges []acceptRange
+	for part := range strings.SplitSeq(header, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaType, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(mediaRange)), "/")
+		if !ok || mediaType == "" || subtype == "" || (mediaType == "*" && subtype != "*") {
+			continue
+		}
+
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType: mediaType, subtype: subtype, q: q})
+	}
+
+	return ranges
+}
+
+// quality is the q-value the ranges give contentType, taken from the most
+// specific range matching it, along with that range's specificity: 2 for an
+// exact match, 1 for type/*, and 0 for */*
+func quality(ranges []acceptRange, contentType string) (q float64, specificity int) {
+	mediaType, subtype, _ := strings.Cut(contentType, "/")
+
+	specificity = -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediaType == mediaType && r.subtype == subtype:
+			s = 2
+		case r.mediaType == mediaType && r.subtype == "*":
+			s = 1
+		case r.mediaType == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+
+	return q, specificity
+}
+
+// variantSelector picks which cached variant of a tile to serve for an
+// Accept header. It learns the content types backends negotiate between
+// from responses that vary on Accept, and remembers the choice made for
+// each Accept header, since the same few headers arrive over and over.
+type variantSelector struct {
+	mu      sync.Mutex
+	types   []string
+	choices map[string]string
+}
+
+// observe records a content type a backend served varying on Accept
+func (s *variantSelector) observe(contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Contains(s.types, contentType) {
+		return
+	}
+
+	s.types = append(s.types, contentType)
+	// A new type may beat earlier choices
+	clear(s.choices)
+}
+
+// choose picks the content type the Accept header ranks highest among those
+// seen. Ties go to the more specific match, then to the type seen first.
+// Reports false when the header accepts none of them.
+func (s *variantSelector) choose(accept string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.types) == 0 {
+		return "", false
+	}
+
+	if choice, ok := s.choices[accept]; ok {
+		return choice, choice != ""
+	}
+
+	type candidate struct {
+		contentType string
+		q           float64
+		specificity int
+	}
+
+	ranges := parseAccept(accept)
+	var candidates []candidate
+	for _, contentType := range s.types {
+		if q, specificity := quality(ranges, contentType); q > 0 {
+			candidates = append(candidates, candidate{contentType, q, specificity})
+		}
+	}
+	// Stable, so ties keep the order the types were seen in
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(b.q, a.q), cmp.Compare(b.specificity, a.specificity))
+	})
+
+	choice := ""
+	if len(candidates) > 0 {
+		choice = candidates[0].contentType
+	}
+
+	if s.choices == nil || len(s.choices) >= maxVariantChoices {
+		s.choices = map[string]string{}
+	}
+	s.choices[accept] = choice
+
+	return choice, choice != ""
+}
+
+// variesOnAccept reports whether a response's Vary header names Accept
+func variesOnAccept(h http.Header) bool {
+	for _, value := range h.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheableVary lists the request headers a stored response may vary on:
+// Accept picks the variant, entries are gunzipped for clients that don't
+// take gzip, and the CORS headers are set per request
+var cacheableVary = []string{"accept", "accept-encoding", "origin"}
+
+// variesOnlyCacheably reports whether a response's Vary header names no
+// request header but those in cacheableVary. A response varying on anything
+// else, like the caller's identity, can't be served to every caller.
+func variesOnlyCacheably(h http.Header) bool {
+	for _, value := range h.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(cacheableVary, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mediaType is the content type without parameters, lowercased
+func mediaType(contentType string) string {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return parsed
+}
+
+// variantKey is the cache key of the variant of key with contentType
+func variantKey(key, contentType string) string {
+	return key + variantSeparator + contentType
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/fips140"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the release the binary was built from, set when building with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+var buildInfo = NewGauge(
+	"civil_gateway_build_info",
+	"Always 1, labelled with the release, platform, and crypto mode of the running gateway",
+	"version", "platform", "crypto",
+)
+
+// VersionInfo describes the running binary, for /version
+type VersionInfo struct {
+	Version   string     `json:"version"`
+	Revision  string     `json:"revision,omitempty"`
+	GoVersion string     `json:"go_version"`
+	Platform  string     `json:"platform"`
+	Crypto    CryptoInfo `json:"crypto"`
+}
+
+// CryptoInfo is the crypto stack TLS and token verification run on. Mode is
+// standard, fips140 when the FIPS 140-3 Go Cryptographic Module is in FIPS
+// mode, or fips140-only when non-approved algorithms are refused outright.
+// Builds with GOFIPS140 set run in FIPS mode by default, and any build can
+// be switched to it with GODEBUG=fips140=on or only.
+type CryptoInfo struct {
+	Mode   string `json:"mode"`
+	Module string `json:"module,omitempty"`
+}
+
+// cryptoInfo reports the crypto mode the process started in
+func cryptoInfo() CryptoInfo {
+	if !fips140.Enabled() {
+		return CryptoInfo{Mode: "standard"}
+	}
+
+	mode := "fips140"
+	if fips140.Enforced() {
+		mode = "fips140-only"
+	}
+	return CryptoInfo{Mode: mode, Module: fips140.Version()}
+}
+
+func currentVersion() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Crypto:    cryptoInfo(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Revision = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// recordBuildInfo exports the version as the build info metric
+func recordBuildInfo() {
+	info := currentVersion()
+	buildInfo.Set(1, info.Version, info.Platform, info.Crypto.Mode)
+}
+
+// VersionHandler serves the release, platform, and crypto mode as JSON
+func VersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(currentVersion())
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// wafClientIdle is how long a client's rate limiter is kept after its last
+// request before it is pruned
+const wafClientIdle = 10 * time.Minute
+
+var wafRuleMatches = NewCounter(
+	"civil_gateway_waf_rule_matches_total",
+	"Requests matched by each WAF rule",
+	"rule", "action",
+)
+
+// WAF is a small rule engine for deployments without an ALB/WAF in front.
+// Rules are evaluated in order before auth. The first allow or block rule
+// that matches decides the request, while count rules only record the match
+// and let evaluation carry on. Requests no rule decides are allowed.
+type WAF struct {
+	rules  []*wafRule
+	logger *slog.Logger
+}
+
+type wafRule struct {
+	name        string
+	action      string
+	path        *regexp.Regexp
+	header      string
+	headerMatch *regexp.Regexp
+	prefixes    []netip.Prefix
+	rate        *clientRateLimiter
+	rateKey     string
+}
+
+func NewWAF(rules []WAFRuleConfig, logger *slog.Logger) (*WAF, error) {
+	waf := &WAF{
+		logger: logger,
+	}
+
+	for _, rc := range rules {
+		rule := &wafRule{
+			name:    rc.Name,
+			action:  rc.Action,
+			header:  http.CanonicalHeaderKey(rc.Header),
+			rateKey: rc.RateKey,
+		}
+
+		if rc.Path != "" {
+			path, err := regexp.Compile(rc.Path)
+			if err != nil {
+				return nil, fmt.Errorf("waf rule %s: invalid path pattern: %w", rc.Name, err)
+			}
+			rule.path = path
+		}
+
+		if rc.HeaderMatch != "" {
+			headerMatch, err := regexp.Compile(rc.HeaderMatch)
+			if err != nil {
+				return nil, fmt.Errorf("waf rule %s: invalid header_match pattern: %w", rc.Name, err)
+			}
+			rule.headerMatch = headerMatch
+		}
+
+		for _, cidr := range rc.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("waf rule %s: invalid cidr: %w", rc.Name, err)
+			}
+			rule.prefixes = append(rule.prefixes, prefix.Masked())
+		}
+
+		if rc.RateLimit > 0 {
+			burst := rc.RateBurst
+			if burst <= 0 {
+				burst = max(1, int(rc.RateLimit))
+			}
+			rule.rate = newClientRateLimiter(rate.Limit(rc.RateLimit), burst)
+		}
+
+		waf.rules = append(waf.rules, rule)
+	}
+
+	return waf, nil
+}
+
+// matches reports whether every condition set on the rule holds. The rate
+// condition goes last so only requests in the rule's scope use up tokens.
+func (rule *wafRule) matches(r *http.Request, addr netip.Addr) bool {
+	if !rule.inScope(r, addr) {
+		return false
+	}
+
+	// A rate rule only matches once the client has gone over its limit
+	if rule.rate != nil && !rule.rate.exceeded(rule.rateClient(r, addr)) {
+		return false
+	}
+
+	return true
+}
+
+// inScope checks every condition but the rate limit
+func (rule *wafRule) inScope(r *http.Request, addr netip.Addr) bool {
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+
+	if rule.header != "" {
+		values := r.Header.Values(rule.header)
+		if len(values) == 0 {
+			return false
+		}
+
+		if rule.headerMatch != nil {
+			matched := false
+			for _, v := range values {
+				if rule.headerMatch.MatchString(v) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+
+	if len(rule.prefixes) > 0 {
+		inRange := false
+		for _, prefix := range rule.prefixes {
+			if prefix.Contains(addr) {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rateClient is the key a rate rule counts requests under: the client
+// address, or its fingerprint so clients rotating IPs share one budget
+func (rule *wafRule) rateClient(r *http.Request, addr netip.Addr) string {
+	if rule.rateKey == "fingerprint" {
+		if fp, ok := fingerprintFromContext(r.Context()); ok {
+			return fp.ID
+		}
+	}
+
+	return addr.String()
+}
+
+// Middleware applies the rules to every request before it reaches next
+func (waf *WAF) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientAddr(r)
+
+		for _, rule := range waf.rules {
+			if !rule.matches(r, addr) {
+				continue
+			}
+
+			wafRuleMatches.Inc(rule.name, rule.action)
+
+			switch rule.action {
+			case "allow":
+				next.ServeHTTP(w, r)
+				return
+			case "block":
+				waf.logger.Warn("request blocked by waf rule",
+					slog.String("rule", rule.name),
+					slog.String("path", r.URL.Path),
+					slog.String("client", addr.String()),
+					fingerprintAttr(r.Context()),
+				)
+				writeError(w, r, http.StatusForbidden, "request_blocked", "")
+				return
+			default:
+				waf.logger.Debug("request matched waf count rule",
+					slog.String("rule", rule.name),
+					slog.String("path", r.URL.Path),
+					slog.String("client", addr.String()),
+				)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Explain lists the rules that would apply to r, without using up any rate
+// limit. Rate rules are listed when the request is in their scope.
+func (waf *WAF) Explain(r *http.Request) []string {
+	addr := clientAddr(r)
+
+	var matched []string
+	for _, rule := range waf.rules {
+		if !rule.inScope(r, addr) {
+			continue
+		}
+
+		entry := "waf:" + rule.name + " (" + rule.action + ")"
+		if rule.rate != nil {
+			entry += " when over rate limit"
+		}
+		matched = append(matched, entry)
+
+		if rule.rate == nil && rule.action != "count" {
+			break
+		}
+	}
+
+	return matched
+}
+
+// SetMemoryPool accounts for the rate rules' buckets in pool
+func (waf *WAF) SetMemoryPool(pool *MemoryPool) {
+	for _, rule := range waf.rules {
+		if rule.rate != nil {
+			rule.rate.memory = pool
+		}
+	}
+}
+
+// Prune drops the rate limiters of clients that have gone quiet. Run as a
+// scheduled job so the per-client state doesn't grow without bound.
+func (waf *WAF) Prune(ctx context.Context) error {
+	for _, rule := range waf.rules {
+		if rule.rate != nil {
+			rule.rate.prune(wafClientIdle)
+		}
+	}
+	return nil
+}
+
+// clientBucketBytes is roughly what a client's bucket costs besides its key
+const clientBucketBytes = 160
+
+// clientRateLimiter is a token bucket per client key
+type clientRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+
+	// When the pool is full, the client seen longest ago makes room
+	memory *MemoryPool
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+
+	// What the bucket is accounted for in the memory pool
+	size int64
+}
+
+func newClientRateLimiter(limit rate.Limit, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:   limit,
+		burst:   burst,
+		clients: map[string]*clientLimiter{},
+	}
+}
+
+// rates are the limit and burst of every key
+func (c *clientRateLimiter) rates() (rate.Limit, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.limit, c.burst
+}
+
+// setRates changes the limit and burst of every key, keeping the tokens
+// each has left
+func (c *clientRateLimiter) setRates(limit rate.Limit, burst int) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit, c.burst = limit, burst
+	for _, client := range c.clients {
+		client.limiter.SetLimitAt(now, limit)
+		client.limiter.SetBurstAt(now, burst)
+	}
+}
+
+func (c *clientRateLimiter) exceeded(key string) bool {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.client(key, now).limiter.AllowN(now, 1)
+}
+
+// delay takes a token for key, or else reports how long until one is free
+// without taking it
+func (c *clientRateLimiter) delay(key string) time.Duration {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reservation := c.client(key, now).limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// client is the limiter of key, created on first use. Called with mu held.
+func (c *clientRateLimiter) client(key string, now time.Time) *clientLimiter {
+	client, ok := c.clients[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(c.limit, c.burst)}
+
+		// The client is limited either way, but only accounted for once
+		// there is room
+		size := clientBucketBytes + int64(len(key))
+		for {
+			if c.memory.Reserve(size) {
+				client.size = size
+				break
+			}
+			if !c.forgetOldest() {
+				break
+			}
+		}
+
+		c.clients[key] = client
+	}
+	client.lastSeen = now
+	return client
+}
+
+// forgetOldest drops the client seen longest ago, reporting false if there
+// are none. Called with mu held.
+func (c *clientRateLimiter) forgetOldest() bool {
+	var oldestKey string
+	var oldest *clientLimiter
+	for key, client := range c.clients {
+		if oldest == nil || client.lastSeen.Before(oldest.lastSeen) {
+			oldestKey, oldest = key, client
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+
+	c.forget(oldestKey)
+	return true
+}
+
+// forget drops key's limiter. Called with mu held.
+func (c *clientRateLimiter) forget(key string) {
+	c.memory.Release(c.clients[key].size)
+	delete(c.clients, key)
+}
+
+func (c *clientRateLimiter) prune(idle time.Duration) {
+	cutoff := time.Now().Add(-idle)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, client := range c.clients {
+		if client.lastSeen.Before(cutoff) {
+			c.forget(key)
+		}
+	}
+}
+
+// trustedProxies holds the proxies in front of the gateway, set at startup
+// by SetTrustedProxies
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For clientAddr
+// believes
+func SetTrustedProxies(prefixes []netip.Prefix) {
+	trustedProxies.Store(&prefixes)
+}
+
+// isTrustedProxy reports whether addr is one of the proxies in front of the
+// gateway, which are never blocked nor rate limited as a client
+func isTrustedProxy(addr netip.Addr) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	return slices.ContainsFunc(*prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// clientAddr is the address of the client, with IPv4-mapped IPv6 addresses
+// unmapped so they match IPv4 ranges. Behind trusted proxies it is the
+// right-most X-Forwarded-For address that isn't one of them: the entries
+// left of it were written by the client and can't be believed.
+func clientAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RemoteAddr was somehow just an IP without a port
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// What the proxy was sent is garbled, so it's the proxy that is
+			// known to have sent the request
+			break
+		}
+		addr = hop.Unmap()
+	}
+
+	return addr
+}
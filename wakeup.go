@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// wakeUpRefreshInterval is how often discovery is re-run while waiting for a
+// woken pool to register capacity, instead of waiting for the normal poll
+const wakeUpRefreshInterval = 2 * time.Second
+
+// WakeUpAction asks the platform to bring a scaled-to-zero pool back up
+type WakeUpAction interface {
+	WakeUp(ctx context.Context) error
+}
+
+// ecsWakeUp raises the desired count of the ECS service backing the pool
+type ecsWakeUp struct {
+	client       *ecs.Client
+	cluster      string
+	service      string
+	desiredCount int32
+}
+
+func (a *ecsWakeUp) WakeUp(ctx context.Context) error {
+	_, err := a.client.UpdateService(ctx, &ecs.UpdateServiceInput{
+		Cluster:      aws.String(a.cluster),
+		Service:      aws.String(a.service),
+		DesiredCount: aws.Int32(a.desiredCount),
+	})
+	return err
+}
+
+// snsWakeUp publishes a message for whatever automation owns the pool's capacity
+type snsWakeUp struct {
+	client   *sns.Client
+	topicArn string
+	pool     string
+}
+
+func (a *snsWakeUp) WakeUp(ctx context.Context) error {
+	_, err := a.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(a.topicArn),
+		Subject:  aws.String("civil-gateway wake-up"),
+		Message:  aws.String(fmt.Sprintf(`{"pool":%q,"reason":"request received while pool has no healthy backends"}`, a.pool)),
+	})
+	return err
+}
+
+// NewWakeUpAction builds the configured wake-up action. Returns nil when no
+// action is configured.
+func NewWakeUpAction(ctx context.Context, cfg *Config, pool string) (WakeUpAction, error) {
+	if cfg.WakeUpAction == "" {
+		return nil, nil
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %v", err)
+	}
+
+	switch cfg.WakeUpAction {
+	case "ecs":
+		return &ecsWakeUp{
+			client:       ecs.NewFromConfig(awsCfg),
+			cluster:      cfg.WakeUpECSCluster,
+			service:      cfg.WakeUpECSService,
+			desiredCount: cfg.WakeUpECSDesiredCount,
+		}, nil
+	case "sns":
+		return &snsWakeUp{
+			client:   sns.NewFromConfig(awsCfg),
+			topicArn: cfg.WakeUpSNSTopicArn,
+			pool:     pool,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown wake-up action %q", cfg.WakeUpAction)
+	}
+}
+
+// WakeUpGate parks requests that arrive while the pool is empty, triggers the
+// wake-up action, and lets them through once capacity appears
+type WakeUpGate struct {
+	stage      *Stage
+	pool       *BackendManager
+	action     WakeUpAction
+	wait       time.Duration
+	cooldown   time.Duration
+	retryAfter time.Duration
+	logger     *slog.Logger
+
+	mu            sync.Mutex
+	lastTriggered time.Time
+}
+
+func NewWakeUpGate(stage *Stage, pool *BackendManager, action WakeUpAction, wait, cooldown, retryAfter time.Duration, logger *slog.Logger) *WakeUpGate {
+	return &WakeUpGate{
+		stage:      stage,
+		pool:       pool,
+		action:     action,
+		wait:       wait,
+		cooldown:   cooldown,
+		retryAfter: retryAfter,
+		logger:     logger,
+	}
+}
+
+// Middleware holds requests for up to the configured wait while the pool
+// wakes up, and answers 503 with Retry-After if it doesn't come up in time
+func (g *WakeUpGate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Dry runs from the admin echo route must not scale anything up
+		if g.pool.IsReady() || isDryRun(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		g.trigger()
+
+		ctx, cancel := context.WithTimeout(r.Context(), g.wait)
+		defer cancel()
+
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				g.logger.Debug("pool did not wake up in time", slog.Duration("waited", g.wait))
+
+				w.Header().Set("Retry-After", strconv.Itoa(int(g.retryAfter.Seconds())))
+				writeError(w, r, http.StatusServiceUnavailable, "backends_starting", "")
+				return
+			case <-ticker.C:
+				if g.pool.IsReady() {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+	})
+}
+
+// trigger fires the wake-up action at most once per cooldown and re-runs
+// discovery frequently until the pool reports capacity
+func (g *WakeUpGate) trigger() {
+	g.mu.Lock()
+	if time.Since(g.lastTriggered) < g.cooldown {
+		g.mu.Unlock()
+		return
+	}
+	g.lastTriggered = time.Now()
+	g.mu.Unlock()
+
+	g.logger.Info("pool has no healthy backends, triggering wake-up")
+
+	// Detached from the request so a disconnecting client doesn't abort the wake-up
+	g.stage.Go("wakeup:"+g.pool.pool, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, g.cooldown)
+		defer cancel()
+
+		if err := g.action.WakeUp(ctx); err != nil {
+			g.logger.Error("wake-up action failed", slog.Any("error", err))
+			return nil
+		}
+
+		ticker := time.NewTicker(wakeUpRefreshInterval)
+		defer ticker.Stop()
+
+		for !g.pool.IsReady() {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				g.pool.refreshEndpoints(ctx)
+			}
+		}
+
+		g.logger.Info("pool woke up", slog.Int("backends", g.pool.EndpointCount()))
+		return nil
+	})
+}
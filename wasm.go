@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"gocloud.dev/blob"
+	"golang.org/x/time/rate"
+)
+
+// The ABI between the gateway and WASM filter modules. A module exports its
+// memory, civil_alloc(size) returning a buffer of size bytes, and either or
+// both of the filters, which are given the JSON of a wasmRequest or
+// wasmResponse in a buffer from civil_alloc. A filter returns 0 to let the
+// request through or an HTTP status to answer it with instead. The buffer is
+// handed back through civil_free(ptr, size) after the filter returns; a
+// module that doesn't export it gets a fresh instance for every call. While
+// a filter runs, it can change the headers of the request or response
+// through the set_header and del_header functions of the "civil" host
+// module, and log through log. WASI is available, without a filesystem or
+// environment.
+const (
+	wasmAllocExport      = "civil_alloc"
+	wasmFreeExport       = "civil_free"
+	wasmOnRequestExport  = "civil_on_request"
+	wasmOnResponseExport = "civil_on_response"
+	wasmHostModule       = "civil"
+)
+
+// A module logs at most wasmLogRate messages a second, in bursts of up to
+// wasmLogBurst, and each is cut to wasmLogMaxBytes. The rest are dropped.
+const (
+	wasmLogRate     = 10
+	wasmLogBurst    = 20
+	wasmLogMaxBytes = 1024
+)
+
+var (
+	wasmCalls = NewCounter(
+		"civil_gateway_wasm_calls_total",
+		"Calls into WASM filter modules, by module, filter, and result",
+		"module", "filter", "result",
+	)
+	wasmCallDuration = NewHistogram(
+		"civil_gateway_wasm_call_seconds",
+		"How long calls into WASM filter modules take, by module and filter",
+		DefaultLatencyBuckets,
+		"module", "filter",
+	)
+	wasmInstances = NewGauge(
+		"civil_gateway_wasm_instances",
+		"Instances of each WASM filter module, idle or running",
+		"module",
+	)
+	wasmLogsDropped = NewCounter(
+		"civil_gateway_wasm_logs_dropped_total",
+		"Messages WASM filter modules logged over their rate limit, by module",
+		"module",
+	)
+)
+
+// WASMModuleConfig is a filter module to load from a path or an object URL
+// such as s3://bucket/filters/geoblock.wasm. With FailOpen, requests are let
+// through when the module fails or runs out of time instead of getting a
+// 500.
+type WASMModuleConfig struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	FailOpen bool   `json:"fail_open,omitempty"`
+}
+
+// WASMLimits bound what each module can use. Every instance gets up to
+// MemoryMB of memory and Timeout per call, and at most MaxInstances run at
+// once, with further requests waiting for one to free up.
+type WASMLimits struct {
+	MemoryMB     int
+	Timeout      time.Duration
+	MaxInstances int
+}
+
+// wasmRequest is what civil_on_request is given
+type wasmRequest struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query"`
+	Headers http.Header `json:"headers"`
+}
+
+// wasmResponse is what civil_on_response is given
+type wasmResponse struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+}
+
+// WASMModule runs a filter module compiled to WASM, so teams can extend the
+// gateway without recompiling it. Instances are pooled, and each call has an
+// instance to itself.
+type WASMModule struct {
+	config   WASMModuleConfig
+	limits   WASMLimits
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	logger   *slog.Logger
+	logRate  *rate.Limiter
+
+	slots chan struct{}
+	idle  chan api.Module
+}
+
+// wasmCall is the headers the running filter can change
+type wasmCall struct {
+	header http.Header
+}
+
+type wasmCallKey struct{}
+
+// LoadWASMModule fetches and compiles the module. Its runtime is closed when
+// stage stops.
+func LoadWASMModule(ctx context.Context, stage *Stage, config WASMModuleConfig, limits WASMLimits, logger *slog.Logger) (*WASMModule, error) {
+	code, err := readWASMModule(ctx, config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("wasm module %s: %w", config.Name, err)
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(limits.MemoryMB)*16). // 64KiB pages
+		WithCloseOnContextDone(true))
+
+	m := &WASMModule{
+		config:  config,
+		limits:  limits,
+		runtime: runtime,
+		logger:  logger.With(slog.String("wasm_module", config.Name)),
+		logRate: rate.NewLimiter(wasmLogRate, wasmLogBurst),
+		slots:   make(chan struct{}, limits.MaxInstances),
+		idle:    make(chan api.Module, limits.MaxInstances),
+	}
+
+	if err := m.compile(ctx, code); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm module %s: %w", config.Name, err)
+	}
+
+	stage.Go("wasm:"+config.Name, func(ctx context.Context) error {
+		<-ctx.Done()
+		return runtime.Close(context.Background())
+	})
+
+	return m, nil
+}
+
+func readWASMModule(ctx context.Context, uri string) ([]byte, error) {
+	bucketURL, key, err := splitBlobURL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open module bucket: %w", err)
+	}
+	defer bucket.Close()
+
+	code, err := bucket.ReadAll(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read module: %w", err)
+	}
+	return code, nil
+}
+
+func (m *WASMModule) compile(ctx context.Context, code []byte) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, m.runtime); err != nil {
+		return fmt.Errorf("failed to provide WASI: %w", err)
+	}
+
+	_, err := m.runtime.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().WithFunc(m.hostSetHeader).Export("set_header").
+		NewFunctionBuilder().WithFunc(m.hostDelHeader).Export("del_header").
+		NewFunctionBuilder().WithFunc(m.hostLog).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to provide host functions: %w", err)
+	}
+
+	compiled, err := m.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return fmt.Errorf("failed to compile: %w", err)
+	}
+
+	exports := compiled.ExportedFunctions()
+	if _, ok := exports[wasmAllocExport]; !ok {
+		return fmt.Errorf("module doesn't export %s", wasmAllocExport)
+	}
+	_, onRequest := exports[wasmOnRequestExport]
+	_, onResponse := exports[wasmOnResponseExport]
+	if !onRequest && !onResponse {
+		return fmt.Errorf("module exports neither %s nor %s", wasmOnRequestExport, wasmOnResponseExport)
+	}
+
+	m.compiled = compiled
+	return nil
+}
+
+// Plugin is the module as a plugin named wasm:Name, with a hook for each
+// filter it exports
+func (m *WASMModule) Plugin() Plugin {
+	plugin := Plugin{Name: "wasm:" + m.config.Name}
+
+	exports := m.compiled.ExportedFunctions()
+	if _, ok := exports[wasmOnRequestExport]; ok {
+		plugin.OnRequest = func(r *http.Request) error {
+			input := wasmRequest{
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				Query:   r.URL.RawQuery,
+				Headers: r.Header,
+			}
+			return m.filter(r.Context(), wasmOnRequestExport, "request", input, r.Header)
+		}
+	}
+	if _, ok := exports[wasmOnResponseExport]; ok {
+		plugin.OnResponse = func(resp *http.Response) error {
+			input := wasmResponse{
+				Status:  resp.StatusCode,
+				Headers: resp.Header,
+			}
+			ctx := context.Background()
+			if resp.Request != nil {
+				ctx = resp.Request.Context()
+				input.Method = resp.Request.Method
+				input.Path = resp.Request.URL.Path
+			}
+			return m.filter(ctx, wasmOnResponseExport, "response", input, resp.Header)
+		}
+	}
+
+	return plugin
+}
+
+// filter calls the export with the JSON of input, letting it change header.
+// Returns a *PluginReject when the module answers the request itself.
+func (m *WASMModule) filter(ctx context.Context, export, filter string, input any, header http.Header) error {
+	start := time.Now()
+	status, err := m.call(ctx, export, input, header)
+	wasmCallDuration.Observe(time.Since(start).Seconds(), m.config.Name, filter)
+
+	switch {
+	case err != nil:
+		result := "error"
+		if errors.Is(err, context.DeadlineExceeded) {
+			result = "timeout"
+		}
+		wasmCalls.Inc(m.config.Name, filter, result)
+		m.logger.Warn("wasm filter failed", slog.String("filter", filter), slog.Any("error", err))
+
+		if m.config.FailOpen {
+			return nil
+		}
+		return err
+	case status == 0:
+		wasmCalls.Inc(m.config.Name, filter, "continue")
+		return nil
+	case status >= 100 && status <= 599:
+		wasmCalls.Inc(m.config.Name, filter, "reject")
+		return &PluginReject{Status: int(status), Message: http.StatusText(int(status))}
+	default:
+		wasmCalls.Inc(m.config.Name, filter, "error")
+		if m.config.FailOpen {
+			return nil
+		}
+		return fmt.Errorf("wasm module %s returned %d", m.config.Name, status)
+	}
+}
+
+func (m *WASMModule) call(ctx context.Context, export string, input any, header http.Header) (uint32, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return 0, err
+	}
+
+	instance, err := m.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.release(instance)
+
+	ctx, cancel := context.WithTimeout(ctx, m.limits.Timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, wasmCallKey{}, &wasmCall{header: header})
+
+	results, err := instance.ExportedFunction(wasmAllocExport).Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", wasmAllocExport, wasmCallError(ctx, err))
+	}
+	ptr := uint32(results[0])
+
+	// An instance whose buffer wasn't freed would grow with every call until
+	// it hit the memory limit, so it isn't reused
+	freed := false
+	defer func() {
+		if !freed {
+			instance.Close(context.Background())
+		}
+	}()
+
+	if !instance.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("%s returned a buffer outside memory", wasmAllocExport)
+	}
+
+	results, err = instance.ExportedFunction(export).Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", export, wasmCallError(ctx, err))
+	}
+	status := uint32(results[0])
+
+	if free := instance.ExportedFunction(wasmFreeExport); free != nil {
+		if _, err := free.Call(ctx, uint64(ptr), uint64(len(data))); err != nil {
+			return 0, fmt.Errorf("%s: %w", wasmFreeExport, wasmCallError(ctx, err))
+		}
+		freed = true
+	}
+	return status, nil
+}
+
+// wasmCallError reports a call stopped by its timeout as such, rather than
+// as the module having exited
+func wasmCallError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// acquire waits for a free slot and returns an idle instance, or a new one
+func (m *WASMModule) acquire(ctx context.Context) (api.Module, error) {
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case instance := <-m.idle:
+		return instance, nil
+	default:
+	}
+
+	config := wazero.NewModuleConfig().
+		WithName(""). // Unnamed, so any number can be instantiated
+		WithStartFunctions("_initialize").
+		WithStdout(io.Discard).
+		WithStderr(io.Discard).
+		WithSysWalltime().
+		WithSysNanotime()
+
+	instance, err := m.runtime.InstantiateModule(context.Background(), m.compiled, config)
+	if err != nil {
+		<-m.slots
+		return nil, fmt.Errorf("failed to instantiate: %w", err)
+	}
+	wasmInstances.Add(1, m.config.Name)
+
+	return instance, nil
+}
+
+// release returns the instance to the pool, unless a timeout or trap closed
+// it
+func (m *WASMModule) release(instance api.Module) {
+	defer func() { <-m.slots }()
+
+	if instance.IsClosed() {
+		wasmInstances.Add(-1, m.config.Name)
+		return
+	}
+
+	select {
+	case m.idle <- instance:
+	default:
+		instance.Close(context.Background())
+		wasmInstances.Add(-1, m.config.Name)
+	}
+}
+
+func (m *WASMModule) hostSetHeader(ctx context.Context, mod api.Module, namePtr, nameLen, valuePtr, valueLen uint32) {
+	call, ok := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if !ok {
+		return
+	}
+	name, ok := mod.Memory().Read(namePtr, nameLen)
+	if !ok {
+		return
+	}
+	value, ok := mod.Memory().Read(valuePtr, valueLen)
+	if !ok {
+		return
+	}
+	call.header.Set(string(name), string(value))
+}
+
+func (m *WASMModule) hostDelHeader(ctx context.Context, mod api.Module, namePtr, nameLen uint32) {
+	call, ok := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if !ok {
+		return
+	}
+	name, ok := mod.Memory().Read(namePtr, nameLen)
+	if !ok {
+		return
+	}
+	call.header.Del(string(name))
+}
+
+func (m *WASMModule) hostLog(ctx context.Context, mod api.Module, ptr, length uint32) {
+	if !m.logRate.Allow() {
+		wasmLogsDropped.Inc(m.config.Name)
+		return
+	}
+	message, ok := mod.Memory().Read(ptr, min(length, wasmLogMaxBytes))
+	if !ok {
+		return
+	}
+	m.logger.Info(string(message))
+}
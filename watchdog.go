@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// watchdogLogInterval is how often at most a stage going over its budget
+// is logged. Every time is counted.
+const watchdogLogInterval = 10 * time.Second
+
+// defaultMiddlewareBudgets are how long each middleware stage is expected
+// to take on its own, without the handlers it passes the request on to
+var defaultMiddlewareBudgets = map[string]time.Duration{
+	"auth":      50 * time.Millisecond,
+	"ratelimit": 20 * time.Millisecond,
+	"cache":     20 * time.Millisecond,
+	"waf":       5 * time.Millisecond,
+	"blocklist": time.Millisecond,
+}
+
+var (
+	middlewareDuration = NewHistogram(
+		"civil_gateway_middleware_duration_seconds",
+		"Time spent in each middleware stage, without the handlers it passes the request on to",
+		[]float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1},
+		"stage",
+	)
+	middlewareOverBudget = NewCounter(
+		"civil_gateway_middleware_over_budget_total",
+		"Requests a middleware stage took longer than its budget on",
+		"stage",
+	)
+)
+
+// stageContextKey holds the stageSpan of a stage's current request
+type stageContextKey string
+
+// stageSpan is when a stage passed the request on and got it back
+type stageSpan struct {
+	nextStart time.Time
+	nextEnd   time.Time
+}
+
+// stageWatch is the budget and the log throttling of one stage
+type stageWatch struct {
+	budget time.Duration
+
+	mu         sync.Mutex
+	lastLogged time.Time
+	unlogged   int
+}
+
+// MiddlewareWatchdog times each middleware stage apart from the rest of
+// the chain and logs the stages that go over their budget, so a slow
+// middleware shows up by name instead of as slower requests overall
+type MiddlewareWatchdog struct {
+	budgets map[string]time.Duration
+	logger  *slog.Logger
+}
+
+// NewMiddlewareWatchdog watches stages against budgets, on top of the
+// defaults. A budget of 0 only times the stage.
+func NewMiddlewareWatchdog(budgets map[string]time.Duration, logger *slog.Logger) *MiddlewareWatchdog {
+	merged := map[string]time.Duration{}
+	for stage, budget := range defaultMiddlewareBudgets {
+		merged[stage] = budget
+	}
+	for stage, budget := range budgets {
+		merged[stage] = budget
+	}
+	return &MiddlewareWatchdog{budgets: merged, logger: logger}
+}
+
+// Stage times middleware as the stage name. The time the rest of the chain
+// takes, from when the middleware passes the request on, isn't counted.
+func (m *MiddlewareWatchdog) Stage(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	watch := &stageWatch{budget: m.budgets[name]}
+	key := stageContextKey(name)
+
+	return func(next http.Handler) http.Handler {
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span, ok := r.Context().Value(key).(*stageSpan)
+			if ok {
+				span.nextStart = time.Now()
+				defer func() { span.nextEnd = time.Now() }()
+			}
+			next.ServeHTTP(w, r)
+		})
+		wrapped := middleware(inner)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := &stageSpan{}
+			start := time.Now()
+			wrapped.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key, span)))
+
+			took := time.Since(start)
+			if !span.nextStart.IsZero() {
+				took -= span.nextEnd.Sub(span.nextStart)
+			}
+			middlewareDuration.Observe(took.Seconds(), name)
+
+			if watch.budget > 0 && took > watch.budget {
+				middlewareOverBudget.Inc(name)
+				m.report(r, name, watch, took)
+			}
+		})
+	}
+}
+
+// report logs a stage going over budget, with how much of the request's
+// deadline was left, unless it was logged within watchdogLogInterval
+func (m *MiddlewareWatchdog) report(r *http.Request, name string, watch *stageWatch, took time.Duration) {
+	now := time.Now()
+
+	watch.mu.Lock()
+	if now.Sub(watch.lastLogged) < watchdogLogInterval {
+		watch.unlogged++
+		watch.mu.Unlock()
+		return
+	}
+	unlogged := watch.unlogged
+	watch.lastLogged = now
+	watch.unlogged = 0
+	watch.mu.Unlock()
+
+	attrs := []any{
+		slog.String("stage", name),
+		slog.Duration("took", took),
+		slog.Duration("budget", watch.budget),
+		slog.String("path", r.URL.Path),
+		slog.Int("since_last_logged", unlogged),
+	}
+	if deadline, ok := r.Context().Deadline(); ok {
+		attrs = append(attrs, slog.Duration("deadline_remaining", time.Until(deadline)))
+	}
+	if err := r.Context().Err(); err != nil {
+		attrs = append(attrs, slog.Any("context_error", err))
+	}
+	m.logger.Warn("middleware stage over budget", attrs...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+)
+
+// watermarkMargin is the gap in pixels between the mark and the tile's edges
+const watermarkMargin = 4
+
+// Watermark stamps an image onto the bottom-right corner of PNG and JPEG
+// tiles
+type Watermark struct {
+	mark image.Image
+}
+
+// NewWatermark loads the mark from a PNG file
+func NewWatermark(path string) (*Watermark, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open watermark: %w", err)
+	}
+	defer f.Close()
+
+	mark, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark: %w", err)
+	}
+
+	return &Watermark{mark: mark}, nil
+}
+
+func (wm *Watermark) Transform(r *http.Request, header http.Header, body io.Reader) (io.Reader, error) {
+	data, err := readTransformBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	tile, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// Not an image after all, so there is nothing to stamp
+		return bytes.NewReader(data), nil
+	}
+
+	bounds := tile.Bounds()
+	stamped := image.NewRGBA(bounds)
+	draw.Draw(stamped, bounds, tile, bounds.Min, draw.Src)
+
+	size := wm.mark.Bounds().Size()
+	at := image.Pt(bounds.Max.X-size.X-watermarkMargin, bounds.Max.Y-size.Y-watermarkMargin)
+	draw.Draw(stamped, image.Rectangle{Min: at, Max: at.Add(size)}, wm.mark, wm.mark.Bounds().Min, draw.Over)
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, stamped, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&out, stamped)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
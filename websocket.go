@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webSocketTokenParam carries the bearer token of WebSocket upgrades, since
+// browsers can't set headers on them
+const webSocketTokenParam = "access_token"
+
+var webSocketUpgrades = NewCounter(
+	"civil_gateway_websocket_upgrades_total",
+	"WebSocket upgrade requests, by route and whether they were passed through",
+	"route", "result",
+)
+
+// isWebSocketUpgrade reports whether r asks to switch to WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Connection") {
+		for token := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketRoutes passes the WebSocket upgrades for paths under one of
+// prefixes straight to upgrade, which relays the connection both ways
+// without buffering, and everything else to next. Caching and the other
+// layers in next only make sense for plain responses, so upgrades never
+// reach them, and elsewhere they are refused.
+func WebSocketRoutes(route string, prefixes []string, upgrade, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				webSocketUpgrades.Inc(route, "ok")
+
+				// The server's read and write timeouts are for plain
+				// requests, and would cut the connection short
+				rc := http.NewResponseController(w)
+				rc.SetReadDeadline(time.Time{})
+				rc.SetWriteDeadline(time.Time{})
+
+				upgrade.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		webSocketUpgrades.Inc(route, "refused")
+		writeError(w, r, http.StatusBadRequest, "websocket_disabled", "")
+	})
+}
+
+// webSocketLifetime closes WebSocket connections after lifetime, in place
+// of the request timeout plain requests get. Cancelling the request context
+// closes the connection to the backend, and with it the client's.
+func webSocketLifetime(lifetime time.Duration, next http.Handler) http.Handler {
+	if lifetime <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), lifetime)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// webSocketToken takes the bearer token of a WebSocket upgrade from the
+// access_token query parameter, removing it so it isn't passed upstream
+func webSocketToken(r *http.Request) (string, bool) {
+	if !isWebSocketUpgrade(r) {
+		return "", false
+	}
+
+	query := r.URL.Query()
+	token := query.Get(webSocketTokenParam)
+	if token == "" {
+		return "", false
+	}
+
+	query.Del(webSocketTokenParam)
+	r.URL.RawQuery = query.Encode()
+	return token, true
+}
+
+// keepWritable keeps the body of a 101 Switching Protocols response
+// writable once wrapped, as the reverse proxy writes the client's side of
+// an upgraded connection to it
+func keepWritable(original, wrapped io.ReadCloser) io.ReadCloser {
+	if writer, ok := original.(io.Writer); ok {
+		return struct {
+			io.ReadCloser
+			io.Writer
+		}{wrapped, writer}
+	}
+	return wrapped
+}
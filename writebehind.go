@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloud.dev/blob"
+)
+
+const (
+	// writeBehindAttempts is how many times a tile upload is tried
+	writeBehindAttempts = 3
+	// writeBehindBackoff is the wait before the first retry, doubling after
+	writeBehindBackoff = time.Second
+	// writeBehindDrainTimeout bounds uploading what is still queued at shutdown
+	writeBehindDrainTimeout = 5 * time.Second
+)
+
+var (
+	writeBehindWrites = NewCounter(
+		"civil_gateway_write_behind_writes_total",
+		"Rendered tiles persisted to the tile bucket, by result",
+		"result",
+	)
+	writeBehindQueued = NewGauge(
+		"civil_gateway_write_behind_queue_depth",
+		"Tiles waiting to be persisted to the tile bucket",
+	)
+)
+
+// tileWrite is one rendered tile waiting to be uploaded
+type tileWrite struct {
+	key             string
+	body            []byte
+	contentType     string
+	contentEncoding string
+}
+
+// TileWriteBehind persists tiles rendered on demand to the tile bucket in
+// the background, so that over time more tiles are served from cheap
+// storage and fewer from the render farm. Uploads go through a bounded
+// queue; when it is full new tiles are dropped rather than holding up
+// responses, since a dropped tile is simply rendered and offered again on a
+// later request.
+type TileWriteBehind struct {
+	bucket *blob.Bucket
+	queue  chan tileWrite
+	logger *slog.Logger
+}
+
+// NewTileWriteBehind opens the bucket at bucketURL, such as
+// s3://tiles?region=us-west-2&prefix=rendered/, and starts workers on stage
+func NewTileWriteBehind(ctx context.Context, stage *Stage, bucketURL string, queueSize, workers int, logger *slog.Logger) (*TileWriteBehind, error) {
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tile bucket: %w", err)
+	}
+
+	wb := &TileWriteBehind{
+		bucket: bucket,
+		queue:  make(chan tileWrite, max(queueSize, 1)),
+		logger: logger,
+	}
+
+	stage.Go("write-behind", func(ctx context.Context) error {
+		var wg sync.WaitGroup
+		for range max(workers, 1) {
+			wg.Go(func() { wb.work(ctx) })
+		}
+		wg.Wait()
+
+		return bucket.Close()
+	})
+
+	return wb, nil
+}
+
+// enqueue offers a tile for upload without blocking. Reports whether it was
+// accepted.
+func (wb *TileWriteBehind) enqueue(write tileWrite) bool {
+	select {
+	case wb.queue <- write:
+		writeBehindQueued.Set(float64(len(wb.queue)))
+		return true
+	default:
+		writeBehindWrites.Inc("dropped")
+		return false
+	}
+}
+
+func (wb *TileWriteBehind) work(ctx context.Context) {
+	for {
+		select {
+		case write := <-wb.queue:
+			writeBehindQueued.Set(float64(len(wb.queue)))
+			wb.upload(ctx, write)
+		case <-ctx.Done():
+			wb.drain()
+			return
+		}
+	}
+}
+
+// drain uploads what is left in the queue once the stage shuts down, giving
+// up after writeBehindDrainTimeout
+func (wb *TileWriteBehind) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), writeBehindDrainTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case write := <-wb.queue:
+			writeBehindQueued.Set(float64(len(wb.queue)))
+			wb.upload(ctx, write)
+		default:
+			return
+		}
+	}
+}
+
+// upload writes the tile, retrying with backoff
+func (wb *TileWriteBehind) upload(ctx context.Context, write tileWrite) {
+	backoff := writeBehindBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := wb.bucket.WriteAll(ctx, write.key, write.body, &blob.WriterOptions{
+			ContentType:     write.contentType,
+			ContentEncoding: write.contentEncoding,
+		})
+		if err == nil {
+			writeBehindWrites.Inc("written")
+			return
+		}
+
+		if attempt == writeBehindAttempts || ctx.Err() != nil {
+			writeBehindWrites.Inc("failed")
+			wb.logger.Warn("failed to persist tile to bucket", slog.String("key", write.key), slog.Int("attempts", attempt), slog.Any("error", err))
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			writeBehindWrites.Inc("failed")
+			return
+		}
+	}
+}
+
+// Middleware queues successful tile responses for upload, keyed by path
+func (wb *TileWriteBehind) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || isDryRun(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &cacheRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status != http.StatusOK || recorder.overflow || recorder.body.Len() == 0 {
+			return
+		}
+
+		wb.enqueue(tileWrite{
+			key:             strings.TrimPrefix(r.URL.Path, "/"),
+			body:            recorder.body.Bytes(),
+			contentType:     recorder.Header().Get("Content-Type"),
+			contentEncoding: recorder.Header().Get("Content-Encoding"),
+		})
+	})
+}
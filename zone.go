@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// zoneAttribute is the Cloud Map attribute ECS registers tasks with their
+// availability zone under
+const zoneAttribute = "AVAILABILITY_ZONE"
+
+var (
+	zoneSpillovers = NewCounter(
+		"civil_gateway_zone_spillovers_total",
+		"Requests sent to another availability zone because too few endpoints in the gateway's own are healthy",
+		"pool",
+	)
+	zoneLocalEndpoints = NewGauge(
+		"civil_gateway_zone_local_endpoints",
+		"Endpoints in rotation in the gateway's own availability zone",
+		"pool",
+	)
+)
+
+// detectZone finds the availability zone the gateway runs in: CIVIL_ZONE if
+// set, or else the zone ECS reports for the task. Empty when neither is
+// known, which leaves routing zone-unaware.
+func detectZone(ctx context.Context, logger *slog.Logger) string {
+	if zone := os.Getenv("CIVIL_ZONE"); zone != "" {
+		return zone
+	}
+
+	metadataURI := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if metadataURI == "" {
+		return ""
+	}
+
+	zone, err := ecsTaskZone(ctx, metadataURI)
+	if err != nil {
+		logger.Warn("failed to read the task's availability zone from ECS metadata, routing without regard to zones", slog.Any("error", err))
+		return ""
+	}
+	return zone
+}
+
+// ecsTaskZone reads the task's availability zone from the ECS task metadata
+// endpoint
+func ecsTaskZone(ctx context.Context, metadataURI string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURI+"/task", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("task metadata answered %s", resp.Status)
+	}
+
+	var task struct {
+		AvailabilityZone string `json:"AvailabilityZone"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return "", fmt.Errorf("invalid task metadata: %w", err)
+	}
+	return task.AvailabilityZone, nil
+}
+
+// local narrows endpoints down to those in the gateway's own zone, as long
+// as at least zoneMinEndpoints of them are there, so tiles don't cross zones
+// and pay for the transfer. With fewer, the requests spill over to every
+// zone rather than overload the few left. Must be called with mu held.
+func (bm *BackendManager) local(endpoints []string) []string {
+	if bm.zone == "" || len(bm.zones) == 0 {
+		return endpoints
+	}
+
+	var local []string
+	for _, endpoint := range endpoints {
+		if bm.zones[endpoint] == bm.zone {
+			local = append(local, endpoint)
+		}
+	}
+
+	if len(local) == len(endpoints) {
+		return endpoints
+	}
+	if len(local) < max(bm.zoneMinEndpoints, 1) {
+		zoneSpillovers.Inc(bm.pool)
+		return endpoints
+	}
+	return local
+}